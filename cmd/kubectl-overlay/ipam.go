@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	iksv1alpha1 "github.com/jkwong888/iks-overlay-ip-controller/pkg/apis/iks/v1alpha1"
+	ipam "github.com/jkwong888/iks-overlay-ip-controller/pkg/ipam"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// the names of the controller's configmap and phpIPAM secret in deploy/
+const (
+	configMapName = "overlay-ip-controller-config"
+	configMapKey  = "overlay-ip-config.yaml"
+	secretName    = "phpipam-secret"
+)
+
+// ipamUsage prints the size and usage of the subnets in the subnet map of each zone
+func ipamUsage(c client.Client, opts options) error {
+	phpIPAM, err := newPhpIPAM(c, opts)
+	if err != nil {
+		return err
+	}
+
+	zones := []string{}
+	for zone := range phpIPAM.PhpIPAMConfig.SubnetMap {
+		zones = append(zones, zone)
+	}
+	sort.Strings(zones)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "ZONE\tSUBNET ID\tSIZE\tUSED\tFREE")
+	for _, zone := range zones {
+		for _, subnetId := range phpIPAM.PhpIPAMConfig.SubnetMap[zone] {
+			usage, err := phpIPAM.GetSubnetUsage(subnetId)
+			if err != nil {
+				fmt.Fprintf(w, "%s\t%d\t%s\n", zone, subnetId, err.Error())
+				continue
+			}
+
+			fmt.Fprintf(w, "%s\t%d\t%.0f\t%.0f\t%.0f\n", zone, subnetId, usage.MaxHosts, usage.Used, usage.FreeHosts)
+		}
+	}
+
+	return w.Flush()
+}
+
+// ipamAddresses prints every address in the subnets of the zone, or of all zones, with the overlay IP resource that
+// has it, so addresses leaked in IPAM or reserved outside of the controller can be found
+func ipamAddresses(c client.Client, opts options, zone string) error {
+	phpIPAM, err := newPhpIPAM(c, opts)
+	if err != nil {
+		return err
+	}
+
+	zones := []string{}
+	for z := range phpIPAM.PhpIPAMConfig.SubnetMap {
+		if zone == "" || z == zone {
+			zones = append(zones, z)
+		}
+	}
+	sort.Strings(zones)
+
+	if len(zones) == 0 {
+		return fmt.Errorf("zone %s isn't in the subnet map", zone)
+	}
+
+	owners, err := overlayIpOwners(c)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "ZONE\tSUBNET ID\tIP\tHOSTNAME\tOWNER\tDESCRIPTION\tRESOURCE")
+	for _, z := range zones {
+		for _, subnetId := range phpIPAM.PhpIPAMConfig.SubnetMap[z] {
+			addresses, err := phpIPAM.ListSubnetAddresses(subnetId)
+			if err != nil {
+				fmt.Fprintf(w, "%s\t%d\t%s\n", z, subnetId, err.Error())
+				continue
+			}
+
+			for _, address := range addresses {
+				fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\t%s\t%s\n", z, subnetId, address.IPAddr, orNone(address.Hostname),
+					orNone(address.Owner), orNone(address.Description), orNone(strings.Join(owners[address.IPAddr], ", ")))
+			}
+		}
+	}
+
+	return w.Flush()
+}
+
+// release returns the overlay IP of a node to IPAM and deletes its NodeOverlayIp, e.g. when it is stuck on its
+// finalizer after the node was removed while IPAM couldn't be reached
+func release(c client.Client, opts options, name string) error {
+	nodeOverlayIp := &iksv1alpha1.NodeOverlayIp{}
+	err := c.Get(context.TODO(), types.NamespacedName{Name: name}, nodeOverlayIp)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return fmt.Errorf("NodeOverlayIp %s not found", name)
+		}
+		return err
+	}
+
+	// the network pod on a node that still exists is using the IP, and the controller would reserve a new one
+	node := &corev1.Node{}
+	err = c.Get(context.TODO(), types.NamespacedName{Name: name}, node)
+	if err == nil && !opts.force {
+		return fmt.Errorf("node %s still exists and may be using the IP, delete the node first or use --force", name)
+	} else if err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+
+	ipAddr := strings.Split(nodeOverlayIp.Status.IpAddr, "/")[0]
+	if ipAddr != "" {
+		owner, err := otherOwner(c, name, ipAddr)
+		if err != nil {
+			return err
+		}
+
+		if owner != "" {
+			return fmt.Errorf("IP %s is also assigned to %s, not releasing it", ipAddr, owner)
+		}
+	}
+
+	if !opts.yes && !confirm(fmt.Sprintf("Release IP %s and delete NodeOverlayIp %s?", orNone(ipAddr), name)) {
+		return fmt.Errorf("aborted")
+	}
+
+	if ipAddr != "" {
+		phpIPAM, err := newPhpIPAM(c, opts)
+		if err != nil {
+			return err
+		}
+
+		err = phpIPAM.DeleteIPAddress(ipAddr)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Released IP %s\n", ipAddr)
+	}
+
+	if nodeOverlayIp.GetDeletionTimestamp() == nil {
+		err = c.Delete(context.TODO(), nodeOverlayIp)
+		if err != nil && !errors.IsNotFound(err) {
+			return err
+		}
+
+		err = c.Get(context.TODO(), types.NamespacedName{Name: name}, nodeOverlayIp)
+		if err != nil {
+			if errors.IsNotFound(err) {
+				fmt.Printf("Deleted NodeOverlayIp %s\n", name)
+				return nil
+			}
+			return err
+		}
+	}
+
+	// the IP is already released, so the controller doesn't need to handle the finalizer
+	nodeOverlayIp.SetFinalizers(nil)
+	err = c.Update(context.TODO(), nodeOverlayIp)
+	if err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+
+	fmt.Printf("Deleted NodeOverlayIp %s\n", name)
+	return nil
+}
+
+// otherOwner returns the kind and name of another overlay IP resource that has the IP, or "" if there is none
+func otherOwner(c client.Client, name string, ipAddr string) (string, error) {
+	owners, err := overlayIpOwners(c)
+	if err != nil {
+		return "", err
+	}
+
+	for _, owner := range owners[ipAddr] {
+		if owner != "NodeOverlayIp "+name {
+			return owner, nil
+		}
+	}
+
+	return "", nil
+}
+
+// overlayIpOwners returns the kinds and names of the overlay IP resources that have each IP, more than one if the IP
+// was assigned twice
+func overlayIpOwners(c client.Client) (map[string][]string, error) {
+	owners := map[string][]string{}
+	add := func(ipAddr string, owner string) {
+		ip := strings.Split(ipAddr, "/")[0]
+		if ip != "" {
+			owners[ip] = append(owners[ip], owner)
+		}
+	}
+
+	nodeOverlayIps := &iksv1alpha1.NodeOverlayIpList{}
+	err := c.List(context.TODO(), &client.ListOptions{}, nodeOverlayIps)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, nodeOverlayIp := range nodeOverlayIps.Items {
+		add(nodeOverlayIp.Status.IpAddr, "NodeOverlayIp "+nodeOverlayIp.Name)
+	}
+
+	podOverlayIps := &iksv1alpha1.PodOverlayIpList{}
+	err = c.List(context.TODO(), &client.ListOptions{}, podOverlayIps)
+	if err != nil && !isNotInstalled(err) {
+		return nil, err
+	}
+
+	for _, podOverlayIp := range podOverlayIps.Items {
+		add(podOverlayIp.Status.IpAddr, fmt.Sprintf("PodOverlayIp %s/%s", podOverlayIp.Namespace, podOverlayIp.Name))
+	}
+
+	floatingOverlayIps := &iksv1alpha1.FloatingOverlayIpList{}
+	err = c.List(context.TODO(), &client.ListOptions{}, floatingOverlayIps)
+	if err != nil && !isNotInstalled(err) {
+		return nil, err
+	}
+
+	for _, floatingOverlayIp := range floatingOverlayIps.Items {
+		add(floatingOverlayIp.Status.IpAddr, "FloatingOverlayIp "+floatingOverlayIp.Name)
+	}
+
+	return owners, nil
+}
+
+// isNotInstalled returns true if the error is because an optional CRD isn't installed
+func isNotInstalled(err error) bool {
+	return errors.IsNotFound(err) || strings.Contains(err.Error(), "no matches for kind")
+}
+
+// newPhpIPAM connects to IPAM with the controller's configuration and credentials, read from its configmap and
+// secret unless they are given with --ipam-config and PHPIPAM_USERNAME and PHPIPAM_PASSWORD
+func newPhpIPAM(c client.Client, opts options) (*ipam.PhpIPAM, error) {
+	if opts.ipamConfig != "" {
+		ipam.ConfigFile = opts.ipamConfig
+	} else {
+		configMap := &corev1.ConfigMap{}
+		err := c.Get(context.TODO(), types.NamespacedName{Namespace: opts.namespace, Name: configMapName}, configMap)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read the controller configuration, use --namespace or --ipam-config: %v", err)
+		}
+
+		f, err := ioutil.TempFile("", "overlay-ip-config")
+		if err != nil {
+			return nil, err
+		}
+		defer os.Remove(f.Name())
+
+		_, err = f.WriteString(configMap.Data[configMapKey])
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		ipam.ConfigFile = f.Name()
+	}
+
+	if os.Getenv("PHPIPAM_USERNAME") == "" {
+		secret := &corev1.Secret{}
+		err := c.Get(context.TODO(), types.NamespacedName{Namespace: opts.namespace, Name: secretName}, secret)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read the phpIPAM credentials, set PHPIPAM_USERNAME and PHPIPAM_PASSWORD: %v", err)
+		}
+
+		os.Setenv("PHPIPAM_USERNAME", string(secret.Data["username"]))
+		os.Setenv("PHPIPAM_PASSWORD", string(secret.Data["password"]))
+	}
+
+	return ipam.NewPhpIPAM()
+}
+
+func confirm(prompt string) bool {
+	fmt.Printf("%s [y/N] ", prompt)
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+
+	return answer == "y" || answer == "yes"
+}
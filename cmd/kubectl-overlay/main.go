@@ -0,0 +1,124 @@
+// kubectl-overlay is a kubectl plugin that shows the state of the overlay network, e.g.
+//
+//	kubectl overlay status
+//	kubectl overlay routes onprem-192.168.0.0-24
+//	kubectl overlay ipam usage
+//	kubectl overlay ipam addresses dal10
+//	kubectl overlay release 10.176.162.151
+//
+// It is installed by copying the binary to a directory in the PATH.
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/jkwong888/iks-overlay-ip-controller/pkg/apis"
+	"github.com/spf13/pflag"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	_ "k8s.io/client-go/plugin/pkg/client/auth"
+	"k8s.io/client-go/tools/clientcmd"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const usage = `Inspect the overlay network.
+
+Usage:
+  kubectl overlay status                 show the overlay IP, gateway, interface and routes of each node
+  kubectl overlay routes <name>          show the nodes a StaticRoute is applied on, and the nodes missing it
+  kubectl overlay ipam usage             show the usage of the IPAM subnets of each zone
+  kubectl overlay ipam addresses [zone]  list the addresses in the IPAM subnets and the resources that have them
+  kubectl overlay release <node>         release the overlay IP of a node that was removed from the cluster
+
+Flags:
+`
+
+type options struct {
+	kubeconfig string
+	context    string
+
+	// namespace the namespace of the controller's configmap and phpIPAM secret
+	namespace string
+
+	// ipamConfig the controller configuration file, read from the controller's configmap if not set
+	ipamConfig string
+
+	// force releases the IP of a node that still exists
+	force bool
+
+	// yes skips the confirmation before releasing an IP
+	yes bool
+}
+
+func main() {
+	opts := options{}
+	flags := pflag.NewFlagSet("kubectl-overlay", pflag.ExitOnError)
+	flags.StringVar(&opts.kubeconfig, "kubeconfig", "", "the kubeconfig file to use")
+	flags.StringVar(&opts.context, "context", "", "the kubeconfig context to use")
+	flags.StringVarP(&opts.namespace, "namespace", "n", "default", "the namespace of the overlay-network-controller")
+	flags.StringVar(&opts.ipamConfig, "ipam-config", "", "the controller configuration file (read from the controller's configmap if not set)")
+	flags.BoolVar(&opts.force, "force", false, "release the IP even if the node still exists")
+	flags.BoolVarP(&opts.yes, "yes", "y", false, "don't ask for confirmation")
+	flags.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flags.PrintDefaults()
+	}
+	flags.Parse(os.Args[1:])
+
+	err := run(opts, flags.Args())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(opts options, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("missing command, see \"kubectl overlay --help\"")
+	}
+
+	c, err := newClient(opts)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case args[0] == "status" && len(args) == 1:
+		return status(c)
+	case args[0] == "routes" && len(args) == 2:
+		return routes(c, args[1])
+	case args[0] == "ipam" && len(args) == 2 && args[1] == "usage":
+		return ipamUsage(c, opts)
+	case args[0] == "ipam" && len(args) == 2 && args[1] == "addresses":
+		return ipamAddresses(c, opts, "")
+	case args[0] == "ipam" && len(args) == 3 && args[1] == "addresses":
+		return ipamAddresses(c, opts, args[2])
+	case args[0] == "release" && len(args) == 2:
+		return release(c, opts, args[1])
+	}
+
+	return fmt.Errorf("unknown command \"%s\", see \"kubectl overlay --help\"", args[0])
+}
+
+// newClient returns a client for the cluster of the current kubeconfig context, like kubectl
+func newClient(opts options) (client.Client, error) {
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	rules.ExplicitPath = opts.kubeconfig
+
+	cfg, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, &clientcmd.ConfigOverrides{CurrentContext: opts.context}).ClientConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		return nil, err
+	}
+
+	if err := apis.AddToScheme(scheme); err != nil {
+		return nil, err
+	}
+
+	return client.New(cfg, client.Options{Scheme: scheme})
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	iksv1alpha1 "github.com/jkwong888/iks-overlay-ip-controller/pkg/apis/iks/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const zoneLabel = "failure-domain.beta.kubernetes.io/zone"
+
+// status prints a row for each node with its overlay IP, gateway, interface and how many of the StaticRoutes for
+// its zone are applied on it
+func status(c client.Client) error {
+	nodes, err := listNodes(c)
+	if err != nil {
+		return err
+	}
+
+	nodeOverlayIps := &iksv1alpha1.NodeOverlayIpList{}
+	err = c.List(context.TODO(), &client.ListOptions{}, nodeOverlayIps)
+	if err != nil {
+		return err
+	}
+
+	overlayIps := map[string]iksv1alpha1.NodeOverlayIp{}
+	for _, nodeOverlayIp := range nodeOverlayIps.Items {
+		overlayIps[nodeOverlayIp.Name] = nodeOverlayIp
+	}
+
+	staticRoutes, err := listStaticRoutes(c)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "NODE\tZONE\tIP\tGATEWAY\tINTERFACE\tLINK\tROUTES")
+	for _, node := range nodes {
+		zone := node.GetLabels()[zoneLabel]
+
+		applied, expected := 0, 0
+		for _, staticRoute := range staticRoutes {
+			if !appliesToZone(&staticRoute, zone) {
+				continue
+			}
+
+			expected++
+			if nodeStatus(&staticRoute, node.Name) != nil {
+				applied++
+			}
+		}
+
+		ip, gateway, intf, link := "<none>", "", "", ""
+		if nodeOverlayIp, ok := overlayIps[node.Name]; ok {
+			ip = orNone(nodeOverlayIp.Status.IpAddr)
+			gateway = nodeOverlayIp.Status.Gateway
+			intf = nodeOverlayIp.Status.InterfaceLabel
+			link = nodeOverlayIp.Status.LinkType
+			if nodeOverlayIp.GetDeletionTimestamp() != nil {
+				ip += " (deleting)"
+			}
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%d/%d\n", node.Name, zone, ip, orNone(gateway), orNone(intf), orNone(link), applied, expected)
+	}
+
+	// overlay IPs of nodes that are gone, e.g. stuck on their finalizer because IPAM couldn't be reached
+	for _, nodeOverlayIp := range nodeOverlayIps.Items {
+		if findNode(nodes, nodeOverlayIp.Name) != nil {
+			continue
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", nodeOverlayIp.Name+" (no node)", nodeOverlayIp.GetLabels()["zone"],
+			orNone(nodeOverlayIp.Status.IpAddr), orNone(nodeOverlayIp.Status.Gateway), "<none>", "<none>", "-")
+	}
+
+	return w.Flush()
+}
+
+// routes prints the nodes the StaticRoute is applied on, and the nodes in its zone that are missing it
+func routes(c client.Client, name string) error {
+	staticRoute := &iksv1alpha1.StaticRoute{}
+	err := c.Get(context.TODO(), types.NamespacedName{Name: name}, staticRoute)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return fmt.Errorf("StaticRoute %s not found", name)
+		}
+		return err
+	}
+
+	nodes, err := listNodes(c)
+	if err != nil {
+		return err
+	}
+
+	missing := []string{}
+	expected := 0
+	for _, node := range nodes {
+		if !appliesToZone(staticRoute, node.GetLabels()[zoneLabel]) {
+			continue
+		}
+
+		expected++
+		if nodeStatus(staticRoute, node.Name) == nil {
+			missing = append(missing, node.Name)
+		}
+	}
+
+	zone := orNone(staticRoute.GetLabels()[zoneLabel])
+	if zone == "<none>" {
+		zone = "all"
+	}
+
+	fmt.Printf("Subnet:   %s\n", staticRoute.Spec.Subnet)
+	fmt.Printf("Zone:     %s\n", zone)
+	fmt.Printf("Coverage: %d/%d nodes\n", expected-len(missing), expected)
+	if staticRoute.GetDeletionTimestamp() != nil {
+		fmt.Printf("Deleting: waiting for %d nodes to remove the route\n", len(staticRoute.Status.NodeStatus))
+	}
+	fmt.Println()
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "NODE\tGATEWAY\tDEVICE\tPATH MTU")
+	for _, val := range staticRoute.Status.NodeStatus {
+		pathMtu := "-"
+		if val.PathMtu != 0 {
+			pathMtu = fmt.Sprintf("%d", val.PathMtu)
+		}
+
+		node := val.Hostname
+		if findNode(nodes, val.Hostname) == nil {
+			node += " (no node)"
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", node, orNone(val.Gateway), orNone(val.Device), pathMtu)
+	}
+	w.Flush()
+
+	if len(missing) > 0 {
+		fmt.Printf("\nMissing on: %s\n", strings.Join(missing, ", "))
+	}
+
+	return nil
+}
+
+// listNodes returns the nodes sorted by name
+func listNodes(c client.Client) ([]corev1.Node, error) {
+	nodes := &corev1.NodeList{}
+	err := c.List(context.TODO(), &client.ListOptions{}, nodes)
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(nodes.Items, func(i, j int) bool { return nodes.Items[i].Name < nodes.Items[j].Name })
+
+	return nodes.Items, nil
+}
+
+// listStaticRoutes returns the StaticRoutes that aren't being deleted
+func listStaticRoutes(c client.Client) ([]iksv1alpha1.StaticRoute, error) {
+	staticRoutes := &iksv1alpha1.StaticRouteList{}
+	err := c.List(context.TODO(), &client.ListOptions{}, staticRoutes)
+	if err != nil {
+		return nil, err
+	}
+
+	active := []iksv1alpha1.StaticRoute{}
+	for _, staticRoute := range staticRoutes.Items {
+		if staticRoute.GetDeletionTimestamp() == nil {
+			active = append(active, staticRoute)
+		}
+	}
+
+	return active, nil
+}
+
+// appliesToZone returns true if the network pods in the zone add the route, the same check as the staticroute
+// controller
+func appliesToZone(staticRoute *iksv1alpha1.StaticRoute, zone string) bool {
+	routeZone := staticRoute.GetLabels()[zoneLabel]
+	return routeZone == "" || routeZone == zone
+}
+
+func nodeStatus(staticRoute *iksv1alpha1.StaticRoute, hostname string) *iksv1alpha1.StaticRouteNodeStatus {
+	for i := range staticRoute.Status.NodeStatus {
+		if staticRoute.Status.NodeStatus[i].Hostname == hostname {
+			return &staticRoute.Status.NodeStatus[i]
+		}
+	}
+
+	return nil
+}
+
+func findNode(nodes []corev1.Node, name string) *corev1.Node {
+	for i := range nodes {
+		if nodes[i].Name == name {
+			return &nodes[i]
+		}
+	}
+
+	return nil
+}
+
+func orNone(s string) string {
+	if s == "" {
+		return "<none>"
+	}
+
+	return s
+}
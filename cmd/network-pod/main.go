@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"os"
 	"runtime"
+	"strconv"
 
 	// Import all Kubernetes client auth plugins (e.g. Azure, GCP, OIDC, etc.)
 	"k8s.io/client-go/kubernetes"
@@ -13,8 +14,18 @@ import (
 
 	//corev1 "k8s.io/api/core/v1"
 	"github.com/jkwong888/iks-overlay-ip-controller/pkg/apis"
+	"github.com/jkwong888/iks-overlay-ip-controller/pkg/bgp"
+	"github.com/jkwong888/iks-overlay-ip-controller/pkg/diagnose"
+	"github.com/jkwong888/iks-overlay-ip-controller/pkg/health"
+	"github.com/jkwong888/iks-overlay-ip-controller/pkg/util"
 	staticroute_controller "github.com/jkwong888/iks-overlay-ip-controller/pkg/controller/staticroute"
 	nodeoverlayip_controller "github.com/jkwong888/iks-overlay-ip-controller/pkg/controller/nodeoverlayip-pod"
+	nodecondition_controller "github.com/jkwong888/iks-overlay-ip-controller/pkg/controller/nodecondition"
+	vxlan_controller "github.com/jkwong888/iks-overlay-ip-controller/pkg/controller/vxlan"
+	wireguard_controller "github.com/jkwong888/iks-overlay-ip-controller/pkg/controller/wireguard-pod"
+	service_controller "github.com/jkwong888/iks-overlay-ip-controller/pkg/controller/service-pod"
+	snat_controller "github.com/jkwong888/iks-overlay-ip-controller/pkg/controller/snat"
+	floatingoverlayip_controller "github.com/jkwong888/iks-overlay-ip-controller/pkg/controller/floatingoverlayip-pod"
 
 	"github.com/operator-framework/operator-sdk/pkg/log/zap"
 	"github.com/operator-framework/operator-sdk/pkg/restmapper"
@@ -29,6 +40,13 @@ import (
 	"k8s.io/apimachinery/pkg/runtime/schema"
 )
 
+// Change below variables to serve metrics and health checks on different host or port.
+// The network pod runs on the host network, so these must not collide with ports used on the node.
+var (
+	metricsHost       = "0.0.0.0"
+	metricsPort int32 = 8384
+	healthPort  int32 = 8385
+)
 var log = logf.Log.WithName("cmd")
 
 func printVersion() {
@@ -46,8 +64,16 @@ func main() {
 	// controller-runtime)
 	pflag.CommandLine.AddGoFlagSet(flag.CommandLine)
 
+	output := pflag.StringP("output", "o", "text", "the format of the diagnose report, text or json")
+	dryRun := pflag.Bool("dry-run", false, "publish the changes to the node's overlay device, IP and routes as events instead of making them")
+
 	pflag.Parse()
 
+	// "network-pod diagnose" compares the host with the CRs and exits, without starting the controllers
+	if pflag.Arg(0) == "diagnose" {
+		os.Exit(runDiagnose(*output))
+	}
+
 	// Use a zap logr.Logger implementation. If none of the zap
 	// flags are configured (or if the zap flag set is not being
 	// used), this defaults to a production zap logger.
@@ -60,6 +86,12 @@ func main() {
 
 	printVersion()
 
+	// in dry-run mode only the node overlay ip and static route controllers run, and they don't change the host
+	util.SetDryRun(*dryRun)
+	if *dryRun {
+		log.Info("Running in dry-run mode, the host won't be changed")
+	}
+
 	// Get a config to talk to the apiserver
 	cfg, err := config.GetConfig()
 	if err != nil {
@@ -70,12 +102,23 @@ func main() {
 	// Create a new Cmd to provide shared dependencies and start components
 	mgr, err := manager.New(cfg, manager.Options{
 		MapperProvider:     restmapper.NewDynamicRESTMapper,
+		MetricsBindAddress: fmt.Sprintf("%s:%d", metricsHost, metricsPort),
 	})
 	if err != nil {
 		log.Error(err, "")
 		os.Exit(1)
 	}
 
+	// the number of gratuitous ARPs or neighbor advertisements sent after an overlay IP is added
+	if count := os.Getenv("ANNOUNCE_COUNT"); count != "" {
+		n, err := strconv.Atoi(count)
+		if err != nil {
+			log.Error(err, "Invalid ANNOUNCE_COUNT")
+			os.Exit(1)
+		}
+		util.SetAnnounceCount(n)
+	}
+
 	hostname := os.Getenv("NODE_HOSTNAME")
 	if hostname == "" {
 		panic(fmt.Errorf("Missing environment variable: NODE_HOSTNAME"))
@@ -135,10 +178,27 @@ func main() {
 			log.Error(err, "")
 			os.Exit(1)
 		}
+
+		// Start vxlan controller, which fills the forwarding database of vxlan overlay devices
+		if !*dryRun {
+			if err := vxlan_controller.Add(mgr, vxlan_controller.ManagerOptions{Hostname: hostname}); err != nil {
+				log.Error(err, "")
+				os.Exit(1)
+			}
+		}
 		hasNodeOverlayIp = true
 		break
 	}
 
+	hasEgressGateway := false
+	for _, resource := range resources.APIResources {
+		if resource.Kind == "OverlayEgressGateway" {
+			hasEgressGateway = true
+			break
+		}
+	}
+
+	hasStaticRoute := false
 	for _, resource := range resources.APIResources {
 		if resource.Kind != "StaticRoute" {
 			continue
@@ -149,6 +209,65 @@ func main() {
 				Hostname: hostname,
 				Zone: zone, 
 				HasNodeOverlayIpCR: hasNodeOverlayIp,
+				HasEgressGatewayCR: hasEgressGateway,
+			}); err != nil {
+			log.Error(err, "")
+			os.Exit(1)
+		}
+
+		// Start SNAT controller, which SNATs pod traffic to the StaticRoute subnets to the node's overlay IP
+		if hasNodeOverlayIp && !*dryRun {
+			if err := snat_controller.Add(mgr, snat_controller.ManagerOptions{Hostname: hostname, Zone: zone}); err != nil {
+				log.Error(err, "")
+				os.Exit(1)
+			}
+		}
+		hasStaticRoute = true
+		break
+	}
+
+	for _, resource := range resources.APIResources {
+		if resource.Kind != "WireguardConfig" || !hasNodeOverlayIp || *dryRun {
+			continue
+		}
+
+		// Start wireguard controller, which configures the peers of wireguard overlay devices
+		if err := wireguard_controller.Add(mgr, wireguard_controller.ManagerOptions{Hostname: hostname}); err != nil {
+			log.Error(err, "")
+			os.Exit(1)
+		}
+		break
+	}
+
+	// Start the BGP speaker, which advertises the node's overlay IP if BGP is configured for the zone, and the
+	// service controller, which binds the overlay IPs of Services the node is the leader for
+	if hasNodeOverlayIp && !*dryRun {
+		if err := bgp.Add(mgr, bgp.Options{Hostname: hostname, Zone: zone}); err != nil {
+			log.Error(err, "")
+			os.Exit(1)
+		}
+
+		if err := service_controller.Add(mgr, service_controller.ManagerOptions{Hostname: hostname}); err != nil {
+			log.Error(err, "")
+			os.Exit(1)
+		}
+	}
+
+	for _, resource := range resources.APIResources {
+		if resource.Kind != "FloatingOverlayIp" || !hasNodeOverlayIp || *dryRun {
+			continue
+		}
+
+		// the Leases electing the holders of the floating IPs are in the network pod's namespace
+		namespace := os.Getenv("POD_NAMESPACE")
+		if namespace == "" {
+			namespace = "default"
+		}
+
+		// Start floating overlay ip controller, which elects the node holding each floating IP
+		if err := floatingoverlayip_controller.Add(mgr, floatingoverlayip_controller.ManagerOptions{
+				Hostname: hostname,
+				Namespace: namespace,
 			}); err != nil {
 			log.Error(err, "")
 			os.Exit(1)
@@ -156,6 +275,33 @@ func main() {
 		break
 	}
 
+	// Start node condition controller; in dry-run mode the node's network isn't configured, so it isn't reported
+	if !*dryRun {
+		if err := nodecondition_controller.Add(mgr, nodecondition_controller.ManagerOptions{
+				Hostname: hostname,
+				Zone: zone,
+				HasNodeOverlayIpCR: hasNodeOverlayIp,
+				HasStaticRouteCR: hasStaticRoute,
+			}); err != nil {
+			log.Error(err, "")
+			os.Exit(1)
+		}
+	}
+
+	// the node is ready once its overlay IP is configured, if there is one
+	ready := func() error {
+		if !hasNodeOverlayIp || *dryRun {
+			return nil
+		}
+
+		return nodeoverlayip_controller.IsConfigured(mgr.GetClient(), hostname)
+	}
+
+	if err := health.Add(mgr, fmt.Sprintf("%s:%d", metricsHost, healthPort), ready); err != nil {
+		log.Error(err, "")
+		os.Exit(1)
+	}
+
 	log.Info("Starting the Cmd.")
 	// Start the Cmd
 	if err := mgr.Start(signals.SetupSignalHandler()); err != nil {
@@ -163,3 +309,29 @@ func main() {
 		os.Exit(1)
 	}
 }
+
+func runDiagnose(output string) int {
+	cfg, err := config.GetConfig()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	hostname := os.Getenv("NODE_HOSTNAME")
+	if hostname == "" {
+		fmt.Fprintln(os.Stderr, "Missing environment variable: NODE_HOSTNAME")
+		return 2
+	}
+
+	mismatches, err := diagnose.Run(cfg, diagnose.Options{Hostname: hostname, Output: output}, os.Stdout)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	if mismatches > 0 {
+		return 1
+	}
+
+	return 0
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/jkwong888/iks-overlay-ip-controller/pkg/util"
+)
+
+var macRe = regexp.MustCompile(`link/ether ([0-9a-f:]+)`)
+
+// linkCmd returns the ip command to create the pod's interface on the master
+func linkCmd(conf *netConf, name string, master string) (string, error) {
+	switch conf.LinkType {
+	case "", "macvlan":
+		mode := conf.Mode
+		if mode == "" {
+			mode = "bridge"
+		}
+		return fmt.Sprintf("link add %s link %s type macvlan mode %s", name, master, mode), nil
+	case "ipvlan":
+		mode := conf.Mode
+		if mode == "" {
+			mode = "l2"
+		}
+		return fmt.Sprintf("link add %s link %s type ipvlan mode %s", name, master, mode), nil
+	}
+
+	return "", fmt.Errorf("Unsupported link type \"%s\", expected macvlan or ipvlan", conf.LinkType)
+}
+
+// addLink creates the interface on the master, moves it into the pod's network namespace and configures the IP
+// and routes on it.  It returns the MAC address of the interface.
+func addLink(conf *netConf, args cniArgs, master string, ipAddr string, routes []route) (string, error) {
+	// the interface is created with a name that is unique on the host, and renamed in the pod
+	tmpName := fmt.Sprintf("ovl%.8s", args.containerId)
+
+	cmd, err := linkCmd(conf, tmpName, master)
+	if err != nil {
+		return "", err
+	}
+
+	// remove the interface left by a previous ADD for the same sandbox
+	delLink(conf, args)
+
+	out, code, err := util.ExecIpCmd(cmd)
+	if err != nil {
+		return "", err
+	}
+
+	if code != 0 {
+		return "", fmt.Errorf("Error executing \"ip link add\", output: %s", out)
+	}
+
+	out, code, err = util.ExecIpCmd(fmt.Sprintf("link set %s netns %s", tmpName, args.netns))
+	if err != nil || code != 0 {
+		util.ExecIpCmd(fmt.Sprintf("link del %s", tmpName))
+		if err != nil {
+			return "", err
+		}
+		return "", fmt.Errorf("Error executing \"ip link set\", output: %s", out)
+	}
+
+	cmds := []string{
+		fmt.Sprintf("link set %s name %s", tmpName, conf.IfName),
+		fmt.Sprintf("addr add %s dev %s", ipAddr, conf.IfName),
+		fmt.Sprintf("link set %s up", conf.IfName),
+	}
+
+	for _, r := range routes {
+		cmds = append(cmds, fmt.Sprintf("route replace %s via %s dev %s", r.subnet, r.gateway, conf.IfName))
+	}
+
+	for _, cmd := range cmds {
+		out, code, err := util.ExecNetnsIpCmd(args.netns, cmd)
+		if err == nil && code != 0 {
+			err = fmt.Errorf("Error executing \"ip %s\" in %s, output: %s", cmd, args.netns, out)
+		}
+
+		if err != nil {
+			util.ExecNetnsIpCmd(args.netns, fmt.Sprintf("link del %s", tmpName))
+			delLink(conf, args)
+			return "", err
+		}
+	}
+
+	out, code, err = util.ExecNetnsIpCmd(args.netns, fmt.Sprintf("-o link show dev %s", conf.IfName))
+	if err != nil {
+		return "", err
+	}
+
+	if code != 0 {
+		return "", fmt.Errorf("Error executing \"ip link show\" in %s, output: %s", args.netns, out)
+	}
+
+	match := macRe.FindStringSubmatch(out)
+	if match == nil {
+		return "", nil
+	}
+
+	return match[1], nil
+}
+
+// delLink deletes the pod's interface, it's gone already if the network namespace was removed
+func delLink(conf *netConf, args cniArgs) {
+	out, code, err := util.ExecNetnsIpCmd(args.netns, fmt.Sprintf("link show dev %s", conf.IfName))
+	if err != nil || code != 0 || out == "" {
+		return
+	}
+
+	util.ExecNetnsIpCmd(args.netns, fmt.Sprintf("link del %s", conf.IfName))
+}
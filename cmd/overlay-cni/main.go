@@ -0,0 +1,193 @@
+// overlay-cni is a chained CNI plugin that adds a secondary interface with an overlay IP to annotated pods.  It is
+// run by the kubelet after the primary plugin, e.g.
+//
+//	{
+//	  "type": "overlay-cni",
+//	  "kubeconfig": "/etc/cni/net.d/overlay-cni.kubeconfig",
+//	  "linkType": "macvlan"
+//	}
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/jkwong888/iks-overlay-ip-controller/pkg/util"
+)
+
+const (
+	// the CNI spec versions the results can be returned in
+	cniVersion = "0.4.0"
+
+	// the error code returned for all errors, codes below 100 are reserved by the CNI spec
+	errCode = 100
+
+	defaultIfName  = "ovl0"
+	defaultTimeout = 30
+)
+
+var supportedVersions = []string{"0.3.0", "0.3.1", "0.4.0"}
+
+// netConf is the plugin's network configuration, read from stdin
+type netConf struct {
+	CNIVersion string `json:"cniVersion"`
+	Name       string `json:"name"`
+	Type       string `json:"type"`
+
+	// Kubeconfig the kubeconfig file used to talk to the apiserver
+	Kubeconfig string `json:"kubeconfig"`
+
+	// Master the host interface the pod interface is created on (optional, defaults to the interface the node's
+	// overlay device is created on)
+	Master string `json:"master,omitempty"`
+
+	// LinkType macvlan or ipvlan (optional, defaults to macvlan)
+	LinkType string `json:"linkType,omitempty"`
+
+	// Mode the macvlan or ipvlan mode (optional, defaults to bridge or l2)
+	Mode string `json:"mode,omitempty"`
+
+	// IfName the name of the interface in the pod (optional, defaults to ovl0)
+	IfName string `json:"ifName,omitempty"`
+
+	// Timeout how many seconds to wait for the IP to be reserved (optional, defaults to 30)
+	Timeout int `json:"timeout,omitempty"`
+
+	// PrevResult the result of the previous plugin in the chain, passed through with the overlay interface added
+	PrevResult map[string]interface{} `json:"prevResult,omitempty"`
+}
+
+// cniArgs are the parameters the runtime passes in the environment
+type cniArgs struct {
+	containerId  string
+	netns        string
+	podName      string
+	podNamespace string
+}
+
+type cniError struct {
+	CNIVersion string `json:"cniVersion"`
+	Code       int    `json:"code"`
+	Msg        string `json:"msg"`
+}
+
+func main() {
+	// the plugin runs on the host, where the binaries aren't at the same paths as in the network pod image
+	util.LookupBinaries()
+
+	err := run(os.Getenv("CNI_COMMAND"))
+	if err != nil {
+		printJson(cniError{CNIVersion: cniVersion, Code: errCode, Msg: err.Error()})
+		os.Exit(1)
+	}
+}
+
+func run(command string) error {
+	if command == "VERSION" {
+		printJson(map[string]interface{}{
+			"cniVersion":        cniVersion,
+			"supportedVersions": supportedVersions,
+		})
+		return nil
+	}
+
+	conf, err := loadConf()
+	if err != nil {
+		return err
+	}
+
+	args := getArgs()
+
+	switch command {
+	case "ADD":
+		result, err := cmdAdd(conf, args)
+		if err != nil {
+			return err
+		}
+
+		printJson(result)
+		return nil
+	case "DEL":
+		return cmdDel(conf, args)
+	case "CHECK":
+		return nil
+	}
+
+	return fmt.Errorf("Unknown CNI_COMMAND \"%s\"", command)
+}
+
+func loadConf() (*netConf, error) {
+	stdin, err := ioutil.ReadAll(os.Stdin)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read the network configuration: %v", err)
+	}
+
+	conf := &netConf{}
+	err = json.Unmarshal(stdin, conf)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse the network configuration: %v", err)
+	}
+
+	if conf.Kubeconfig == "" {
+		return nil, fmt.Errorf("kubeconfig is required in the network configuration")
+	}
+
+	if conf.IfName == "" {
+		conf.IfName = defaultIfName
+	}
+
+	if conf.Timeout <= 0 {
+		conf.Timeout = defaultTimeout
+	}
+
+	return conf, nil
+}
+
+// getArgs reads the container and pod from the environment, the pod is passed by the kubelet in CNI_ARGS, e.g.
+// "IgnoreUnknown=1;K8S_POD_NAMESPACE=default;K8S_POD_NAME=my-pod"
+func getArgs() cniArgs {
+	args := cniArgs{
+		containerId: os.Getenv("CNI_CONTAINERID"),
+		netns:       os.Getenv("CNI_NETNS"),
+	}
+
+	for _, kv := range strings.Split(os.Getenv("CNI_ARGS"), ";") {
+		splits := strings.SplitN(kv, "=", 2)
+		if len(splits) != 2 {
+			continue
+		}
+
+		switch splits[0] {
+		case "K8S_POD_NAME":
+			args.podName = splits[1]
+		case "K8S_POD_NAMESPACE":
+			args.podNamespace = splits[1]
+		}
+	}
+
+	return args
+}
+
+func (c *netConf) timeout() time.Duration {
+	return time.Duration(c.Timeout) * time.Second
+}
+
+// result returns the result of the previous plugin to add the overlay interface to
+func (c *netConf) result() map[string]interface{} {
+	result := c.PrevResult
+	if result == nil {
+		result = map[string]interface{}{}
+	}
+
+	result["cniVersion"] = c.CNIVersion
+	return result
+}
+
+func printJson(v interface{}) {
+	out, _ := json.Marshal(v)
+	os.Stdout.Write(out)
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/jkwong888/iks-overlay-ip-controller/pkg/apis"
+	iksv1alpha1 "github.com/jkwong888/iks-overlay-ip-controller/pkg/apis/iks/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/clientcmd"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// how often to check whether the controller has reserved the IP
+var pollInterval = time.Second
+
+type route struct {
+	subnet  string
+	gateway string
+}
+
+func newClient(kubeconfig string) (client.Client, error) {
+	cfg, err := clientcmd.BuildConfigFromFlags("", kubeconfig)
+	if err != nil {
+		return nil, err
+	}
+
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		return nil, err
+	}
+
+	if err := apis.AddToScheme(scheme); err != nil {
+		return nil, err
+	}
+
+	return client.New(cfg, client.Options{Scheme: scheme})
+}
+
+// cmdAdd adds the overlay interface to the pod if it's annotated, and returns the result with the interface added
+func cmdAdd(conf *netConf, args cniArgs) (map[string]interface{}, error) {
+	result := conf.result()
+	if args.podName == "" {
+		// not a kubernetes pod
+		return result, nil
+	}
+
+	c, err := newClient(conf.Kubeconfig)
+	if err != nil {
+		return nil, err
+	}
+
+	pod := &corev1.Pod{}
+	err = c.Get(context.TODO(), types.NamespacedName{Namespace: args.podNamespace, Name: args.podName}, pod)
+	if err != nil {
+		return nil, err
+	}
+
+	if pod.GetAnnotations()[iksv1alpha1.PodOverlayIpAnnotation] != "true" {
+		return result, nil
+	}
+
+	instance, err := requestIp(c, pod, args.containerId, conf.timeout())
+	if err != nil {
+		return nil, err
+	}
+
+	master := conf.Master
+	if master == "" {
+		nodeOverlayIp := &iksv1alpha1.NodeOverlayIp{}
+		err = c.Get(context.TODO(), types.NamespacedName{Name: pod.Spec.NodeName}, nodeOverlayIp)
+		if err != nil && !errors.IsNotFound(err) {
+			return nil, err
+		}
+
+		master = nodeOverlayIp.Status.Interface
+		if master == "" {
+			return nil, fmt.Errorf("No master interface configured and the node's overlay interface is unknown")
+		}
+	}
+
+	routes, err := podRoutes(c, instance)
+	if err != nil {
+		return nil, err
+	}
+
+	mac, err := addLink(conf, args, master, instance.Status.IpAddr, routes)
+	if err != nil {
+		return nil, err
+	}
+
+	interfaces, _ := result["interfaces"].([]interface{})
+	interfaces = append(interfaces, map[string]interface{}{
+		"name":    conf.IfName,
+		"mac":     mac,
+		"sandbox": args.netns,
+	})
+	result["interfaces"] = interfaces
+
+	ips, _ := result["ips"].([]interface{})
+	ips = append(ips, map[string]interface{}{
+		"version":   "4",
+		"address":   instance.Status.IpAddr,
+		"interface": len(interfaces) - 1,
+	})
+	result["ips"] = ips
+
+	resultRoutes, _ := result["routes"].([]interface{})
+	for _, r := range routes {
+		resultRoutes = append(resultRoutes, map[string]interface{}{
+			"dst": r.subnet,
+			"gw":  r.gateway,
+		})
+	}
+	if len(resultRoutes) > 0 {
+		result["routes"] = resultRoutes
+	}
+
+	return result, nil
+}
+
+// cmdDel removes the overlay interface from the pod, and deletes the PodOverlayIp so the controller releases the
+// IP.  The PodOverlayIp is kept if it belongs to a newer sandbox of the same pod.
+func cmdDel(conf *netConf, args cniArgs) error {
+	if args.netns != "" {
+		delLink(conf, args)
+	}
+
+	if args.podName == "" {
+		return nil
+	}
+
+	c, err := newClient(conf.Kubeconfig)
+	if err != nil {
+		return err
+	}
+
+	instance := &iksv1alpha1.PodOverlayIp{}
+	err = c.Get(context.TODO(), types.NamespacedName{Namespace: args.podNamespace, Name: args.podName}, instance)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return nil
+		}
+		return err
+	}
+
+	if instance.Spec.ContainerId != args.containerId || instance.GetDeletionTimestamp() != nil {
+		return nil
+	}
+
+	err = c.Delete(context.TODO(), instance)
+	if err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+
+	return nil
+}
+
+// requestIp creates the PodOverlayIp for the pod, or takes over the existing one for a new sandbox, and waits for
+// the controller to reserve the IP
+func requestIp(c client.Client, pod *corev1.Pod, containerId string, timeout time.Duration) (*iksv1alpha1.PodOverlayIp, error) {
+	key := types.NamespacedName{Namespace: pod.Namespace, Name: pod.Name}
+	deadline := time.Now().Add(timeout)
+
+	for {
+		instance := &iksv1alpha1.PodOverlayIp{}
+		err := c.Get(context.TODO(), key, instance)
+		switch {
+		case errors.IsNotFound(err):
+			err = c.Create(context.TODO(), newPodOverlayIp(pod, containerId))
+			if err != nil && !errors.IsAlreadyExists(err) {
+				return nil, err
+			}
+		case err != nil:
+			return nil, err
+		case instance.GetDeletionTimestamp() != nil:
+			// wait for the previous IP to be released
+		case !ownedBy(instance, pod):
+			// left over from a previous pod with the same name
+			err = c.Delete(context.TODO(), instance)
+			if err != nil && !errors.IsNotFound(err) {
+				return nil, err
+			}
+		case instance.Spec.ContainerId != containerId:
+			instance.Spec.ContainerId = containerId
+			err = c.Update(context.TODO(), instance)
+			if err != nil && !errors.IsConflict(err) {
+				return nil, err
+			}
+		case instance.Status.IpAddr != "":
+			return instance, nil
+		}
+
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("Timed out waiting for an overlay IP to be reserved for pod %s/%s", pod.Namespace, pod.Name)
+		}
+
+		time.Sleep(pollInterval)
+	}
+}
+
+func newPodOverlayIp(pod *corev1.Pod, containerId string) *iksv1alpha1.PodOverlayIp {
+	return &iksv1alpha1.PodOverlayIp{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      pod.Name,
+			Namespace: pod.Namespace,
+			// garbage collected with the pod, in case the CNI DEL never happens
+			OwnerReferences: []metav1.OwnerReference{
+				{
+					APIVersion: "v1",
+					Kind:       "Pod",
+					Name:       pod.Name,
+					UID:        pod.UID,
+				},
+			},
+		},
+		Spec: iksv1alpha1.PodOverlayIpSpec{
+			NodeName:    pod.Spec.NodeName,
+			ContainerId: containerId,
+		},
+	}
+}
+
+func ownedBy(instance *iksv1alpha1.PodOverlayIp, pod *corev1.Pod) bool {
+	for _, ref := range instance.GetOwnerReferences() {
+		if ref.UID == pod.UID {
+			return true
+		}
+	}
+
+	return false
+}
+
+// podRoutes returns the StaticRoutes for the pod's zone that can be routed through the pod's overlay subnet
+func podRoutes(c client.Client, instance *iksv1alpha1.PodOverlayIp) ([]route, error) {
+	_, subnet, err := net.ParseCIDR(instance.Status.IpAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	staticRoutes := &iksv1alpha1.StaticRouteList{}
+	err = c.List(context.TODO(), &client.ListOptions{}, staticRoutes)
+	if err != nil {
+		return nil, err
+	}
+
+	routes := []route{}
+	for _, staticRoute := range staticRoutes.Items {
+		zone := staticRoute.GetLabels()["failure-domain.beta.kubernetes.io/zone"]
+		if (zone != "" && zone != instance.Status.Zone) || staticRoute.GetDeletionTimestamp() != nil {
+			continue
+		}
+
+		gateway := staticRoute.Spec.Gateway
+		if gateway == "" {
+			gateway = instance.Status.Gateway
+		}
+
+		gatewayIp := net.ParseIP(gateway)
+		if gatewayIp == nil || !subnet.Contains(gatewayIp) {
+			continue
+		}
+
+		routes = append(routes, route{subnet: staticRoute.Spec.Subnet, gateway: gateway})
+	}
+
+	return routes, nil
+}
@@ -12,6 +12,7 @@ import (
 
 	"github.com/jkwong888/iks-overlay-ip-controller/pkg/apis"
 	"github.com/jkwong888/iks-overlay-ip-controller/pkg/controller"
+	"github.com/jkwong888/iks-overlay-ip-controller/pkg/webhook"
 
 	"github.com/operator-framework/operator-sdk/pkg/leader"
 	"github.com/operator-framework/operator-sdk/pkg/log/zap"
@@ -29,6 +30,8 @@ import (
 var (
 	metricsHost       = "0.0.0.0"
 	metricsPort int32 = 8383
+	webhookPort int32 = 9443
+	webhookCertDir    = "/tmp/cert"
 )
 var log = logf.Log.WithName("cmd")
 
@@ -101,6 +104,12 @@ func main() {
 		os.Exit(1)
 	}
 
+	// Setup the validating webhook
+	if err := webhook.Add(mgr, webhook.ServerOptions{Port: webhookPort, CertDir: webhookCertDir}); err != nil {
+		log.Error(err, "")
+		os.Exit(1)
+	}
+
 	// Create Service object to expose the metrics port.
 	_, err = metrics.ExposeMetricsPort(ctx, metricsPort)
 	if err != nil {
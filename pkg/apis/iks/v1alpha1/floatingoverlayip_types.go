@@ -0,0 +1,62 @@
+package v1alpha1
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// FloatingOverlayIpSpec defines the desired state of FloatingOverlayIp
+// +k8s:openapi-gen=true
+type FloatingOverlayIpSpec struct {
+	// Zone the zone the IP is reserved in, only nodes in the zone can hold it
+	Zone string `json:"zone"`
+
+	// NodeSelector the labels of the nodes that can hold the IP (optional, all nodes in the zone if empty)
+	NodeSelector map[string]string `json:"nodeSelector,omitempty"`
+}
+
+// FloatingOverlayIpStatus defines the observed state of FloatingOverlayIp
+// +k8s:openapi-gen=true
+type FloatingOverlayIpStatus struct {
+	// IpAddr reserved in IPAM for the floating IP
+	IpAddr string `json:"ipAddr,omitempty"`
+
+	// Holder the node currently holding the IP, set by the network pod that holds the lease
+	Holder string `json:"holder,omitempty"`
+}
+
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// FloatingOverlayIp is the Schema for the floatingoverlayips API
+// +k8s:openapi-gen=true
+// +kubebuilder:subresource:status
+type FloatingOverlayIp struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   FloatingOverlayIpSpec   `json:"spec,omitempty"`
+	Status FloatingOverlayIpStatus `json:"status,omitempty"`
+}
+
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// FloatingOverlayIpList contains a list of FloatingOverlayIp
+type FloatingOverlayIpList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []FloatingOverlayIp `json:"items"`
+}
+
+// Selects returns true if the node can hold the IP
+func (f *FloatingOverlayIp) Selects(node *corev1.Node) bool {
+	if node.GetLabels()["failure-domain.beta.kubernetes.io/zone"] != f.Spec.Zone {
+		return false
+	}
+
+	return labels.SelectorFromSet(f.Spec.NodeSelector).Matches(labels.Set(node.GetLabels()))
+}
+
+func init() {
+	SchemeBuilder.Register(&FloatingOverlayIp{}, &FloatingOverlayIpList{})
+}
@@ -0,0 +1,14 @@
+package v1alpha1
+
+import (
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// NodeOverlayNetworkReady is the Node condition set by the network pod once the node's overlay IP
+	// and all static routes that apply to the node are configured
+	NodeOverlayNetworkReady corev1.NodeConditionType = "OverlayNetworkReady"
+
+	// OverlayNotReadyTaintKey is the startup taint kept on a Node until its overlay network is ready
+	OverlayNotReadyTaintKey = "iks.ibm.com/overlay-network-not-ready"
+)
@@ -1,12 +1,39 @@
 package v1alpha1
 
 import (
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
+// NodeOverlayIpTunnelAnnotation the link type the controller set from the zone's tunnel config, set by the controller
+// while it manages the linkType, tunnelRemote and tunnelKey fields
+const NodeOverlayIpTunnelAnnotation = "iks.ibm.com/overlay-tunnel"
+
 // NodeOverlayIpSpec defines the desired state of NodeOverlayIp
 // +k8s:openapi-gen=true
 type NodeOverlayIpSpec struct {
+	// LinkType the type of overlay link to create: macvlan, ipvlan, vlan, vxlan, wireguard, gre, ipip or dummy
+	// (optional, defaults to the network pod's LINK_TYPE)
+	LinkType string `json:"linkType,omitempty"`
+
+	// MacvlanMode the mode of a macvlan link: private, vepa, bridge or passthru (optional)
+	MacvlanMode string `json:"macvlanMode,omitempty"`
+
+	// IpvlanMode the mode of an ipvlan link: l2 or l3 (optional)
+	IpvlanMode string `json:"ipvlanMode,omitempty"`
+
+	// VlanId the 802.1Q VLAN ID of a vlan link
+	VlanId int `json:"vlanId,omitempty"`
+
+	// TunnelRemote the remote endpoint of a gre or ipip link, set by the controller from the zone's tunnel config
+	TunnelRemote string `json:"tunnelRemote,omitempty"`
+
+	// TunnelKey the key of a gre link (optional)
+	TunnelKey int `json:"tunnelKey,omitempty"`
+
+	// Mtu the MTU of the overlay link (optional, defaults to the network pod's MTU, or the kernel's default for the
+	// link type if neither is set)
+	Mtu int `json:"mtu,omitempty"`
 }
 
 // NodeOverlayIpStatus defines the observed state of NodeOverlayIp
@@ -15,6 +42,13 @@ type NodeOverlayIpStatus struct {
 	// IpAddr reserved in IPAM to configure on the node
 	IpAddr string `json:"ipAddr,omitempty"`
 
+	// PendingReservation the token of a reservation being made in IPAM that isn't recorded in IpAddr yet; the address
+	// is looked up by its owner and the token in its note before another is reserved, or when the node is deleted
+	PendingReservation string `json:"pendingReservation,omitempty"`
+
+	// SubnetId the ID of the IPAM subnet the IP was reserved in, chosen by the subnet selection strategy
+	SubnetId int `json:"subnetId,omitempty"`
+
 	// Gateway the gateway IP address of the network (optional)
 	Gateway string `json:"gateway,omitempty"`
 
@@ -23,6 +57,54 @@ type NodeOverlayIpStatus struct {
 
 	// InterfaceLabel the name of the overlay interface
 	InterfaceLabel string `json:"interfaceLabel,omitempty"`
+
+	// LinkType the type of the overlay interface configured on the node
+	LinkType string `json:"linkType,omitempty"`
+
+	// UnderlayIp the node's IP address on the interface, used as the VTEP address of vxlan links
+	UnderlayIp string `json:"underlayIp,omitempty"`
+
+	// WireguardPublicKey the public key of a wireguard link, published so peers can be configured
+	WireguardPublicKey string `json:"wireguardPublicKey,omitempty"`
+
+	// WireguardListenPort the UDP port a wireguard link listens on
+	WireguardListenPort int `json:"wireguardListenPort,omitempty"`
+
+	// Mtu the MTU of the overlay interface configured on the node
+	Mtu int `json:"mtu,omitempty"`
+
+	// GatewayPathMtu the path MTU to the gateway found by the probe, if enabled
+	GatewayPathMtu int `json:"gatewayPathMtu,omitempty"`
+
+	// Conditions the latest observations of the NodeOverlayIp's state, e.g. why an IP can't be reserved
+	Conditions []NodeOverlayIpCondition `json:"conditions,omitempty"`
+}
+
+// NodeOverlayIpConditionType the type of a NodeOverlayIp condition
+type NodeOverlayIpConditionType string
+
+const (
+	// NodeOverlayIpReserved is True once the IP is reserved in IPAM, and False with the reason while it can't be
+	NodeOverlayIpReserved NodeOverlayIpConditionType = "Reserved"
+)
+
+// NodeOverlayIpCondition the state of a NodeOverlayIp at a point in time
+// +k8s:openapi-gen=true
+type NodeOverlayIpCondition struct {
+	// Type the type of condition, e.g. Reserved
+	Type NodeOverlayIpConditionType `json:"type"`
+
+	// Status True, False or Unknown
+	Status corev1.ConditionStatus `json:"status"`
+
+	// LastTransitionTime the last time the status changed
+	LastTransitionTime metav1.Time `json:"lastTransitionTime,omitempty"`
+
+	// Reason a CamelCase reason for the status, e.g. PoolExhausted
+	Reason string `json:"reason,omitempty"`
+
+	// Message a human readable description of the status
+	Message string `json:"message,omitempty"`
 }
 
 // +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
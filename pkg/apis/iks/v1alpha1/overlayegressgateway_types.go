@@ -0,0 +1,70 @@
+package v1alpha1
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// OverlayEgressGatewaySpec defines the desired state of OverlayEgressGateway
+// +k8s:openapi-gen=true
+type OverlayEgressGatewaySpec struct {
+	// NodeSelector the labels of the nodes that hold overlay IPs and can be the egress gateway
+	NodeSelector map[string]string `json:"nodeSelector"`
+
+	// Zone the zone the gateway serves (optional, all zones if empty)
+	Zone string `json:"zone,omitempty"`
+}
+
+// OverlayEgressGatewayStatus defines the observed state of OverlayEgressGateway
+// +k8s:openapi-gen=true
+type OverlayEgressGatewayStatus struct {
+	// Node the active gateway node
+	Node string `json:"node,omitempty"`
+
+	// NodeIp the private IP of the active gateway node, the other nodes route the StaticRoute subnets through it
+	NodeIp string `json:"nodeIp,omitempty"`
+
+	// OverlayIp the overlay IP of the active gateway node
+	OverlayIp string `json:"overlayIp,omitempty"`
+}
+
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// OverlayEgressGateway is the Schema for the overlayegressgateways API
+// +k8s:openapi-gen=true
+// +kubebuilder:subresource:status
+type OverlayEgressGateway struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   OverlayEgressGatewaySpec   `json:"spec,omitempty"`
+	Status OverlayEgressGatewayStatus `json:"status,omitempty"`
+}
+
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// OverlayEgressGatewayList contains a list of OverlayEgressGateway
+type OverlayEgressGatewayList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []OverlayEgressGateway `json:"items"`
+}
+
+// AppliesToZone returns true if the gateway serves the nodes in the zone
+func (g *OverlayEgressGateway) AppliesToZone(zone string) bool {
+	return g.Spec.Zone == "" || g.Spec.Zone == zone
+}
+
+// Selects returns true if the node can be the gateway
+func (g *OverlayEgressGateway) Selects(node *corev1.Node) bool {
+	if len(g.Spec.NodeSelector) == 0 || !g.AppliesToZone(node.GetLabels()["failure-domain.beta.kubernetes.io/zone"]) {
+		return false
+	}
+
+	return labels.SelectorFromSet(g.Spec.NodeSelector).Matches(labels.Set(node.GetLabels()))
+}
+
+func init() {
+	SchemeBuilder.Register(&OverlayEgressGateway{}, &OverlayEgressGatewayList{})
+}
@@ -0,0 +1,57 @@
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// PodOverlayIpAnnotation set to "true" on a Pod requests an overlay IP for it from the CNI plugin
+const PodOverlayIpAnnotation = "iks.ibm.com/overlay-ip"
+
+// PodOverlayIpSpec defines the desired state of PodOverlayIp
+// +k8s:openapi-gen=true
+type PodOverlayIpSpec struct {
+	// NodeName the node the pod is scheduled to, the IP is reserved in the node's zone
+	NodeName string `json:"nodeName"`
+
+	// ContainerId the ID of the pod sandbox the IP is configured in, set by the CNI plugin
+	ContainerId string `json:"containerId,omitempty"`
+}
+
+// PodOverlayIpStatus defines the observed state of PodOverlayIp
+// +k8s:openapi-gen=true
+type PodOverlayIpStatus struct {
+	// IpAddr reserved in IPAM to configure in the pod
+	IpAddr string `json:"ipAddr,omitempty"`
+
+	// Gateway the gateway IP address of the network (optional)
+	Gateway string `json:"gateway,omitempty"`
+
+	// Zone the zone the IP is reserved in
+	Zone string `json:"zone,omitempty"`
+}
+
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// PodOverlayIp is the Schema for the podoverlayips API
+// +k8s:openapi-gen=true
+// +kubebuilder:subresource:status
+type PodOverlayIp struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   PodOverlayIpSpec   `json:"spec,omitempty"`
+	Status PodOverlayIpStatus `json:"status,omitempty"`
+}
+
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// PodOverlayIpList contains a list of PodOverlayIp
+type PodOverlayIpList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []PodOverlayIp `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&PodOverlayIp{}, &PodOverlayIpList{})
+}
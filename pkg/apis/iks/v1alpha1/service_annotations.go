@@ -0,0 +1,15 @@
+package v1alpha1
+
+const (
+	// ServiceOverlayIpAnnotation set to "true" on a Service of type LoadBalancer requests an overlay IP for it
+	ServiceOverlayIpAnnotation = "iks.ibm.com/overlay-ip"
+
+	// ServiceOverlayIpZoneAnnotation the zone to reserve the overlay IP in (optional, set by the controller if empty)
+	ServiceOverlayIpZoneAnnotation = "iks.ibm.com/overlay-ip-zone"
+
+	// ServiceOverlayIpAddressAnnotation the overlay IP reserved for the Service, set by the controller
+	ServiceOverlayIpAddressAnnotation = "iks.ibm.com/overlay-ip-address"
+
+	// ServiceOverlayIpNodeAnnotation the leader node that binds the overlay IP, set by the controller
+	ServiceOverlayIpNodeAnnotation = "iks.ibm.com/overlay-ip-node"
+)
@@ -12,12 +12,21 @@ type StaticRouteSpec struct {
 
 	// Gateway the gateway the subnet is routed through (optional, discovered if not set)
 	Gateway string `json:"gateway,omitempty"`
+
+	// Mtu the MTU of the route (optional, the MTU of the device the subnet is routed through if not set)
+	Mtu int `json:"mtu,omitempty"`
+
+	// ProbeIp the address in the subnet the path MTU is probed to (optional, the first address in the subnet)
+	ProbeIp string `json:"probeIp,omitempty"`
 }
 
 type StaticRouteNodeStatus struct {
 	Hostname string `json:"hostname"`
 	Gateway string `json:"gateway"`
 	Device string `json:"device"`
+
+	// PathMtu the path MTU to the subnet found by the probe, if enabled
+	PathMtu int `json:"pathMtu,omitempty"`
 }
 
 // StaticRouteStatus defines the observed state of StaticRoute
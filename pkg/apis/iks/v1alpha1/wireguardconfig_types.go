@@ -0,0 +1,63 @@
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// WireguardConfigName is the name of the WireguardConfig the controller gathers the overlay peers into
+const WireguardConfigName = "overlay"
+
+// WireguardPeer is a wireguard peer of the overlay network, either a node or an on-premise gateway
+type WireguardPeer struct {
+	// Name the node name, or the name of the on-premise gateway in the controller config
+	Name string `json:"name"`
+
+	// PublicKey the wireguard public key of the peer
+	PublicKey string `json:"publicKey"`
+
+	// Endpoint the address and port of the peer, e.g. 10.176.162.151:51820 (optional)
+	Endpoint string `json:"endpoint,omitempty"`
+
+	// AllowedIps the addresses and subnets routed to the peer
+	AllowedIps []string `json:"allowedIps"`
+
+	// PersistentKeepalive the interval in seconds to send keepalives, to keep NAT mappings open (optional)
+	PersistentKeepalive int `json:"persistentKeepalive,omitempty"`
+}
+
+// WireguardConfigSpec defines the desired state of WireguardConfig
+// +k8s:openapi-gen=true
+type WireguardConfigSpec struct {
+	Peers []WireguardPeer `json:"peers,omitempty"`
+}
+
+// WireguardConfigStatus defines the observed state of WireguardConfig
+// +k8s:openapi-gen=true
+type WireguardConfigStatus struct {
+}
+
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// WireguardConfig is the Schema for the wireguardconfigs API
+// +k8s:openapi-gen=true
+// +kubebuilder:subresource:status
+type WireguardConfig struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   WireguardConfigSpec   `json:"spec,omitempty"`
+	Status WireguardConfigStatus `json:"status,omitempty"`
+}
+
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// WireguardConfigList contains a list of WireguardConfig
+type WireguardConfigList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []WireguardConfig `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&WireguardConfig{}, &WireguardConfigList{})
+}
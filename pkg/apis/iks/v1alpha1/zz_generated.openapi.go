@@ -13,12 +13,130 @@ import (
 
 func GetOpenAPIDefinitions(ref common.ReferenceCallback) map[string]common.OpenAPIDefinition {
 	return map[string]common.OpenAPIDefinition{
-		"github.com/jkwong888/iks-overlay-ip-controller/pkg/apis/iks/v1alpha1.NodeOverlayIp":       schema_pkg_apis_iks_v1alpha1_NodeOverlayIp(ref),
-		"github.com/jkwong888/iks-overlay-ip-controller/pkg/apis/iks/v1alpha1.NodeOverlayIpSpec":   schema_pkg_apis_iks_v1alpha1_NodeOverlayIpSpec(ref),
-		"github.com/jkwong888/iks-overlay-ip-controller/pkg/apis/iks/v1alpha1.NodeOverlayIpStatus": schema_pkg_apis_iks_v1alpha1_NodeOverlayIpStatus(ref),
-		"github.com/jkwong888/iks-overlay-ip-controller/pkg/apis/iks/v1alpha1.StaticRoute":         schema_pkg_apis_iks_v1alpha1_StaticRoute(ref),
-		"github.com/jkwong888/iks-overlay-ip-controller/pkg/apis/iks/v1alpha1.StaticRouteSpec":     schema_pkg_apis_iks_v1alpha1_StaticRouteSpec(ref),
-		"github.com/jkwong888/iks-overlay-ip-controller/pkg/apis/iks/v1alpha1.StaticRouteStatus":   schema_pkg_apis_iks_v1alpha1_StaticRouteStatus(ref),
+		"github.com/jkwong888/iks-overlay-ip-controller/pkg/apis/iks/v1alpha1.FloatingOverlayIp":          schema_pkg_apis_iks_v1alpha1_FloatingOverlayIp(ref),
+		"github.com/jkwong888/iks-overlay-ip-controller/pkg/apis/iks/v1alpha1.FloatingOverlayIpSpec":      schema_pkg_apis_iks_v1alpha1_FloatingOverlayIpSpec(ref),
+		"github.com/jkwong888/iks-overlay-ip-controller/pkg/apis/iks/v1alpha1.FloatingOverlayIpStatus":    schema_pkg_apis_iks_v1alpha1_FloatingOverlayIpStatus(ref),
+		"github.com/jkwong888/iks-overlay-ip-controller/pkg/apis/iks/v1alpha1.NodeOverlayIp":              schema_pkg_apis_iks_v1alpha1_NodeOverlayIp(ref),
+		"github.com/jkwong888/iks-overlay-ip-controller/pkg/apis/iks/v1alpha1.NodeOverlayIpCondition":     schema_pkg_apis_iks_v1alpha1_NodeOverlayIpCondition(ref),
+		"github.com/jkwong888/iks-overlay-ip-controller/pkg/apis/iks/v1alpha1.NodeOverlayIpSpec":          schema_pkg_apis_iks_v1alpha1_NodeOverlayIpSpec(ref),
+		"github.com/jkwong888/iks-overlay-ip-controller/pkg/apis/iks/v1alpha1.NodeOverlayIpStatus":        schema_pkg_apis_iks_v1alpha1_NodeOverlayIpStatus(ref),
+		"github.com/jkwong888/iks-overlay-ip-controller/pkg/apis/iks/v1alpha1.OverlayEgressGateway":       schema_pkg_apis_iks_v1alpha1_OverlayEgressGateway(ref),
+		"github.com/jkwong888/iks-overlay-ip-controller/pkg/apis/iks/v1alpha1.OverlayEgressGatewaySpec":   schema_pkg_apis_iks_v1alpha1_OverlayEgressGatewaySpec(ref),
+		"github.com/jkwong888/iks-overlay-ip-controller/pkg/apis/iks/v1alpha1.OverlayEgressGatewayStatus": schema_pkg_apis_iks_v1alpha1_OverlayEgressGatewayStatus(ref),
+		"github.com/jkwong888/iks-overlay-ip-controller/pkg/apis/iks/v1alpha1.PodOverlayIp":               schema_pkg_apis_iks_v1alpha1_PodOverlayIp(ref),
+		"github.com/jkwong888/iks-overlay-ip-controller/pkg/apis/iks/v1alpha1.PodOverlayIpSpec":           schema_pkg_apis_iks_v1alpha1_PodOverlayIpSpec(ref),
+		"github.com/jkwong888/iks-overlay-ip-controller/pkg/apis/iks/v1alpha1.PodOverlayIpStatus":         schema_pkg_apis_iks_v1alpha1_PodOverlayIpStatus(ref),
+		"github.com/jkwong888/iks-overlay-ip-controller/pkg/apis/iks/v1alpha1.StaticRoute":                schema_pkg_apis_iks_v1alpha1_StaticRoute(ref),
+		"github.com/jkwong888/iks-overlay-ip-controller/pkg/apis/iks/v1alpha1.StaticRouteSpec":            schema_pkg_apis_iks_v1alpha1_StaticRouteSpec(ref),
+		"github.com/jkwong888/iks-overlay-ip-controller/pkg/apis/iks/v1alpha1.StaticRouteStatus":          schema_pkg_apis_iks_v1alpha1_StaticRouteStatus(ref),
+		"github.com/jkwong888/iks-overlay-ip-controller/pkg/apis/iks/v1alpha1.WireguardConfig":            schema_pkg_apis_iks_v1alpha1_WireguardConfig(ref),
+		"github.com/jkwong888/iks-overlay-ip-controller/pkg/apis/iks/v1alpha1.WireguardConfigSpec":        schema_pkg_apis_iks_v1alpha1_WireguardConfigSpec(ref),
+		"github.com/jkwong888/iks-overlay-ip-controller/pkg/apis/iks/v1alpha1.WireguardConfigStatus":      schema_pkg_apis_iks_v1alpha1_WireguardConfigStatus(ref),
+	}
+}
+
+func schema_pkg_apis_iks_v1alpha1_FloatingOverlayIp(ref common.ReferenceCallback) common.OpenAPIDefinition {
+	return common.OpenAPIDefinition{
+		Schema: spec.Schema{
+			SchemaProps: spec.SchemaProps{
+				Description: "FloatingOverlayIp is the Schema for the floatingoverlayips API",
+				Properties: map[string]spec.Schema{
+					"kind": {
+						SchemaProps: spec.SchemaProps{
+							Description: "Kind is a string value representing the REST resource this object represents. Servers may infer this from the endpoint the client submits requests to. Cannot be updated. In CamelCase. More info: https://git.k8s.io/community/contributors/devel/api-conventions.md#types-kinds",
+							Type:        []string{"string"},
+							Format:      "",
+						},
+					},
+					"apiVersion": {
+						SchemaProps: spec.SchemaProps{
+							Description: "APIVersion defines the versioned schema of this representation of an object. Servers should convert recognized schemas to the latest internal value, and may reject unrecognized values. More info: https://git.k8s.io/community/contributors/devel/api-conventions.md#resources",
+							Type:        []string{"string"},
+							Format:      "",
+						},
+					},
+					"metadata": {
+						SchemaProps: spec.SchemaProps{
+							Ref: ref("k8s.io/apimachinery/pkg/apis/meta/v1.ObjectMeta"),
+						},
+					},
+					"spec": {
+						SchemaProps: spec.SchemaProps{
+							Ref: ref("github.com/jkwong888/iks-overlay-ip-controller/pkg/apis/iks/v1alpha1.FloatingOverlayIpSpec"),
+						},
+					},
+					"status": {
+						SchemaProps: spec.SchemaProps{
+							Ref: ref("github.com/jkwong888/iks-overlay-ip-controller/pkg/apis/iks/v1alpha1.FloatingOverlayIpStatus"),
+						},
+					},
+				},
+			},
+		},
+		Dependencies: []string{
+			"github.com/jkwong888/iks-overlay-ip-controller/pkg/apis/iks/v1alpha1.FloatingOverlayIpSpec", "github.com/jkwong888/iks-overlay-ip-controller/pkg/apis/iks/v1alpha1.FloatingOverlayIpStatus", "k8s.io/apimachinery/pkg/apis/meta/v1.ObjectMeta"},
+	}
+}
+
+func schema_pkg_apis_iks_v1alpha1_FloatingOverlayIpSpec(ref common.ReferenceCallback) common.OpenAPIDefinition {
+	return common.OpenAPIDefinition{
+		Schema: spec.Schema{
+			SchemaProps: spec.SchemaProps{
+				Description: "FloatingOverlayIpSpec defines the desired state of FloatingOverlayIp",
+				Properties: map[string]spec.Schema{
+					"zone": {
+						SchemaProps: spec.SchemaProps{
+							Description: "Zone the zone the IP is reserved in, only nodes in the zone can hold it",
+							Type:        []string{"string"},
+							Format:      "",
+						},
+					},
+					"nodeSelector": {
+						SchemaProps: spec.SchemaProps{
+							Description: "NodeSelector the labels of the nodes that can hold the IP (optional, all nodes in the zone if empty)",
+							Type:        []string{"object"},
+							AdditionalProperties: &spec.SchemaOrBool{
+								Schema: &spec.Schema{
+									SchemaProps: spec.SchemaProps{
+										Type:   []string{"string"},
+										Format: "",
+									},
+								},
+							},
+						},
+					},
+				},
+				Required: []string{"zone"},
+			},
+		},
+		Dependencies: []string{},
+	}
+}
+
+func schema_pkg_apis_iks_v1alpha1_FloatingOverlayIpStatus(ref common.ReferenceCallback) common.OpenAPIDefinition {
+	return common.OpenAPIDefinition{
+		Schema: spec.Schema{
+			SchemaProps: spec.SchemaProps{
+				Description: "FloatingOverlayIpStatus defines the observed state of FloatingOverlayIp",
+				Properties: map[string]spec.Schema{
+					"ipAddr": {
+						SchemaProps: spec.SchemaProps{
+							Description: "IpAddr reserved in IPAM for the floating IP",
+							Type:        []string{"string"},
+							Format:      "",
+						},
+					},
+					"holder": {
+						SchemaProps: spec.SchemaProps{
+							Description: "Holder the node currently holding the IP, set by the network pod that holds the lease",
+							Type:        []string{"string"},
+							Format:      "",
+						},
+					},
+				},
+			},
+		},
+		Dependencies: []string{},
 	}
 }
 
@@ -65,12 +183,111 @@ func schema_pkg_apis_iks_v1alpha1_NodeOverlayIp(ref common.ReferenceCallback) co
 	}
 }
 
+func schema_pkg_apis_iks_v1alpha1_NodeOverlayIpCondition(ref common.ReferenceCallback) common.OpenAPIDefinition {
+	return common.OpenAPIDefinition{
+		Schema: spec.Schema{
+			SchemaProps: spec.SchemaProps{
+				Description: "NodeOverlayIpCondition the state of a NodeOverlayIp at a point in time",
+				Properties: map[string]spec.Schema{
+					"type": {
+						SchemaProps: spec.SchemaProps{
+							Description: "Type the type of condition, e.g. Reserved",
+							Type:        []string{"string"},
+							Format:      "",
+						},
+					},
+					"status": {
+						SchemaProps: spec.SchemaProps{
+							Description: "Status True, False or Unknown",
+							Type:        []string{"string"},
+							Format:      "",
+						},
+					},
+					"lastTransitionTime": {
+						SchemaProps: spec.SchemaProps{
+							Description: "LastTransitionTime the last time the status changed",
+							Ref:         ref("k8s.io/apimachinery/pkg/apis/meta/v1.Time"),
+						},
+					},
+					"reason": {
+						SchemaProps: spec.SchemaProps{
+							Description: "Reason a CamelCase reason for the status, e.g. PoolExhausted",
+							Type:        []string{"string"},
+							Format:      "",
+						},
+					},
+					"message": {
+						SchemaProps: spec.SchemaProps{
+							Description: "Message a human readable description of the status",
+							Type:        []string{"string"},
+							Format:      "",
+						},
+					},
+				},
+				Required: []string{"type", "status"},
+			},
+		},
+		Dependencies: []string{
+			"k8s.io/apimachinery/pkg/apis/meta/v1.Time"},
+	}
+}
+
 func schema_pkg_apis_iks_v1alpha1_NodeOverlayIpSpec(ref common.ReferenceCallback) common.OpenAPIDefinition {
 	return common.OpenAPIDefinition{
 		Schema: spec.Schema{
 			SchemaProps: spec.SchemaProps{
 				Description: "NodeOverlayIpSpec defines the desired state of NodeOverlayIp",
-				Properties:  map[string]spec.Schema{},
+				Properties: map[string]spec.Schema{
+					"linkType": {
+						SchemaProps: spec.SchemaProps{
+							Description: "LinkType the type of overlay link to create: macvlan, ipvlan, vlan, vxlan, wireguard, gre, ipip or dummy (optional, defaults to the network pod's LINK_TYPE)",
+							Type:        []string{"string"},
+							Format:      "",
+						},
+					},
+					"macvlanMode": {
+						SchemaProps: spec.SchemaProps{
+							Description: "MacvlanMode the mode of a macvlan link: private, vepa, bridge or passthru (optional)",
+							Type:        []string{"string"},
+							Format:      "",
+						},
+					},
+					"ipvlanMode": {
+						SchemaProps: spec.SchemaProps{
+							Description: "IpvlanMode the mode of an ipvlan link: l2 or l3 (optional)",
+							Type:        []string{"string"},
+							Format:      "",
+						},
+					},
+					"vlanId": {
+						SchemaProps: spec.SchemaProps{
+							Description: "VlanId the 802.1Q VLAN ID of a vlan link",
+							Type:        []string{"integer"},
+							Format:      "int32",
+						},
+					},
+					"tunnelRemote": {
+						SchemaProps: spec.SchemaProps{
+							Description: "TunnelRemote the remote endpoint of a gre or ipip link, set by the controller from the zone's tunnel config",
+							Type:        []string{"string"},
+							Format:      "",
+						},
+					},
+					"tunnelKey": {
+						SchemaProps: spec.SchemaProps{
+							Description: "TunnelKey the key of a gre link (optional)",
+							Type:        []string{"integer"},
+							Format:      "int32",
+						},
+					},
+					"mtu": {
+						SchemaProps: spec.SchemaProps{
+							Description: "Mtu the MTU of the overlay link (optional, defaults to the network pod's MTU, or the kernel's default for the link type if neither is set)",
+							Type:        []string{"integer"},
+							Format:      "int32",
+						},
+					},
+				},
 			},
 		},
 		Dependencies: []string{},
@@ -90,6 +307,20 @@ func schema_pkg_apis_iks_v1alpha1_NodeOverlayIpStatus(ref common.ReferenceCallba
 							Format:      "",
 						},
 					},
+					"pendingReservation": {
+						SchemaProps: spec.SchemaProps{
+							Description: "PendingReservation the token of a reservation being made in IPAM that isn't recorded in IpAddr yet; the address is looked up by its owner and the token in its note before another is reserved, or when the node is deleted",
+							Type:        []string{"string"},
+							Format:      "",
+						},
+					},
+					"subnetId": {
+						SchemaProps: spec.SchemaProps{
+							Description: "SubnetId the ID of the IPAM subnet the IP was reserved in, chosen by the subnet selection strategy",
+							Type:        []string{"integer"},
+							Format:      "int32",
+						},
+					},
 					"gateway": {
 						SchemaProps: spec.SchemaProps{
 							Description: "Gateway the gateway IP address of the network (optional)",
@@ -111,6 +342,279 @@ func schema_pkg_apis_iks_v1alpha1_NodeOverlayIpStatus(ref common.ReferenceCallba
 							Format:      "",
 						},
 					},
+					"linkType": {
+						SchemaProps: spec.SchemaProps{
+							Description: "LinkType the type of the overlay interface configured on the node",
+							Type:        []string{"string"},
+							Format:      "",
+						},
+					},
+					"underlayIp": {
+						SchemaProps: spec.SchemaProps{
+							Description: "UnderlayIp the node's IP address on the interface, used as the VTEP address of vxlan links",
+							Type:        []string{"string"},
+							Format:      "",
+						},
+					},
+					"wireguardPublicKey": {
+						SchemaProps: spec.SchemaProps{
+							Description: "WireguardPublicKey the public key of a wireguard link, published so peers can be configured",
+							Type:        []string{"string"},
+							Format:      "",
+						},
+					},
+					"wireguardListenPort": {
+						SchemaProps: spec.SchemaProps{
+							Description: "WireguardListenPort the UDP port a wireguard link listens on",
+							Type:        []string{"integer"},
+							Format:      "int32",
+						},
+					},
+					"mtu": {
+						SchemaProps: spec.SchemaProps{
+							Description: "Mtu the MTU of the overlay interface configured on the node",
+							Type:        []string{"integer"},
+							Format:      "int32",
+						},
+					},
+					"gatewayPathMtu": {
+						SchemaProps: spec.SchemaProps{
+							Description: "GatewayPathMtu the path MTU to the gateway found by the probe, if enabled",
+							Type:        []string{"integer"},
+							Format:      "int32",
+						},
+					},
+					"conditions": {
+						SchemaProps: spec.SchemaProps{
+							Description: "Conditions the latest observations of the NodeOverlayIp's state, e.g. why an IP can't be reserved",
+							Type:        []string{"array"},
+							Items: &spec.SchemaOrArray{
+								Schema: &spec.Schema{
+									SchemaProps: spec.SchemaProps{
+										Ref: ref("github.com/jkwong888/iks-overlay-ip-controller/pkg/apis/iks/v1alpha1.NodeOverlayIpCondition"),
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+		Dependencies: []string{
+			"github.com/jkwong888/iks-overlay-ip-controller/pkg/apis/iks/v1alpha1.NodeOverlayIpCondition"},
+	}
+}
+
+func schema_pkg_apis_iks_v1alpha1_OverlayEgressGateway(ref common.ReferenceCallback) common.OpenAPIDefinition {
+	return common.OpenAPIDefinition{
+		Schema: spec.Schema{
+			SchemaProps: spec.SchemaProps{
+				Description: "OverlayEgressGateway is the Schema for the overlayegressgateways API",
+				Properties: map[string]spec.Schema{
+					"kind": {
+						SchemaProps: spec.SchemaProps{
+							Description: "Kind is a string value representing the REST resource this object represents. Servers may infer this from the endpoint the client submits requests to. Cannot be updated. In CamelCase. More info: https://git.k8s.io/community/contributors/devel/api-conventions.md#types-kinds",
+							Type:        []string{"string"},
+							Format:      "",
+						},
+					},
+					"apiVersion": {
+						SchemaProps: spec.SchemaProps{
+							Description: "APIVersion defines the versioned schema of this representation of an object. Servers should convert recognized schemas to the latest internal value, and may reject unrecognized values. More info: https://git.k8s.io/community/contributors/devel/api-conventions.md#resources",
+							Type:        []string{"string"},
+							Format:      "",
+						},
+					},
+					"metadata": {
+						SchemaProps: spec.SchemaProps{
+							Ref: ref("k8s.io/apimachinery/pkg/apis/meta/v1.ObjectMeta"),
+						},
+					},
+					"spec": {
+						SchemaProps: spec.SchemaProps{
+							Ref: ref("github.com/jkwong888/iks-overlay-ip-controller/pkg/apis/iks/v1alpha1.OverlayEgressGatewaySpec"),
+						},
+					},
+					"status": {
+						SchemaProps: spec.SchemaProps{
+							Ref: ref("github.com/jkwong888/iks-overlay-ip-controller/pkg/apis/iks/v1alpha1.OverlayEgressGatewayStatus"),
+						},
+					},
+				},
+			},
+		},
+		Dependencies: []string{
+			"github.com/jkwong888/iks-overlay-ip-controller/pkg/apis/iks/v1alpha1.OverlayEgressGatewaySpec", "github.com/jkwong888/iks-overlay-ip-controller/pkg/apis/iks/v1alpha1.OverlayEgressGatewayStatus", "k8s.io/apimachinery/pkg/apis/meta/v1.ObjectMeta"},
+	}
+}
+
+func schema_pkg_apis_iks_v1alpha1_OverlayEgressGatewaySpec(ref common.ReferenceCallback) common.OpenAPIDefinition {
+	return common.OpenAPIDefinition{
+		Schema: spec.Schema{
+			SchemaProps: spec.SchemaProps{
+				Description: "OverlayEgressGatewaySpec defines the desired state of OverlayEgressGateway",
+				Properties: map[string]spec.Schema{
+					"nodeSelector": {
+						SchemaProps: spec.SchemaProps{
+							Description: "NodeSelector the labels of the nodes that hold overlay IPs and can be the egress gateway",
+							Type:        []string{"object"},
+							AdditionalProperties: &spec.SchemaOrBool{
+								Schema: &spec.Schema{
+									SchemaProps: spec.SchemaProps{
+										Type:   []string{"string"},
+										Format: "",
+									},
+								},
+							},
+						},
+					},
+					"zone": {
+						SchemaProps: spec.SchemaProps{
+							Description: "Zone the zone the gateway serves (optional, all zones if empty)",
+							Type:        []string{"string"},
+							Format:      "",
+						},
+					},
+				},
+				Required: []string{"nodeSelector"},
+			},
+		},
+		Dependencies: []string{},
+	}
+}
+
+func schema_pkg_apis_iks_v1alpha1_OverlayEgressGatewayStatus(ref common.ReferenceCallback) common.OpenAPIDefinition {
+	return common.OpenAPIDefinition{
+		Schema: spec.Schema{
+			SchemaProps: spec.SchemaProps{
+				Description: "OverlayEgressGatewayStatus defines the observed state of OverlayEgressGateway",
+				Properties: map[string]spec.Schema{
+					"node": {
+						SchemaProps: spec.SchemaProps{
+							Description: "Node the active gateway node",
+							Type:        []string{"string"},
+							Format:      "",
+						},
+					},
+					"nodeIp": {
+						SchemaProps: spec.SchemaProps{
+							Description: "NodeIp the private IP of the active gateway node, the other nodes route the StaticRoute subnets through it",
+							Type:        []string{"string"},
+							Format:      "",
+						},
+					},
+					"overlayIp": {
+						SchemaProps: spec.SchemaProps{
+							Description: "OverlayIp the overlay IP of the active gateway node",
+							Type:        []string{"string"},
+							Format:      "",
+						},
+					},
+				},
+			},
+		},
+		Dependencies: []string{},
+	}
+}
+
+func schema_pkg_apis_iks_v1alpha1_PodOverlayIp(ref common.ReferenceCallback) common.OpenAPIDefinition {
+	return common.OpenAPIDefinition{
+		Schema: spec.Schema{
+			SchemaProps: spec.SchemaProps{
+				Description: "PodOverlayIp is the Schema for the podoverlayips API",
+				Properties: map[string]spec.Schema{
+					"kind": {
+						SchemaProps: spec.SchemaProps{
+							Description: "Kind is a string value representing the REST resource this object represents. Servers may infer this from the endpoint the client submits requests to. Cannot be updated. In CamelCase. More info: https://git.k8s.io/community/contributors/devel/api-conventions.md#types-kinds",
+							Type:        []string{"string"},
+							Format:      "",
+						},
+					},
+					"apiVersion": {
+						SchemaProps: spec.SchemaProps{
+							Description: "APIVersion defines the versioned schema of this representation of an object. Servers should convert recognized schemas to the latest internal value, and may reject unrecognized values. More info: https://git.k8s.io/community/contributors/devel/api-conventions.md#resources",
+							Type:        []string{"string"},
+							Format:      "",
+						},
+					},
+					"metadata": {
+						SchemaProps: spec.SchemaProps{
+							Ref: ref("k8s.io/apimachinery/pkg/apis/meta/v1.ObjectMeta"),
+						},
+					},
+					"spec": {
+						SchemaProps: spec.SchemaProps{
+							Ref: ref("github.com/jkwong888/iks-overlay-ip-controller/pkg/apis/iks/v1alpha1.PodOverlayIpSpec"),
+						},
+					},
+					"status": {
+						SchemaProps: spec.SchemaProps{
+							Ref: ref("github.com/jkwong888/iks-overlay-ip-controller/pkg/apis/iks/v1alpha1.PodOverlayIpStatus"),
+						},
+					},
+				},
+			},
+		},
+		Dependencies: []string{
+			"github.com/jkwong888/iks-overlay-ip-controller/pkg/apis/iks/v1alpha1.PodOverlayIpSpec", "github.com/jkwong888/iks-overlay-ip-controller/pkg/apis/iks/v1alpha1.PodOverlayIpStatus", "k8s.io/apimachinery/pkg/apis/meta/v1.ObjectMeta"},
+	}
+}
+
+func schema_pkg_apis_iks_v1alpha1_PodOverlayIpSpec(ref common.ReferenceCallback) common.OpenAPIDefinition {
+	return common.OpenAPIDefinition{
+		Schema: spec.Schema{
+			SchemaProps: spec.SchemaProps{
+				Description: "PodOverlayIpSpec defines the desired state of PodOverlayIp",
+				Properties: map[string]spec.Schema{
+					"nodeName": {
+						SchemaProps: spec.SchemaProps{
+							Description: "NodeName the node the pod is scheduled to, the IP is reserved in the node's zone",
+							Type:        []string{"string"},
+							Format:      "",
+						},
+					},
+					"containerId": {
+						SchemaProps: spec.SchemaProps{
+							Description: "ContainerId the ID of the pod sandbox the IP is configured in, set by the CNI plugin",
+							Type:        []string{"string"},
+							Format:      "",
+						},
+					},
+				},
+				Required: []string{"nodeName"},
+			},
+		},
+		Dependencies: []string{},
+	}
+}
+
+func schema_pkg_apis_iks_v1alpha1_PodOverlayIpStatus(ref common.ReferenceCallback) common.OpenAPIDefinition {
+	return common.OpenAPIDefinition{
+		Schema: spec.Schema{
+			SchemaProps: spec.SchemaProps{
+				Description: "PodOverlayIpStatus defines the observed state of PodOverlayIp",
+				Properties: map[string]spec.Schema{
+					"ipAddr": {
+						SchemaProps: spec.SchemaProps{
+							Description: "IpAddr reserved in IPAM to configure in the pod",
+							Type:        []string{"string"},
+							Format:      "",
+						},
+					},
+					"gateway": {
+						SchemaProps: spec.SchemaProps{
+							Description: "Gateway the gateway IP address of the network (optional)",
+							Type:        []string{"string"},
+							Format:      "",
+						},
+					},
+					"zone": {
+						SchemaProps: spec.SchemaProps{
+							Description: "Zone the zone the IP is reserved in",
+							Type:        []string{"string"},
+							Format:      "",
+						},
+					},
 				},
 			},
 		},
@@ -180,6 +684,20 @@ func schema_pkg_apis_iks_v1alpha1_StaticRouteSpec(ref common.ReferenceCallback)
 							Format:      "",
 						},
 					},
+					"mtu": {
+						SchemaProps: spec.SchemaProps{
+							Description: "Mtu the MTU of the route (optional, the MTU of the device the subnet is routed through if not set)",
+							Type:        []string{"integer"},
+							Format:      "int32",
+						},
+					},
+					"probeIp": {
+						SchemaProps: spec.SchemaProps{
+							Description: "ProbeIp the address in the subnet the path MTU is probed to (optional, the first address in the subnet)",
+							Type:        []string{"string"},
+							Format:      "",
+						},
+					},
 				},
 				Required: []string{"subnet"},
 			},
@@ -214,3 +732,84 @@ func schema_pkg_apis_iks_v1alpha1_StaticRouteStatus(ref common.ReferenceCallback
 			"github.com/jkwong888/iks-overlay-ip-controller/pkg/apis/iks/v1alpha1.StaticRouteNodeStatus"},
 	}
 }
+
+func schema_pkg_apis_iks_v1alpha1_WireguardConfig(ref common.ReferenceCallback) common.OpenAPIDefinition {
+	return common.OpenAPIDefinition{
+		Schema: spec.Schema{
+			SchemaProps: spec.SchemaProps{
+				Description: "WireguardConfig is the Schema for the wireguardconfigs API",
+				Properties: map[string]spec.Schema{
+					"kind": {
+						SchemaProps: spec.SchemaProps{
+							Description: "Kind is a string value representing the REST resource this object represents. Servers may infer this from the endpoint the client submits requests to. Cannot be updated. In CamelCase. More info: https://git.k8s.io/community/contributors/devel/api-conventions.md#types-kinds",
+							Type:        []string{"string"},
+							Format:      "",
+						},
+					},
+					"apiVersion": {
+						SchemaProps: spec.SchemaProps{
+							Description: "APIVersion defines the versioned schema of this representation of an object. Servers should convert recognized schemas to the latest internal value, and may reject unrecognized values. More info: https://git.k8s.io/community/contributors/devel/api-conventions.md#resources",
+							Type:        []string{"string"},
+							Format:      "",
+						},
+					},
+					"metadata": {
+						SchemaProps: spec.SchemaProps{
+							Ref: ref("k8s.io/apimachinery/pkg/apis/meta/v1.ObjectMeta"),
+						},
+					},
+					"spec": {
+						SchemaProps: spec.SchemaProps{
+							Ref: ref("github.com/jkwong888/iks-overlay-ip-controller/pkg/apis/iks/v1alpha1.WireguardConfigSpec"),
+						},
+					},
+					"status": {
+						SchemaProps: spec.SchemaProps{
+							Ref: ref("github.com/jkwong888/iks-overlay-ip-controller/pkg/apis/iks/v1alpha1.WireguardConfigStatus"),
+						},
+					},
+				},
+			},
+		},
+		Dependencies: []string{
+			"github.com/jkwong888/iks-overlay-ip-controller/pkg/apis/iks/v1alpha1.WireguardConfigSpec", "github.com/jkwong888/iks-overlay-ip-controller/pkg/apis/iks/v1alpha1.WireguardConfigStatus", "k8s.io/apimachinery/pkg/apis/meta/v1.ObjectMeta"},
+	}
+}
+
+func schema_pkg_apis_iks_v1alpha1_WireguardConfigSpec(ref common.ReferenceCallback) common.OpenAPIDefinition {
+	return common.OpenAPIDefinition{
+		Schema: spec.Schema{
+			SchemaProps: spec.SchemaProps{
+				Description: "WireguardConfigSpec defines the desired state of WireguardConfig",
+				Properties: map[string]spec.Schema{
+					"peers": {
+						SchemaProps: spec.SchemaProps{
+							Type: []string{"array"},
+							Items: &spec.SchemaOrArray{
+								Schema: &spec.Schema{
+									SchemaProps: spec.SchemaProps{
+										Ref: ref("github.com/jkwong888/iks-overlay-ip-controller/pkg/apis/iks/v1alpha1.WireguardPeer"),
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+		Dependencies: []string{
+			"github.com/jkwong888/iks-overlay-ip-controller/pkg/apis/iks/v1alpha1.WireguardPeer"},
+	}
+}
+
+func schema_pkg_apis_iks_v1alpha1_WireguardConfigStatus(ref common.ReferenceCallback) common.OpenAPIDefinition {
+	return common.OpenAPIDefinition{
+		Schema: spec.Schema{
+			SchemaProps: spec.SchemaProps{
+				Description: "WireguardConfigStatus defines the observed state of WireguardConfig",
+				Properties:  map[string]spec.Schema{},
+			},
+		},
+		Dependencies: []string{},
+	}
+}
@@ -0,0 +1,832 @@
+package bgp
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/ptypes"
+	"github.com/golang/protobuf/ptypes/any"
+	iksv1alpha1 "github.com/jkwong888/iks-overlay-ip-controller/pkg/apis/iks/v1alpha1"
+	ipam "github.com/jkwong888/iks-overlay-ip-controller/pkg/ipam"
+	"github.com/jkwong888/iks-overlay-ip-controller/pkg/metrics"
+	"github.com/jkwong888/iks-overlay-ip-controller/pkg/webhook"
+	api "github.com/osrg/gobgp/api"
+	gobgp "github.com/osrg/gobgp/pkg/server"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/retry"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	logf "sigs.k8s.io/controller-runtime/pkg/runtime/log"
+)
+
+var log = logf.Log.WithName("bgp")
+
+// ManagedByLabel marks the StaticRoutes created for learned prefixes
+const ManagedByLabel = "iks.ibm.com/managed-by"
+
+// LearnedFromAnnotation lists the sessions a StaticRoute for a learned prefix was learned on, as comma separated
+// <node>/<peer> pairs; the route is deleted when none of them have it anymore
+const LearnedFromAnnotation = "iks.ibm.com/bgp-learned-from"
+
+// how often to check whether the node's overlay IP has been reserved before starting the sessions
+var waitInterval = 10 * time.Second
+
+// how often to remove the node's sessions that are no longer established from the learned routes
+var gcInterval = 5 * time.Minute
+
+// how often to check whether the prefix to advertise changed
+var advertiseInterval = 10 * time.Second
+
+// how long to wait before reconnecting to a peer after the session goes down
+const connectRetry = 30 * time.Second
+
+// the export policy that only advertises the node's own prefix, and not the prefixes learned from one router to the
+// others
+const exportPolicy = "advertise-local"
+
+var ipv4Unicast = &api.Family{Afi: api.Family_AFI_IP, Safi: api.Family_SAFI_UNICAST}
+
+// RouteHandler is told about the prefixes learned from a peer
+type RouteHandler interface {
+	Learned(peer string, prefix *net.IPNet, nextHop net.IP)
+	Withdrawn(peer string, prefix *net.IPNet)
+
+	// PeerUp is called when the session with the peer is established
+	PeerUp(peer string)
+
+	// PeerDown is called when the session with the peer goes down, all the prefixes learned from it are withdrawn
+	PeerDown(peer string)
+}
+
+// AdvertiseFunc returns the prefix to advertise to peers, or nil if there is nothing to advertise yet
+type AdvertiseFunc func() (*net.IPNet, error)
+
+type Options struct {
+	Hostname string
+	Zone     string
+}
+
+// Add creates the BGP speaker that advertises the node's overlay IP to the routers configured for its zone, and
+// adds it to the Manager.  The speaker is disabled if there is no bgp config for the zone.
+func Add(mgr manager.Manager, options Options) error {
+	config, err := loadConfig()
+	if err != nil {
+		if os.IsNotExist(err) {
+			log.Info("No controller config found, BGP is disabled", "configFile", ipam.ConfigFile)
+			return nil
+		}
+
+		return err
+	}
+
+	if config == nil || len(config.Peers[options.Zone]) == 0 {
+		log.Info("No BGP peers configured for zone, BGP is disabled", "zone", options.Zone)
+		return nil
+	}
+
+	// learned prefixes become StaticRoutes on every node in the zone, and the webhook rejecting the ones overlapping the
+	// protected ranges may not be enabled
+	protectedRanges, err := webhook.ProtectedRanges()
+	if err != nil {
+		return err
+	}
+
+	a := &agent{
+		client:          mgr.GetClient(),
+		options:         options,
+		config:          config,
+		protectedRanges: protectedRanges,
+		established:     map[string]bool{},
+	}
+
+	return mgr.Add(manager.RunnableFunc(a.run))
+}
+
+type agent struct {
+	client  client.Client
+	options Options
+	config  *BGPConfigSpec
+
+	// the ranges learned prefixes may not overlap
+	protectedRanges []*net.IPNet
+
+	// the peers the sessions are established with
+	established     map[string]bool
+	establishedLock sync.Mutex
+}
+
+func (a *agent) run(stop <-chan struct{}) error {
+	// the overlay IP is the router ID, so wait for it to be reserved
+	var routerId net.IP
+	for routerId == nil {
+		instance, err := a.nodeOverlayIp()
+		if err != nil && !errors.IsNotFound(err) {
+			log.Error(err, "Unable to get NodeOverlayIp")
+		}
+
+		if instance != nil {
+			routerId, _, _ = net.ParseCIDR(instance.Status.IpAddr)
+		}
+
+		if routerId != nil {
+			break
+		}
+
+		select {
+		case <-stop:
+			return nil
+		case <-time.After(waitInterval):
+		}
+	}
+
+	s := &speaker{
+		localAs:   a.config.LocalAs,
+		holdTime:  a.config.HoldTime,
+		routerId:  routerId,
+		peers:     a.config.Peers[a.options.Zone],
+		advertise: a.advertise,
+		handler:   a,
+		learn:     a.config.LearnRoutes,
+	}
+
+	if a.config.LearnRoutes {
+		// routes left behind by sessions that went down without withdrawing them, e.g. when the pod was killed
+		a.gc()
+		go a.gcLoop(stop)
+	}
+
+	return s.run(stop)
+}
+
+func (a *agent) gcLoop(stop <-chan struct{}) {
+	gcTicker := time.NewTicker(gcInterval)
+	defer gcTicker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-gcTicker.C:
+			a.gc()
+		}
+	}
+}
+
+// speaker runs a GoBGP server with a session to each of the peers.  The sessions are always opened by this side, and
+// only IPv4 unicast routes are exchanged.  The next hop of the advertised prefix is the local address of the session.
+type speaker struct {
+	localAs   uint32
+	holdTime  uint16
+	routerId  net.IP
+	peers     []PeerConfig
+	advertise AdvertiseFunc
+	handler   RouteHandler
+	learn     bool
+
+	// the peers the sessions are established with
+	up     map[string]bool
+	upLock sync.Mutex
+}
+
+// run keeps the sessions established and the prefix advertised until stop is closed
+func (s *speaker) run(stop <-chan struct{}) error {
+	s.up = map[string]bool{}
+
+	server := gobgp.NewBgpServer()
+	go server.Serve()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	err := server.StartBgp(ctx, &api.StartBgpRequest{
+		Global: &api.Global{
+			As:       s.localAs,
+			RouterId: s.routerId.String(),
+			// don't listen for sessions opened by the peers
+			ListenPort: -1,
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	// the sessions are closed when the speaker stops, and the routes learned on them are withdrawn
+	defer s.stop(server)
+
+	err = s.addExportPolicy(ctx, server)
+	if err != nil {
+		return err
+	}
+
+	err = server.MonitorPeer(ctx, &api.MonitorPeerRequest{}, func(peer *api.Peer) {
+		s.peerState(peer.State.NeighborAddress, peer.State.SessionState == api.PeerState_ESTABLISHED)
+	})
+	if err != nil {
+		return err
+	}
+
+	if s.learn {
+		err = server.MonitorTable(ctx, &api.MonitorTableRequest{TableType: api.TableType_ADJ_IN, Family: ipv4Unicast}, s.received)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, peer := range s.peers {
+		log.Info("Starting BGP session", "peer", peer.Address, "peerAs", peer.As, "localAs", s.localAs)
+		err = server.AddPeer(ctx, &api.AddPeerRequest{
+			Peer: &api.Peer{
+				Conf: &api.PeerConf{
+					NeighborAddress: peer.Address,
+					PeerAs:          peer.As,
+				},
+				Timers: &api.Timers{
+					Config: &api.TimersConfig{
+						ConnectRetry:      uint64(connectRetry / time.Second),
+						HoldTime:          uint64(s.holdTime),
+						KeepaliveInterval: uint64(s.holdTime / 3),
+					},
+				},
+			},
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	var advertised *net.IPNet
+	var advertisedId []byte
+
+	advertiseTicker := time.NewTicker(advertiseInterval)
+	defer advertiseTicker.Stop()
+
+	for {
+		// advertise the prefix, or update it if it changed
+		prefix, err := s.advertise()
+		if err != nil {
+			log.Error(err, "Unable to get the prefix to advertise")
+		} else if !samePrefix(prefix, advertised) {
+			log.Info("Advertising prefix", "prefix", prefixString(prefix), "withdrawn", prefixString(advertised))
+			advertisedId, err = s.replacePath(ctx, server, advertisedId, prefix)
+			if err != nil {
+				log.Error(err, "Unable to advertise prefix", "prefix", prefixString(prefix))
+			} else {
+				advertised = prefix
+			}
+		}
+
+		select {
+		case <-stop:
+			return nil
+		case <-advertiseTicker.C:
+		}
+	}
+}
+
+// addExportPolicy only lets the locally originated path, the node's prefix, be advertised to the peers
+func (s *speaker) addExportPolicy(ctx context.Context, server *gobgp.BgpServer) error {
+	err := server.AddPolicy(ctx, &api.AddPolicyRequest{
+		Policy: &api.Policy{
+			Name: exportPolicy,
+			Statements: []*api.Statement{{
+				Name:       exportPolicy + "-local",
+				Conditions: &api.Conditions{RouteType: api.Conditions_ROUTE_TYPE_LOCAL},
+				Actions:    &api.Actions{RouteAction: api.RouteAction_ACCEPT},
+			}},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	return server.AddPolicyAssignment(ctx, &api.AddPolicyAssignmentRequest{
+		Assignment: &api.PolicyAssignment{
+			Name:          "global",
+			Direction:     api.PolicyDirection_EXPORT,
+			Policies:      []*api.Policy{{Name: exportPolicy}},
+			DefaultAction: api.RouteAction_REJECT,
+		},
+	})
+}
+
+// replacePath withdraws the path with the ID, if it isn't nil, and advertises the prefix, if it isn't nil, returning
+// the ID of its path
+func (s *speaker) replacePath(ctx context.Context, server *gobgp.BgpServer, id []byte, prefix *net.IPNet) ([]byte, error) {
+	if id != nil {
+		err := server.DeletePath(ctx, &api.DeletePathRequest{TableType: api.TableType_GLOBAL, Family: ipv4Unicast, Uuid: id})
+		if err != nil {
+			return id, err
+		}
+	}
+
+	if prefix == nil {
+		return nil, nil
+	}
+
+	path, err := newPath(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := server.AddPath(ctx, &api.AddPathRequest{TableType: api.TableType_GLOBAL, Path: path})
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.Uuid, nil
+}
+
+// stop closes the sessions, and withdraws the prefixes learned on the ones that were still established
+func (s *speaker) stop(server *gobgp.BgpServer) {
+	err := server.StopBgp(context.Background(), &api.StopBgpRequest{})
+	if err != nil {
+		log.Error(err, "Unable to stop BGP")
+	}
+
+	s.upLock.Lock()
+	peers := []string{}
+	for peer := range s.up {
+		peers = append(peers, peer)
+	}
+	s.upLock.Unlock()
+
+	for _, peer := range peers {
+		s.peerState(peer, false)
+	}
+}
+
+// peerState records whether the session with the peer is established, and tells the handler when it changes
+func (s *speaker) peerState(peer string, established bool) {
+	s.upLock.Lock()
+	changed := s.up[peer] != established
+	if established {
+		s.up[peer] = true
+	} else {
+		delete(s.up, peer)
+	}
+	s.upLock.Unlock()
+
+	if !changed {
+		return
+	}
+
+	if established {
+		log.Info("BGP session established", "peer", peer)
+		metrics.AgentBGPSessionUp.WithLabelValues(peer).Set(1)
+	} else {
+		log.Info("BGP session down", "peer", peer)
+		metrics.AgentBGPSessionUp.WithLabelValues(peer).Set(0)
+	}
+
+	if !s.learn {
+		return
+	}
+
+	if established {
+		s.handler.PeerUp(peer)
+	} else {
+		s.handler.PeerDown(peer)
+	}
+}
+
+// received tells the handler about a path received from a peer
+func (s *speaker) received(path *api.Path) {
+	if path.NeighborIp == "" {
+		return
+	}
+
+	prefix, err := pathPrefix(path)
+	if err != nil {
+		log.Error(err, "Unable to decode path received from peer", "peer", path.NeighborIp)
+		return
+	}
+
+	if path.IsWithdraw {
+		s.handler.Withdrawn(path.NeighborIp, prefix)
+		return
+	}
+
+	s.handler.Learned(path.NeighborIp, prefix, pathNextHop(path))
+}
+
+// newPath returns the path advertising the prefix, with the local address of each session as the next hop
+func newPath(prefix *net.IPNet) (*api.Path, error) {
+	ones, _ := prefix.Mask.Size()
+	nlri, err := ptypes.MarshalAny(&api.IPAddressPrefix{Prefix: prefix.IP.String(), PrefixLen: uint32(ones)})
+	if err != nil {
+		return nil, err
+	}
+
+	origin, err := ptypes.MarshalAny(&api.OriginAttribute{Origin: 0})
+	if err != nil {
+		return nil, err
+	}
+
+	// GoBGP replaces an unspecified next hop with the local address of the session
+	nextHop, err := ptypes.MarshalAny(&api.NextHopAttribute{NextHop: "0.0.0.0"})
+	if err != nil {
+		return nil, err
+	}
+
+	return &api.Path{
+		Family: ipv4Unicast,
+		Nlri:   nlri,
+		Pattrs: []*any.Any{origin, nextHop},
+	}, nil
+}
+
+// pathPrefix returns the IPv4 prefix of a path
+func pathPrefix(path *api.Path) (*net.IPNet, error) {
+	nlri := &api.IPAddressPrefix{}
+	err := ptypes.UnmarshalAny(path.Nlri, nlri)
+	if err != nil {
+		return nil, err
+	}
+
+	ip := net.ParseIP(nlri.Prefix).To4()
+	if ip == nil || nlri.PrefixLen > 32 {
+		return nil, fmt.Errorf("Invalid IPv4 prefix %s/%d", nlri.Prefix, nlri.PrefixLen)
+	}
+
+	mask := net.CIDRMask(int(nlri.PrefixLen), 32)
+	return &net.IPNet{IP: ip.Mask(mask), Mask: mask}, nil
+}
+
+// pathNextHop returns the next hop of a path, or nil if it doesn't have one
+func pathNextHop(path *api.Path) net.IP {
+	for _, attr := range path.Pattrs {
+		nextHop := &api.NextHopAttribute{}
+		if ptypes.Is(attr, nextHop) && ptypes.UnmarshalAny(attr, nextHop) == nil {
+			return net.ParseIP(nextHop.NextHop).To4()
+		}
+	}
+
+	return nil
+}
+
+func samePrefix(a *net.IPNet, b *net.IPNet) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+
+	return a.String() == b.String()
+}
+
+func prefixString(prefix *net.IPNet) string {
+	if prefix == nil {
+		return ""
+	}
+
+	return prefix.String()
+}
+
+func (a *agent) nodeOverlayIp() (*iksv1alpha1.NodeOverlayIp, error) {
+	instance := &iksv1alpha1.NodeOverlayIp{}
+	err := a.client.Get(context.TODO(), types.NamespacedName{Name: a.options.Hostname}, instance)
+	if err != nil {
+		return nil, err
+	}
+
+	return instance, nil
+}
+
+// advertise returns the node's overlay IP once the network pod has configured it on the node
+func (a *agent) advertise() (*net.IPNet, error) {
+	instance, err := a.nodeOverlayIp()
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	if instance.Status.IpAddr == "" || instance.Status.InterfaceLabel == "" || instance.GetDeletionTimestamp() != nil {
+		return nil, nil
+	}
+
+	ip, _, err := net.ParseCIDR(instance.Status.IpAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	return &net.IPNet{IP: ip.To4(), Mask: net.CIDRMask(32, 32)}, nil
+}
+
+// Learned creates or updates the StaticRoute for a prefix learned from a peer, and adds the session to the ones it
+// was learned on
+func (a *agent) Learned(peer string, prefix *net.IPNet, nextHop net.IP) {
+	if !a.acceptPrefix(prefix) || nextHop == nil {
+		return
+	}
+
+	name := routeName(a.options.Zone, prefix)
+	learner := a.learner(peer)
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		route := &iksv1alpha1.StaticRoute{}
+		err := a.client.Get(context.TODO(), types.NamespacedName{Name: name}, route)
+		if err != nil && errors.IsNotFound(err) {
+			route = &iksv1alpha1.StaticRoute{
+				ObjectMeta: metav1.ObjectMeta{
+					Name: name,
+					Labels: map[string]string{
+						ManagedByLabel: "bgp",
+					},
+					Annotations: map[string]string{
+						LearnedFromAnnotation: learner,
+					},
+				},
+				Spec: iksv1alpha1.StaticRouteSpec{
+					Subnet:  prefix.String(),
+					Gateway: nextHop.String(),
+				},
+			}
+
+			if a.options.Zone != "" {
+				route.Labels["failure-domain.beta.kubernetes.io/zone"] = a.options.Zone
+			}
+
+			log.Info("Creating StaticRoute for learned prefix", "peer", peer, "prefix", prefix.String(), "nextHop", nextHop.String())
+			err = a.client.Create(context.TODO(), route)
+			if errors.IsAlreadyExists(err) {
+				// created by another node in the zone, add this session to it
+				return errors.NewConflict(iksv1alpha1.SchemeGroupVersion.WithResource("staticroutes").GroupResource(), name, err)
+			}
+			return err
+		} else if err != nil {
+			return err
+		}
+
+		if route.GetLabels()[ManagedByLabel] != "bgp" {
+			return nil
+		}
+
+		learners := learnedFrom(route)
+		if hasLearner(learners, learner) && route.Spec.Gateway == nextHop.String() {
+			return nil
+		}
+
+		log.Info("Updating StaticRoute for learned prefix", "peer", peer, "prefix", prefix.String(), "nextHop", nextHop.String())
+		setLearnedFrom(route, addLearner(learners, learner))
+		route.Spec.Gateway = nextHop.String()
+		return a.client.Update(context.TODO(), route)
+	})
+	if err != nil {
+		log.Error(err, "Unable to create or update StaticRoute for learned prefix", "prefix", prefix.String())
+	}
+}
+
+// Withdrawn removes the session from the ones the StaticRoute for a prefix withdrawn by a peer was learned on, and
+// deletes the route if it isn't learned on any other session
+func (a *agent) Withdrawn(peer string, prefix *net.IPNet) {
+	name := routeName(a.options.Zone, prefix)
+	learner := a.learner(peer)
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		route := &iksv1alpha1.StaticRoute{}
+		err := a.client.Get(context.TODO(), types.NamespacedName{Name: name}, route)
+		if err != nil {
+			if errors.IsNotFound(err) {
+				return nil
+			}
+			return err
+		}
+
+		if route.GetLabels()[ManagedByLabel] != "bgp" {
+			return nil
+		}
+
+		return a.removeLearners(route, func(l string) bool { return l == learner })
+	})
+	if err != nil {
+		log.Error(err, "Unable to remove withdrawn prefix from StaticRoute", "peer", peer, "prefix", prefix.String())
+	}
+}
+
+// PeerUp records that the session with the peer is established
+func (a *agent) PeerUp(peer string) {
+	a.establishedLock.Lock()
+	defer a.establishedLock.Unlock()
+
+	a.established[peer] = true
+}
+
+// PeerDown withdraws all the prefixes learned from the peer when the session with it goes down
+func (a *agent) PeerDown(peer string) {
+	a.establishedLock.Lock()
+	delete(a.established, peer)
+	a.establishedLock.Unlock()
+
+	learner := a.learner(peer)
+	log.Info("Withdrawing the prefixes learned from peer", "peer", peer)
+	a.pruneRoutes(func(l string) bool { return l == learner })
+}
+
+// gc removes the node's sessions that aren't established, and the sessions of nodes that no longer exist, from the
+// StaticRoutes for learned prefixes
+func (a *agent) gc() {
+	a.establishedLock.Lock()
+	established := map[string]bool{}
+	for peer := range a.established {
+		established[a.learner(peer)] = true
+	}
+	a.establishedLock.Unlock()
+
+	nodes := map[string]bool{a.options.Hostname: true}
+	a.pruneRoutes(func(l string) bool {
+		node := strings.SplitN(l, "/", 2)[0]
+		if node == a.options.Hostname {
+			return !established[l]
+		}
+
+		exists, ok := nodes[node]
+		if !ok {
+			err := a.client.Get(context.TODO(), types.NamespacedName{Name: node}, &corev1.Node{})
+			exists = err == nil || !errors.IsNotFound(err)
+			nodes[node] = exists
+		}
+
+		return !exists
+	})
+}
+
+// pruneRoutes removes the sessions matched by remove from the StaticRoutes for learned prefixes
+func (a *agent) pruneRoutes(remove func(learner string) bool) {
+	routes := &iksv1alpha1.StaticRouteList{}
+	err := a.client.List(context.TODO(), (&client.ListOptions{}).MatchingLabels(map[string]string{ManagedByLabel: "bgp"}), routes)
+	if err != nil {
+		log.Error(err, "Unable to list StaticRoutes for learned prefixes")
+		return
+	}
+
+	for i := range routes.Items {
+		route := &routes.Items[i]
+		err = retry.RetryOnConflict(retry.DefaultRetry, func() error {
+			err := a.removeLearners(route, remove)
+			if errors.IsConflict(err) {
+				getErr := a.client.Get(context.TODO(), types.NamespacedName{Name: route.Name}, route)
+				if getErr != nil {
+					return getErr
+				}
+			}
+			return err
+		})
+		if err != nil && !errors.IsNotFound(err) {
+			log.Error(err, "Unable to remove sessions from StaticRoute for learned prefix", "route", route.Name)
+		}
+	}
+}
+
+// removeLearners removes the sessions matched by remove from the route, and deletes it if it isn't learned on any
+// session anymore
+func (a *agent) removeLearners(route *iksv1alpha1.StaticRoute, remove func(learner string) bool) error {
+	if route.GetDeletionTimestamp() != nil {
+		return nil
+	}
+
+	learners := learnedFrom(route)
+	kept := []string{}
+	for _, l := range learners {
+		if !remove(l) {
+			kept = append(kept, l)
+		}
+	}
+
+	if len(kept) == 0 {
+		log.Info("Deleting StaticRoute for withdrawn prefix", "route", route.Name, "subnet", route.Spec.Subnet)
+		err := a.client.Delete(context.TODO(), route)
+		if errors.IsNotFound(err) {
+			return nil
+		}
+		return err
+	}
+
+	if len(kept) == len(learners) {
+		return nil
+	}
+
+	setLearnedFrom(route, kept)
+	return a.client.Update(context.TODO(), route)
+}
+
+// learner returns the entry for the node's session with the peer in the learned from annotation
+func (a *agent) learner(peer string) string {
+	return a.options.Hostname + "/" + peer
+}
+
+func learnedFrom(route *iksv1alpha1.StaticRoute) []string {
+	value := route.GetAnnotations()[LearnedFromAnnotation]
+	if value == "" {
+		return []string{}
+	}
+
+	return strings.Split(value, ",")
+}
+
+func setLearnedFrom(route *iksv1alpha1.StaticRoute, learners []string) {
+	annotations := route.GetAnnotations()
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+
+	annotations[LearnedFromAnnotation] = strings.Join(learners, ",")
+	route.SetAnnotations(annotations)
+}
+
+func hasLearner(learners []string, learner string) bool {
+	for _, l := range learners {
+		if l == learner {
+			return true
+		}
+	}
+
+	return false
+}
+
+// addLearner returns the sorted learners with the learner added
+func addLearner(learners []string, learner string) []string {
+	if hasLearner(learners, learner) {
+		return learners
+	}
+
+	learners = append(append([]string{}, learners...), learner)
+	sort.Strings(learners)
+	return learners
+}
+
+// acceptPrefix returns false for the prefixes that may not be routed through the overlay, see checkPrefix
+func (a *agent) acceptPrefix(prefix *net.IPNet) bool {
+	instance, err := a.nodeOverlayIp()
+	if err != nil {
+		return false
+	}
+
+	_, subnet, err := net.ParseCIDR(instance.Status.IpAddr)
+	if err != nil {
+		return false
+	}
+
+	err = checkPrefix(prefix, subnet, a.protectedRanges, a.config.acceptPrefixes)
+	if err != nil {
+		log.Info("Ignoring learned prefix", "prefix", prefix.String(), "reason", err.Error())
+		return false
+	}
+
+	return true
+}
+
+// checkPrefix returns an error for the default route, for prefixes overlapping the node's overlay subnet, e.g. the
+// other nodes' overlay IPs reflected back by the routers, or the protected ranges, e.g. a summary route covering the
+// private network, and for prefixes that aren't within the accepted prefixes if there are any
+func checkPrefix(prefix *net.IPNet, overlaySubnet *net.IPNet, protectedRanges []*net.IPNet, acceptPrefixes []*net.IPNet) error {
+	ones, _ := prefix.Mask.Size()
+	if ones == 0 {
+		return fmt.Errorf("default route")
+	}
+
+	if overlaps(prefix, overlaySubnet) {
+		return fmt.Errorf("overlaps the overlay subnet %s", overlaySubnet.String())
+	}
+
+	for _, protected := range protectedRanges {
+		if overlaps(prefix, protected) {
+			return fmt.Errorf("overlaps the protected range %s", protected.String())
+		}
+	}
+
+	if len(acceptPrefixes) == 0 {
+		return nil
+	}
+
+	for _, accepted := range acceptPrefixes {
+		acceptedOnes, _ := accepted.Mask.Size()
+		if accepted.Contains(prefix.IP) && acceptedOnes <= ones {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("not within the accepted prefixes")
+}
+
+// overlaps returns true if the two networks share any addresses
+func overlaps(a *net.IPNet, b *net.IPNet) bool {
+	return a.Contains(b.IP) || b.Contains(a.IP)
+}
+
+// routeName returns the name of the StaticRoute for a prefix learned in the zone, e.g. bgp-dal10-192-168-0-0-24
+func routeName(zone string, prefix *net.IPNet) string {
+	name := strings.NewReplacer(".", "-", "/", "-").Replace(prefix.String())
+	if zone == "" {
+		return "bgp-" + name
+	}
+
+	return "bgp-" + strings.ToLower(zone) + "-" + name
+}
@@ -0,0 +1,181 @@
+package bgp
+
+import (
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/golang/protobuf/ptypes"
+	"github.com/golang/protobuf/ptypes/any"
+	iksv1alpha1 "github.com/jkwong888/iks-overlay-ip-controller/pkg/apis/iks/v1alpha1"
+	api "github.com/osrg/gobgp/api"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func cidr(t *testing.T, s string) *net.IPNet {
+	_, prefix, err := net.ParseCIDR(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return prefix
+}
+
+func TestRouteName(t *testing.T) {
+	tests := []struct {
+		zone     string
+		prefix   string
+		expected string
+	}{
+		{"dal10", "192.168.0.0/24", "bgp-dal10-192-168-0-0-24"},
+		{"DAL10", "10.0.0.0/8", "bgp-dal10-10-0-0-0-8"},
+		{"", "192.168.1.1/32", "bgp-192-168-1-1-32"},
+	}
+
+	for _, test := range tests {
+		name := routeName(test.zone, cidr(t, test.prefix))
+		if name != test.expected {
+			t.Errorf("routeName(%q, %s) = %s, expected %s", test.zone, test.prefix, name, test.expected)
+		}
+	}
+}
+
+func TestLearnedFrom(t *testing.T) {
+	route := &iksv1alpha1.StaticRoute{}
+	if learners := learnedFrom(route); len(learners) != 0 {
+		t.Errorf("learners of a route without the annotation %v", learners)
+	}
+
+	setLearnedFrom(route, addLearner(learnedFrom(route), "node-b/10.0.0.1"))
+	setLearnedFrom(route, addLearner(learnedFrom(route), "node-a/10.0.0.1"))
+	setLearnedFrom(route, addLearner(learnedFrom(route), "node-b/10.0.0.1"))
+
+	if value := route.Annotations[LearnedFromAnnotation]; value != "node-a/10.0.0.1,node-b/10.0.0.1" {
+		t.Errorf("annotation %q", value)
+	}
+
+	expected := []string{"node-a/10.0.0.1", "node-b/10.0.0.1"}
+	if learners := learnedFrom(route); !reflect.DeepEqual(learners, expected) {
+		t.Errorf("learners %v, expected %v", learners, expected)
+	}
+
+	if !hasLearner(expected, "node-a/10.0.0.1") || hasLearner(expected, "node-a/10.0.0.2") {
+		t.Error("hasLearner doesn't match the learners")
+	}
+}
+
+func TestAddLearnerKeepsOthers(t *testing.T) {
+	route := &iksv1alpha1.StaticRoute{
+		ObjectMeta: metav1.ObjectMeta{
+			Annotations: map[string]string{"other": "value"},
+		},
+	}
+
+	setLearnedFrom(route, []string{"node-a/10.0.0.1"})
+	if route.Annotations["other"] != "value" || route.Annotations[LearnedFromAnnotation] != "node-a/10.0.0.1" {
+		t.Errorf("annotations %v", route.Annotations)
+	}
+}
+
+func TestNewPath(t *testing.T) {
+	path, err := newPath(cidr(t, "10.10.0.5/32"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	prefix, err := pathPrefix(path)
+	if err != nil || prefix.String() != "10.10.0.5/32" {
+		t.Errorf("prefix %v, error %v", prefix, err)
+	}
+
+	if nextHop := pathNextHop(path); !nextHop.Equal(net.IPv4zero) {
+		t.Errorf("next hop %v", nextHop)
+	}
+}
+
+func TestPathPrefix(t *testing.T) {
+	tests := []struct {
+		name      string
+		prefix    string
+		prefixLen uint32
+		expected  string
+	}{
+		{"prefix", "192.168.10.0", 24, "192.168.10.0/24"},
+		{"host bits", "192.168.10.1", 24, "192.168.10.0/24"},
+		{"default route", "0.0.0.0", 0, "0.0.0.0/0"},
+		{"ipv6", "2001:db8::", 32, ""},
+		{"too long", "192.168.10.0", 33, ""},
+	}
+
+	for _, test := range tests {
+		nlri, err := ptypes.MarshalAny(&api.IPAddressPrefix{Prefix: test.prefix, PrefixLen: test.prefixLen})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		prefix, err := pathPrefix(&api.Path{Nlri: nlri})
+		if test.expected == "" {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %v", test.name, prefix)
+			}
+			continue
+		}
+
+		if err != nil || prefix.String() != test.expected {
+			t.Errorf("%s: prefix %v, error %v, expected %s", test.name, prefix, err, test.expected)
+		}
+	}
+}
+
+func TestPathNextHop(t *testing.T) {
+	origin, _ := ptypes.MarshalAny(&api.OriginAttribute{Origin: 0})
+	nextHop, _ := ptypes.MarshalAny(&api.NextHopAttribute{NextHop: "10.176.162.129"})
+
+	tests := []struct {
+		name     string
+		pattrs   []*any.Any
+		expected string
+	}{
+		{"next hop", []*any.Any{origin, nextHop}, "10.176.162.129"},
+		{"no next hop", []*any.Any{origin}, "<nil>"},
+	}
+
+	for _, test := range tests {
+		if ip := pathNextHop(&api.Path{Pattrs: test.pattrs}); ip.String() != test.expected {
+			t.Errorf("%s: next hop %v, expected %s", test.name, ip, test.expected)
+		}
+	}
+}
+
+func TestCheckPrefix(t *testing.T) {
+	overlaySubnet := cidr(t, "172.16.0.0/24")
+	protectedRanges := []*net.IPNet{cidr(t, "10.0.0.0/8"), cidr(t, "172.30.0.0/16"), cidr(t, "161.26.0.0/16")}
+
+	tests := []struct {
+		name           string
+		prefix         string
+		acceptPrefixes []*net.IPNet
+		accepted       bool
+	}{
+		{"prefix", "192.168.10.0/24", nil, true},
+		{"default route", "0.0.0.0/0", nil, false},
+		{"overlay IP", "172.16.0.5/32", nil, false},
+		{"overlay summary", "172.16.0.0/16", nil, false},
+		{"private network summary", "10.0.0.0/8", nil, false},
+		{"in the private network", "10.176.0.0/16", nil, false},
+		{"covers the pod network", "172.0.0.0/8", nil, false},
+		{"service network", "161.26.0.0/16", nil, false},
+		{"accepted", "192.168.10.0/24", []*net.IPNet{cidr(t, "192.168.0.0/16")}, true},
+		{"accepted exactly", "192.168.0.0/16", []*net.IPNet{cidr(t, "192.168.0.0/16")}, true},
+		{"wider than accepted", "192.168.0.0/15", []*net.IPNet{cidr(t, "192.168.0.0/16")}, false},
+		{"not accepted", "192.169.10.0/24", []*net.IPNet{cidr(t, "192.168.0.0/16")}, false},
+		{"accepted but protected", "10.1.0.0/16", []*net.IPNet{cidr(t, "10.0.0.0/8")}, false},
+	}
+
+	for _, test := range tests {
+		err := checkPrefix(cidr(t, test.prefix), overlaySubnet, protectedRanges, test.acceptPrefixes)
+		if (err == nil) != test.accepted {
+			t.Errorf("%s: error %v, expected accepted %v", test.name, err, test.accepted)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package bgp
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+
+	ipam "github.com/jkwong888/iks-overlay-ip-controller/pkg/ipam"
+	"gopkg.in/yaml.v2"
+)
+
+type BGPConfig struct {
+	BGPConfig *BGPConfigSpec `yaml:"bgp,omitempty"`
+}
+
+type BGPConfigSpec struct {
+	// the AS number of the nodes
+	LocalAs uint32 `yaml:"localAS"`
+
+	// hold time in seconds proposed to peers, defaults to 90
+	HoldTime uint16 `yaml:"holdTime"`
+
+	// create StaticRoutes for the prefixes learned from the peers
+	LearnRoutes bool `yaml:"learnRoutes"`
+
+	// if set, only the learned prefixes within these are accepted
+	AcceptPrefixes []string `yaml:"acceptPrefixes"`
+
+	// map of zone to the routers the nodes in the zone peer with
+	Peers map[string][]PeerConfig `yaml:"peers"`
+
+	acceptPrefixes []*net.IPNet
+}
+
+type PeerConfig struct {
+	Address string `yaml:"address"`
+	As      uint32 `yaml:"as"`
+}
+
+const defaultHoldTime = 90
+
+// loadConfig reads the bgp section of the controller config, returning nil if there isn't one
+func loadConfig() (*BGPConfigSpec, error) {
+	config := &BGPConfig{}
+
+	yamlFile, err := ioutil.ReadFile(ipam.ConfigFile)
+	if err != nil {
+		return nil, err
+	}
+
+	err = yaml.Unmarshal(yamlFile, config)
+	if err != nil {
+		return nil, err
+	}
+
+	spec := config.BGPConfig
+	if spec == nil {
+		return nil, nil
+	}
+
+	if spec.LocalAs == 0 {
+		return nil, fmt.Errorf("bgp localAS is required")
+	}
+
+	if spec.HoldTime == 0 {
+		spec.HoldTime = defaultHoldTime
+	}
+
+	if spec.HoldTime < 3 {
+		return nil, fmt.Errorf("Invalid bgp holdTime %d, must be at least 3 seconds", spec.HoldTime)
+	}
+
+	for _, cidr := range spec.AcceptPrefixes {
+		_, prefix, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid bgp acceptPrefixes: %v", err)
+		}
+
+		spec.acceptPrefixes = append(spec.acceptPrefixes, prefix)
+	}
+
+	for zone, peers := range spec.Peers {
+		for _, peer := range peers {
+			if ip := net.ParseIP(peer.Address); ip == nil || ip.To4() == nil {
+				return nil, fmt.Errorf("Invalid bgp peer address %q in zone %s", peer.Address, zone)
+			}
+
+			if peer.As == 0 {
+				return nil, fmt.Errorf("bgp peer %s in zone %s has no AS", peer.Address, zone)
+			}
+		}
+	}
+
+	return spec, nil
+}
@@ -0,0 +1,213 @@
+package bgp
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// the addresses of the veth pair between the test and the network namespace gobgpd runs in
+const (
+	gobgpLocalAddr = "169.254.179.1"
+	gobgpPeerAddr  = "169.254.179.2"
+)
+
+const gobgpConfig = `[global.config]
+  as = 65001
+  router-id = "%s"
+
+[[neighbors]]
+  [neighbors.config]
+    neighbor-address = "%s"
+    peer-as = 65000
+  [neighbors.transport.config]
+    passive-mode = true
+  [neighbors.timers.config]
+    hold-time = 9
+    keepalive-interval = 3
+`
+
+// routeEvent is a call to a RouteHandler
+type routeEvent struct {
+	event  string
+	peer   string
+	prefix string
+}
+
+// testHandler sends the calls to the RouteHandler to a channel
+type testHandler struct {
+	events chan routeEvent
+}
+
+func newTestHandler() *testHandler {
+	return &testHandler{events: make(chan routeEvent, 100)}
+}
+
+func (h *testHandler) Learned(peer string, prefix *net.IPNet, nextHop net.IP) {
+	h.events <- routeEvent{"learned", peer, prefix.String() + " via " + nextHop.String()}
+}
+
+func (h *testHandler) Withdrawn(peer string, prefix *net.IPNet) {
+	h.events <- routeEvent{"withdrawn", peer, prefix.String()}
+}
+
+func (h *testHandler) PeerUp(peer string) {
+	h.events <- routeEvent{"up", peer, ""}
+}
+
+func (h *testHandler) PeerDown(peer string) {
+	h.events <- routeEvent{"down", peer, ""}
+}
+
+// expect waits for the next call to the handler
+func (h *testHandler) expect(t *testing.T, expected routeEvent, timeout time.Duration) {
+	t.Helper()
+
+	select {
+	case event := <-h.events:
+		if event != expected {
+			t.Fatalf("handler called with %+v, expected %+v", event, expected)
+		}
+	case <-time.After(timeout):
+		t.Fatalf("timed out waiting for %+v", expected)
+	}
+}
+
+// run runs a command, failing the test if it doesn't succeed
+func run(t *testing.T, name string, args ...string) string {
+	t.Helper()
+
+	out, err := exec.Command(name, args...).CombinedOutput()
+	if err != nil {
+		t.Fatalf("%s %s: %v, output: %s", name, strings.Join(args, " "), err, out)
+	}
+
+	return string(out)
+}
+
+// waitFor polls until the condition is true
+func waitFor(t *testing.T, what string, timeout time.Duration, condition func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(timeout)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+}
+
+// startGobgp runs gobgpd in a new network namespace connected to the test's with a veth pair, and returns a
+// function running the gobgp CLI against it
+func startGobgp(t *testing.T) func(args ...string) string {
+	if os.Getuid() != 0 {
+		t.Skip("creating a network namespace needs root")
+	}
+
+	for _, bin := range []string{"ip", "gobgpd", "gobgp"} {
+		if _, err := exec.LookPath(bin); err != nil {
+			t.Skipf("%s isn't installed", bin)
+		}
+	}
+
+	netns := fmt.Sprintf("bgptest%d", os.Getpid())
+	run(t, "ip", "netns", "add", netns)
+	t.Cleanup(func() { exec.Command("ip", "netns", "del", netns).Run() })
+
+	run(t, "ip", "link", "add", "bgptest0", "type", "veth", "peer", "name", "bgptest1")
+	t.Cleanup(func() { exec.Command("ip", "link", "del", "bgptest0").Run() })
+
+	run(t, "ip", "link", "set", "bgptest1", "netns", netns)
+	run(t, "ip", "addr", "add", gobgpLocalAddr+"/30", "dev", "bgptest0")
+	run(t, "ip", "link", "set", "bgptest0", "up")
+	run(t, "ip", "netns", "exec", netns, "ip", "addr", "add", gobgpPeerAddr+"/30", "dev", "bgptest1")
+	run(t, "ip", "netns", "exec", netns, "ip", "link", "set", "bgptest1", "up")
+	run(t, "ip", "netns", "exec", netns, "ip", "link", "set", "lo", "up")
+
+	dir, err := ioutil.TempDir("", "gobgp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	configFile := filepath.Join(dir, "gobgpd.toml")
+	err = ioutil.WriteFile(configFile, []byte(fmt.Sprintf(gobgpConfig, gobgpPeerAddr, gobgpLocalAddr)), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gobgpd := exec.Command("ip", "netns", "exec", netns, "gobgpd", "-t", "toml", "-f", configFile)
+	if err = gobgpd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		gobgpd.Process.Kill()
+		gobgpd.Wait()
+	})
+
+	gobgp := func(args ...string) string {
+		out, _ := exec.Command("ip", append([]string{"netns", "exec", netns, "gobgp"}, args...)...).CombinedOutput()
+		return string(out)
+	}
+
+	waitFor(t, "gobgpd to start", 10*time.Second, func() bool {
+		return strings.Contains(gobgp("neighbor"), gobgpLocalAddr)
+	})
+
+	return gobgp
+}
+
+// TestGobgp runs the speaker against gobgpd, checking that the overlay IP is advertised and that the prefixes
+// announced by gobgpd are learned and withdrawn
+func TestGobgp(t *testing.T) {
+	gobgp := startGobgp(t)
+
+	handler := newTestHandler()
+	s := &speaker{
+		localAs:   65000,
+		holdTime:  9,
+		routerId:  net.ParseIP("10.10.0.5"),
+		peers:     []PeerConfig{{Address: gobgpPeerAddr, As: 65001}},
+		advertise: func() (*net.IPNet, error) { return cidr(t, "10.10.0.5/32"), nil },
+		handler:   handler,
+		learn:     true,
+	}
+
+	stop := make(chan struct{})
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- s.run(stop)
+	}()
+
+	handler.expect(t, routeEvent{"up", gobgpPeerAddr, ""}, 30*time.Second)
+
+	waitFor(t, "the overlay IP to be advertised", 30*time.Second, func() bool {
+		rib := gobgp("global", "rib", "-a", "ipv4")
+		return strings.Contains(rib, "10.10.0.5/32") && strings.Contains(rib, gobgpLocalAddr)
+	})
+
+	gobgp("global", "rib", "add", "-a", "ipv4", "192.168.10.0/24")
+	handler.expect(t, routeEvent{"learned", gobgpPeerAddr, "192.168.10.0/24 via " + gobgpPeerAddr}, 30*time.Second)
+
+	gobgp("global", "rib", "del", "-a", "ipv4", "192.168.10.0/24")
+	handler.expect(t, routeEvent{"withdrawn", gobgpPeerAddr, "192.168.10.0/24"}, 30*time.Second)
+
+	// the session is closed when the speaker stops, and gobgpd drops the advertised prefix
+	close(stop)
+	handler.expect(t, routeEvent{"down", gobgpPeerAddr, ""}, 10*time.Second)
+
+	if err := <-errChan; err != nil {
+		t.Errorf("speaker returned %v", err)
+	}
+
+	waitFor(t, "the overlay IP to be withdrawn", 30*time.Second, func() bool {
+		return !strings.Contains(gobgp("global", "rib", "-a", "ipv4"), "10.10.0.5/32")
+	})
+}
@@ -0,0 +1,253 @@
+package egressgateway
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	iksv1alpha1 "github.com/jkwong888/iks-overlay-ip-controller/pkg/apis/iks/v1alpha1"
+	"github.com/jkwong888/iks-overlay-ip-controller/pkg/util"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	logf "sigs.k8s.io/controller-runtime/pkg/runtime/log"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+)
+
+var log = logf.Log.WithName("controller_egressgateway")
+
+// how long to wait before checking again when no node can be the gateway
+var noGatewayRequeueDelay = 30 * time.Second
+
+// Add creates a new OverlayEgressGateway Controller and adds it to the Manager. The Manager will set fields on the
+// Controller and Start it when the Manager is Started.
+func Add(mgr manager.Manager) error {
+	hasEgressGateway, err := util.HasKind(mgr.GetConfig(), "OverlayEgressGateway")
+	if err != nil {
+		return err
+	}
+
+	if !hasEgressGateway {
+		log.Info("OverlayEgressGateway CRD isn't installed, the egress gateway controller is disabled")
+		return nil
+	}
+
+	return add(mgr, newReconciler(mgr))
+}
+
+// newReconciler returns a new reconcile.Reconciler
+func newReconciler(mgr manager.Manager) reconcile.Reconciler {
+	return &ReconcileOverlayEgressGateway{client: mgr.GetClient(), scheme: mgr.GetScheme()}
+}
+
+// add adds a new Controller to mgr with r as the reconcile.Reconciler
+func add(mgr manager.Manager, r reconcile.Reconciler) error {
+	// Create a new controller
+	c, err := controller.New("overlayegressgateway-controller", mgr, controller.Options{Reconciler: r})
+	if err != nil {
+		return err
+	}
+
+	// Watch for changes to primary resource OverlayEgressGateway
+	err = c.Watch(&source.Kind{Type: &iksv1alpha1.OverlayEgressGateway{}}, &handler.EnqueueRequestForObject{})
+	if err != nil {
+		return err
+	}
+
+	// nodes becoming ready or not ready, or their overlay IPs being configured, may change the active gateway
+	mgrClient := mgr.GetClient()
+	allGateways := &handler.EnqueueRequestsFromMapFunc{
+		ToRequests: handler.ToRequestsFunc(func(a handler.MapObject) []reconcile.Request {
+			gateways := &iksv1alpha1.OverlayEgressGatewayList{}
+			err := mgrClient.List(context.TODO(), &client.ListOptions{}, gateways)
+			if err != nil {
+				log.Error(err, "Failed to list OverlayEgressGateways")
+				return nil
+			}
+
+			requests := []reconcile.Request{}
+			for _, gateway := range gateways.Items {
+				requests = append(requests, reconcile.Request{
+					NamespacedName: types.NamespacedName{Name: gateway.Name},
+				})
+			}
+
+			return requests
+		}),
+	}
+
+	// the nodes' status is updated by every heartbeat, only the changes that make a node a candidate or not matter
+	candidateChanged := predicate.Funcs{
+		UpdateFunc: func(e event.UpdateEvent) bool {
+			oldNode, ok := e.ObjectOld.(*corev1.Node)
+			if !ok {
+				return true
+			}
+
+			newNode, ok := e.ObjectNew.(*corev1.Node)
+			if !ok {
+				return true
+			}
+
+			return !reflect.DeepEqual(oldNode.GetLabels(), newNode.GetLabels()) ||
+				isReady(oldNode) != isReady(newNode) ||
+				internalIp(oldNode) != internalIp(newNode) ||
+				(oldNode.GetDeletionTimestamp() == nil) != (newNode.GetDeletionTimestamp() == nil)
+		},
+	}
+
+	err = c.Watch(&source.Kind{Type: &corev1.Node{}}, allGateways, candidateChanged)
+	if err != nil {
+		return err
+	}
+
+	err = c.Watch(&source.Kind{Type: &iksv1alpha1.NodeOverlayIp{}}, allGateways)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// blank assignment to verify that ReconcileOverlayEgressGateway implements reconcile.Reconciler
+var _ reconcile.Reconciler = &ReconcileOverlayEgressGateway{}
+
+// ReconcileOverlayEgressGateway reconciles an OverlayEgressGateway object
+type ReconcileOverlayEgressGateway struct {
+	// This client, initialized using mgr.Client() above, is a split client
+	// that reads objects from the cache and writes to the apiserver
+	client client.Client
+	scheme *runtime.Scheme
+}
+
+// Reconcile picks the active gateway node from the ready nodes selected by the OverlayEgressGateway that have a
+// configured overlay IP.  The active gateway is kept until it is no longer a candidate, e.g. when it becomes not
+// ready, then the gateway fails over to the next candidate.
+// Note:
+// The Controller will requeue the Request to be processed again if the returned error is non-nil or
+// Result.Requeue is true, otherwise upon completion it will remove the work from the queue.
+func (r *ReconcileOverlayEgressGateway) Reconcile(request reconcile.Request) (reconcile.Result, error) {
+	reqLogger := log.WithValues("Request.Name", request.Name)
+
+	// Fetch the OverlayEgressGateway instance
+	instance := &iksv1alpha1.OverlayEgressGateway{}
+	err := r.client.Get(context.TODO(), request.NamespacedName, instance)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return reconcile.Result{}, nil
+		}
+		// Error reading the object - requeue the request.
+		return reconcile.Result{}, err
+	}
+
+	candidates, overlayIps, err := r.candidateNodes(instance)
+	if err != nil {
+		return reconcile.Result{}, err
+	}
+
+	status := iksv1alpha1.OverlayEgressGatewayStatus{}
+	var active *corev1.Node
+	for i := range candidates {
+		if candidates[i].Name == instance.Status.Node {
+			active = &candidates[i]
+			break
+		}
+	}
+
+	if active == nil && len(candidates) > 0 {
+		active = &candidates[0]
+	}
+
+	if active != nil {
+		status.Node = active.Name
+		status.NodeIp = internalIp(active)
+		status.OverlayIp = overlayIps[active.Name]
+	}
+
+	if status != instance.Status {
+		reqLogger.Info("Setting active egress gateway", "from", instance.Status.Node, "to", status.Node, "nodeIp", status.NodeIp)
+		instance.Status = status
+		err = r.client.Status().Update(context.TODO(), instance)
+		if err != nil {
+			return reconcile.Result{}, err
+		}
+	}
+
+	if active == nil {
+		reqLogger.Info("No node can be the egress gateway, requeuing")
+		return reconcile.Result{RequeueAfter: noGatewayRequeueDelay}, nil
+	}
+
+	return reconcile.Result{}, nil
+}
+
+// candidateNodes returns the ready nodes selected by the gateway with a configured overlay IP, sorted by name, and
+// their overlay IPs
+func (r *ReconcileOverlayEgressGateway) candidateNodes(instance *iksv1alpha1.OverlayEgressGateway) ([]corev1.Node, map[string]string, error) {
+	nodes := &corev1.NodeList{}
+	err := r.client.List(context.TODO(), &client.ListOptions{}, nodes)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	nodeOverlayIps := &iksv1alpha1.NodeOverlayIpList{}
+	err = r.client.List(context.TODO(), &client.ListOptions{}, nodeOverlayIps)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	overlayIps := map[string]string{}
+	for _, nodeOverlayIp := range nodeOverlayIps.Items {
+		if nodeOverlayIp.Status.IpAddr != "" && nodeOverlayIp.Status.InterfaceLabel != "" && nodeOverlayIp.GetDeletionTimestamp() == nil {
+			overlayIps[nodeOverlayIp.Name] = strings.Split(nodeOverlayIp.Status.IpAddr, "/")[0]
+		}
+	}
+
+	candidates := []corev1.Node{}
+	for _, node := range nodes.Items {
+		if node.GetDeletionTimestamp() != nil || overlayIps[node.Name] == "" || !isReady(&node) || internalIp(&node) == "" {
+			continue
+		}
+
+		if !instance.Selects(&node) {
+			continue
+		}
+
+		candidates = append(candidates, node)
+	}
+
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].Name < candidates[j].Name })
+
+	return candidates, overlayIps, nil
+}
+
+func isReady(node *corev1.Node) bool {
+	for _, condition := range node.Status.Conditions {
+		if condition.Type == corev1.NodeReady {
+			return condition.Status == corev1.ConditionTrue
+		}
+	}
+
+	return false
+}
+
+// internalIp returns the node's private IP, which the other nodes route through
+func internalIp(node *corev1.Node) string {
+	for _, addr := range node.Status.Addresses {
+		if addr.Type == corev1.NodeInternalIP {
+			return addr.Address
+		}
+	}
+
+	return ""
+}
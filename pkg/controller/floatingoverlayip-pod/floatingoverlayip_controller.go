@@ -0,0 +1,560 @@
+package floatingoverlayip
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	iksv1alpha1 "github.com/jkwong888/iks-overlay-ip-controller/pkg/apis/iks/v1alpha1"
+	"github.com/jkwong888/iks-overlay-ip-controller/pkg/util"
+	coordinationv1beta1 "k8s.io/api/coordination/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/rest"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	logf "sigs.k8s.io/controller-runtime/pkg/runtime/log"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+)
+
+var log = logf.Log.WithName("controller_floatingoverlayip")
+
+// the suffix of the address label that marks the floating IPs on the overlay device, e.g. tmp0:fip
+const addrLabelSuffix = ":fip"
+
+// how long a holder keeps the floating IP without renewing its lease before another node takes over
+var leaseDuration = 15 * time.Second
+
+// how often the holder renews its lease, and the other nodes check whether it expired
+var renewInterval = 5 * time.Second
+
+type ManagerOptions struct {
+	Hostname string
+
+	// Namespace the namespace of the Leases, the network pod's namespace
+	Namespace string
+}
+
+// Add creates a new FloatingOverlayIp Controller and adds it to the Manager. The Manager will set fields on the
+// Controller and Start it when the Manager is Started.
+func Add(mgr manager.Manager, options ManagerOptions) error {
+	r, err := newReconciler(mgr, options)
+	if err != nil {
+		return err
+	}
+
+	// the floating IPs are dropped when their leases can't be renewed, even if nothing is reconciled
+	err = mgr.Add(manager.RunnableFunc(r.expireHeld))
+	if err != nil {
+		return err
+	}
+
+	return add(mgr, r, options)
+}
+
+// newReconciler returns a new reconcile.Reconciler
+func newReconciler(mgr manager.Manager, options ManagerOptions) (*ReconcileFloatingOverlayIp, error) {
+	// the Leases are read from the API server rather than the manager's cache, which would watch the Leases in all
+	// namespaces, and the calls time out before the lease could expire
+	cfg := rest.CopyConfig(mgr.GetConfig())
+	cfg.Timeout = renewInterval
+	leases, err := client.New(cfg, client.Options{Scheme: mgr.GetScheme(), Mapper: mgr.GetRESTMapper()})
+	if err != nil {
+		return nil, err
+	}
+
+	return &ReconcileFloatingOverlayIp{
+		client:   mgr.GetClient(),
+		leases:   leases,
+		scheme:   mgr.GetScheme(),
+		options:  options,
+		held:     map[string]heldIp{},
+		observed: map[string]observedLease{},
+	}, nil
+}
+
+// add adds a new Controller to mgr with r as the reconcile.Reconciler
+func add(mgr manager.Manager, r reconcile.Reconciler, options ManagerOptions) error {
+	// Create a new controller
+	c, err := controller.New("floatingoverlayip-controller", mgr, controller.Options{Reconciler: r})
+	if err != nil {
+		return err
+	}
+
+	// Watch for changes to primary resource FloatingOverlayIp
+	err = c.Watch(&source.Kind{Type: &iksv1alpha1.FloatingOverlayIp{}}, &handler.EnqueueRequestForObject{})
+	if err != nil {
+		return err
+	}
+
+	// this node's labels and overlay device decide which floating IPs it can hold
+	mgrClient := mgr.GetClient()
+	allFloatingIps := &handler.EnqueueRequestsFromMapFunc{
+		ToRequests: handler.ToRequestsFunc(func(a handler.MapObject) []reconcile.Request {
+			floatingIps := &iksv1alpha1.FloatingOverlayIpList{}
+			err := mgrClient.List(context.TODO(), &client.ListOptions{}, floatingIps)
+			if err != nil {
+				log.Error(err, "Failed to list FloatingOverlayIps")
+				return nil
+			}
+
+			requests := []reconcile.Request{}
+			for _, floatingIp := range floatingIps.Items {
+				requests = append(requests, reconcile.Request{
+					NamespacedName: types.NamespacedName{Name: floatingIp.Name},
+				})
+			}
+
+			return requests
+		}),
+	}
+
+	isMyNode := predicate.Funcs{
+		CreateFunc:  func(e event.CreateEvent) bool { return e.Meta.GetName() == options.Hostname },
+		UpdateFunc:  func(e event.UpdateEvent) bool { return e.MetaNew.GetName() == options.Hostname },
+		DeleteFunc:  func(e event.DeleteEvent) bool { return e.Meta.GetName() == options.Hostname },
+		GenericFunc: func(e event.GenericEvent) bool { return e.Meta.GetName() == options.Hostname },
+	}
+
+	err = c.Watch(&source.Kind{Type: &corev1.Node{}}, allFloatingIps, isMyNode)
+	if err != nil {
+		return err
+	}
+
+	err = c.Watch(&source.Kind{Type: &iksv1alpha1.NodeOverlayIp{}}, allFloatingIps, isMyNode)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// observedLease records when this node last saw a lease renewed, so expiry is judged by this node's clock rather
+// than by comparing the holder's timestamps with it
+type observedLease struct {
+	holder    string
+	renewTime time.Time
+	seenAt    time.Time
+}
+
+// heldIp is a floating IP this node holds, and when it last renewed its lease
+type heldIp struct {
+	ipAddr  string
+	renewed time.Time
+}
+
+// blank assignment to verify that ReconcileFloatingOverlayIp implements reconcile.Reconciler
+var _ reconcile.Reconciler = &ReconcileFloatingOverlayIp{}
+
+// ReconcileFloatingOverlayIp elects the node holding each FloatingOverlayIp and binds the held IPs on this node
+type ReconcileFloatingOverlayIp struct {
+	// This client, initialized using mgr.Client() above, is a split client
+	// that reads objects from the cache and writes to the apiserver
+	client  client.Client
+	leases  client.Client
+	scheme  *runtime.Scheme
+	options ManagerOptions
+
+	// the floating IPs this node holds, by FloatingOverlayIp name, and the overlay device they're bound to
+	held     map[string]heldIp
+	device   string
+	heldLock sync.Mutex
+
+	// the leases of the floating IPs held by other nodes, by FloatingOverlayIp name
+	observed map[string]observedLease
+}
+
+// Reconcile takes part in the Lease based election of the node holding the FloatingOverlayIp when this node can
+// hold it.  The holder renews the Lease, binds the IP to its overlay device, announces it with gratuitous ARPs and
+// records itself in the status.  Another node takes over once the Lease isn't renewed for the lease duration.
+// Note:
+// The Controller will requeue the Request to be processed again if the returned error is non-nil or
+// Result.Requeue is true, otherwise upon completion it will remove the work from the queue.
+func (r *ReconcileFloatingOverlayIp) Reconcile(request reconcile.Request) (reconcile.Result, error) {
+	reqLogger := log.WithValues("Request.Name", request.Name)
+
+	nodeOverlayIp := &iksv1alpha1.NodeOverlayIp{}
+	err := r.client.Get(context.TODO(), types.NamespacedName{Name: r.options.Hostname}, nodeOverlayIp)
+	if err != nil && !errors.IsNotFound(err) {
+		return reconcile.Result{}, err
+	}
+
+	// the floating IPs are bound to the overlay device, so this node can only hold them once it's created
+	device := ""
+	if err == nil && nodeOverlayIp.GetDeletionTimestamp() == nil {
+		device = nodeOverlayIp.Status.InterfaceLabel
+	}
+
+	// Fetch the FloatingOverlayIp instance
+	instance := &iksv1alpha1.FloatingOverlayIp{}
+	err = r.client.Get(context.TODO(), request.NamespacedName, instance)
+	if err != nil {
+		if !errors.IsNotFound(err) {
+			// Error reading the object - requeue the request.
+			return reconcile.Result{}, err
+		}
+
+		// the Lease is garbage collected with the FloatingOverlayIp
+		r.drop(request.Name)
+		delete(r.observed, request.Name)
+		return reconcile.Result{}, r.syncAddrs(device)
+	}
+
+	eligible, err := r.canHold(instance, device)
+	if err != nil {
+		return reconcile.Result{}, err
+	}
+
+	if !eligible {
+		if r.drop(instance.Name) {
+			reqLogger.Info("Releasing floating IP", "ipAddr", instance.Status.IpAddr)
+		}
+
+		err = r.release(instance)
+		if err != nil {
+			return reconcile.Result{}, err
+		}
+
+		return reconcile.Result{}, r.syncAddrs(device)
+	}
+
+	isHolder, err := r.elect(instance)
+	if err != nil {
+		// the IP stays bound until the lease would expire, see expireHeld
+		return reconcile.Result{}, err
+	}
+
+	if isHolder {
+		if !r.hold(instance.Name, instance.Status.IpAddr) {
+			reqLogger.Info("Taking over floating IP", "ipAddr", instance.Status.IpAddr)
+		}
+	} else if r.drop(instance.Name) {
+		reqLogger.Info("Lost the lease of floating IP", "ipAddr", instance.Status.IpAddr)
+	}
+
+	err = r.syncAddrs(device)
+	if err != nil {
+		return reconcile.Result{}, err
+	}
+
+	if isHolder && instance.Status.Holder != r.options.Hostname {
+		instance.Status.Holder = r.options.Hostname
+		err = r.client.Status().Update(context.TODO(), instance)
+		if err != nil {
+			return reconcile.Result{}, err
+		}
+	}
+
+	return reconcile.Result{RequeueAfter: renewInterval}, nil
+}
+
+// canHold returns true if this node can hold the floating IP
+func (r *ReconcileFloatingOverlayIp) canHold(instance *iksv1alpha1.FloatingOverlayIp, device string) (bool, error) {
+	if instance.Status.IpAddr == "" || instance.GetDeletionTimestamp() != nil || device == "" {
+		return false, nil
+	}
+
+	node := &corev1.Node{}
+	err := r.client.Get(context.TODO(), types.NamespacedName{Name: r.options.Hostname}, node)
+	if err != nil {
+		return false, err
+	}
+
+	return instance.Selects(node), nil
+}
+
+// elect returns true if this node holds the lease of the floating IP, creating, renewing or taking it over
+func (r *ReconcileFloatingOverlayIp) elect(instance *iksv1alpha1.FloatingOverlayIp) (bool, error) {
+	now := metav1.NewMicroTime(time.Now())
+	leaseSeconds := int32(leaseDuration / time.Second)
+
+	lease := &coordinationv1beta1.Lease{}
+	err := r.leases.Get(context.TODO(), types.NamespacedName{Namespace: r.options.Namespace, Name: leaseName(instance)}, lease)
+	if err != nil {
+		if !errors.IsNotFound(err) {
+			return false, err
+		}
+
+		lease = &coordinationv1beta1.Lease{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      leaseName(instance),
+				Namespace: r.options.Namespace,
+				OwnerReferences: []metav1.OwnerReference{
+					*metav1.NewControllerRef(instance, iksv1alpha1.SchemeGroupVersion.WithKind("FloatingOverlayIp")),
+				},
+			},
+			Spec: coordinationv1beta1.LeaseSpec{
+				HolderIdentity:       &r.options.Hostname,
+				LeaseDurationSeconds: &leaseSeconds,
+				AcquireTime:          &now,
+				RenewTime:            &now,
+			},
+		}
+
+		err = r.leases.Create(context.TODO(), lease)
+		if err != nil {
+			if errors.IsAlreadyExists(err) {
+				// another node created it first
+				return false, nil
+			}
+			return false, err
+		}
+
+		return true, nil
+	}
+
+	holder := ""
+	if lease.Spec.HolderIdentity != nil {
+		holder = *lease.Spec.HolderIdentity
+	}
+
+	if holder != r.options.Hostname {
+		if holder != "" && !r.expired(instance.Name, lease) {
+			return false, nil
+		}
+
+		log.Info("Lease expired, taking over", "lease", lease.Name, "holder", holder)
+		transitions := int32(1)
+		if lease.Spec.LeaseTransitions != nil {
+			transitions = *lease.Spec.LeaseTransitions + 1
+		}
+
+		lease.Spec.HolderIdentity = &r.options.Hostname
+		lease.Spec.AcquireTime = &now
+		lease.Spec.LeaseTransitions = &transitions
+	}
+
+	lease.Spec.LeaseDurationSeconds = &leaseSeconds
+	lease.Spec.RenewTime = &now
+	err = r.leases.Update(context.TODO(), lease)
+	if err != nil {
+		if errors.IsConflict(err) {
+			// another node renewed or took over the lease since it was read
+			return false, nil
+		}
+		return false, err
+	}
+
+	delete(r.observed, instance.Name)
+	return true, nil
+}
+
+// expired returns true if the lease hasn't been renewed by its holder for its duration, as seen by this node
+func (r *ReconcileFloatingOverlayIp) expired(name string, lease *coordinationv1beta1.Lease) bool {
+	current := observedLease{holder: *lease.Spec.HolderIdentity}
+	if lease.Spec.RenewTime != nil {
+		current.renewTime = lease.Spec.RenewTime.Time
+	}
+
+	duration := leaseDuration
+	if lease.Spec.LeaseDurationSeconds != nil {
+		duration = time.Duration(*lease.Spec.LeaseDurationSeconds) * time.Second
+	}
+
+	last, ok := r.observed[name]
+	if !ok || last.holder != current.holder || !last.renewTime.Equal(current.renewTime) {
+		current.seenAt = time.Now()
+		r.observed[name] = current
+		return false
+	}
+
+	return time.Since(last.seenAt) > duration
+}
+
+// release gives up the lease of the floating IP if this node holds it, so another node can take over right away
+func (r *ReconcileFloatingOverlayIp) release(instance *iksv1alpha1.FloatingOverlayIp) error {
+	lease := &coordinationv1beta1.Lease{}
+	err := r.leases.Get(context.TODO(), types.NamespacedName{Namespace: r.options.Namespace, Name: leaseName(instance)}, lease)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return nil
+		}
+		return err
+	}
+
+	if lease.Spec.HolderIdentity == nil || *lease.Spec.HolderIdentity != r.options.Hostname {
+		return nil
+	}
+
+	lease.Spec.HolderIdentity = nil
+	err = r.leases.Update(context.TODO(), lease)
+	if err != nil && !errors.IsConflict(err) {
+		return err
+	}
+
+	if instance.Status.Holder == r.options.Hostname && instance.GetDeletionTimestamp() == nil {
+		instance.Status.Holder = ""
+		return r.client.Status().Update(context.TODO(), instance)
+	}
+
+	return nil
+}
+
+// hold records that this node renewed the lease of the floating IP, and returns true if it already held it
+func (r *ReconcileFloatingOverlayIp) hold(name string, ipAddr string) bool {
+	r.heldLock.Lock()
+	defer r.heldLock.Unlock()
+
+	_, held := r.held[name]
+	r.held[name] = heldIp{ipAddr: ipAddr, renewed: time.Now()}
+
+	return held
+}
+
+// drop records that this node no longer holds the floating IP, and returns true if it held it
+func (r *ReconcileFloatingOverlayIp) drop(name string) bool {
+	r.heldLock.Lock()
+	defer r.heldLock.Unlock()
+
+	_, held := r.held[name]
+	delete(r.held, name)
+
+	return held
+}
+
+// expireHeld drops the floating IPs whose lease this node couldn't renew, e.g. because the API server is
+// unreachable, before the other nodes may take them over.  It runs until stop is closed.
+func (r *ReconcileFloatingOverlayIp) expireHeld(stop <-chan struct{}) error {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return nil
+		case <-ticker.C:
+		}
+
+		// another node takes over once it hasn't seen the lease renewed for the lease duration, which it may
+		// have last seen up to a renew interval after it was renewed
+		holdDuration := leaseDuration - renewInterval
+
+		r.heldLock.Lock()
+		expired := false
+		for name, held := range r.held {
+			if time.Since(held.renewed) <= holdDuration {
+				continue
+			}
+
+			log.Info("Lease of floating IP wasn't renewed, dropping it", "FloatingOverlayIp", name, "ipAddr", held.ipAddr, "renewed", held.renewed)
+			delete(r.held, name)
+			expired = true
+		}
+
+		device := r.device
+		r.heldLock.Unlock()
+
+		if expired {
+			err := r.syncAddrs(device)
+			if err != nil {
+				log.Error(err, "Failed to remove expired floating IPs", "device", device)
+			}
+		}
+	}
+}
+
+// syncAddrs binds the floating IPs this node holds to the overlay device, announcing each new one with
+// gratuitous ARPs, and removes the floating IPs it no longer holds
+func (r *ReconcileFloatingOverlayIp) syncAddrs(device string) error {
+	r.heldLock.Lock()
+	defer r.heldLock.Unlock()
+
+	r.device = device
+	if device == "" {
+		return nil
+	}
+
+	desired := map[string]string{}
+	for _, held := range r.held {
+		ip, _, err := net.ParseCIDR(held.ipAddr)
+		if err != nil {
+			continue
+		}
+
+		desired[fmt.Sprintf("%s/32", ip.String())] = ip.String()
+	}
+
+	current, err := getFloatingAddrs(device)
+	if err != nil {
+		return err
+	}
+
+	for addr, ip := range desired {
+		if current[addr] {
+			continue
+		}
+
+		log.Info("Binding floating IP", "ipAddr", addr, "device", device)
+		out, code, err := util.ExecIpCmd(fmt.Sprintf("addr add %s dev %s label %s%s", addr, device, device, addrLabelSuffix))
+		if err != nil {
+			return err
+		}
+
+		if code != 0 {
+			return fmt.Errorf("Error executing \"ip addr add\", output: %s", out)
+		}
+
+		// the IP is bound, so a failed announcement only delays the other hosts finding it
+		err = util.AnnounceAddress(device, ip)
+		if err != nil {
+			log.Error(err, "Failed to announce floating IP", "ipAddr", ip, "device", device)
+		}
+	}
+
+	for addr := range current {
+		if _, ok := desired[addr]; ok {
+			continue
+		}
+
+		log.Info("Removing floating IP", "ipAddr", addr, "device", device)
+		out, code, err := util.ExecIpCmd(fmt.Sprintf("addr del %s dev %s", addr, device))
+		if err != nil {
+			return err
+		}
+
+		if code != 0 {
+			return fmt.Errorf("Error executing \"ip addr del\", output: %s", out)
+		}
+	}
+
+	return nil
+}
+
+// getFloatingAddrs returns the floating IPs bound to the device
+func getFloatingAddrs(device string) (map[string]bool, error) {
+	out, code, err := util.ExecIpCmd(fmt.Sprintf("addr show dev %s", device))
+	if err != nil {
+		return nil, err
+	}
+
+	if code != 0 {
+		return nil, fmt.Errorf("Error executing \"ip addr show\", output: %s", out)
+	}
+
+	addrs := map[string]bool{}
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || fields[0] != "inet" || fields[len(fields)-1] != device+addrLabelSuffix {
+			continue
+		}
+
+		addrs[fields[1]] = true
+	}
+
+	return addrs, nil
+}
+
+func leaseName(instance *iksv1alpha1.FloatingOverlayIp) string {
+	return fmt.Sprintf("floatingoverlayip-%s", instance.Name)
+}
@@ -0,0 +1,181 @@
+package floatingoverlayip
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	iksv1alpha1 "github.com/jkwong888/iks-overlay-ip-controller/pkg/apis/iks/v1alpha1"
+	ipam "github.com/jkwong888/iks-overlay-ip-controller/pkg/ipam"
+	"github.com/jkwong888/iks-overlay-ip-controller/pkg/metrics"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	logf "sigs.k8s.io/controller-runtime/pkg/runtime/log"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+)
+
+var log = logf.Log.WithName("controller_floatingoverlayip")
+
+// Add creates a new FloatingOverlayIp Controller and adds it to the Manager. The Manager will set fields on the
+// Controller and Start it when the Manager is Started.
+func Add(mgr manager.Manager) error {
+	return add(mgr, newReconciler(mgr))
+}
+
+// newReconciler returns a new reconcile.Reconciler
+func newReconciler(mgr manager.Manager) reconcile.Reconciler {
+	return &ReconcileFloatingOverlayIp{client: mgr.GetClient(), scheme: mgr.GetScheme()}
+}
+
+// add adds a new Controller to mgr with r as the reconcile.Reconciler
+func add(mgr manager.Manager, r reconcile.Reconciler) error {
+	// Create a new controller
+	c, err := controller.New("floatingoverlayip-controller", mgr, controller.Options{Reconciler: r})
+	if err != nil {
+		return err
+	}
+
+	// Watch for changes to primary resource FloatingOverlayIp
+	err = c.Watch(&source.Kind{Type: &iksv1alpha1.FloatingOverlayIp{}}, &handler.EnqueueRequestForObject{})
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// blank assignment to verify that ReconcileFloatingOverlayIp implements reconcile.Reconciler
+var _ reconcile.Reconciler = &ReconcileFloatingOverlayIp{}
+
+// ReconcileFloatingOverlayIp reconciles a FloatingOverlayIp object
+type ReconcileFloatingOverlayIp struct {
+	// This client, initialized using mgr.Client() above, is a split client
+	// that reads objects from the cache and writes to the apiserver
+	client client.Client
+	scheme *runtime.Scheme
+}
+
+// Reconcile reserves an IP in IPAM for a FloatingOverlayIp in its zone, and releases it when the FloatingOverlayIp
+// is deleted.  The network pods elect the node that holds the IP.
+// Note:
+// The Controller will requeue the Request to be processed again if the returned error is non-nil or
+// Result.Requeue is true, otherwise upon completion it will remove the work from the queue.
+func (r *ReconcileFloatingOverlayIp) Reconcile(request reconcile.Request) (reconcile.Result, error) {
+	reqLogger := log.WithValues("Request.Name", request.Name)
+	reqLogger.Info("Reconciling FloatingOverlayIp")
+
+	// Fetch the FloatingOverlayIp instance
+	instance := &iksv1alpha1.FloatingOverlayIp{}
+	err := r.client.Get(context.TODO(), request.NamespacedName, instance)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			// Request object not found, could have been deleted after reconcile request.
+			// Return and don't requeue
+			return reconcile.Result{}, nil
+		}
+		// Error reading the object - requeue the request.
+		return reconcile.Result{}, err
+	}
+
+	if err := r.addFinalizer(instance); err != nil {
+		reqLogger.Error(err, "Failed to update FloatingOverlayIp with finalizer")
+		return reconcile.Result{}, err
+	}
+
+	phpIPAM, err := ipam.NewPhpIPAM()
+	if err != nil {
+		return reconcile.Result{}, err
+	}
+
+	// someone deleted the IP, clean up IPAM
+	if instance.GetDeletionTimestamp() != nil {
+		ipAddr := instance.Status.IpAddr
+		if ipAddr == "" && instance.Spec.Zone != "" {
+			// the IP may have been reserved by a reconcile that failed to record it
+			ipAddr, _, err = phpIPAM.FindIPAddressByOwner(ipamOwner(instance), ipam.Placement{Zone: instance.Spec.Zone})
+			if err != nil {
+				return reconcile.Result{}, err
+			}
+		}
+
+		if ipAddr != "" {
+			reqLogger.Info("Releasing IP", "ipAddr", ipAddr)
+
+			// remove the mask from the ip address
+			ipAddrArr := strings.Split(ipAddr, "/")
+			err = phpIPAM.DeleteIPAddress(ipAddrArr[0])
+			metrics.IPAMReleases.WithLabelValues(metrics.Result(err)).Inc()
+			if err != nil {
+				return reconcile.Result{}, err
+			}
+		}
+
+		instance.SetFinalizers(nil)
+		err = r.client.Update(context.TODO(), instance)
+		if err != nil {
+			return reconcile.Result{}, err
+		}
+
+		return reconcile.Result{}, nil
+	}
+
+	if instance.Status.IpAddr != "" {
+		return reconcile.Result{}, nil
+	}
+
+	if instance.Spec.Zone == "" {
+		return reconcile.Result{}, fmt.Errorf("FloatingOverlayIp %s has no zone", instance.Name)
+	}
+
+	// look the IP up by its owner first, so an IP reserved by a reconcile that failed to record it isn't leaked; all the
+	// subnets of the zone are searched, as the node selector may have changed since
+	myIP, _, err := phpIPAM.FindIPAddressByOwner(ipamOwner(instance), ipam.Placement{Zone: instance.Spec.Zone})
+	if err != nil {
+		return reconcile.Result{}, err
+	}
+
+	if myIP == "" {
+		// the IP moves between the nodes the selector matches, so if it selects a VLAN the IP is reserved in a subnet
+		// reachable from it
+		placement := ipam.Placement{Zone: instance.Spec.Zone, Labels: instance.Spec.NodeSelector}
+		myIP, err = phpIPAM.ReserveIPAddress(ipamOwner(instance), placement)
+		metrics.IPAMReservations.WithLabelValues(instance.Spec.Zone, metrics.Result(err)).Inc()
+		if err != nil {
+			return reconcile.Result{}, err
+		}
+
+		reqLogger.Info("Reserved IP", "ipAddr", myIP, "zone", instance.Spec.Zone)
+	}
+
+	instance.Status.IpAddr = myIP
+	err = r.client.Status().Update(context.TODO(), instance)
+	if err != nil {
+		reqLogger.Error(err, "failed to update the FloatingOverlayIp")
+		return reconcile.Result{}, err
+	}
+
+	return reconcile.Result{}, nil
+}
+
+// ipamOwner returns the owner recorded in IPAM for the FloatingOverlayIp's IP
+func ipamOwner(instance *iksv1alpha1.FloatingOverlayIp) string {
+	return fmt.Sprintf("floating/%s", instance.Name)
+}
+
+// addFinalizer adds the finalizer so the IP is released in IPAM before the FloatingOverlayIp is deleted
+func (r *ReconcileFloatingOverlayIp) addFinalizer(m *iksv1alpha1.FloatingOverlayIp) error {
+	if len(m.GetFinalizers()) < 1 && m.GetDeletionTimestamp() == nil {
+		m.SetFinalizers([]string{"finalizer.iks.ibm.com"})
+
+		err := r.client.Update(context.TODO(), m)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+package ipamusage
+
+import (
+	"strconv"
+	"time"
+
+	ipam "github.com/jkwong888/iks-overlay-ip-controller/pkg/ipam"
+	"github.com/jkwong888/iks-overlay-ip-controller/pkg/metrics"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	logf "sigs.k8s.io/controller-runtime/pkg/runtime/log"
+)
+
+var log = logf.Log.WithName("controller_ipamusage")
+
+// how often the subnet usage is pulled from IPAM
+var pollInterval = 60 * time.Second
+
+// Add creates a runnable that periodically pulls subnet usage from IPAM into the pool metrics
+// and adds it to the Manager. The Manager will Start it when the Manager is Started.
+func Add(mgr manager.Manager) error {
+	return mgr.Add(manager.RunnableFunc(func(stop <-chan struct{}) error {
+		wait.Until(updatePoolMetrics, pollInterval, stop)
+		return nil
+	}))
+}
+
+func updatePoolMetrics() {
+	phpIPAM, err := ipam.NewPhpIPAM()
+	if err != nil {
+		log.Error(err, "Unable to connect to IPAM, skipping pool usage update")
+		return
+	}
+
+	for zone, subnetIds := range phpIPAM.PhpIPAMConfig.SubnetMap {
+		for _, subnetId := range subnetIds {
+			usage, err := phpIPAM.GetSubnetUsage(subnetId)
+			if err != nil {
+				log.Error(err, "Unable to get subnet usage", "zone", zone, "subnet", subnetId)
+				continue
+			}
+
+			subnet := strconv.Itoa(subnetId)
+			metrics.IPAMPoolSize.WithLabelValues(zone, subnet).Set(usage.MaxHosts)
+			metrics.IPAMPoolUsed.WithLabelValues(zone, subnet).Set(usage.Used)
+			metrics.IPAMPoolFree.WithLabelValues(zone, subnet).Set(usage.FreeHosts)
+		}
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 
 	iksv1alpha1 "github.com/jkwong888/iks-overlay-ip-controller/pkg/apis/iks/v1alpha1"
+	"github.com/jkwong888/iks-overlay-ip-controller/pkg/util"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -21,19 +22,28 @@ import (
 
 var log = logf.Log.WithName("controller_node")
 
+// nodeFinalizer is added to Nodes so their overlay IP is released before they are removed
+const nodeFinalizer = "finalizer.iks.ibm.com"
+
 // Add creates a new Node Controller and adds it to the Manager. The Manager will set fields on the Controller
 // and Start it when the Manager is Started.
 func Add(mgr manager.Manager) error {
-	return add(mgr, newReconciler(mgr))
+	// the OverlayEgressGateway CRD is optional
+	hasEgressGateway, err := util.HasKind(mgr.GetConfig(), "OverlayEgressGateway")
+	if err != nil {
+		return err
+	}
+
+	return add(mgr, newReconciler(mgr, hasEgressGateway), hasEgressGateway)
 }
 
 // newReconciler returns a new reconcile.Reconciler
-func newReconciler(mgr manager.Manager) reconcile.Reconciler {
-	return &ReconcileNode{client: mgr.GetClient(), scheme: mgr.GetScheme()}
+func newReconciler(mgr manager.Manager, hasEgressGateway bool) reconcile.Reconciler {
+	return &ReconcileNode{client: mgr.GetClient(), scheme: mgr.GetScheme(), hasEgressGateway: hasEgressGateway}
 }
 
 // add adds a new Controller to mgr with r as the reconcile.Reconciler
-func add(mgr manager.Manager, r reconcile.Reconciler) error {
+func add(mgr manager.Manager, r reconcile.Reconciler, hasEgressGateway bool) error {
 	// Create a new controller
 	c, err := controller.New("node-controller", mgr, controller.Options{Reconciler: r})
 	if err != nil {
@@ -64,6 +74,34 @@ func add(mgr manager.Manager, r reconcile.Reconciler) error {
 		return err
 	}
 
+	if !hasEgressGateway {
+		return nil
+	}
+
+	// changing the egress gateways changes which nodes hold overlay IPs, so requeue all nodes
+	mgrClient := mgr.GetClient()
+	err = c.Watch(&source.Kind{Type: &iksv1alpha1.OverlayEgressGateway{}}, &handler.EnqueueRequestsFromMapFunc{
+		ToRequests: handler.ToRequestsFunc(func(a handler.MapObject) []reconcile.Request {
+			nodes := &corev1.NodeList{}
+			err := mgrClient.List(context.TODO(), &client.ListOptions{}, nodes)
+			if err != nil {
+				log.Error(err, "Failed to list Nodes")
+				return nil
+			}
+
+			requests := []reconcile.Request{}
+			for _, node := range nodes.Items {
+				requests = append(requests, reconcile.Request{
+					NamespacedName: types.NamespacedName{Name: node.Name},
+				})
+			}
+
+			return requests
+		}),
+	})
+	if err != nil {
+		return err
+	}
 
 	return nil
 }
@@ -77,6 +115,9 @@ type ReconcileNode struct {
 	// that reads objects from the cache and writes to the apiserver
 	client client.Client
 	scheme *runtime.Scheme
+
+	// whether the OverlayEgressGateway CRD is installed
+	hasEgressGateway bool
 }
 
 // Reconcile reads that state of the cluster for a Node object and makes changes based on the state read
@@ -92,18 +133,69 @@ func (r *ReconcileNode) Reconcile(request reconcile.Request) (reconcile.Result,
 	instance := &corev1.Node{}
 	err := r.client.Get(context.TODO(), request.NamespacedName, instance)
 	if err != nil {
-		// TODO: use a finalizer to cleanup IPAM
-
 		if errors.IsNotFound(err) {
-			// Request object not found, could have been deleted after reconcile request.
-			// Owned objects are automatically garbage collected. For additional cleanup logic use finalizers.
-			// Return and don't requeue
-			return reconcile.Result{}, nil
+			// Request object not found, could have been deleted after reconcile request, or someone
+			// removed our finalizer.  Make sure the NodeOverlayIp is deleted so its IP is released
+			// from IPAM even if it was never garbage collected.
+			reqLogger.Info("Node is gone, deleting its NodeOverlayIp")
+			_, err := r.deleteNodeOverlayIP(request.Name)
+			return reconcile.Result{}, err
 		}
 		// Error reading the object - requeue the request.
 		return reconcile.Result{}, err
 	}
 
+	// the node is being deleted, release its IP before letting kube remove it
+	isDeleted := instance.GetDeletionTimestamp() != nil
+	if isDeleted {
+		if !hasFinalizer(instance) {
+			return reconcile.Result{}, nil
+		}
+
+		gone, err := r.deleteNodeOverlayIP(instance.Name)
+		if err != nil {
+			return reconcile.Result{}, err
+		}
+
+		if !gone {
+			// the NodeOverlayIp finalizer releases the IP from IPAM, wait for it to finish
+			reqLogger.Info("Waiting for NodeOverlayIp to be deleted")
+			return reconcile.Result{Requeue: true}, nil
+		}
+
+		reqLogger.Info("Removing finalizer for Node")
+		removeFinalizer(instance)
+		err = r.client.Update(context.TODO(), instance)
+		if err != nil {
+			return reconcile.Result{}, err
+		}
+
+		return reconcile.Result{}, nil
+	}
+
+	// Add finalizer for the node, so the IP is released even if the NodeOverlayIp isn't garbage collected
+	if !hasFinalizer(instance) {
+		reqLogger.Info("Adding Finalizer for the Node")
+		instance.SetFinalizers(append(instance.GetFinalizers(), nodeFinalizer))
+		err = r.client.Update(context.TODO(), instance)
+		if err != nil {
+			reqLogger.Error(err, "Failed to update Node with finalizer")
+			return reconcile.Result{}, err
+		}
+	}
+
+	// in zones with an egress gateway, only the gateway nodes hold overlay IPs
+	needed, err := r.needsOverlayIp(instance)
+	if err != nil {
+		return reconcile.Result{}, err
+	}
+
+	if !needed {
+		reqLogger.Info("Node is not an egress gateway, deleting its NodeOverlayIp")
+		_, err := r.deleteNodeOverlayIP(instance.Name)
+		return reconcile.Result{}, err
+	}
+
 	// Check if an IP already exists
 	found := &iksv1alpha1.NodeOverlayIp{}
 	err = r.client.Get(context.TODO(), types.NamespacedName{Name: instance.Name}, found)
@@ -114,14 +206,14 @@ func (r *ReconcileNode) Reconcile(request reconcile.Request) (reconcile.Result,
 			return reconcile.Result{}, err
 		}
 
-		reqLogger.Info("Creating a new NodeOverlayIp", "node", instance.Name)
-		err = r.client.Create(context.TODO(), nodeOverlayIP)
-		if err != nil {
+		// Set Node instance as the owner and controller
+		if err := controllerutil.SetControllerReference(instance, nodeOverlayIP, r.scheme); err != nil {
 			return reconcile.Result{}, err
 		}
 
-		// Set Node instance as the owner and controller
-		if err := controllerutil.SetControllerReference(instance, nodeOverlayIP, r.scheme); err != nil {
+		reqLogger.Info("Creating a new NodeOverlayIp", "node", instance.Name)
+		err = r.client.Create(context.TODO(), nodeOverlayIP)
+		if err != nil {
 			return reconcile.Result{}, err
 		}
 
@@ -129,13 +221,102 @@ func (r *ReconcileNode) Reconcile(request reconcile.Request) (reconcile.Result,
 		return reconcile.Result{Requeue: true}, nil
 	} else if err != nil {
 		return reconcile.Result{}, err
-	} else {
-		reqLogger.Info("NodeOverlayIp already exists", "NodeOverlayIp.Name", found.Name)
+	}
+
+	reqLogger.Info("NodeOverlayIp already exists", "NodeOverlayIp.Name", found.Name)
+
+	// NodeOverlayIps created by older versions have no owner, backfill it so they're garbage collected
+	if metav1.GetControllerOf(found) == nil {
+		reqLogger.Info("Setting Node as the owner of NodeOverlayIp", "NodeOverlayIp.Name", found.Name)
+		if err := controllerutil.SetControllerReference(instance, found, r.scheme); err != nil {
+			return reconcile.Result{}, err
+		}
+
+		err = r.client.Update(context.TODO(), found)
+		if err != nil {
+			return reconcile.Result{}, err
+		}
 	}
 
 	return reconcile.Result{}, nil
 }
 
+// deleteNodeOverlayIP deletes the NodeOverlayIp for the node, and returns true once it is gone
+func (r *ReconcileNode) deleteNodeOverlayIP(name string) (bool, error) {
+	found := &iksv1alpha1.NodeOverlayIp{}
+	err := r.client.Get(context.TODO(), types.NamespacedName{Name: name}, found)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return true, nil
+		}
+		return false, err
+	}
+
+	if found.GetDeletionTimestamp() != nil {
+		// already being deleted
+		return false, nil
+	}
+
+	err = r.client.Delete(context.TODO(), found)
+	if err != nil && !errors.IsNotFound(err) {
+		return false, err
+	}
+
+	return false, nil
+}
+
+// needsOverlayIp returns false if an OverlayEgressGateway serves the node's zone and doesn't select the node
+func (r *ReconcileNode) needsOverlayIp(node *corev1.Node) (bool, error) {
+	if !r.hasEgressGateway {
+		return true, nil
+	}
+
+	gateways := &iksv1alpha1.OverlayEgressGatewayList{}
+	err := r.client.List(context.TODO(), &client.ListOptions{}, gateways)
+	if err != nil {
+		return false, err
+	}
+
+	zone := node.GetLabels()["failure-domain.beta.kubernetes.io/zone"]
+	needed := true
+	for _, gateway := range gateways.Items {
+		if !gateway.AppliesToZone(zone) {
+			continue
+		}
+
+		if gateway.Selects(node) {
+			return true, nil
+		}
+
+		needed = false
+	}
+
+	return needed, nil
+}
+
+func hasFinalizer(node *corev1.Node) bool {
+	for _, finalizer := range node.GetFinalizers() {
+		if finalizer == nodeFinalizer {
+			return true
+		}
+	}
+
+	return false
+}
+
+func removeFinalizer(node *corev1.Node) {
+	finalizers := []string{}
+	for _, finalizer := range node.GetFinalizers() {
+		if finalizer == nodeFinalizer {
+			continue
+		}
+
+		finalizers = append(finalizers, finalizer)
+	}
+
+	node.SetFinalizers(finalizers)
+}
+
 // newNodeOverlayIP asks IPAM for an IP and returns a CR. TODO: return nil if no IPAM is configured
 func newNodeOverlayIP(cr *corev1.Node) (*iksv1alpha1.NodeOverlayIp, error) {
 	zone := cr.GetLabels()["failure-domain.beta.kubernetes.io/zone"]
@@ -152,4 +333,4 @@ func newNodeOverlayIP(cr *corev1.Node) (*iksv1alpha1.NodeOverlayIp, error) {
 			Labels: labels,
 		},
 	}, nil
-}
\ No newline at end of file
+}
@@ -0,0 +1,261 @@
+package nodecondition
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	iksv1alpha1 "github.com/jkwong888/iks-overlay-ip-controller/pkg/apis/iks/v1alpha1"
+	nodeoverlayip "github.com/jkwong888/iks-overlay-ip-controller/pkg/controller/nodeoverlayip-pod"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	logf "sigs.k8s.io/controller-runtime/pkg/runtime/log"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+)
+
+var log = logf.Log.WithName("controller_nodecondition")
+
+// how long to wait before checking the host again while the overlay is not ready
+var notReadyRequeueDelay = 10 * time.Second
+
+type ManagerOptions struct {
+	Hostname string
+	Zone string
+	HasNodeOverlayIpCR bool
+	HasStaticRouteCR bool
+}
+
+// Add creates a new NodeCondition Controller and adds it to the Manager. The Manager will set fields on the Controller
+// and Start it when the Manager is Started.
+func Add(mgr manager.Manager, options ManagerOptions) error {
+	return add(mgr, newReconciler(mgr, options), options)
+}
+
+// newReconciler returns a new reconcile.Reconciler
+func newReconciler(mgr manager.Manager, options ManagerOptions) reconcile.Reconciler {
+	return &ReconcileNodeCondition{client: mgr.GetClient(), scheme: mgr.GetScheme(), options: options}
+}
+
+// add adds a new Controller to mgr with r as the reconcile.Reconciler
+func add(mgr manager.Manager, r reconcile.Reconciler, options ManagerOptions) error {
+	// Create a new controller
+	c, err := controller.New("nodecondition-controller", mgr, controller.Options{Reconciler: r})
+	if err != nil {
+		return err
+	}
+
+	// Watch for changes to this node only
+	isMyNode := predicate.Funcs{
+		CreateFunc:  func(e event.CreateEvent) bool { return e.Meta.GetName() == options.Hostname },
+		UpdateFunc:  func(e event.UpdateEvent) bool { return e.MetaNew.GetName() == options.Hostname },
+		DeleteFunc:  func(e event.DeleteEvent) bool { return false },
+		GenericFunc: func(e event.GenericEvent) bool { return e.Meta.GetName() == options.Hostname },
+	}
+	err = c.Watch(&source.Kind{Type: &corev1.Node{}}, &handler.EnqueueRequestForObject{}, isMyNode)
+	if err != nil {
+		return err
+	}
+
+	// any change to the overlay IP or static routes may change whether this node is ready
+	toMyNode := &handler.EnqueueRequestsFromMapFunc{
+		ToRequests: handler.ToRequestsFunc(func(a handler.MapObject) []reconcile.Request {
+			return []reconcile.Request{
+				{NamespacedName: types.NamespacedName{Name: options.Hostname}},
+			}
+		}),
+	}
+
+	if options.HasNodeOverlayIpCR {
+		err = c.Watch(&source.Kind{Type: &iksv1alpha1.NodeOverlayIp{}}, toMyNode)
+		if err != nil {
+			return err
+		}
+	}
+
+	if options.HasStaticRouteCR {
+		err = c.Watch(&source.Kind{Type: &iksv1alpha1.StaticRoute{}}, toMyNode)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// blank assignment to verify that ReconcileNodeCondition implements reconcile.Reconciler
+var _ reconcile.Reconciler = &ReconcileNodeCondition{}
+
+// ReconcileNodeCondition reconciles the overlay network condition and startup taint of this Node
+type ReconcileNodeCondition struct {
+	// This client, initialized using mgr.Client() above, is a split client
+	// that reads objects from the cache and writes to the apiserver
+	client client.Client
+	scheme *runtime.Scheme
+	options ManagerOptions
+}
+
+// Reconcile checks whether the overlay network is configured on this node, and sets the OverlayNetworkReady
+// condition on the Node accordingly.  Once the node is ready, the startup taint is removed.
+// Note:
+// The Controller will requeue the Request to be processed again if the returned error is non-nil or
+// Result.Requeue is true, otherwise upon completion it will remove the work from the queue.
+func (r *ReconcileNodeCondition) Reconcile(request reconcile.Request) (reconcile.Result, error) {
+	reqLogger := log.WithValues("Request.Name", request.Name)
+
+	if request.Name != r.options.Hostname {
+		return reconcile.Result{}, nil
+	}
+
+	// Fetch the Node instance
+	instance := &corev1.Node{}
+	err := r.client.Get(context.TODO(), request.NamespacedName, instance)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return reconcile.Result{}, nil
+		}
+		// Error reading the object - requeue the request.
+		return reconcile.Result{}, err
+	}
+
+	condition := corev1.NodeCondition{
+		Type:    iksv1alpha1.NodeOverlayNetworkReady,
+		Status:  corev1.ConditionTrue,
+		Reason:  "OverlayNetworkConfigured",
+		Message: "Overlay IP and static routes are configured on the node",
+	}
+
+	notReady := r.checkReady()
+	if notReady != nil {
+		condition.Status = corev1.ConditionFalse
+		condition.Reason = "OverlayNetworkNotConfigured"
+		condition.Message = notReady.Error()
+	}
+
+	if setCondition(instance, condition) {
+		reqLogger.Info("Updating node condition", "type", condition.Type, "status", condition.Status, "message", condition.Message)
+		err = r.client.Status().Update(context.TODO(), instance)
+		if err != nil {
+			return reconcile.Result{}, err
+		}
+	}
+
+	if notReady != nil {
+		// the host network isn't watched, so check it again later
+		return reconcile.Result{RequeueAfter: notReadyRequeueDelay}, nil
+	}
+
+	if removeTaint(instance, iksv1alpha1.OverlayNotReadyTaintKey) {
+		reqLogger.Info("Removing startup taint", "taint", iksv1alpha1.OverlayNotReadyTaintKey)
+		err = r.client.Update(context.TODO(), instance)
+		if err != nil {
+			return reconcile.Result{}, err
+		}
+	}
+
+	return reconcile.Result{}, nil
+}
+
+// checkReady returns an error describing what is not yet configured on this node, or nil if the overlay is ready
+func (r *ReconcileNodeCondition) checkReady() error {
+	if r.options.HasNodeOverlayIpCR {
+		err := nodeoverlayip.IsConfigured(r.client, r.options.Hostname)
+		if err != nil {
+			return err
+		}
+	}
+
+	if !r.options.HasStaticRouteCR {
+		return nil
+	}
+
+	routes := &iksv1alpha1.StaticRouteList{}
+	err := r.client.List(context.TODO(), &client.ListOptions{}, routes)
+	if err != nil {
+		return err
+	}
+
+	for _, route := range routes.Items {
+		if route.GetDeletionTimestamp() != nil {
+			continue
+		}
+
+		zoneVal := route.GetLabels()["failure-domain.beta.kubernetes.io/zone"]
+		if zoneVal != "" && zoneVal != r.options.Zone {
+			// route is not for this zone
+			continue
+		}
+
+		installed := false
+		for _, val := range route.Status.NodeStatus {
+			if val.Hostname == r.options.Hostname {
+				installed = true
+				break
+			}
+		}
+
+		if !installed {
+			return fmt.Errorf("StaticRoute %s for %s is not installed on the node yet", route.Name, route.Spec.Subnet)
+		}
+	}
+
+	return nil
+}
+
+// setCondition sets the condition on the node, and returns true if the node was changed
+func setCondition(node *corev1.Node, condition corev1.NodeCondition) bool {
+	now := metav1.Now()
+
+	for i, existing := range node.Status.Conditions {
+		if existing.Type != condition.Type {
+			continue
+		}
+
+		if existing.Status == condition.Status && existing.Reason == condition.Reason && existing.Message == condition.Message {
+			return false
+		}
+
+		condition.LastHeartbeatTime = now
+		condition.LastTransitionTime = existing.LastTransitionTime
+		if existing.Status != condition.Status {
+			condition.LastTransitionTime = now
+		}
+
+		node.Status.Conditions[i] = condition
+		return true
+	}
+
+	condition.LastHeartbeatTime = now
+	condition.LastTransitionTime = now
+	node.Status.Conditions = append(node.Status.Conditions, condition)
+
+	return true
+}
+
+// removeTaint removes the taint with key from the node, and returns true if the node was changed
+func removeTaint(node *corev1.Node, key string) bool {
+	taints := []corev1.Taint{}
+	for _, taint := range node.Spec.Taints {
+		if taint.Key == key {
+			continue
+		}
+
+		taints = append(taints, taint)
+	}
+
+	if len(taints) == len(node.Spec.Taints) {
+		return false
+	}
+
+	node.Spec.Taints = taints
+	return true
+}
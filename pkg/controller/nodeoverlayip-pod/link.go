@@ -0,0 +1,264 @@
+package nodeoverlayip
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+
+	iksv1alpha1 "github.com/jkwong888/iks-overlay-ip-controller/pkg/apis/iks/v1alpha1"
+	"github.com/jkwong888/iks-overlay-ip-controller/pkg/util"
+)
+
+const (
+	LinkTypeMacvlan   = "macvlan"
+	LinkTypeIpvlan    = "ipvlan"
+	LinkTypeVlan      = "vlan"
+	LinkTypeVxlan     = "vxlan"
+	LinkTypeWireguard = "wireguard"
+	LinkTypeGre       = "gre"
+	LinkTypeIpip      = "ipip"
+	LinkTypeDummy     = "dummy"
+)
+
+// overlayLink describes the overlay device to create on the node
+type overlayLink struct {
+	Type   string
+	Mode   string
+	VlanId int
+	Vni    int
+	Port   int
+	Remote string
+	Key    int
+	Mtu    int
+}
+
+// the IANA assigned VXLAN port
+const defaultVxlanPort = 4789
+
+// desiredLink returns the link requested in the NodeOverlayIp spec, falling back to the
+// LINK_TYPE, MACVLAN_MODE, IPVLAN_MODE, VLAN_ID and MTU environment variables.  The VNI and port of a vxlan
+// link must be the same on every node, so they are only read from VXLAN_VNI and VXLAN_PORT
+func desiredLink(instance *iksv1alpha1.NodeOverlayIp) (overlayLink, error) {
+	link := overlayLink{Type: instance.Spec.LinkType}
+	if link.Type == "" {
+		link.Type = os.Getenv("LINK_TYPE")
+	}
+
+	if link.Type == "" {
+		link.Type = LinkTypeMacvlan
+	}
+
+	link.Mtu = instance.Spec.Mtu
+	if link.Mtu == 0 {
+		mtu, err := envInt("MTU", 0)
+		if err != nil {
+			return link, err
+		}
+		link.Mtu = mtu
+	}
+
+	if link.Mtu != 0 && link.Mtu < util.MinIpv4Mtu {
+		return link, fmt.Errorf("Invalid MTU %d", link.Mtu)
+	}
+
+	switch link.Type {
+	case LinkTypeMacvlan:
+		link.Mode = instance.Spec.MacvlanMode
+		if link.Mode == "" {
+			link.Mode = os.Getenv("MACVLAN_MODE")
+		}
+
+		switch link.Mode {
+		case "", "private", "vepa", "bridge", "passthru":
+		default:
+			return link, fmt.Errorf("Invalid macvlan mode %q", link.Mode)
+		}
+	case LinkTypeIpvlan:
+		link.Mode = instance.Spec.IpvlanMode
+		if link.Mode == "" {
+			link.Mode = os.Getenv("IPVLAN_MODE")
+		}
+
+		if link.Mode == "" {
+			link.Mode = "l2"
+		}
+
+		if link.Mode != "l2" && link.Mode != "l3" {
+			return link, fmt.Errorf("Invalid ipvlan mode %q", link.Mode)
+		}
+	case LinkTypeVlan:
+		link.VlanId = instance.Spec.VlanId
+		if link.VlanId == 0 {
+			vlanId, err := envInt("VLAN_ID", 0)
+			if err != nil {
+				return link, err
+			}
+
+			link.VlanId = vlanId
+		}
+
+		if link.VlanId < 1 || link.VlanId > 4094 {
+			return link, fmt.Errorf("Invalid VLAN ID %d, must be between 1 and 4094", link.VlanId)
+		}
+	case LinkTypeVxlan:
+		vni, err := envInt("VXLAN_VNI", 0)
+		if err != nil {
+			return link, err
+		}
+
+		if vni < 1 || vni > 16777215 {
+			return link, fmt.Errorf("Invalid VXLAN_VNI %d, must be between 1 and 16777215", vni)
+		}
+
+		port, err := envInt("VXLAN_PORT", defaultVxlanPort)
+		if err != nil {
+			return link, err
+		}
+
+		link.Vni = vni
+		link.Port = port
+	case LinkTypeGre, LinkTypeIpip:
+		link.Remote = instance.Spec.TunnelRemote
+		link.Key = instance.Spec.TunnelKey
+
+		if net.ParseIP(link.Remote) == nil {
+			return link, fmt.Errorf("Invalid tunnel remote %q", link.Remote)
+		}
+
+		if link.Key != 0 && link.Type != LinkTypeGre {
+			return link, fmt.Errorf("Tunnel key is only supported on gre links")
+		}
+	case LinkTypeWireguard, LinkTypeDummy:
+	default:
+		return link, fmt.Errorf("Invalid link type %q", link.Type)
+	}
+
+	return link, nil
+}
+
+// addCmd returns the "ip" command that creates the link named label on top of the device
+func (l overlayLink) addCmd(label string, device string) string {
+	switch l.Type {
+	case LinkTypeIpvlan:
+		return fmt.Sprintf("link add %s link %s type ipvlan mode %s", label, device, l.Mode)
+	case LinkTypeVlan:
+		return fmt.Sprintf("link add link %s name %s type vlan id %d", device, label, l.VlanId)
+	case LinkTypeVxlan:
+		// remote VTEPs are added to the forwarding database explicitly, so don't learn them
+		return fmt.Sprintf("link add %s type vxlan id %d dstport %d dev %s nolearning", label, l.Vni, l.Port, device)
+	case LinkTypeGre, LinkTypeIpip:
+		if l.Key != 0 {
+			return fmt.Sprintf("link add %s type %s remote %s key %d dev %s", label, l.Type, l.Remote, l.Key, device)
+		}
+
+		return fmt.Sprintf("link add %s type %s remote %s dev %s", label, l.Type, l.Remote, device)
+	case LinkTypeWireguard:
+		return fmt.Sprintf("link add %s type wireguard", label)
+	case LinkTypeDummy:
+		return fmt.Sprintf("link add %s type dummy", label)
+	}
+
+	if l.Mode != "" {
+		return fmt.Sprintf("link add %s link %s type macvlan mode %s", label, device, l.Mode)
+	}
+
+	return fmt.Sprintf("link add %s link %s type macvlan", label, device)
+}
+
+// matches returns true if the existing link satisfies this one; an empty macvlan mode accepts any mode
+func (l overlayLink) matches(actual overlayLink) bool {
+	if l.Type != actual.Type {
+		return false
+	}
+
+	if l.Mode != "" && l.Mode != actual.Mode {
+		return false
+	}
+
+	return l.VlanId == actual.VlanId && l.Vni == actual.Vni && l.Port == actual.Port &&
+		l.Remote == actual.Remote && l.Key == actual.Key
+}
+
+var (
+	linkTypeRe    = regexp.MustCompile(`(?m)^\s+(macvlan|ipvlan|vlan|vxlan|wireguard|gre|ipip|dummy)\b`)
+	linkModeRe    = regexp.MustCompile(`(?m)^\s+(?:macvlan|ipvlan)\s+mode (\S+)`)
+	linkVlanIdRe  = regexp.MustCompile(`(?m)^\s+vlan protocol \S+ id (\d+)`)
+	linkVniRe     = regexp.MustCompile(`(?m)^\s+vxlan id (\d+)`)
+	linkDstPortRe = regexp.MustCompile(`(?m)^\s+vxlan id .* dstport (\d+)`)
+	linkRemoteRe  = regexp.MustCompile(`(?m)^\s+(?:gre|ipip ipip|ipip) remote (\S+)`)
+	linkKeyRe     = regexp.MustCompile(`(?m)^\s+gre remote .* okey (\S+)`)
+)
+
+// parseLink reads the link details from the output of "ip -d link show"
+func parseLink(out string) overlayLink {
+	link := overlayLink{}
+
+	if m := linkTypeRe.FindStringSubmatch(out); m != nil {
+		link.Type = m[1]
+	}
+
+	if m := linkModeRe.FindStringSubmatch(out); m != nil {
+		link.Mode = m[1]
+	}
+
+	if m := linkVlanIdRe.FindStringSubmatch(out); m != nil {
+		link.VlanId, _ = strconv.Atoi(m[1])
+	}
+
+	if m := linkVniRe.FindStringSubmatch(out); m != nil {
+		link.Vni, _ = strconv.Atoi(m[1])
+	}
+
+	if m := linkDstPortRe.FindStringSubmatch(out); m != nil {
+		link.Port, _ = strconv.Atoi(m[1])
+	}
+
+	if m := linkRemoteRe.FindStringSubmatch(out); m != nil {
+		link.Remote = m[1]
+	}
+
+	if m := linkKeyRe.FindStringSubmatch(out); m != nil {
+		// the key is shown as a dotted quad, e.g. 0.0.0.100
+		if key := net.ParseIP(m[1]).To4(); key != nil {
+			link.Key = int(key[0])<<24 | int(key[1])<<16 | int(key[2])<<8 | int(key[3])
+		}
+	}
+
+	return link
+}
+
+// overlayAddr returns the address to set on a link of linkType; a dummy link isn't attached to the
+// overlay subnet, so it only gets the host address
+func overlayAddr(ipAddr string, linkType string) string {
+	if linkType != LinkTypeDummy {
+		return ipAddr
+	}
+
+	ip, _, err := net.ParseCIDR(ipAddr)
+	if err != nil {
+		return ipAddr
+	}
+
+	if ip.To4() != nil {
+		return fmt.Sprintf("%s/32", ip.String())
+	}
+
+	return fmt.Sprintf("%s/128", ip.String())
+}
+
+// envInt returns the integer value of the environment variable name, or def if it isn't set
+func envInt(name string, def int) (int, error) {
+	val := os.Getenv(name)
+	if val == "" {
+		return def, nil
+	}
+
+	i, err := strconv.Atoi(val)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid %s %q", name, val)
+	}
+
+	return i, nil
+}
@@ -0,0 +1,122 @@
+package nodeoverlayip
+
+import (
+	"testing"
+)
+
+func TestParseLink(t *testing.T) {
+	tests := []struct {
+		name     string
+		out      string
+		expected overlayLink
+	}{
+		{
+			name: "macvlan",
+			out: `5: tmp0@eth0: <BROADCAST,MULTICAST,UP,LOWER_UP> mtu 1500 qdisc noqueue state UP mode DEFAULT group default qlen 1000
+    link/ether 4a:2b:8c:1d:5e:6f brd ff:ff:ff:ff:ff:ff promiscuity 0 minmtu 68 maxmtu 9194
+    macvlan mode bridge addrgenmode eui64 numtxqueues 1 numrxqueues 1 gso_max_size 65536 gso_max_segs 65535`,
+			expected: overlayLink{Type: LinkTypeMacvlan, Mode: "bridge"},
+		},
+		{
+			name: "ipvlan",
+			out: `6: tmp0@eth0: <BROADCAST,MULTICAST,NOARP,UP,LOWER_UP> mtu 1500 qdisc noqueue state UNKNOWN mode DEFAULT group default qlen 1000
+    link/ether 06:7c:3e:21:90:aa brd ff:ff:ff:ff:ff:ff promiscuity 0 minmtu 68 maxmtu 65535
+    ipvlan  mode l3 bridge addrgenmode eui64 numtxqueues 1 numrxqueues 1 gso_max_size 65536 gso_max_segs 65535`,
+			expected: overlayLink{Type: LinkTypeIpvlan, Mode: "l3"},
+		},
+		{
+			name: "vlan",
+			out: `7: tmp0@eth0: <BROADCAST,MULTICAST,UP,LOWER_UP> mtu 1500 qdisc noqueue state UP mode DEFAULT group default qlen 1000
+    link/ether 06:7c:3e:21:90:aa brd ff:ff:ff:ff:ff:ff promiscuity 0 minmtu 0 maxmtu 65535
+    vlan protocol 802.1Q id 1234 <REORDER_HDR> addrgenmode eui64 numtxqueues 1 numrxqueues 1 gso_max_size 65536 gso_max_segs 65535`,
+			expected: overlayLink{Type: LinkTypeVlan, VlanId: 1234},
+		},
+		{
+			name: "vxlan",
+			out: `8: tmp0: <BROADCAST,MULTICAST,UP,LOWER_UP> mtu 1450 qdisc noqueue state UNKNOWN mode DEFAULT group default qlen 1000
+    link/ether 6e:1f:42:9a:0b:cd brd ff:ff:ff:ff:ff:ff promiscuity 0 minmtu 68 maxmtu 65535
+    vxlan id 42 dev eth0 srcport 0 0 dstport 4789 nolearning ttl auto ageing 300 udpcsum noudp6zerocsumtx noudp6zerocsumrx addrgenmode eui64 numtxqueues 1 numrxqueues 1 gso_max_size 65536 gso_max_segs 65535`,
+			expected: overlayLink{Type: LinkTypeVxlan, Vni: 42, Port: 4789},
+		},
+		{
+			name: "gre with key",
+			out: `9: tmp0@eth0: <POINTOPOINT,NOARP,UP,LOWER_UP> mtu 1476 qdisc noqueue state UNKNOWN mode DEFAULT group default qlen 1000
+    link/gre 0.0.0.0 peer 10.0.0.2 promiscuity 0 minmtu 0 maxmtu 0
+    gre remote 10.0.0.2 local any dev eth0 ttl inherit ikey 0.0.0.100 okey 0.0.1.1 pmtudisc addrgenmode eui64 numtxqueues 1 numrxqueues 1 gso_max_size 65536 gso_max_segs 65535`,
+			expected: overlayLink{Type: LinkTypeGre, Remote: "10.0.0.2", Key: 257},
+		},
+		{
+			name: "gre without key",
+			out: `9: tmp0@eth0: <POINTOPOINT,NOARP,UP,LOWER_UP> mtu 1476 qdisc noqueue state UNKNOWN mode DEFAULT group default qlen 1000
+    link/gre 0.0.0.0 peer 10.0.0.2 promiscuity 0 minmtu 0 maxmtu 0
+    gre remote 10.0.0.2 local any dev eth0 ttl inherit pmtudisc addrgenmode eui64 numtxqueues 1 numrxqueues 1 gso_max_size 65536 gso_max_segs 65535`,
+			expected: overlayLink{Type: LinkTypeGre, Remote: "10.0.0.2"},
+		},
+		{
+			name: "ipip",
+			out: `10: tmp0@eth0: <POINTOPOINT,NOARP,UP,LOWER_UP> mtu 1480 qdisc noqueue state UNKNOWN mode DEFAULT group default qlen 1000
+    link/ipip 0.0.0.0 peer 10.0.0.3 promiscuity 0 minmtu 0 maxmtu 0
+    ipip ipip remote 10.0.0.3 local any dev eth0 ttl inherit pmtudisc addrgenmode eui64 numtxqueues 1 numrxqueues 1 gso_max_size 65536 gso_max_segs 65535`,
+			expected: overlayLink{Type: LinkTypeIpip, Remote: "10.0.0.3"},
+		},
+		{
+			name: "ipip older iproute2",
+			out: `10: tmp0@eth0: <POINTOPOINT,NOARP,UP,LOWER_UP> mtu 1480 qdisc noqueue state UNKNOWN mode DEFAULT group default qlen 1000
+    link/ipip 0.0.0.0 peer 10.0.0.3 promiscuity 0
+    ipip remote 10.0.0.3 local any dev eth0 ttl inherit pmtudisc addrgenmode eui64`,
+			expected: overlayLink{Type: LinkTypeIpip, Remote: "10.0.0.3"},
+		},
+		{
+			name: "wireguard",
+			out: `11: tmp0: <POINTOPOINT,NOARP,UP,LOWER_UP> mtu 1420 qdisc noqueue state UNKNOWN mode DEFAULT group default qlen 1000
+    link/none  promiscuity 0 minmtu 0 maxmtu 2147483552
+    wireguard addrgenmode none numtxqueues 1 numrxqueues 1 gso_max_size 65536 gso_max_segs 65535`,
+			expected: overlayLink{Type: LinkTypeWireguard},
+		},
+		{
+			name: "dummy",
+			out: `12: tmp0: <BROADCAST,NOARP,UP,LOWER_UP> mtu 1500 qdisc noqueue state UNKNOWN mode DEFAULT group default qlen 1000
+    link/ether 9a:3c:55:0e:71:02 brd ff:ff:ff:ff:ff:ff promiscuity 0 minmtu 0 maxmtu 0
+    dummy addrgenmode eui64 numtxqueues 1 numrxqueues 1 gso_max_size 65536 gso_max_segs 65535`,
+			expected: overlayLink{Type: LinkTypeDummy},
+		},
+		{
+			name: "physical device",
+			out: `2: eth0: <BROADCAST,MULTICAST,UP,LOWER_UP> mtu 1500 qdisc mq state UP mode DEFAULT group default qlen 1000
+    link/ether 06:7c:3e:21:90:aa brd ff:ff:ff:ff:ff:ff promiscuity 0 minmtu 68 maxmtu 9194 addrgenmode eui64 numtxqueues 8 numrxqueues 8 gso_max_size 65536 gso_max_segs 65535`,
+			expected: overlayLink{},
+		},
+	}
+
+	for _, test := range tests {
+		link := parseLink(test.out)
+		if link != test.expected {
+			t.Errorf("%s: parsed %+v, expected %+v", test.name, link, test.expected)
+		}
+	}
+}
+
+func TestLinkMatches(t *testing.T) {
+	tests := []struct {
+		name     string
+		desired  overlayLink
+		actual   overlayLink
+		expected bool
+	}{
+		{"same", overlayLink{Type: LinkTypeVlan, VlanId: 100}, overlayLink{Type: LinkTypeVlan, VlanId: 100}, true},
+		{"any macvlan mode", overlayLink{Type: LinkTypeMacvlan}, overlayLink{Type: LinkTypeMacvlan, Mode: "vepa"}, true},
+		{"macvlan mode", overlayLink{Type: LinkTypeMacvlan, Mode: "bridge"}, overlayLink{Type: LinkTypeMacvlan, Mode: "vepa"}, false},
+		{"type", overlayLink{Type: LinkTypeIpvlan, Mode: "l2"}, overlayLink{Type: LinkTypeMacvlan, Mode: "l2"}, false},
+		{"vlan id", overlayLink{Type: LinkTypeVlan, VlanId: 100}, overlayLink{Type: LinkTypeVlan, VlanId: 101}, false},
+		{"vxlan port", overlayLink{Type: LinkTypeVxlan, Vni: 42, Port: 4789}, overlayLink{Type: LinkTypeVxlan, Vni: 42, Port: 8472}, false},
+		{"tunnel key", overlayLink{Type: LinkTypeGre, Remote: "10.0.0.2", Key: 100}, overlayLink{Type: LinkTypeGre, Remote: "10.0.0.2"}, false},
+		// the MTU is changed on the existing link rather than recreating it
+		{"mtu", overlayLink{Type: LinkTypeDummy, Mtu: 1400}, overlayLink{Type: LinkTypeDummy}, true},
+	}
+
+	for _, test := range tests {
+		if matches := test.desired.matches(test.actual); matches != test.expected {
+			t.Errorf("%s: matches returned %v, expected %v", test.name, matches, test.expected)
+		}
+	}
+}
@@ -7,13 +7,20 @@ import (
 	"fmt"
 	"os"
 	"reflect"
+	"time"
 
 	iksv1alpha1 "github.com/jkwong888/iks-overlay-ip-controller/pkg/apis/iks/v1alpha1"
+	"github.com/jkwong888/iks-overlay-ip-controller/pkg/metrics"
 	 "github.com/jkwong888/iks-overlay-ip-controller/pkg/util"
+	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/event"
 	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/manager"
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
@@ -23,6 +30,10 @@ import (
 
 var log = logf.Log.WithName("controller_nodeoverlayip")
 
+// probe the path MTU to the gateway if PMTU_PROBE is "true", and how often
+var probePathMtu = os.Getenv("PMTU_PROBE") == "true"
+var probeInterval = 5 * time.Minute
+
 type ManagerOptions struct {
 	Hostname string
 }
@@ -30,16 +41,25 @@ type ManagerOptions struct {
 // Add creates a new NodeOverlayIP Controller and adds it to the Manager. The Manager will set fields on the Controller
 // and Start it when the Manager is Started.
 func Add(mgr manager.Manager, options ManagerOptions) error {
-	return add(mgr, newReconciler(mgr, options))
+	probed := make(chan event.GenericEvent)
+	return add(mgr, newReconciler(mgr, options, probed), probed)
 }
 
 // newReconciler returns a new reconcile.Reconciler
-func newReconciler(mgr manager.Manager, options ManagerOptions) reconcile.Reconciler {
-	return &ReconcileNodeOverlayIP{client: mgr.GetClient(), scheme: mgr.GetScheme(), options: options}
+func newReconciler(mgr manager.Manager, options ManagerOptions, probed chan<- event.GenericEvent) reconcile.Reconciler {
+	return &ReconcileNodeOverlayIP{
+		client:   mgr.GetClient(),
+		scheme:   mgr.GetScheme(),
+		recorder: mgr.GetRecorder("nodeoverlayip-controller"),
+		options:  options,
+		prober: util.NewPathMtuProber(probeInterval, func(name string) {
+			probed <- event.GenericEvent{Meta: &metav1.ObjectMeta{Name: name}}
+		}),
+	}
 }
 
 // add adds a new Controller to mgr with r as the reconcile.Reconciler
-func add(mgr manager.Manager, r reconcile.Reconciler) error {
+func add(mgr manager.Manager, r reconcile.Reconciler, probed <-chan event.GenericEvent) error {
 	// Create a new controller
 	c, err := controller.New("nodeoverlayip-controller", mgr, controller.Options{Reconciler: r})
 	if err != nil {
@@ -52,6 +72,12 @@ func add(mgr manager.Manager, r reconcile.Reconciler) error {
 		return err
 	}
 
+	// the path MTU to the gateway is probed in the background, update the status when the probe finishes
+	err = c.Watch(&source.Channel{Source: probed}, &handler.EnqueueRequestForObject{})
+	if err != nil {
+		return err
+	}
+
 	return nil
 }
 
@@ -64,7 +90,9 @@ type ReconcileNodeOverlayIP struct {
 	// that reads objects from the cache and writes to the apiserver
 	client client.Client
 	scheme *runtime.Scheme
+	recorder record.EventRecorder
 	options ManagerOptions
+	prober *util.PathMtuProber
 }
 
 // Reconcile reads that state of the cluster for a NodeOverlayIP object and makes changes based on the state read
@@ -102,12 +130,21 @@ func (r *ReconcileNodeOverlayIP) Reconcile(request reconcile.Request) (reconcile
 		return reconcile.Result{}, nil
 	}
 
+	// in dry-run mode the device and address changes are published as events instead of made, and the status isn't
+	// updated as they aren't applied
+	plan := util.NewPlan()
+	if util.DryRun() {
+		defer func() {
+			util.PublishPlan(r.recorder, instance, plan.Steps())
+		}()
+	}
+
 	// someone deleted the IP manually, but i'm still alive, so remove the device
 	isDeleted := instance.GetDeletionTimestamp() != nil
 	if isDeleted {
 		// remove the IP
 		if instance.Status.InterfaceLabel != "" {
-			err := delOverlayDevice(instance.Status.InterfaceLabel)
+			err := delOverlayDevice(plan, instance.Status.InterfaceLabel)
 			if err != nil {
 				return reconcile.Result{}, err
 			}
@@ -116,75 +153,204 @@ func (r *ReconcileNodeOverlayIP) Reconcile(request reconcile.Request) (reconcile
 		return reconcile.Result{}, nil
 	}
 
+	// until the controller reserves the IP, report the node's address on the interface, so the controller can find the
+	// subnets reachable from its VLAN
+	if instance.Status.IpAddr == "" {
+		return r.reportUnderlay(instance, intf)
+	}
+
+	link, err := desiredLink(instance)
+	if err != nil {
+		// the spec needs fixing, don't requeue
+		reqLogger.Error(err, "Invalid overlay link in NodeOverlayIp")
+		return reconcile.Result{}, nil
+	}
+
 	// actually create the node device according to the CR
-	err = addOverlayDevice(intf, intfLabel)
+	err = addOverlayDevice(plan, intf, intfLabel, link)
 	if err != nil {
 		// Error reading the object - requeue the request.
 		return reconcile.Result{}, err
 	}
 
+	mtu, err := setOverlayMtu(plan, intfLabel, link.Mtu)
+	if err != nil {
+		return reconcile.Result{}, err
+	}
+
+	publicKey, listenPort := "", 0
+	if link.Type == LinkTypeWireguard && !util.DryRun() {
+		publicKey, listenPort, err = configureWireguard(intfLabel)
+		if err != nil {
+			return reconcile.Result{}, err
+		}
+	}
+
 	// add the node IP according to the CR
-	err = addOverlayIp(intfLabel, instance.Status.IpAddr)
+	err = addOverlayIp(plan, intfLabel, overlayAddr(instance.Status.IpAddr, link.Type), instance.Status.Gateway)
 	if err != nil {
 		// Error reading the object - requeue the request.
 		return reconcile.Result{}, err
 	}
 
-	// Update the status if necessary
-	status := iksv1alpha1.NodeOverlayIpStatus{
-		Interface: intf,
-		InterfaceLabel: intfLabel,
+	// large packets are black-holed if a tunnel on the path to the gateway has a smaller MTU than the link
+	gatewayPathMtu := 0
+	if probePathMtu && instance.Status.Gateway != "" {
+		gatewayPathMtu = r.prober.PathMtu(instance.Name, intfLabel, instance.Status.Gateway, mtu)
+	}
+
+	// the address of the interface is the VTEP other nodes send vxlan traffic to
+	underlayIp, err := getOverlayIp(intf)
+	if err != nil {
+		return reconcile.Result{}, err
 	}
 
-	if !reflect.DeepEqual(instance.Status, status) {
+	// Update the status if necessary
+	status := instance.Status
+	status.Interface = intf
+	status.InterfaceLabel = intfLabel
+	status.LinkType = link.Type
+	status.UnderlayIp = strings.Split(underlayIp, "/")[0]
+	status.WireguardPublicKey = publicKey
+	status.WireguardListenPort = listenPort
+	status.Mtu = mtu
+	status.GatewayPathMtu = gatewayPathMtu
+
+	if !reflect.DeepEqual(instance.Status, status) && !util.DryRun() {
 		instance.Status = status
-		err := r.client.Update(context.TODO(), instance)
+		err := r.client.Status().Update(context.TODO(), instance)
 		if err != nil {
 			reqLogger.Error(err, "failed to update the NodeOverlayIp")
 			return reconcile.Result{}, err
 		}
 	}
 
+	if probePathMtu {
+		return reconcile.Result{RequeueAfter: probeInterval}, nil
+	}
+
 	return reconcile.Result{}, nil
 }
 
-func delOverlayDevice(label string) (error) {
+// reportUnderlay sets the interface and its address in the status of a NodeOverlayIp without an IP
+func (r *ReconcileNodeOverlayIP) reportUnderlay(instance *iksv1alpha1.NodeOverlayIp, intf string) (reconcile.Result, error) {
+	underlayIp, err := getOverlayIp(intf)
+	if err != nil {
+		return reconcile.Result{}, err
+	}
+
+	status := instance.Status
+	status.Interface = intf
+	status.UnderlayIp = strings.Split(underlayIp, "/")[0]
+
+	if !reflect.DeepEqual(instance.Status, status) && !util.DryRun() {
+		instance.Status = status
+		err := r.client.Status().Update(context.TODO(), instance)
+		if err != nil {
+			log.Error(err, "failed to update the NodeOverlayIp", "Request.Name", instance.Name)
+			return reconcile.Result{}, err
+		}
+	}
+
+	log.Info("Waiting for the IP to be reserved", "Request.Name", instance.Name)
+	return reconcile.Result{}, nil
+}
+
+// setOverlayMtu sets the MTU of the overlay device if one is requested, and returns the device's MTU
+func setOverlayMtu(plan *util.Plan, label string, mtu int) (int, error) {
+	current, err := util.LinkMtu(label)
+	if err != nil {
+		if util.DryRun() {
+			// the device wasn't created, and is created with the MTU
+			return mtu, nil
+		}
+		return 0, err
+	}
+
+	if mtu == 0 || mtu == current {
+		return current, nil
+	}
+
+	log.Info(fmt.Sprintf("Setting MTU of device %s from %d to %d", label, current, mtu))
+	out, code, err := plan.ExecIpCmd(fmt.Sprintf("link set dev %s mtu %d", label, mtu))
+	if err != nil {
+		return 0, err
+	}
+
+	if code != 0 {
+		return 0, fmt.Errorf("Error executing \"ip link set\", output: %s", out)
+	}
+
+	return mtu, nil
+}
+
+func delOverlayDevice(plan *util.Plan, label string) (error) {
 	// check if overlay device still exists
 	out, code, err := util.ExecIpCmd(fmt.Sprintf("link show %s", label))
 	if err != nil {
 		return err
 	}
 
-	// if device doesn't exist, create macvlan device
+	// if device doesn't exist, there is nothing to do
 	if code != 0 {
 		if strings.Contains(out, "does not exist") {
 			log.Info(fmt.Sprintf("Device %s is already deleted", label))
 			return nil
 		}
-	} else {
+
 		return fmt.Errorf("Error executing \"ip link show\", output: %s", out)
 	}
 
 	log.Info(fmt.Sprintf("Deleting device %s", label))
-	out, code, err = util.ExecIpCmd(fmt.Sprintf("link del %s", label))
+	out, code, err = plan.ExecIpCmd(fmt.Sprintf("link del %s", label))
 	if err != nil {
 		return err
 	}
 
+	if code != 0 {
+		return fmt.Errorf("Error executing \"ip link del\", output: %s", out)
+	}
+
 	return nil
 }
 
-func addOverlayDevice(device string, label string) (error) {
+func addOverlayDevice(plan *util.Plan, device string, label string, link overlayLink) (error) {
 	// check if overlay device already exists
-	out, code, err := util.ExecIpCmd(fmt.Sprintf("link show %s", label))
+	out, code, err := util.ExecIpCmd(fmt.Sprintf("-d link show %s", label))
 	if err != nil {
 		return err
 	}
 
-	// if device doesn't exist, create macvlan device
+	// if the device exists but is the wrong type (e.g. the link type was changed), delete it and
+	// create it again; the address and routes on it are restored on the next reconcile
+	if code == 0 {
+		actual := parseLink(out)
+		if !link.matches(actual) {
+			log.Info(fmt.Sprintf("Device %s is type %s, recreating as %s", label, actual.Type, link.Type))
+			metrics.AgentDriftCorrections.WithLabelValues("link").Inc()
+
+			err = delOverlayDevice(plan, label)
+			if err != nil {
+				return err
+			}
+
+			if util.DryRun() {
+				// the device wasn't deleted, plan creating it again as if it had been
+				out, code = fmt.Sprintf("Device \"%s\" does not exist.", label), 1
+			} else {
+				out, code, err = util.ExecIpCmd(fmt.Sprintf("-d link show %s", label))
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	// if device doesn't exist, create the overlay device
+	created := false
 	if code != 0 {
 		if strings.Contains(out, "does not exist") {
-			out, code, err := util.ExecIpCmd(fmt.Sprintf("link add %s link %s type macvlan", label, device))
+			out, code, err = plan.ExecIpCmd(link.addCmd(label, device))
 			if err != nil {
 				return err
 			}
@@ -192,6 +358,12 @@ func addOverlayDevice(device string, label string) (error) {
 			if code != 0 {
 				return fmt.Errorf("Error executing \"ip link add\", output: %s", out)
 			}
+			created = true
+
+			if util.DryRun() {
+				// the device wasn't created, so there is nothing to bring up
+				return nil
+			}
 
 			// now check if overlay device exists
 			out, code, err = util.ExecIpCmd(fmt.Sprintf("link show %s", label))
@@ -206,7 +378,7 @@ func addOverlayDevice(device string, label string) (error) {
 		}
 	}
 
-	// if device isn't up, create macvlan device
+	// if device isn't up, bring it up
 	re := regexp.MustCompile(`(?s).*state (UP|DOWN).*`)
 	linkState := re.ReplaceAllString(out, "$1")
 	if linkState != "DOWN" {
@@ -214,7 +386,12 @@ func addOverlayDevice(device string, label string) (error) {
 		return nil
 	}
 
-	out, code, err = util.ExecIpCmd(fmt.Sprintf("link set %s up", label))
+	// a device that was just created is always down, it only drifted if it existed
+	if !created {
+		metrics.AgentDriftCorrections.WithLabelValues("link").Inc()
+	}
+
+	out, code, err = plan.ExecIpCmd(fmt.Sprintf("link set %s up", label))
 	if err != nil {
 		return err
 	}
@@ -226,33 +403,143 @@ func addOverlayDevice(device string, label string) (error) {
 	return nil
 }
 
-func addOverlayIp(device string, ipAddr string) (error) {
-	// check if overlay ip already exists
-	out, code, err := util.ExecIpCmd(fmt.Sprintf("addr show %s", device))
+// IsConfigured returns an error unless the NodeOverlayIp for hostname has been configured on this node, or the node
+// routes through an egress gateway and has no NodeOverlayIp
+func IsConfigured(c client.Client, hostname string) error {
+	instance := &iksv1alpha1.NodeOverlayIp{}
+	err := c.Get(context.TODO(), types.NamespacedName{Name: hostname}, instance)
 	if err != nil {
+		if errors.IsNotFound(err) && usesEgressGateway(c, hostname) {
+			return nil
+		}
 		return err
 	}
 
+	if instance.Status.IpAddr == "" {
+		return fmt.Errorf("NodeOverlayIp %s has no IP reserved yet", hostname)
+	}
+
+	if instance.Status.InterfaceLabel == "" {
+		return fmt.Errorf("NodeOverlayIp %s has not been configured on the node yet", hostname)
+	}
+
+	currIP, err := getOverlayIp(instance.Status.InterfaceLabel)
+	if err != nil {
+		return err
+	}
+
+	ipAddr := overlayAddr(instance.Status.IpAddr, instance.Status.LinkType)
+	if currIP != ipAddr {
+		return fmt.Errorf("IP %s is not set on device %s", ipAddr, instance.Status.InterfaceLabel)
+	}
+
+	return nil
+}
+
+// usesEgressGateway returns true if an OverlayEgressGateway serves the node's zone and doesn't select the node, so
+// the node doesn't get an overlay IP
+func usesEgressGateway(c client.Client, hostname string) bool {
+	node := &corev1.Node{}
+	err := c.Get(context.TODO(), types.NamespacedName{Name: hostname}, node)
+	if err != nil {
+		return false
+	}
+
+	gateways := &iksv1alpha1.OverlayEgressGatewayList{}
+	err = c.List(context.TODO(), &client.ListOptions{}, gateways)
+	if err != nil {
+		return false
+	}
+
+	zone := node.GetLabels()["failure-domain.beta.kubernetes.io/zone"]
+	uses := false
+	for _, gateway := range gateways.Items {
+		if !gateway.AppliesToZone(zone) {
+			continue
+		}
+
+		if gateway.Selects(node) {
+			return false
+		}
+
+		uses = true
+	}
+
+	return uses
+}
+
+func getOverlayIp(device string) (string, error) {
+	out, code, err := util.ExecIpCmd(fmt.Sprintf("addr show %s", device))
+	if err != nil {
+		return "", err
+	}
+
 	if code != 0 {
+		if util.DryRun() && strings.Contains(out, "does not exist") {
+			// the device wasn't created in dry-run mode, so it has no IP
+			return "", nil
+		}
+
 		// some other error
-		return fmt.Errorf("Error executing \"ip addr show\", output: %s", out)
+		return "", fmt.Errorf("Error executing \"ip addr show\", output: %s", out)
 	}
 
-	// get the existing IP
-	currIP := ""
-	re := regexp.MustCompile(`(?s).*inet ([^\s]*) .*`)
-	if re.MatchString(out) {
-		currIP = re.ReplaceAllString(out, "$1")
-		if currIP == ipAddr {
-			log.Info(fmt.Sprintf("IP %s is already set on device %s", ipAddr, device))
-			return nil
+	return parseOverlayIp(out, device), nil
+}
+
+// parseOverlayIp returns the address in the "ip addr show" output of the device; IPv4 addresses with a label other
+// than the device name, e.g. Service overlay IPs, are ignored.  IPv6 addresses have no label, so the first global
+// IPv6 address is returned if the device has no IPv4 address
+func parseOverlayIp(out string, device string) string {
+	inet6 := ""
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+
+		if fields[0] == "inet" && fields[len(fields)-1] == device {
+			return fields[1]
+		}
+
+		if fields[0] == "inet6" && inet6 == "" && scopeGlobal(fields) {
+			inet6 = fields[1]
 		}
 	}
+
+	return inet6
+}
+
+// scopeGlobal returns true if the fields of an "ip addr show" address line have "scope global", so link-local
+// addresses are skipped
+func scopeGlobal(fields []string) bool {
+	for i := 0; i < len(fields)-1; i++ {
+		if fields[i] == "scope" {
+			return fields[i+1] == "global"
+		}
+	}
+
+	return false
+}
+
+// addOverlayIp sets the overlay IP on the device, replacing any other IP, and announces it
+func addOverlayIp(plan *util.Plan, device string, ipAddr string, gateway string) (error) {
+	// check if overlay ip already exists
+	currIP, err := getOverlayIp(device)
+	if err != nil {
+		return err
+	}
+
+	if currIP == ipAddr {
+		log.Info(fmt.Sprintf("IP %s is already set on device %s", ipAddr, device))
+		return nil
+	}
 	
 	// an existing IP (not the real IP) is already there, delete the bad IP
 	if currIP != "" {
 		log.Info(fmt.Sprintf("IP addr %s is currently set on device %s, removing ...", currIP, device))
-		out, code, err = util.ExecIpCmd(fmt.Sprintf("addr del %s dev %s", currIP, device))
+		metrics.AgentDriftCorrections.WithLabelValues("address").Inc()
+		out, code, err := plan.ExecIpCmd(fmt.Sprintf("addr del %s dev %s", currIP, device))
 		if err != nil {
 			return err
 		}
@@ -263,7 +550,7 @@ func addOverlayIp(device string, ipAddr string) (error) {
 	}
 
 	// add IP
-	out, code, err = util.ExecIpCmd(fmt.Sprintf("addr add %s dev %s", ipAddr, device))
+	out, code, err := plan.ExecIpCmd(fmt.Sprintf("addr add %s dev %s", ipAddr, device))
 	if err != nil {
 		return err
 	}
@@ -271,7 +558,21 @@ func addOverlayIp(device string, ipAddr string) (error) {
 	if code != 0 {
 		return fmt.Errorf("Error executing \"ip addr del\", output: %s", out)
 	}
-	
+
+	// the gateway may still have the IP mapped to the MAC address of the node that had it before, and this node may
+	// have a stale entry for the gateway, e.g. from before the device was recreated
+	err = util.AnnounceAddress(device, ipAddr)
+	if err != nil {
+		log.Error(err, "Failed to announce overlay IP", "ipAddr", ipAddr, "device", device)
+	}
+
+	if gateway != "" {
+		err = util.FlushNeighbor(plan, device, gateway)
+		if err != nil {
+			log.Error(err, "Failed to flush the gateway neighbor entry", "gateway", gateway, "device", device)
+		}
+	}
+
 	return  nil
 }
 
@@ -0,0 +1,69 @@
+package nodeoverlayip
+
+import (
+	"testing"
+)
+
+func TestParseOverlayIp(t *testing.T) {
+	tests := []struct {
+		name     string
+		out      string
+		expected string
+	}{
+		{
+			name: "ipv4",
+			out: `5: tmp0@eth0: <BROADCAST,MULTICAST,UP,LOWER_UP> mtu 1500 qdisc noqueue state UP group default qlen 1000
+    link/ether 4a:2b:8c:1d:5e:6f brd ff:ff:ff:ff:ff:ff
+    inet 192.168.100.4/24 brd 192.168.100.255 scope global tmp0
+       valid_lft forever preferred_lft forever
+    inet6 fe80::482b:8cff:fe1d:5e6f/64 scope link
+       valid_lft forever preferred_lft forever`,
+			expected: "192.168.100.4/24",
+		},
+		{
+			name: "ipv4 with Service overlay IP",
+			out: `5: tmp0@eth0: <BROADCAST,MULTICAST,UP,LOWER_UP> mtu 1500 qdisc noqueue state UP group default qlen 1000
+    link/ether 4a:2b:8c:1d:5e:6f brd ff:ff:ff:ff:ff:ff
+    inet 192.168.100.20/32 scope global tmp0:lb
+       valid_lft forever preferred_lft forever
+    inet 192.168.100.4/24 brd 192.168.100.255 scope global tmp0
+       valid_lft forever preferred_lft forever`,
+			expected: "192.168.100.4/24",
+		},
+		{
+			name: "ipv6",
+			out: `5: tmp0@eth0: <BROADCAST,MULTICAST,UP,LOWER_UP> mtu 1500 qdisc noqueue state UP group default qlen 1000
+    link/ether 4a:2b:8c:1d:5e:6f brd ff:ff:ff:ff:ff:ff
+    inet6 fd00:100::4/64 scope global
+       valid_lft forever preferred_lft forever
+    inet6 fe80::482b:8cff:fe1d:5e6f/64 scope link
+       valid_lft forever preferred_lft forever`,
+			expected: "fd00:100::4/64",
+		},
+		{
+			name: "ipv6 after link-local",
+			out: `5: tmp0@eth0: <BROADCAST,MULTICAST,UP,LOWER_UP> mtu 1500 qdisc noqueue state UP group default qlen 1000
+    link/ether 4a:2b:8c:1d:5e:6f brd ff:ff:ff:ff:ff:ff
+    inet6 fe80::482b:8cff:fe1d:5e6f/64 scope link
+       valid_lft forever preferred_lft forever
+    inet6 fd00:100::4/64 scope global
+       valid_lft forever preferred_lft forever`,
+			expected: "fd00:100::4/64",
+		},
+		{
+			name: "link-local only",
+			out: `5: tmp0@eth0: <BROADCAST,MULTICAST,UP,LOWER_UP> mtu 1500 qdisc noqueue state UP group default qlen 1000
+    link/ether 4a:2b:8c:1d:5e:6f brd ff:ff:ff:ff:ff:ff
+    inet6 fe80::482b:8cff:fe1d:5e6f/64 scope link
+       valid_lft forever preferred_lft forever`,
+			expected: "",
+		},
+	}
+
+	for _, test := range tests {
+		ipAddr := parseOverlayIp(test.out, "tmp0")
+		if ipAddr != test.expected {
+			t.Errorf("%s: expected %q, got %q", test.name, test.expected, ipAddr)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package nodeoverlayip
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/jkwong888/iks-overlay-ip-controller/pkg/util"
+)
+
+const (
+	defaultWireguardKeyFile = "/var/lib/overlay-network/wireguard.key"
+	defaultWireguardPort    = 51820
+)
+
+// configureWireguard sets the private key and listen port of the wireguard device, generating the key on
+// first use, and returns the public key and port to publish to the other peers
+func configureWireguard(label string) (string, int, error) {
+	keyFile := os.Getenv("WIREGUARD_KEY_FILE")
+	if keyFile == "" {
+		keyFile = defaultWireguardKeyFile
+	}
+
+	port, err := envInt("WIREGUARD_PORT", defaultWireguardPort)
+	if err != nil {
+		return "", 0, err
+	}
+
+	err = ensurePrivateKey(keyFile)
+	if err != nil {
+		return "", 0, err
+	}
+
+	out, code, err := util.ExecWgCmd(fmt.Sprintf("set %s private-key %s listen-port %d", label, keyFile, port))
+	if err != nil {
+		return "", 0, err
+	}
+
+	if code != 0 {
+		return "", 0, fmt.Errorf("Error executing \"wg set\", output: %s", out)
+	}
+
+	out, code, err = util.ExecWgCmd(fmt.Sprintf("show %s public-key", label))
+	if err != nil {
+		return "", 0, err
+	}
+
+	if code != 0 {
+		return "", 0, fmt.Errorf("Error executing \"wg show\", output: %s", out)
+	}
+
+	return strings.TrimSpace(out), port, nil
+}
+
+// ensurePrivateKey generates a wireguard private key in keyFile if it doesn't exist.  The key file is kept
+// on the host so the public key published for the node stays the same when the network pod restarts.
+func ensurePrivateKey(keyFile string) error {
+	_, err := os.Stat(keyFile)
+	if err == nil {
+		return nil
+	}
+
+	if !os.IsNotExist(err) {
+		return err
+	}
+
+	// a curve25519 private key is 32 random bytes, clamped
+	key := make([]byte, 32)
+	_, err = rand.Read(key)
+	if err != nil {
+		return err
+	}
+
+	key[0] &= 248
+	key[31] &= 127
+	key[31] |= 64
+
+	err = os.MkdirAll(filepath.Dir(keyFile), 0700)
+	if err != nil {
+		return err
+	}
+
+	log.Info(fmt.Sprintf("Generated wireguard private key %s", keyFile))
+	return ioutil.WriteFile(keyFile, []byte(base64.StdEncoding.EncodeToString(key)+"\n"), 0600)
+}
@@ -4,11 +4,19 @@ import (
 	"context"
 	"strings"
 	"reflect"
+	"strconv"
+	"sync"
+	"time"
 
 	ipam "github.com/jkwong888/iks-overlay-ip-controller/pkg/ipam"
+	"github.com/jkwong888/iks-overlay-ip-controller/pkg/metrics"
 	iksv1alpha1 "github.com/jkwong888/iks-overlay-ip-controller/pkg/apis/iks/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/uuid"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/controller"
 	"sigs.k8s.io/controller-runtime/pkg/handler"
@@ -20,15 +28,41 @@ import (
 
 var log = logf.Log.WithName("controller_nodeoverlayip")
 
+// how long to wait before retrying IPAM errors; transient errors are retried with exponential backoff, the others
+// need someone to add addresses or fix the credentials first
+const (
+	transientBackoffBase = 5 * time.Second
+	transientBackoffMax  = 5 * time.Minute
+	poolExhaustedRequeue = 10 * time.Minute
+	authRequeue          = 5 * time.Minute
+	unreachableRequeue   = 10 * time.Minute
+)
+
 // Add creates a new NodeOverlayIP Controller and adds it to the Manager. The Manager will set fields on the Controller
 // and Start it when the Manager is Started.
 func Add(mgr manager.Manager) error {
-	return add(mgr, newReconciler(mgr))
+	r, err := newReconciler(mgr)
+	if err != nil {
+		return err
+	}
+
+	return add(mgr, r)
 }
 
 // newReconciler returns a new reconcile.Reconciler
-func newReconciler(mgr manager.Manager) reconcile.Reconciler {
-	return &ReconcileNodeOverlayIP{client: mgr.GetClient(), scheme: mgr.GetScheme()}
+func newReconciler(mgr manager.Manager) (reconcile.Reconciler, error) {
+	// reads from the API server instead of the cache, so an address just recorded by a parallel reconcile is seen
+	apiReader, err := client.New(mgr.GetConfig(), client.Options{Scheme: mgr.GetScheme(), Mapper: mgr.GetRESTMapper()})
+	if err != nil {
+		return nil, err
+	}
+
+	return &ReconcileNodeOverlayIP{
+		client:    mgr.GetClient(),
+		apiReader: apiReader,
+		scheme:    mgr.GetScheme(),
+		failures:  map[string]uint{},
+	}, nil
 }
 
 // add adds a new Controller to mgr with r as the reconcile.Reconciler
@@ -56,7 +90,12 @@ type ReconcileNodeOverlayIP struct {
 	// This client, initialized using mgr.Client() above, is a split client
 	// that reads objects from the cache and writes to the apiserver
 	client client.Client
+	apiReader client.Reader
 	scheme *runtime.Scheme
+
+	// the number of consecutive transient IPAM errors of each NodeOverlayIp, for the backoff
+	failures     map[string]uint
+	failuresLock sync.Mutex
 }
 
 // Reconcile reads that state of the cluster for a NodeOverlayIP object and makes changes based on the state read
@@ -93,21 +132,36 @@ func (r *ReconcileNodeOverlayIP) Reconcile(request reconcile.Request) (reconcile
 
 	phpIPAM, err := ipam.NewPhpIPAM()
 	if err != nil {
-		return reconcile.Result{}, err
+		return r.requeueIPAMError(instance, err)
 	}
 
 	// someone deleted the IP, clean up IPAM
 	isDeleted := instance.GetDeletionTimestamp() != nil
 	if isDeleted {
-		if instance.Status.IpAddr != "" {
+		metrics.NodeOverlayConfigured.DeleteLabelValues(instance.Name, instance.GetLabels()["zone"])
+
+		ipAddr := instance.Status.IpAddr
+		if ipAddr == "" && instance.Status.PendingReservation != "" {
+			// the controller may have reserved the address without recording it before the node was deleted
+			// the node may be gone, so all the subnets of the zone are searched
+			placement := ipam.Placement{Zone: instance.GetLabels()["zone"]}
+			ipAddr, _, err = phpIPAM.FindIPAddressByNote(instance.Name, placement, reservationNote(instance.Status.PendingReservation))
+			if err != nil {
+				return r.requeueIPAMError(instance, err)
+			}
+		}
+
+		if ipAddr != "" {
 			// remove the mask from the ip address
-			ipAddrArr := strings.Split(instance.Status.IpAddr, "/")
+			ipAddrArr := strings.Split(ipAddr, "/")
 			err = phpIPAM.DeleteIPAddress(ipAddrArr[0])
+			metrics.IPAMReleases.WithLabelValues(metrics.Result(err)).Inc()
 			if err != nil {
-				return reconcile.Result{}, err
+				return r.requeueIPAMError(instance, err)
 			}
 			instance.Status.IpAddr = ""
 			instance.Status.Gateway = ""
+			instance.Status.PendingReservation = ""
 		}
 
 		// remove the finalizers if the IP address could be removed from IPAM, so kube
@@ -118,35 +172,122 @@ func (r *ReconcileNodeOverlayIP) Reconcile(request reconcile.Request) (reconcile
 			return reconcile.Result{}, err
 		}
 
+		r.resetBackoff(instance.Name)
 		return reconcile.Result{}, nil
 	}
 
+	// nodes in zones with a tunnel configured create it as their overlay device
+	tunnels, err := loadTunnelConfig()
+	if err != nil {
+		return reconcile.Result{}, err
+	}
+
+	var tunnel *TunnelConfigSpec
+	if zoneTunnel, ok := tunnels[instance.GetLabels()["zone"]]; ok {
+		tunnel = &zoneTunnel
+	}
+
+	if setTunnel(instance, tunnel) {
+		reqLogger.Info("Updating tunnel for zone", "linkType", instance.Spec.LinkType, "remote", instance.Spec.TunnelRemote)
+		err = r.client.Update(context.TODO(), instance)
+		if err != nil {
+			return reconcile.Result{}, err
+		}
+	}
+
+	// the network pod sets the interface in the status once the IP is configured on the node
+	configured := 0.0
+	if instance.Status.IpAddr != "" && instance.Status.InterfaceLabel != "" {
+		configured = 1.0
+	}
+	metrics.NodeOverlayConfigured.WithLabelValues(instance.Name, instance.GetLabels()["zone"]).Set(configured)
+
 	// Update the status 
 	status := instance.Status
 	if status.IpAddr == "" {
 		zone := instance.GetLabels()["zone"]
-		// reserve an IP
-		myIP, err := phpIPAM.ReserveIPAddress(instance.Name, zone)
+		myIP, subnetId := "", 0
+
+		placement, err := r.placement(instance, zone)
+		if err != nil {
+			return reconcile.Result{}, err
+		}
+
+		if status.PendingReservation == "" {
+			// record the reservation before making it, so if the controller crashes or fails to record the address,
+			// the next reconcile looks it up by its owner instead of reserving another; a parallel reconcile of the
+			// NodeOverlayIp fails this update with a conflict
+			instance.Status.PendingReservation = string(uuid.NewUUID())
+			err = r.client.Status().Update(context.TODO(), instance)
+			if err != nil {
+				return reconcile.Result{}, err
+			}
+			status = instance.Status
+		} else {
+			// node names are reused, e.g. by IKS when a worker is reloaded, so only the address with the token is this
+			// reservation's, and not one an earlier node of the same name failed to release
+			myIP, subnetId, err = phpIPAM.FindIPAddressByNote(instance.Name, placement, reservationNote(status.PendingReservation))
+			if err != nil {
+				return r.requeueIPAMError(instance, err)
+			}
+		}
+
+		if myIP == "" {
+			// reserve an IP
+			myIP, subnetId, err = phpIPAM.ReserveIPAddressWithFields(instance.Name, placement, addressFields(instance.Name, status.PendingReservation))
+			metrics.IPAMReservations.WithLabelValues(zone, metrics.Result(err)).Inc()
+			if err != nil {
+				return r.requeueIPAMError(instance, err)
+			}
+			reqLogger.Info("Reserved IP", "ipAddr", myIP)
+		} else {
+			reqLogger.Info("Found IP reserved by an earlier reconcile", "ipAddr", myIP)
+		}
+
+		// IPAM may hand out an address a node still has, e.g. if it was released in phpIPAM by hand
+		holder, err := r.duplicateHolder(instance.Name, myIP)
 		if err != nil {
 			return reconcile.Result{}, err
 		}
 
+		if holder != "" {
+			// give the address back to the node that has it, so the next reservation gets another one
+			reqLogger.Info("IP is already assigned to another NodeOverlayIp, correcting its owner", "ipAddr", myIP, "holder", holder)
+			err = phpIPAM.UpdateIPAddress(strings.Split(myIP, "/")[0], holder, addressFields(holder, ""))
+			if err != nil {
+				return r.requeueIPAMError(instance, err)
+			}
+
+			return reconcile.Result{Requeue: true}, nil
+		}
+
 		status.IpAddr = myIP
-		reqLogger.Info("Reserved IP", "ipAddr", myIP)
+		status.SubnetId = subnetId
+		status.PendingReservation = ""
 	}
 
-	if status.Gateway == "" {
+	// the subnet is also looked up for IPs reserved before it was recorded
+	if status.Gateway == "" || status.SubnetId == 0 {
 		ipAddrArr := strings.Split(status.IpAddr, "/")
 		reqLogger.Info("Find gateway", "ipAddr", ipAddrArr[0])
 		mySubnet, err := phpIPAM.GetSubnetForIP(ipAddrArr[0])
-		if err != nil {
-			return reconcile.Result{}, err
-		}
+		if err != nil && status.Gateway == "" {
+			return r.requeueIPAMError(instance, err)
+		} else if err != nil {
+			// the IP is configured with its gateway, so only the subnet ID is missing
+			reqLogger.Error(err, "Unable to find the subnet of the IP", "ipAddr", ipAddrArr[0])
+		} else {
+			if status.Gateway == "" {
+				status.Gateway =  mySubnet["gateway"]
+				reqLogger.Info("Gateway set in CR", "gateway", mySubnet["gateway"])
+			}
 
-		status.Gateway =  mySubnet["gateway"]
-		reqLogger.Info("Gateway set in CR", "gateway", mySubnet["gateway"])
+			status.SubnetId, _ = strconv.Atoi(mySubnet["id"])
+		}
 	}
 
+	status.Conditions = setCondition(status.Conditions, corev1.ConditionTrue, "Reserved", "")
+
 	if !reflect.DeepEqual(instance.Status, status) {
 		instance.Status = status
 		err := r.client.Status().Update(context.TODO(), instance)
@@ -156,9 +297,185 @@ func (r *ReconcileNodeOverlayIP) Reconcile(request reconcile.Request) (reconcile
 		}
 	}
 
+	r.resetBackoff(instance.Name)
 	return reconcile.Result{}, nil
 }
 
+// placement returns the zone, labels and private addresses of the node, which the subnets reachable from its VLAN and
+// the subnet selection strategy's choice are found by
+func (r *ReconcileNodeOverlayIP) placement(instance *iksv1alpha1.NodeOverlayIp, zone string) (ipam.Placement, error) {
+	return nodePlacement(r.client, instance.Name, instance.Status.UnderlayIp, zone)
+}
+
+// NodePlacement returns the placement of the node like that of its own overlay IP, for other addresses bound to the
+// node, e.g. of its pods
+func NodePlacement(c client.Client, nodeName string, zone string) (ipam.Placement, error) {
+	nodeOverlayIp := &iksv1alpha1.NodeOverlayIp{}
+	err := c.Get(context.TODO(), types.NamespacedName{Name: nodeName}, nodeOverlayIp)
+	if err != nil && !errors.IsNotFound(err) {
+		return ipam.Placement{}, err
+	}
+
+	return nodePlacement(c, nodeName, nodeOverlayIp.Status.UnderlayIp, zone)
+}
+
+func nodePlacement(c client.Client, nodeName string, underlayIp string, zone string) (ipam.Placement, error) {
+	node := &corev1.Node{}
+	err := c.Get(context.TODO(), types.NamespacedName{Name: nodeName}, node)
+	if err != nil && !errors.IsNotFound(err) {
+		return ipam.Placement{}, err
+	}
+
+	underlayIps := []string{}
+	for _, address := range node.Status.Addresses {
+		if address.Type == corev1.NodeInternalIP {
+			underlayIps = append(underlayIps, address.Address)
+		}
+	}
+
+	// the network pod reports the address of the interface the overlay device is created on
+	if underlayIp != "" {
+		underlayIps = append(underlayIps, underlayIp)
+	}
+
+	return ipam.Placement{Zone: zone, Labels: node.GetLabels(), UnderlayIps: underlayIps}, nil
+}
+
+// duplicateHolder returns the name of another NodeOverlayIp with the IP, or "" if there is none
+func (r *ReconcileNodeOverlayIP) duplicateHolder(name string, ipAddr string) (string, error) {
+	nodeOverlayIps := &iksv1alpha1.NodeOverlayIpList{}
+	err := r.apiReader.List(context.TODO(), &client.ListOptions{}, nodeOverlayIps)
+	if err != nil {
+		return "", err
+	}
+
+	ip := strings.Split(ipAddr, "/")[0]
+	for _, nodeOverlayIp := range nodeOverlayIps.Items {
+		if nodeOverlayIp.Name != name && strings.Split(nodeOverlayIp.Status.IpAddr, "/")[0] == ip {
+			return nodeOverlayIp.Name, nil
+		}
+	}
+
+	return "", nil
+}
+
+// addressFields returns the fields set on the address of a node in IPAM, with the token of the reservation
+func addressFields(name string, reservation string) ipam.AddressFields {
+	fields := ipam.AddressFields{
+		Hostname:    name,
+		Description: "Overlay IP of node " + name,
+	}
+
+	if reservation != "" {
+		fields.Note = reservationNote(reservation)
+	}
+
+	return fields
+}
+
+// reservationNote returns the note of an address reserved with the token, which it's found by if the reservation
+// wasn't recorded
+func reservationNote(reservation string) string {
+	return "reservation " + reservation
+}
+
+// requeueIPAMError picks when to retry after an IPAM error: transient errors are retried with exponential backoff,
+// and an exhausted pool, no subnet reachable from the node's VLAN or rejected credentials are retried after a long
+// delay with the reason in the Reserved condition.  Other errors are returned to be retried by the controller.
+func (r *ReconcileNodeOverlayIP) requeueIPAMError(instance *iksv1alpha1.NodeOverlayIp, err error) (reconcile.Result, error) {
+	reqLogger := log.WithValues("Request.Name", instance.Name)
+
+	switch {
+	case ipam.IsTransient(err):
+		delay := r.backoff(instance.Name)
+		reqLogger.Error(err, "IPAM is unavailable, retrying", "after", delay.String())
+		return reconcile.Result{RequeueAfter: delay}, nil
+
+	case ipam.IsPoolExhausted(err):
+		reqLogger.Error(err, "No free IP in the zone, retrying", "after", poolExhaustedRequeue.String())
+		r.setReservedFailed(instance, "PoolExhausted", err)
+		return reconcile.Result{RequeueAfter: poolExhaustedRequeue}, nil
+
+	case ipam.IsUnreachable(err):
+		reqLogger.Error(err, "No subnet is reachable from the node's VLAN, retrying", "after", unreachableRequeue.String())
+		r.setReservedFailed(instance, "Unreachable", err)
+		return reconcile.Result{RequeueAfter: unreachableRequeue}, nil
+
+	case ipam.IsAuth(err):
+		reqLogger.Error(err, "IPAM rejected the credentials, retrying", "after", authRequeue.String())
+		r.setReservedFailed(instance, "Unauthorized", err)
+		return reconcile.Result{RequeueAfter: authRequeue}, nil
+	}
+
+	return reconcile.Result{}, err
+}
+
+// setReservedFailed sets the Reserved condition to False with the reason, unless the IP is already reserved or the
+// NodeOverlayIp is being deleted
+func (r *ReconcileNodeOverlayIP) setReservedFailed(instance *iksv1alpha1.NodeOverlayIp, reason string, err error) {
+	if instance.Status.IpAddr != "" || instance.GetDeletionTimestamp() != nil {
+		return
+	}
+
+	conditions := setCondition(instance.Status.Conditions, corev1.ConditionFalse, reason, err.Error())
+	if reflect.DeepEqual(instance.Status.Conditions, conditions) {
+		return
+	}
+
+	instance.Status.Conditions = conditions
+	updateErr := r.client.Status().Update(context.TODO(), instance)
+	if updateErr != nil {
+		log.Error(updateErr, "failed to update the NodeOverlayIp conditions", "Request.Name", instance.Name)
+	}
+}
+
+// backoff returns the delay before retrying the NodeOverlayIp after another transient error
+func (r *ReconcileNodeOverlayIP) backoff(name string) time.Duration {
+	r.failuresLock.Lock()
+	defer r.failuresLock.Unlock()
+
+	delay := transientBackoffBase << r.failures[name]
+	if delay > transientBackoffMax || delay <= 0 {
+		return transientBackoffMax
+	}
+
+	r.failures[name]++
+	return delay
+}
+
+func (r *ReconcileNodeOverlayIP) resetBackoff(name string) {
+	r.failuresLock.Lock()
+	defer r.failuresLock.Unlock()
+
+	delete(r.failures, name)
+}
+
+// setCondition returns a copy of the conditions with the Reserved condition set, keeping its transition time if the
+// status doesn't change
+func setCondition(conditions []iksv1alpha1.NodeOverlayIpCondition, status corev1.ConditionStatus, reason string, message string) []iksv1alpha1.NodeOverlayIpCondition {
+	condition := iksv1alpha1.NodeOverlayIpCondition{
+		Type:               iksv1alpha1.NodeOverlayIpReserved,
+		Status:             status,
+		LastTransitionTime: metav1.Now(),
+		Reason:             reason,
+		Message:            message,
+	}
+
+	result := []iksv1alpha1.NodeOverlayIpCondition{}
+	for _, c := range conditions {
+		if c.Type != condition.Type {
+			result = append(result, c)
+			continue
+		}
+
+		if c.Status == condition.Status {
+			condition.LastTransitionTime = c.LastTransitionTime
+		}
+	}
+
+	return append(result, condition)
+}
+
 //addFinalizer will add this attribute to the CR
 func (r *ReconcileNodeOverlayIP) addFinalizer(m *iksv1alpha1.NodeOverlayIp) error {
     if len(m.GetFinalizers()) < 1 && m.GetDeletionTimestamp() == nil {
@@ -0,0 +1,105 @@
+package nodeoverlayip
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+
+	ipam "github.com/jkwong888/iks-overlay-ip-controller/pkg/ipam"
+	iksv1alpha1 "github.com/jkwong888/iks-overlay-ip-controller/pkg/apis/iks/v1alpha1"
+	"gopkg.in/yaml.v2"
+)
+
+type TunnelConfig struct {
+	// map of zone to the tunnel the nodes in the zone create, e.g. "dal10": {type: gre, remote: 203.0.113.1}
+	Tunnels map[string]TunnelConfigSpec `yaml:"tunnels,omitempty"`
+}
+
+type TunnelConfigSpec struct {
+	// gre or ipip
+	Type string `yaml:"type"`
+
+	// the address of the router terminating the tunnels
+	Remote string `yaml:"remote"`
+
+	// the gre key (optional)
+	Key int `yaml:"key"`
+}
+
+// loadTunnelConfig reads the tunnels section of the controller config
+func loadTunnelConfig() (map[string]TunnelConfigSpec, error) {
+	config := &TunnelConfig{}
+
+	yamlFile, err := ioutil.ReadFile(ipam.ConfigFile)
+	if err != nil {
+		return nil, err
+	}
+
+	err = yaml.Unmarshal(yamlFile, config)
+	if err != nil {
+		return nil, err
+	}
+
+	for zone, tunnel := range config.Tunnels {
+		if tunnel.Type != "gre" && tunnel.Type != "ipip" {
+			return nil, fmt.Errorf("Invalid tunnel type %q for zone %s, must be gre or ipip", tunnel.Type, zone)
+		}
+
+		if net.ParseIP(tunnel.Remote) == nil {
+			return nil, fmt.Errorf("Invalid tunnel remote %q for zone %s", tunnel.Remote, zone)
+		}
+
+		if tunnel.Key != 0 && tunnel.Type != "gre" {
+			return nil, fmt.Errorf("Tunnel key for zone %s is only supported on gre tunnels", zone)
+		}
+	}
+
+	return config.Tunnels, nil
+}
+
+// setTunnel sets the tunnel of the zone in the spec, or clears the tunnel the controller set if the zone no longer has
+// one, and returns true if the NodeOverlayIp was changed.  The link type the controller set is recorded in an
+// annotation, so a link type set by the user, or changed by the user since, is left alone
+func setTunnel(instance *iksv1alpha1.NodeOverlayIp, tunnel *TunnelConfigSpec) bool {
+	annotations := instance.GetAnnotations()
+	managed, ok := annotations[iksv1alpha1.NodeOverlayIpTunnelAnnotation]
+	if ok && managed != instance.Spec.LinkType {
+		// the user changed the link type, so the tunnel fields are theirs now
+		delete(annotations, iksv1alpha1.NodeOverlayIpTunnelAnnotation)
+		instance.SetAnnotations(annotations)
+		return true
+	}
+
+	if !ok && instance.Spec.LinkType != "" {
+		return false
+	}
+
+	if tunnel == nil {
+		if !ok {
+			return false
+		}
+
+		instance.Spec.LinkType = ""
+		instance.Spec.TunnelRemote = ""
+		instance.Spec.TunnelKey = 0
+		delete(annotations, iksv1alpha1.NodeOverlayIpTunnelAnnotation)
+		instance.SetAnnotations(annotations)
+		return true
+	}
+
+	if ok && instance.Spec.LinkType == tunnel.Type && instance.Spec.TunnelRemote == tunnel.Remote && instance.Spec.TunnelKey == tunnel.Key {
+		return false
+	}
+
+	instance.Spec.LinkType = tunnel.Type
+	instance.Spec.TunnelRemote = tunnel.Remote
+	instance.Spec.TunnelKey = tunnel.Key
+
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	annotations[iksv1alpha1.NodeOverlayIpTunnelAnnotation] = tunnel.Type
+	instance.SetAnnotations(annotations)
+
+	return true
+}
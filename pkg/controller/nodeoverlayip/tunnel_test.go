@@ -0,0 +1,107 @@
+package nodeoverlayip
+
+import (
+	"testing"
+
+	iksv1alpha1 "github.com/jkwong888/iks-overlay-ip-controller/pkg/apis/iks/v1alpha1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestSetTunnel(t *testing.T) {
+	gre := &TunnelConfigSpec{Type: "gre", Remote: "203.0.113.1", Key: 100}
+	managed := map[string]string{iksv1alpha1.NodeOverlayIpTunnelAnnotation: "gre"}
+
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		spec        iksv1alpha1.NodeOverlayIpSpec
+		tunnel      *TunnelConfigSpec
+		changed     bool
+		expected    iksv1alpha1.NodeOverlayIpSpec
+		annotated   bool
+	}{
+		{
+			name:      "set",
+			tunnel:    gre,
+			changed:   true,
+			expected:  iksv1alpha1.NodeOverlayIpSpec{LinkType: "gre", TunnelRemote: "203.0.113.1", TunnelKey: 100},
+			annotated: true,
+		},
+		{
+			name:        "unchanged",
+			annotations: managed,
+			spec:        iksv1alpha1.NodeOverlayIpSpec{LinkType: "gre", TunnelRemote: "203.0.113.1", TunnelKey: 100},
+			tunnel:      gre,
+			changed:     false,
+			expected:    iksv1alpha1.NodeOverlayIpSpec{LinkType: "gre", TunnelRemote: "203.0.113.1", TunnelKey: 100},
+			annotated:   true,
+		},
+		{
+			name:        "remote changed",
+			annotations: managed,
+			spec:        iksv1alpha1.NodeOverlayIpSpec{LinkType: "gre", TunnelRemote: "203.0.113.2"},
+			tunnel:      gre,
+			changed:     true,
+			expected:    iksv1alpha1.NodeOverlayIpSpec{LinkType: "gre", TunnelRemote: "203.0.113.1", TunnelKey: 100},
+			annotated:   true,
+		},
+		{
+			name:        "tunnel removed",
+			annotations: managed,
+			spec:        iksv1alpha1.NodeOverlayIpSpec{LinkType: "gre", TunnelRemote: "203.0.113.1", TunnelKey: 100},
+			changed:     true,
+			expected:    iksv1alpha1.NodeOverlayIpSpec{},
+			annotated:   false,
+		},
+		{
+			name:      "set by the user",
+			spec:      iksv1alpha1.NodeOverlayIpSpec{LinkType: "vlan", VlanId: 1234},
+			tunnel:    gre,
+			changed:   false,
+			expected:  iksv1alpha1.NodeOverlayIpSpec{LinkType: "vlan", VlanId: 1234},
+			annotated: false,
+		},
+		{
+			name:        "changed by the user",
+			annotations: managed,
+			spec:        iksv1alpha1.NodeOverlayIpSpec{LinkType: "ipip", TunnelRemote: "203.0.113.1", TunnelKey: 100},
+			tunnel:      gre,
+			changed:     true,
+			expected:    iksv1alpha1.NodeOverlayIpSpec{LinkType: "ipip", TunnelRemote: "203.0.113.1", TunnelKey: 100},
+			annotated:   false,
+		},
+		{
+			name:      "no tunnel",
+			spec:      iksv1alpha1.NodeOverlayIpSpec{},
+			changed:   false,
+			expected:  iksv1alpha1.NodeOverlayIpSpec{},
+			annotated: false,
+		},
+	}
+
+	for _, test := range tests {
+		annotations := map[string]string{}
+		for k, v := range test.annotations {
+			annotations[k] = v
+		}
+
+		instance := &iksv1alpha1.NodeOverlayIp{
+			ObjectMeta: metav1.ObjectMeta{Name: "10.176.162.151", Annotations: annotations},
+			Spec:       test.spec,
+		}
+
+		changed := setTunnel(instance, test.tunnel)
+		if changed != test.changed {
+			t.Errorf("%s: expected changed %v, got %v", test.name, test.changed, changed)
+		}
+
+		if instance.Spec != test.expected {
+			t.Errorf("%s: expected spec %+v, got %+v", test.name, test.expected, instance.Spec)
+		}
+
+		_, annotated := instance.GetAnnotations()[iksv1alpha1.NodeOverlayIpTunnelAnnotation]
+		if annotated != test.annotated {
+			t.Errorf("%s: expected annotated %v, got %v", test.name, test.annotated, annotated)
+		}
+	}
+}
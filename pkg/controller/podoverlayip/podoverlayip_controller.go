@@ -0,0 +1,243 @@
+package podoverlayip
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+
+	iksv1alpha1 "github.com/jkwong888/iks-overlay-ip-controller/pkg/apis/iks/v1alpha1"
+	"github.com/jkwong888/iks-overlay-ip-controller/pkg/controller/nodeoverlayip"
+	ipam "github.com/jkwong888/iks-overlay-ip-controller/pkg/ipam"
+	"github.com/jkwong888/iks-overlay-ip-controller/pkg/metrics"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	logf "sigs.k8s.io/controller-runtime/pkg/runtime/log"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+)
+
+var log = logf.Log.WithName("controller_podoverlayip")
+
+// Add creates a new PodOverlayIp Controller and adds it to the Manager. The Manager will set fields on the Controller
+// and Start it when the Manager is Started.
+func Add(mgr manager.Manager) error {
+	return add(mgr, newReconciler(mgr))
+}
+
+// newReconciler returns a new reconcile.Reconciler
+func newReconciler(mgr manager.Manager) reconcile.Reconciler {
+	return &ReconcilePodOverlayIp{client: mgr.GetClient(), scheme: mgr.GetScheme()}
+}
+
+// add adds a new Controller to mgr with r as the reconcile.Reconciler
+func add(mgr manager.Manager, r reconcile.Reconciler) error {
+	// Create a new controller
+	c, err := controller.New("podoverlayip-controller", mgr, controller.Options{Reconciler: r})
+	if err != nil {
+		return err
+	}
+
+	// Watch for changes to primary resource PodOverlayIp
+	err = c.Watch(&source.Kind{Type: &iksv1alpha1.PodOverlayIp{}}, &handler.EnqueueRequestForObject{})
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// blank assignment to verify that ReconcilePodOverlayIp implements reconcile.Reconciler
+var _ reconcile.Reconciler = &ReconcilePodOverlayIp{}
+
+// ReconcilePodOverlayIp reconciles a PodOverlayIp object
+type ReconcilePodOverlayIp struct {
+	// This client, initialized using mgr.Client() above, is a split client
+	// that reads objects from the cache and writes to the apiserver
+	client client.Client
+	scheme *runtime.Scheme
+}
+
+// Reconcile reserves an IP in IPAM for a PodOverlayIp created by the CNI plugin, in the zone of the node the pod
+// is scheduled to, and releases it when the PodOverlayIp is deleted.
+// Note:
+// The Controller will requeue the Request to be processed again if the returned error is non-nil or
+// Result.Requeue is true, otherwise upon completion it will remove the work from the queue.
+func (r *ReconcilePodOverlayIp) Reconcile(request reconcile.Request) (reconcile.Result, error) {
+	reqLogger := log.WithValues("Request.Namespace", request.Namespace, "Request.Name", request.Name)
+	reqLogger.Info("Reconciling PodOverlayIp")
+
+	// Fetch the PodOverlayIp instance
+	instance := &iksv1alpha1.PodOverlayIp{}
+	err := r.client.Get(context.TODO(), request.NamespacedName, instance)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			// Request object not found, could have been deleted after reconcile request.
+			// Return and don't requeue
+			return reconcile.Result{}, nil
+		}
+		// Error reading the object - requeue the request.
+		return reconcile.Result{}, err
+	}
+
+	if err := r.addFinalizer(instance); err != nil {
+		reqLogger.Error(err, "Failed to update PodOverlayIp with finalizer")
+		return reconcile.Result{}, err
+	}
+
+	phpIPAM, err := ipam.NewPhpIPAM()
+	if err != nil {
+		return reconcile.Result{}, err
+	}
+
+	// the CNI plugin deleted the IP, or the pod was deleted, clean up IPAM
+	if instance.GetDeletionTimestamp() != nil {
+		ipAddr := instance.Status.IpAddr
+		if ipAddr == "" {
+			// the IP may have been reserved by a reconcile that failed to record it
+			ipAddr, err = r.unrecordedIP(phpIPAM, instance)
+			if err != nil {
+				return reconcile.Result{}, err
+			}
+		}
+
+		if ipAddr != "" {
+			reqLogger.Info("Releasing IP", "ipAddr", ipAddr)
+
+			// remove the mask from the ip address
+			ipAddrArr := strings.Split(ipAddr, "/")
+			err = phpIPAM.DeleteIPAddress(ipAddrArr[0])
+			metrics.IPAMReleases.WithLabelValues(metrics.Result(err)).Inc()
+			if err != nil {
+				return reconcile.Result{}, err
+			}
+		}
+
+		instance.SetFinalizers(nil)
+		err = r.client.Update(context.TODO(), instance)
+		if err != nil {
+			return reconcile.Result{}, err
+		}
+
+		return reconcile.Result{}, nil
+	}
+
+	status := instance.Status
+	if status.Zone == "" {
+		node := &corev1.Node{}
+		err = r.client.Get(context.TODO(), types.NamespacedName{Name: instance.Spec.NodeName}, node)
+		if err != nil {
+			return reconcile.Result{}, err
+		}
+
+		status.Zone = node.GetLabels()["failure-domain.beta.kubernetes.io/zone"]
+	}
+
+	if status.IpAddr == "" {
+		// only reserve in the zone's own subnets, never fall back to another zone's pool
+		if len(phpIPAM.PhpIPAMConfig.SubnetMap[status.Zone]) == 0 {
+			return reconcile.Result{}, fmt.Errorf("No subnets configured for zone \"%s\" in the subnet map", status.Zone)
+		}
+
+		// the address is configured in the pod on its node, so it's reserved in a subnet reachable from the node's VLAN
+		placement, err := nodeoverlayip.NodePlacement(r.client, instance.Spec.NodeName, status.Zone)
+		if err != nil {
+			return reconcile.Result{}, err
+		}
+
+		// look the IP up by its owner first, so an IP reserved by a reconcile that failed to record it isn't leaked
+		myIP, _, err := phpIPAM.FindIPAddressByOwner(ipamOwner(instance), placement)
+		if err != nil {
+			return reconcile.Result{}, err
+		}
+
+		if myIP == "" {
+			myIP, err = phpIPAM.ReserveIPAddress(ipamOwner(instance), placement)
+			metrics.IPAMReservations.WithLabelValues(status.Zone, metrics.Result(err)).Inc()
+			if err != nil {
+				return reconcile.Result{}, err
+			}
+
+			reqLogger.Info("Reserved IP", "ipAddr", myIP, "zone", status.Zone)
+		}
+
+		// record the IP before looking up its gateway
+		status.IpAddr = myIP
+		instance.Status = status
+		err = r.client.Status().Update(context.TODO(), instance)
+		if err != nil {
+			reqLogger.Error(err, "failed to update the PodOverlayIp")
+			return reconcile.Result{}, err
+		}
+	}
+
+	if status.Gateway == "" {
+		ipAddrArr := strings.Split(status.IpAddr, "/")
+		mySubnet, err := phpIPAM.GetSubnetForIP(ipAddrArr[0])
+		if err != nil {
+			return reconcile.Result{}, err
+		}
+
+		status.Gateway = mySubnet["gateway"]
+	}
+
+	if !reflect.DeepEqual(instance.Status, status) {
+		instance.Status = status
+		err := r.client.Status().Update(context.TODO(), instance)
+		if err != nil {
+			reqLogger.Error(err, "failed to update the PodOverlayIp")
+			return reconcile.Result{}, err
+		}
+	}
+
+	return reconcile.Result{}, nil
+}
+
+// unrecordedIP returns the IP reserved in IPAM for the PodOverlayIp, or "" if there is none or its zone isn't known
+func (r *ReconcilePodOverlayIp) unrecordedIP(phpIPAM *ipam.PhpIPAM, instance *iksv1alpha1.PodOverlayIp) (string, error) {
+	zone := instance.Status.Zone
+	if zone == "" {
+		node := &corev1.Node{}
+		err := r.client.Get(context.TODO(), types.NamespacedName{Name: instance.Spec.NodeName}, node)
+		if err != nil {
+			if errors.IsNotFound(err) {
+				return "", nil
+			}
+			return "", err
+		}
+
+		zone = node.GetLabels()["failure-domain.beta.kubernetes.io/zone"]
+	}
+
+	if zone == "" {
+		return "", nil
+	}
+
+	// the node may be gone, so all the subnets of the zone are searched
+	ipAddr, _, err := phpIPAM.FindIPAddressByOwner(ipamOwner(instance), ipam.Placement{Zone: zone})
+	return ipAddr, err
+}
+
+// ipamOwner returns the owner recorded in IPAM for the PodOverlayIp's IP
+func ipamOwner(instance *iksv1alpha1.PodOverlayIp) string {
+	return fmt.Sprintf("pod/%s/%s", instance.Namespace, instance.Name)
+}
+
+// addFinalizer adds the finalizer so the IP is released in IPAM before the PodOverlayIp is deleted
+func (r *ReconcilePodOverlayIp) addFinalizer(m *iksv1alpha1.PodOverlayIp) error {
+	if len(m.GetFinalizers()) < 1 && m.GetDeletionTimestamp() == nil {
+		m.SetFinalizers([]string{"finalizer.iks.ibm.com"})
+
+		err := r.client.Update(context.TODO(), m)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
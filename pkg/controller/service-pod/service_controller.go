@@ -0,0 +1,227 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+
+	iksv1alpha1 "github.com/jkwong888/iks-overlay-ip-controller/pkg/apis/iks/v1alpha1"
+	"github.com/jkwong888/iks-overlay-ip-controller/pkg/util"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	logf "sigs.k8s.io/controller-runtime/pkg/runtime/log"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+)
+
+var log = logf.Log.WithName("controller_service")
+
+// the suffix of the address label that marks the Service overlay IPs on the overlay device, e.g. tmp0:lb
+const addrLabelSuffix = ":lb"
+
+type ManagerOptions struct {
+	Hostname string
+}
+
+// Add creates a new Service Controller and adds it to the Manager. The Manager will set fields on the Controller
+// and Start it when the Manager is Started.
+func Add(mgr manager.Manager, options ManagerOptions) error {
+	return add(mgr, newReconciler(mgr, options), options)
+}
+
+// newReconciler returns a new reconcile.Reconciler
+func newReconciler(mgr manager.Manager, options ManagerOptions) reconcile.Reconciler {
+	return &ReconcileService{client: mgr.GetClient(), scheme: mgr.GetScheme(), options: options}
+}
+
+// add adds a new Controller to mgr with r as the reconcile.Reconciler
+func add(mgr manager.Manager, r reconcile.Reconciler, options ManagerOptions) error {
+	// Create a new controller
+	c, err := controller.New("service-controller", mgr, controller.Options{Reconciler: r})
+	if err != nil {
+		return err
+	}
+
+	// all Service overlay IPs on this node are reconciled together
+	toMyNode := &handler.EnqueueRequestsFromMapFunc{
+		ToRequests: handler.ToRequestsFunc(func(a handler.MapObject) []reconcile.Request {
+			return []reconcile.Request{
+				{NamespacedName: types.NamespacedName{Name: options.Hostname}},
+			}
+		}),
+	}
+
+	err = c.Watch(&source.Kind{Type: &corev1.Service{}}, toMyNode)
+	if err != nil {
+		return err
+	}
+
+	// the addresses are lost when this node's overlay device is recreated
+	isMyNode := predicate.Funcs{
+		CreateFunc:  func(e event.CreateEvent) bool { return e.Meta.GetName() == options.Hostname },
+		UpdateFunc:  func(e event.UpdateEvent) bool { return e.MetaNew.GetName() == options.Hostname },
+		DeleteFunc:  func(e event.DeleteEvent) bool { return false },
+		GenericFunc: func(e event.GenericEvent) bool { return e.Meta.GetName() == options.Hostname },
+	}
+	err = c.Watch(&source.Kind{Type: &iksv1alpha1.NodeOverlayIp{}}, toMyNode, isMyNode)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// blank assignment to verify that ReconcileService implements reconcile.Reconciler
+var _ reconcile.Reconciler = &ReconcileService{}
+
+// ReconcileService reconciles the Service overlay IPs bound on this node
+type ReconcileService struct {
+	// This client, initialized using mgr.Client() above, is a split client
+	// that reads objects from the cache and writes to the apiserver
+	client client.Client
+	scheme *runtime.Scheme
+	options ManagerOptions
+}
+
+// Reconcile binds the overlay IPs of the Services whose leader is this node to the overlay device, so the node
+// answers ARP for them, and removes the overlay IPs of Services that moved to another node.
+// Note:
+// The Controller will requeue the Request to be processed again if the returned error is non-nil or
+// Result.Requeue is true, otherwise upon completion it will remove the work from the queue.
+func (r *ReconcileService) Reconcile(request reconcile.Request) (reconcile.Result, error) {
+	reqLogger := log.WithValues("Request.Name", request.Name)
+
+	// Fetch this node's NodeOverlayIp instance
+	nodeOverlayIp := &iksv1alpha1.NodeOverlayIp{}
+	err := r.client.Get(context.TODO(), types.NamespacedName{Name: r.options.Hostname}, nodeOverlayIp)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return reconcile.Result{}, nil
+		}
+		// Error reading the object - requeue the request.
+		return reconcile.Result{}, err
+	}
+
+	device := nodeOverlayIp.Status.InterfaceLabel
+	if device == "" {
+		// the overlay device isn't created yet
+		return reconcile.Result{}, nil
+	}
+
+	services := &corev1.ServiceList{}
+	err = r.client.List(context.TODO(), &client.ListOptions{}, services)
+	if err != nil {
+		return reconcile.Result{}, err
+	}
+
+	desired := map[string]bool{}
+	for _, service := range services.Items {
+		annotations := service.GetAnnotations()
+		if annotations[iksv1alpha1.ServiceOverlayIpNodeAnnotation] != r.options.Hostname || service.GetDeletionTimestamp() != nil {
+			continue
+		}
+
+		ip, _, err := net.ParseCIDR(annotations[iksv1alpha1.ServiceOverlayIpAddressAnnotation])
+		if err != nil {
+			continue
+		}
+
+		// the annotation can be written by the Service's users, the address is only bound once the controller
+		// has checked it's reserved for the Service and published it in the status
+		if !inIngress(&service, ip.String()) {
+			reqLogger.Info("Service overlay IP isn't in the load balancer ingress yet, not binding it", "Service", service.Namespace+"/"+service.Name, "ipAddr", ip.String())
+			continue
+		}
+
+		desired[fmt.Sprintf("%s/32", ip.String())] = true
+	}
+
+	current, err := getServiceAddrs(device)
+	if err != nil {
+		return reconcile.Result{}, err
+	}
+
+	for addr := range desired {
+		if current[addr] {
+			continue
+		}
+
+		reqLogger.Info("Binding Service overlay IP", "ipAddr", addr, "device", device)
+		out, code, err := util.ExecIpCmd(fmt.Sprintf("addr add %s dev %s label %s%s", addr, device, device, addrLabelSuffix))
+		if err != nil {
+			return reconcile.Result{}, err
+		}
+
+		if code != 0 {
+			return reconcile.Result{}, fmt.Errorf("Error executing \"ip addr add\", output: %s", out)
+		}
+
+		// the Service may have moved from another node, so tell the other hosts the IP is here now
+		err = util.AnnounceAddress(device, addr)
+		if err != nil {
+			reqLogger.Error(err, "Failed to announce Service overlay IP", "ipAddr", addr, "device", device)
+		}
+	}
+
+	for addr := range current {
+		if desired[addr] {
+			continue
+		}
+
+		reqLogger.Info("Removing Service overlay IP", "ipAddr", addr, "device", device)
+		out, code, err := util.ExecIpCmd(fmt.Sprintf("addr del %s dev %s", addr, device))
+		if err != nil {
+			return reconcile.Result{}, err
+		}
+
+		if code != 0 {
+			return reconcile.Result{}, fmt.Errorf("Error executing \"ip addr del\", output: %s", out)
+		}
+	}
+
+	return reconcile.Result{}, nil
+}
+
+// getServiceAddrs returns the Service overlay IPs bound to the device
+func getServiceAddrs(device string) (map[string]bool, error) {
+	out, code, err := util.ExecIpCmd(fmt.Sprintf("addr show dev %s", device))
+	if err != nil {
+		return nil, err
+	}
+
+	if code != 0 {
+		return nil, fmt.Errorf("Error executing \"ip addr show\", output: %s", out)
+	}
+
+	addrs := map[string]bool{}
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || fields[0] != "inet" || fields[len(fields)-1] != device+addrLabelSuffix {
+			continue
+		}
+
+		addrs[fields[1]] = true
+	}
+
+	return addrs, nil
+}
+
+// inIngress returns true if the IP is in the load balancer ingress of the Service
+func inIngress(service *corev1.Service, ip string) bool {
+	for _, ingress := range service.Status.LoadBalancer.Ingress {
+		if ingress.IP == ip {
+			return true
+		}
+	}
+
+	return false
+}
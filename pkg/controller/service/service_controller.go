@@ -0,0 +1,506 @@
+package service
+
+import (
+	"context"
+	"hash/fnv"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	iksv1alpha1 "github.com/jkwong888/iks-overlay-ip-controller/pkg/apis/iks/v1alpha1"
+	"github.com/jkwong888/iks-overlay-ip-controller/pkg/controller/nodeoverlayip"
+	ipam "github.com/jkwong888/iks-overlay-ip-controller/pkg/ipam"
+	"github.com/jkwong888/iks-overlay-ip-controller/pkg/metrics"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	logf "sigs.k8s.io/controller-runtime/pkg/runtime/log"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+)
+
+var log = logf.Log.WithName("controller_service")
+
+// serviceFinalizer is added to Services with an overlay IP so the IP is released when they are removed
+const serviceFinalizer = "finalizer.iks.ibm.com"
+
+// how long to wait before trying again when there is no node that can bind the overlay IP
+var noLeaderRequeueDelay = 30 * time.Second
+
+// Add creates a new Service Controller and adds it to the Manager. The Manager will set fields on the Controller
+// and Start it when the Manager is Started.
+func Add(mgr manager.Manager) error {
+	return add(mgr, newReconciler(mgr))
+}
+
+// newReconciler returns a new reconcile.Reconciler
+func newReconciler(mgr manager.Manager) reconcile.Reconciler {
+	return &ReconcileService{client: mgr.GetClient(), scheme: mgr.GetScheme(), verified: map[types.NamespacedName]reservation{}}
+}
+
+// add adds a new Controller to mgr with r as the reconcile.Reconciler
+func add(mgr manager.Manager, r reconcile.Reconciler) error {
+	// Create a new controller
+	c, err := controller.New("service-controller", mgr, controller.Options{Reconciler: r})
+	if err != nil {
+		return err
+	}
+
+	// Watch for changes to primary resource Service
+	err = c.Watch(&source.Kind{Type: &corev1.Service{}}, &handler.EnqueueRequestForObject{})
+	if err != nil {
+		return err
+	}
+
+	// nodes coming, going or becoming not ready may move the overlay IPs to another node
+	mgrClient := mgr.GetClient()
+	toServices := &handler.EnqueueRequestsFromMapFunc{
+		ToRequests: handler.ToRequestsFunc(func(a handler.MapObject) []reconcile.Request {
+			services := &corev1.ServiceList{}
+			err := mgrClient.List(context.TODO(), &client.ListOptions{}, services)
+			if err != nil {
+				log.Error(err, "Failed to list Services")
+				return nil
+			}
+
+			requests := []reconcile.Request{}
+			for _, service := range services.Items {
+				if service.GetAnnotations()[iksv1alpha1.ServiceOverlayIpAnnotation] != "true" {
+					continue
+				}
+
+				requests = append(requests, reconcile.Request{
+					NamespacedName: types.NamespacedName{Namespace: service.Namespace, Name: service.Name},
+				})
+			}
+
+			return requests
+		}),
+	}
+
+	err = c.Watch(&source.Kind{Type: &corev1.Node{}}, toServices)
+	if err != nil {
+		return err
+	}
+
+	err = c.Watch(&source.Kind{Type: &iksv1alpha1.NodeOverlayIp{}}, toServices)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// blank assignment to verify that ReconcileService implements reconcile.Reconciler
+var _ reconcile.Reconciler = &ReconcileService{}
+
+// ReconcileService reconciles the overlay IP of a Service object
+type ReconcileService struct {
+	// This client, initialized using mgr.Client() above, is a split client
+	// that reads objects from the cache and writes to the apiserver
+	client client.Client
+	scheme *runtime.Scheme
+
+	// the overlay IP of each Service that was found reserved for it in IPAM; the address annotation can be
+	// written by the Service's users, so it's only trusted while it matches
+	verified     map[types.NamespacedName]reservation
+	verifiedLock sync.Mutex
+}
+
+// reservation is the overlay IP reserved for a Service in IPAM, and the ID of its subnet
+type reservation struct {
+	ipAddr   string
+	subnetId int
+}
+
+// Reconcile reserves an overlay IP in IPAM for each annotated Service of type LoadBalancer, picks a leader node
+// whose network pod binds the IP, and sets the IP as the Service's load balancer ingress.  If the leader node
+// goes away or becomes not ready, another node in the zone is picked.
+// Note:
+// The Controller will requeue the Request to be processed again if the returned error is non-nil or
+// Result.Requeue is true, otherwise upon completion it will remove the work from the queue.
+func (r *ReconcileService) Reconcile(request reconcile.Request) (reconcile.Result, error) {
+	reqLogger := log.WithValues("Request.Namespace", request.Namespace, "Request.Name", request.Name)
+
+	// Fetch the Service instance
+	instance := &corev1.Service{}
+	err := r.client.Get(context.TODO(), request.NamespacedName, instance)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return reconcile.Result{}, nil
+		}
+		// Error reading the object - requeue the request.
+		return reconcile.Result{}, err
+	}
+
+	annotations := instance.GetAnnotations()
+	enabled := annotations[iksv1alpha1.ServiceOverlayIpAnnotation] == "true" &&
+		instance.Spec.Type == corev1.ServiceTypeLoadBalancer &&
+		instance.GetDeletionTimestamp() == nil
+
+	if !enabled {
+		if !hasFinalizer(instance) {
+			return reconcile.Result{}, nil
+		}
+
+		reqLogger.Info("Releasing overlay IP for Service")
+		return reconcile.Result{}, r.release(instance)
+	}
+
+	reqLogger.Info("Reconciling overlay IP for Service")
+
+	if !hasFinalizer(instance) {
+		instance.SetFinalizers(append(instance.GetFinalizers(), serviceFinalizer))
+		err = r.client.Update(context.TODO(), instance)
+		if err != nil {
+			return reconcile.Result{}, err
+		}
+	}
+
+	zone := annotations[iksv1alpha1.ServiceOverlayIpZoneAnnotation]
+	candidates, err := r.candidateNodes(zone)
+	if err != nil {
+		return reconcile.Result{}, err
+	}
+
+	if len(candidates) == 0 {
+		reqLogger.Info("No node with a configured overlay IP to bind the Service's overlay IP, requeuing", "zone", zone)
+		return reconcile.Result{RequeueAfter: noLeaderRequeueDelay}, nil
+	}
+
+	newAnnotations := map[string]string{}
+	for k, v := range annotations {
+		newAnnotations[k] = v
+	}
+
+	if zone == "" {
+		zone = candidates[0].GetLabels()["failure-domain.beta.kubernetes.io/zone"]
+		newAnnotations[iksv1alpha1.ServiceOverlayIpZoneAnnotation] = zone
+	}
+
+	previous := r.verifiedIP(request.NamespacedName).ipAddr
+	reserved, err := r.reservedIP(instance, zone, candidates)
+	if err != nil {
+		return reconcile.Result{}, err
+	}
+
+	// with a VLAN map, only the nodes on a VLAN that reaches the IP's subnet can bind it
+	candidates, err = reachingCandidates(r.client, candidates, zone, reserved.subnetId)
+	if err != nil {
+		return reconcile.Result{}, err
+	}
+
+	if len(candidates) == 0 {
+		reqLogger.Info("No node reaching the subnet of the Service's overlay IP, requeuing", "ipAddr", reserved.ipAddr, "subnet", reserved.subnetId)
+		return reconcile.Result{RequeueAfter: noLeaderRequeueDelay}, nil
+	}
+
+	ipAddr := reserved.ipAddr
+
+	if annotated := annotations[iksv1alpha1.ServiceOverlayIpAddressAnnotation]; annotated != ipAddr {
+		if annotated != "" {
+			reqLogger.Info("Overlay IP annotation doesn't match the IP reserved for the Service, correcting it", "annotated", annotated, "ipAddr", ipAddr)
+		}
+
+		newAnnotations[iksv1alpha1.ServiceOverlayIpAddressAnnotation] = ipAddr
+	}
+
+	leader := pickLeader(instance, candidates, annotations[iksv1alpha1.ServiceOverlayIpNodeAnnotation])
+	if leader != annotations[iksv1alpha1.ServiceOverlayIpNodeAnnotation] {
+		reqLogger.Info("Moving overlay IP for Service to node", "ipAddr", ipAddr, "from", annotations[iksv1alpha1.ServiceOverlayIpNodeAnnotation], "to", leader)
+		newAnnotations[iksv1alpha1.ServiceOverlayIpNodeAnnotation] = leader
+	}
+
+	if !reflect.DeepEqual(newAnnotations, annotations) {
+		instance.SetAnnotations(newAnnotations)
+		err = r.client.Update(context.TODO(), instance)
+		if err != nil {
+			return reconcile.Result{}, err
+		}
+	}
+
+	// add the address to the load balancer ingress, so kube-proxy forwards it to the endpoints and the leader's
+	// network pod binds it; the ingress of the cloud provider's load balancer is kept
+	ip := strings.Split(ipAddr, "/")[0]
+	stale := ""
+	if previous != "" && previous != ipAddr {
+		stale = strings.Split(previous, "/")[0]
+	}
+
+	ingress := []corev1.LoadBalancerIngress{}
+	published := false
+	for _, val := range instance.Status.LoadBalancer.Ingress {
+		if val.IP == stale {
+			continue
+		}
+
+		published = published || val.IP == ip
+		ingress = append(ingress, val)
+	}
+
+	if !published {
+		ingress = append(ingress, corev1.LoadBalancerIngress{IP: ip})
+	}
+
+	if !reflect.DeepEqual(ingress, instance.Status.LoadBalancer.Ingress) {
+		instance.Status.LoadBalancer.Ingress = ingress
+		err = r.client.Status().Update(context.TODO(), instance)
+		if err != nil {
+			return reconcile.Result{}, err
+		}
+	}
+
+	return reconcile.Result{}, nil
+}
+
+// reservedIP returns the overlay IP reserved in IPAM for the Service, reserving one in a subnet reachable from the
+// node that would bind it if there isn't one.  IPAM is looked up by the Service's owner rather than trusting the
+// address annotation, which the Service's users can write, and so that an address reserved by a reconcile that failed
+// to record it isn't leaked.
+func (r *ReconcileService) reservedIP(instance *corev1.Service, zone string, candidates []corev1.Node) (reservation, error) {
+	name := types.NamespacedName{Namespace: instance.Namespace, Name: instance.Name}
+	verified := r.verifiedIP(name)
+	if verified.ipAddr != "" && verified.ipAddr == instance.GetAnnotations()[iksv1alpha1.ServiceOverlayIpAddressAnnotation] {
+		return verified, nil
+	}
+
+	phpIPAM, err := ipam.NewPhpIPAM()
+	if err != nil {
+		return reservation{}, err
+	}
+
+	// all the subnets of the zone are searched, so the IP is found after the leader moved to another VLAN
+	owner := ipamOwner(instance)
+	ipAddr, subnetId, err := phpIPAM.FindIPAddressByOwner(owner, ipam.Placement{Zone: zone})
+	if err != nil {
+		return reservation{}, err
+	}
+
+	if ipAddr == "" {
+		leader := pickLeader(instance, candidates, instance.GetAnnotations()[iksv1alpha1.ServiceOverlayIpNodeAnnotation])
+		placement, err := nodeoverlayip.NodePlacement(r.client, leader, zone)
+		if err != nil {
+			return reservation{}, err
+		}
+
+		ipAddr, subnetId, err = phpIPAM.ReserveIPAddressWithFields(owner, placement, ipam.AddressFields{})
+		metrics.IPAMReservations.WithLabelValues(zone, metrics.Result(err)).Inc()
+		if err != nil {
+			return reservation{}, err
+		}
+
+		log.Info("Reserved overlay IP for Service", "Service", name.String(), "ipAddr", ipAddr, "zone", zone)
+	}
+
+	r.verifiedLock.Lock()
+	defer r.verifiedLock.Unlock()
+	r.verified[name] = reservation{ipAddr: ipAddr, subnetId: subnetId}
+
+	return r.verified[name], nil
+}
+
+func (r *ReconcileService) verifiedIP(name types.NamespacedName) reservation {
+	r.verifiedLock.Lock()
+	defer r.verifiedLock.Unlock()
+
+	return r.verified[name]
+}
+
+// release returns the Service's overlay IP to IPAM, and removes it from the Service.  The address to release is
+// looked up by the Service's owner in IPAM, never taken from the annotation, so that another reservation can't be
+// released by annotating a Service with its address.
+func (r *ReconcileService) release(instance *corev1.Service) error {
+	annotations := instance.GetAnnotations()
+
+	phpIPAM, err := ipam.NewPhpIPAM()
+	if err != nil {
+		return err
+	}
+
+	// the zone is recorded with the address, but may be missing if recording it failed
+	zones := []string{annotations[iksv1alpha1.ServiceOverlayIpZoneAnnotation]}
+	if zones[0] == "" {
+		zones = []string{}
+		for zone := range phpIPAM.PhpIPAMConfig.SubnetMap {
+			zones = append(zones, zone)
+		}
+	}
+
+	ip := ""
+	for _, zone := range zones {
+		ipAddr, _, err := phpIPAM.FindIPAddressByOwner(ipamOwner(instance), ipam.Placement{Zone: zone})
+		if err != nil {
+			return err
+		}
+
+		if ipAddr == "" {
+			continue
+		}
+
+		ip = strings.Split(ipAddr, "/")[0]
+		err = phpIPAM.DeleteIPAddress(ip)
+		metrics.IPAMReleases.WithLabelValues(metrics.Result(err)).Inc()
+		if err != nil {
+			return err
+		}
+
+		log.Info("Released overlay IP for Service", "Service", instance.Namespace+"/"+instance.Name, "ipAddr", ipAddr)
+		break
+	}
+
+	r.verifiedLock.Lock()
+	delete(r.verified, types.NamespacedName{Namespace: instance.Namespace, Name: instance.Name})
+	r.verifiedLock.Unlock()
+
+	// stop advertising the address before the IP can be reused; if it was already released by an earlier attempt,
+	// the annotated address is removed, which only affects this Service
+	if ip == "" {
+		ip = strings.Split(annotations[iksv1alpha1.ServiceOverlayIpAddressAnnotation], "/")[0]
+	}
+
+	ingress := []corev1.LoadBalancerIngress{}
+	for _, val := range instance.Status.LoadBalancer.Ingress {
+		if ip != "" && val.IP == ip {
+			continue
+		}
+
+		ingress = append(ingress, val)
+	}
+
+	if len(ingress) != len(instance.Status.LoadBalancer.Ingress) {
+		instance.Status.LoadBalancer.Ingress = ingress
+		err := r.client.Status().Update(context.TODO(), instance)
+		if err != nil {
+			return err
+		}
+	}
+
+	delete(annotations, iksv1alpha1.ServiceOverlayIpAddressAnnotation)
+	delete(annotations, iksv1alpha1.ServiceOverlayIpNodeAnnotation)
+	instance.SetAnnotations(annotations)
+	removeFinalizer(instance)
+
+	return r.client.Update(context.TODO(), instance)
+}
+
+// candidateNodes returns the ready nodes in the zone with a configured overlay IP, sorted by name.  If zone is
+// empty, nodes in all zones are returned.
+func (r *ReconcileService) candidateNodes(zone string) ([]corev1.Node, error) {
+	nodes := &corev1.NodeList{}
+	err := r.client.List(context.TODO(), &client.ListOptions{}, nodes)
+	if err != nil {
+		return nil, err
+	}
+
+	nodeOverlayIps := &iksv1alpha1.NodeOverlayIpList{}
+	err = r.client.List(context.TODO(), &client.ListOptions{}, nodeOverlayIps)
+	if err != nil {
+		return nil, err
+	}
+
+	configured := map[string]bool{}
+	for _, nodeOverlayIp := range nodeOverlayIps.Items {
+		if nodeOverlayIp.Status.IpAddr != "" && nodeOverlayIp.Status.InterfaceLabel != "" && nodeOverlayIp.GetDeletionTimestamp() == nil {
+			configured[nodeOverlayIp.Name] = true
+		}
+	}
+
+	candidates := []corev1.Node{}
+	for _, node := range nodes.Items {
+		if node.GetDeletionTimestamp() != nil || !configured[node.Name] || !isReady(&node) {
+			continue
+		}
+
+		if zone != "" && node.GetLabels()["failure-domain.beta.kubernetes.io/zone"] != zone {
+			continue
+		}
+
+		candidates = append(candidates, node)
+	}
+
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].Name < candidates[j].Name })
+
+	return candidates, nil
+}
+
+// reachingCandidates returns the candidates on a VLAN that reaches the subnet, which is all of them without a VLAN map
+func reachingCandidates(c client.Client, candidates []corev1.Node, zone string, subnetId int) ([]corev1.Node, error) {
+	config, err := ipam.LoadConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	reaching := []corev1.Node{}
+	for _, node := range candidates {
+		placement, err := nodeoverlayip.NodePlacement(c, node.Name, zone)
+		if err != nil {
+			return nil, err
+		}
+
+		if config.Reaches(placement, subnetId) {
+			reaching = append(reaching, node)
+		}
+	}
+
+	return reaching, nil
+}
+
+// pickLeader keeps the current leader if it is still a candidate, otherwise the Services are spread across the
+// candidates by hashing their names
+func pickLeader(instance *corev1.Service, candidates []corev1.Node, current string) string {
+	for _, node := range candidates {
+		if node.Name == current {
+			return current
+		}
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(instance.Namespace + "/" + instance.Name))
+
+	return candidates[int(h.Sum32()%uint32(len(candidates)))].Name
+}
+
+func isReady(node *corev1.Node) bool {
+	for _, condition := range node.Status.Conditions {
+		if condition.Type == corev1.NodeReady {
+			return condition.Status == corev1.ConditionTrue
+		}
+	}
+
+	return false
+}
+
+// ipamOwner returns the owner recorded in IPAM for the Service's overlay IP
+func ipamOwner(instance *corev1.Service) string {
+	return "service/" + instance.Namespace + "/" + instance.Name
+}
+
+func hasFinalizer(service *corev1.Service) bool {
+	for _, finalizer := range service.GetFinalizers() {
+		if finalizer == serviceFinalizer {
+			return true
+		}
+	}
+
+	return false
+}
+
+func removeFinalizer(service *corev1.Service) {
+	finalizers := []string{}
+	for _, finalizer := range service.GetFinalizers() {
+		if finalizer == serviceFinalizer {
+			continue
+		}
+
+		finalizers = append(finalizers, finalizer)
+	}
+
+	service.SetFinalizers(finalizers)
+}
@@ -0,0 +1,374 @@
+package snat
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	iksv1alpha1 "github.com/jkwong888/iks-overlay-ip-controller/pkg/apis/iks/v1alpha1"
+	"github.com/jkwong888/iks-overlay-ip-controller/pkg/util"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	logf "sigs.k8s.io/controller-runtime/pkg/runtime/log"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+)
+
+var log = logf.Log.WithName("controller_snat")
+
+// the nat chain holding the SNAT rules, jumped to from POSTROUTING
+const snatChain = "OVERLAY-SNAT"
+
+// how often the rules are checked, in case they were flushed by something else on the node
+var resyncInterval = 60 * time.Second
+
+type ManagerOptions struct {
+	Hostname string
+	Zone     string
+}
+
+// Add creates a new SNAT Controller and adds it to the Manager if EGRESS_SNAT is "true". The Manager will set
+// fields on the Controller and Start it when the Manager is Started.
+func Add(mgr manager.Manager, options ManagerOptions) error {
+	if os.Getenv("EGRESS_SNAT") != "true" {
+		log.Info("EGRESS_SNAT is not enabled, pod traffic to StaticRoute subnets is not SNATed")
+		return nil
+	}
+
+	return add(mgr, newReconciler(mgr, options), options)
+}
+
+// newReconciler returns a new reconcile.Reconciler
+func newReconciler(mgr manager.Manager, options ManagerOptions) reconcile.Reconciler {
+	return &ReconcileSnat{client: mgr.GetClient(), scheme: mgr.GetScheme(), options: options}
+}
+
+// add adds a new Controller to mgr with r as the reconcile.Reconciler
+func add(mgr manager.Manager, r reconcile.Reconciler, options ManagerOptions) error {
+	// Create a new controller
+	c, err := controller.New("snat-controller", mgr, controller.Options{Reconciler: r})
+	if err != nil {
+		return err
+	}
+
+	// all of the rules on this node are reconciled together
+	toMyNode := &handler.EnqueueRequestsFromMapFunc{
+		ToRequests: handler.ToRequestsFunc(func(a handler.MapObject) []reconcile.Request {
+			return []reconcile.Request{
+				{NamespacedName: types.NamespacedName{Name: options.Hostname}},
+			}
+		}),
+	}
+
+	err = c.Watch(&source.Kind{Type: &iksv1alpha1.StaticRoute{}}, toMyNode)
+	if err != nil {
+		return err
+	}
+
+	// the source of the rules is this node's overlay IP
+	isMyNode := predicate.Funcs{
+		CreateFunc:  func(e event.CreateEvent) bool { return e.Meta.GetName() == options.Hostname },
+		UpdateFunc:  func(e event.UpdateEvent) bool { return e.MetaNew.GetName() == options.Hostname },
+		DeleteFunc:  func(e event.DeleteEvent) bool { return e.Meta.GetName() == options.Hostname },
+		GenericFunc: func(e event.GenericEvent) bool { return e.Meta.GetName() == options.Hostname },
+	}
+	err = c.Watch(&source.Kind{Type: &iksv1alpha1.NodeOverlayIp{}}, toMyNode, isMyNode)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// blank assignment to verify that ReconcileSnat implements reconcile.Reconciler
+var _ reconcile.Reconciler = &ReconcileSnat{}
+
+// ReconcileSnat reconciles the SNAT rules of this node
+type ReconcileSnat struct {
+	// This client, initialized using mgr.Client() above, is a split client
+	// that reads objects from the cache and writes to the apiserver
+	client client.Client
+	scheme *runtime.Scheme
+	options ManagerOptions
+}
+
+// Reconcile SNATs traffic from the pod CIDR to each StaticRoute subnet in this node's zone to the node's overlay
+// IP, and removes the rules of StaticRoutes that were deleted.
+// Note:
+// The Controller will requeue the Request to be processed again if the returned error is non-nil or
+// Result.Requeue is true, otherwise upon completion it will remove the work from the queue.
+func (r *ReconcileSnat) Reconcile(request reconcile.Request) (reconcile.Result, error) {
+	reqLogger := log.WithValues("Request.Name", request.Name)
+
+	err := ensureChain()
+	if err != nil {
+		return reconcile.Result{}, err
+	}
+
+	desired, err := r.desiredRules()
+	if err != nil {
+		return reconcile.Result{}, err
+	}
+
+	current, err := currentRules()
+	if err != nil {
+		return reconcile.Result{}, err
+	}
+
+	for _, rule := range desired {
+		if current[rule] {
+			continue
+		}
+
+		reqLogger.Info("Adding SNAT rule", "rule", rule)
+		out, code, err := util.ExecIptablesCmd(fmt.Sprintf("-t nat -A %s %s", snatChain, rule))
+		if err != nil {
+			return reconcile.Result{}, err
+		}
+
+		if code != 0 {
+			return reconcile.Result{}, fmt.Errorf("Error executing \"iptables -A\", output: %s", out)
+		}
+	}
+
+	isDesired := map[string]bool{}
+	for _, rule := range desired {
+		isDesired[rule] = true
+	}
+
+	for rule := range current {
+		if isDesired[rule] {
+			continue
+		}
+
+		reqLogger.Info("Removing SNAT rule", "rule", rule)
+		out, code, err := util.ExecIptablesCmd(fmt.Sprintf("-t nat -D %s %s", snatChain, rule))
+		if err != nil {
+			return reconcile.Result{}, err
+		}
+
+		if code != 0 {
+			return reconcile.Result{}, fmt.Errorf("Error executing \"iptables -D\", output: %s", out)
+		}
+	}
+
+	return reconcile.Result{RequeueAfter: resyncInterval}, nil
+}
+
+// desiredRules returns the SNAT rules for this node, in the format printed by "iptables -S" so they can be
+// compared with the current rules
+func (r *ReconcileSnat) desiredRules() ([]string, error) {
+	nodeOverlayIp := &iksv1alpha1.NodeOverlayIp{}
+	err := r.client.Get(context.TODO(), types.NamespacedName{Name: r.options.Hostname}, nodeOverlayIp)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	if nodeOverlayIp.Status.IpAddr == "" || nodeOverlayIp.Status.InterfaceLabel == "" || nodeOverlayIp.GetDeletionTimestamp() != nil {
+		// the overlay IP isn't configured on the node, so it can't be the source
+		return nil, nil
+	}
+
+	overlayIp, _, err := net.ParseCIDR(nodeOverlayIp.Status.IpAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	podCidrs, err := r.podCidrs()
+	if err != nil {
+		return nil, err
+	}
+
+	staticRoutes := &iksv1alpha1.StaticRouteList{}
+	err = r.client.List(context.TODO(), &client.ListOptions{}, staticRoutes)
+	if err != nil {
+		return nil, err
+	}
+
+	rules := []string{}
+	seen := map[string]bool{}
+	for _, staticRoute := range staticRoutes.Items {
+		zone := staticRoute.GetLabels()["failure-domain.beta.kubernetes.io/zone"]
+		if (zone != "" && zone != r.options.Zone) || staticRoute.GetDeletionTimestamp() != nil {
+			continue
+		}
+
+		_, subnet, err := net.ParseCIDR(staticRoute.Spec.Subnet)
+		if err != nil {
+			log.Info("Ignoring StaticRoute with invalid subnet", "name", staticRoute.Name, "subnet", staticRoute.Spec.Subnet)
+			continue
+		}
+
+		for _, podCidr := range podCidrs {
+			rule := fmt.Sprintf("-s %s -d %s -j SNAT --to-source %s", podCidr, subnet.String(), overlayIp.String())
+			if !seen[rule] {
+				rules = append(rules, rule)
+				seen[rule] = true
+			}
+		}
+	}
+
+	return rules, nil
+}
+
+// podCidrs returns the CIDRs in POD_CIDR, e.g. "172.30.0.0/16", or the node's pod CIDR if it isn't set
+func (r *ReconcileSnat) podCidrs() ([]string, error) {
+	cidrs := []string{}
+	for _, cidr := range strings.Split(os.Getenv("POD_CIDR"), ",") {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid POD_CIDR entry %q", cidr)
+		}
+
+		cidrs = append(cidrs, ipNet.String())
+	}
+
+	if len(cidrs) > 0 {
+		return cidrs, nil
+	}
+
+	node := &corev1.Node{}
+	err := r.client.Get(context.TODO(), types.NamespacedName{Name: r.options.Hostname}, node)
+	if err != nil {
+		return nil, err
+	}
+
+	_, ipNet, err := net.ParseCIDR(node.Spec.PodCIDR)
+	if err != nil {
+		return nil, fmt.Errorf("POD_CIDR is not set and node %s has no pod CIDR", r.options.Hostname)
+	}
+
+	return []string{ipNet.String()}, nil
+}
+
+// ensureChain creates the SNAT chain and keeps the jump to it as the first rule in POSTROUTING, so it's
+// evaluated before masquerade rules that other agents insert at the top of POSTROUTING after it was added
+func ensureChain() error {
+	out, code, err := util.ExecIptablesCmd(fmt.Sprintf("-t nat -S %s", snatChain))
+	if err != nil {
+		return err
+	}
+
+	if code != 0 {
+		log.Info("Creating SNAT chain", "chain", snatChain)
+		out, code, err = util.ExecIptablesCmd(fmt.Sprintf("-t nat -N %s", snatChain))
+		if err != nil {
+			return err
+		}
+
+		if code != 0 {
+			return fmt.Errorf("Error executing \"iptables -N\", output: %s", out)
+		}
+	}
+
+	out, code, err = util.ExecIptablesCmd("-t nat -S POSTROUTING")
+	if err != nil {
+		return err
+	}
+
+	if code != 0 {
+		return fmt.Errorf("Error executing \"iptables -S\", output: %s", out)
+	}
+
+	first, jumps := jumpPosition(out)
+	if first && jumps == 1 {
+		return nil
+	}
+
+	if jumps > 0 {
+		log.Info("Moving jump to SNAT chain to the top of POSTROUTING", "chain", snatChain)
+	} else {
+		log.Info("Adding jump to SNAT chain", "chain", snatChain)
+	}
+
+	for i := 0; i < jumps; i++ {
+		out, code, err = util.ExecIptablesCmd(fmt.Sprintf("-t nat -D POSTROUTING -j %s", snatChain))
+		if err != nil {
+			return err
+		}
+
+		if code != 0 {
+			return fmt.Errorf("Error executing \"iptables -D\", output: %s", out)
+		}
+	}
+
+	out, code, err = util.ExecIptablesCmd(fmt.Sprintf("-t nat -I POSTROUTING 1 -j %s", snatChain))
+	if err != nil {
+		return err
+	}
+
+	if code != 0 {
+		return fmt.Errorf("Error executing \"iptables -I\", output: %s", out)
+	}
+
+	return nil
+}
+
+// jumpPosition returns whether the first rule in the "iptables -S POSTROUTING" output is the jump to the SNAT
+// chain, and how many jumps to it there are
+func jumpPosition(out string) (bool, int) {
+	jump := fmt.Sprintf("-A POSTROUTING -j %s", snatChain)
+	first := false
+	jumps := 0
+	rules := 0
+	for _, line := range strings.Split(out, "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, "-A POSTROUTING ") {
+			continue
+		}
+
+		if line == jump {
+			if rules == 0 {
+				first = true
+			}
+			jumps++
+		}
+		rules++
+	}
+
+	return first, jumps
+}
+
+// currentRules returns the rules in the SNAT chain, without the "-A OVERLAY-SNAT" prefix
+func currentRules() (map[string]bool, error) {
+	out, code, err := util.ExecIptablesCmd(fmt.Sprintf("-t nat -S %s", snatChain))
+	if err != nil {
+		return nil, err
+	}
+
+	if code != 0 {
+		return nil, fmt.Errorf("Error executing \"iptables -S\", output: %s", out)
+	}
+
+	prefix := fmt.Sprintf("-A %s ", snatChain)
+	rules := map[string]bool{}
+	for _, line := range strings.Split(out, "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, prefix) {
+			continue
+		}
+
+		rules[strings.TrimPrefix(line, prefix)] = true
+	}
+
+	return rules, nil
+}
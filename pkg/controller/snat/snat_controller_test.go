@@ -0,0 +1,62 @@
+package snat
+
+import (
+	"testing"
+)
+
+func TestJumpPosition(t *testing.T) {
+	tests := []struct {
+		name  string
+		out   string
+		first bool
+		jumps int
+	}{
+		{
+			name: "first",
+			out: `-P POSTROUTING ACCEPT
+-A POSTROUTING -j OVERLAY-SNAT
+-A POSTROUTING -m comment --comment "kubernetes postrouting rules" -j KUBE-POSTROUTING
+-A POSTROUTING -s 172.30.0.0/16 ! -o cali+ -j MASQUERADE`,
+			first: true,
+			jumps: 1,
+		},
+		{
+			name: "behind another rule",
+			out: `-P POSTROUTING ACCEPT
+-A POSTROUTING -m comment --comment "cali:O3lYWMrLQYEMJtB5" -j cali-POSTROUTING
+-A POSTROUTING -j OVERLAY-SNAT
+-A POSTROUTING -m comment --comment "kubernetes postrouting rules" -j KUBE-POSTROUTING`,
+			first: false,
+			jumps: 1,
+		},
+		{
+			name: "duplicated",
+			out: `-P POSTROUTING ACCEPT
+-A POSTROUTING -j OVERLAY-SNAT
+-A POSTROUTING -m comment --comment "kubernetes postrouting rules" -j KUBE-POSTROUTING
+-A POSTROUTING -j OVERLAY-SNAT`,
+			first: true,
+			jumps: 2,
+		},
+		{
+			name: "missing",
+			out: `-P POSTROUTING ACCEPT
+-A POSTROUTING -m comment --comment "kubernetes postrouting rules" -j KUBE-POSTROUTING`,
+			first: false,
+			jumps: 0,
+		},
+		{
+			name:  "empty chain",
+			out:   `-P POSTROUTING ACCEPT`,
+			first: false,
+			jumps: 0,
+		},
+	}
+
+	for _, test := range tests {
+		first, jumps := jumpPosition(test.out)
+		if first != test.first || jumps != test.jumps {
+			t.Errorf("%s: expected first %v and %d jumps, got first %v and %d jumps", test.name, test.first, test.jumps, first, jumps)
+		}
+	}
+}
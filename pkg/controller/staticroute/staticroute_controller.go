@@ -3,16 +3,24 @@ package staticroute
 import (
 	"context"
 	"fmt"
+	"net"
+	"os"
 	"regexp"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/jkwong888/iks-overlay-ip-controller/pkg/metrics"
 	"github.com/jkwong888/iks-overlay-ip-controller/pkg/util"
 	iksv1alpha1 "github.com/jkwong888/iks-overlay-ip-controller/pkg/apis/iks/v1alpha1"
 	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/event"
 	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/manager"
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
@@ -22,25 +30,39 @@ import (
 
 var log = logf.Log.WithName("controller_staticroute")
 
+// probe the path MTU to the subnets if PMTU_PROBE is "true", and how often
+var probePathMtu = os.Getenv("PMTU_PROBE") == "true"
+var probeInterval = 5 * time.Minute
+
 type ManagerOptions struct {
 	Hostname string
 	Zone string
 	HasNodeOverlayIpCR bool
+	HasEgressGatewayCR bool
 }
 
 // Add creates a new StaticRoute Controller and adds it to the Manager. The Manager will set fields on the Controller
 // and Start it when the Manager is Started.
 func Add(mgr manager.Manager, options ManagerOptions) error {
-	return add(mgr, newReconciler(mgr, options))
+	probed := make(chan event.GenericEvent)
+	return add(mgr, newReconciler(mgr, options, probed), options, probed)
 }
 
 // newReconciler returns a new reconcile.Reconciler
-func newReconciler(mgr manager.Manager, options ManagerOptions) reconcile.Reconciler {
-	return &ReconcileStaticRoute{client: mgr.GetClient(), scheme: mgr.GetScheme(), options: options}
+func newReconciler(mgr manager.Manager, options ManagerOptions, probed chan<- event.GenericEvent) reconcile.Reconciler {
+	return &ReconcileStaticRoute{
+		client:   mgr.GetClient(),
+		scheme:   mgr.GetScheme(),
+		recorder: mgr.GetRecorder("staticroute-controller"),
+		options:  options,
+		prober: util.NewPathMtuProber(probeInterval, func(name string) {
+			probed <- event.GenericEvent{Meta: &metav1.ObjectMeta{Name: name}}
+		}),
+	}
 }
 
 // add adds a new Controller to mgr with r as the reconcile.Reconciler
-func add(mgr manager.Manager, r reconcile.Reconciler) error {
+func add(mgr manager.Manager, r reconcile.Reconciler, options ManagerOptions, probed <-chan event.GenericEvent) error {
 	// Create a new controller
 	c, err := controller.New("staticroute-controller", mgr, controller.Options{Reconciler: r})
 	if err != nil {
@@ -53,6 +75,64 @@ func add(mgr manager.Manager, r reconcile.Reconciler) error {
 		return err
 	}
 
+	// the path MTUs are probed in the background, update the status of a route when its probe finishes
+	err = c.Watch(&source.Channel{Source: probed}, &handler.EnqueueRequestForObject{})
+	if err != nil {
+		return err
+	}
+
+	if !options.HasNodeOverlayIpCR {
+		return nil
+	}
+
+	// routes are lost when the overlay device is recreated, and the gateway may change with this
+	// node's overlay IP, so reconcile all static routes when it changes
+	mgrClient := mgr.GetClient()
+	allRoutes := func() []reconcile.Request {
+		routes := &iksv1alpha1.StaticRouteList{}
+		err := mgrClient.List(context.TODO(), &client.ListOptions{}, routes)
+		if err != nil {
+			log.Error(err, "Failed to list StaticRoutes")
+			return nil
+		}
+
+		requests := []reconcile.Request{}
+		for _, route := range routes.Items {
+			requests = append(requests, reconcile.Request{
+				NamespacedName: types.NamespacedName{Name: route.Name},
+			})
+		}
+
+		return requests
+	}
+
+	err = c.Watch(&source.Kind{Type: &iksv1alpha1.NodeOverlayIp{}}, &handler.EnqueueRequestsFromMapFunc{
+		ToRequests: handler.ToRequestsFunc(func(a handler.MapObject) []reconcile.Request {
+			if a.Meta.GetName() != options.Hostname {
+				return nil
+			}
+
+			return allRoutes()
+		}),
+	})
+	if err != nil {
+		return err
+	}
+
+	if !options.HasEgressGatewayCR {
+		return nil
+	}
+
+	// nodes without an overlay IP route through the active egress gateway, which changes on failover
+	err = c.Watch(&source.Kind{Type: &iksv1alpha1.OverlayEgressGateway{}}, &handler.EnqueueRequestsFromMapFunc{
+		ToRequests: handler.ToRequestsFunc(func(a handler.MapObject) []reconcile.Request {
+			return allRoutes()
+		}),
+	})
+	if err != nil {
+		return err
+	}
+
 	return nil
 }
 
@@ -65,7 +145,9 @@ type ReconcileStaticRoute struct {
 	// that reads objects from the cache and writes to the apiserver
 	client client.Client
 	scheme *runtime.Scheme
+	recorder record.EventRecorder
 	options ManagerOptions
+	prober *util.PathMtuProber
 }
 
 // Reconcile reads that state of the cluster for a StaticRoute object and makes changes based on the state read
@@ -92,6 +174,15 @@ func (r *ReconcileStaticRoute) Reconcile(request reconcile.Request) (reconcile.R
 		return reconcile.Result{}, err
 	}
 
+	// in dry-run mode the route changes are recorded in the plan and published as events instead of made, and the
+	// status isn't updated as the routes aren't applied
+	plan := util.NewPlan()
+	if util.DryRun() {
+		defer func() {
+			util.PublishPlan(r.recorder, instance, plan.Steps())
+		}()
+	}
+
 	// Add finalizer for this CR
 	reqLogger.Info("Adding Finalizer for the StaticRoute")
 	if err := r.addFinalizer(instance); err != nil {
@@ -102,11 +193,23 @@ func (r *ReconcileStaticRoute) Reconcile(request reconcile.Request) (reconcile.R
 	isDeleted := instance.GetDeletionTimestamp() != nil
 	if isDeleted {
 		// handle finalizer -- first delete static route
-		err := delStaticRoute(instance.Spec.Subnet)
+		err := delStaticRoute(plan, instance.Spec.Subnet)
 		if err != nil {
 			return reconcile.Result{}, err
 		}
 
+		for _, val := range instance.Status.NodeStatus {
+			if val.Hostname == r.options.Hostname {
+				metrics.AgentRouteInstalled.DeleteLabelValues(instance.Spec.Subnet, val.Gateway)
+			}
+		}
+
+		r.prober.Forget(instance.Name)
+
+		if util.DryRun() {
+			return reconcile.Result{}, nil
+		}
+
 		if len(instance.Status.NodeStatus) > 0 {
 			// remove myself from the status list
 			removeFromStatus(instance, r.options.Hostname)
@@ -142,6 +245,20 @@ func (r *ReconcileStaticRoute) Reconcile(request reconcile.Request) (reconcile.R
 	}
 
 	gateway := instance.Spec.Gateway
+	src := ""
+	if r.options.HasNodeOverlayIpCR && r.options.HasEgressGatewayCR {
+		// nodes without an overlay IP route through the egress gateway node over the private network
+		egressGateway, err := r.getEgressGateway()
+		if err != nil {
+			return reconcile.Result{}, err
+		}
+
+		if egressGateway != "" {
+			reqLogger.Info("Routing through egress gateway", "gateway", egressGateway)
+			gateway = egressGateway
+		}
+	}
+
 	if gateway == "" && r.options.HasNodeOverlayIpCR {
 		// if the NodeOverlayIp CR is available, we can query this node's IP and possibly get its gateway
 		nodeOverlayIp := &iksv1alpha1.NodeOverlayIp{}
@@ -152,9 +269,21 @@ func (r *ReconcileStaticRoute) Reconcile(request reconcile.Request) (reconcile.R
 			return reconcile.Result{Requeue: true}, nil
 		}
 
+		if nodeOverlayIp.Status.LinkType == "dummy" {
+			// a dummy device isn't attached to the overlay subnet, so route through the private network
+			// gateway and source the traffic from the overlay IP
+			src = strings.Split(nodeOverlayIp.Status.IpAddr, "/")[0]
+			if src == "" {
+				reqLogger.Info("NodeOverlayIp has no IP in status yet, requeuing", "node", r.options.Hostname)
+				return reconcile.Result{Requeue: true}, nil
+			}
+		}
+
 		// the NodeOverlayIp has an optional Gateway in the spec, grab this if it exists
 		gateway = nodeOverlayIp.Status.Gateway
-		if gateway == "" {
+		if src != "" {
+			gateway = ""
+		} else if gateway == "" {
 			// gateway may not be set yet, requeue immediately
 			reqLogger.Info("NodeOverlayIp has no gateway in status yet, requeuing", "node", r.options.Hostname)
 			return reconcile.Result{Requeue: true}, nil
@@ -172,17 +301,31 @@ func (r *ReconcileStaticRoute) Reconcile(request reconcile.Request) (reconcile.R
 		}
 	}
 
-	err = addStaticRoute(instance.Spec.Subnet, gateway)
+	err = addStaticRoute(plan, instance.Spec.Subnet, gateway, src, instance.Spec.Mtu)
 	if err != nil {
 		return reconcile.Result{}, err
 	}
 
+	metrics.AgentRouteInstalled.WithLabelValues(instance.Spec.Subnet, gateway).Set(1)
+
 	device, err := getRouteDevice(instance.Spec.Subnet)
 	if err != nil {
 		return reconcile.Result{}, err
 	}
 
-	addToStatus(instance, r.options.Hostname, device, gateway)
+	pathMtu := 0
+	if probePathMtu {
+		pathMtu, err = r.probeSubnet(instance, device)
+		if err != nil {
+			reqLogger.Error(err, "Failed to probe the path MTU to the subnet", "subnet", instance.Spec.Subnet)
+		}
+	}
+
+	if util.DryRun() {
+		return reconcile.Result{}, nil
+	}
+
+	addToStatus(instance, r.options.Hostname, device, gateway, pathMtu)
 
 	reqLogger.Info("Update the StaticRoute status", "staticroute", instance)
 	err = r.client.Status().Update(context.TODO(), instance)
@@ -191,19 +334,80 @@ func (r *ReconcileStaticRoute) Reconcile(request reconcile.Request) (reconcile.R
 		return reconcile.Result{}, err
 	}
 
+	if probePathMtu {
+		return reconcile.Result{RequeueAfter: probeInterval}, nil
+	}
+
 	return reconcile.Result{}, nil
 }
 
-func addToStatus(m *iksv1alpha1.StaticRoute, hostname string, device string, gateway string) {
+// probeSubnet returns the last path MTU probed to the probe IP of the StaticRoute, up to the MTU of the route, and
+// probes it again in the background if the result is stale
+func (r *ReconcileStaticRoute) probeSubnet(instance *iksv1alpha1.StaticRoute, device string) (int, error) {
+	ip := instance.Spec.ProbeIp
+	if ip == "" {
+		_, subnet, err := net.ParseCIDR(instance.Spec.Subnet)
+		if err != nil {
+			return 0, err
+		}
+
+		// the first address in the subnet, usually its router
+		first := make(net.IP, len(subnet.IP))
+		copy(first, subnet.IP)
+		first[len(first)-1]++
+		ip = first.String()
+	}
+
+	maxMtu := instance.Spec.Mtu
+	if maxMtu == 0 {
+		mtu, err := util.LinkMtu(device)
+		if err != nil {
+			return 0, err
+		}
+		maxMtu = mtu
+	}
+
+	return r.prober.PathMtu(instance.Name, device, ip, maxMtu), nil
+}
+
+// getEgressGateway returns the private IP of the active egress gateway node for this node's zone if this node has
+// no overlay IP, or "" if it routes through its own overlay IP
+func (r *ReconcileStaticRoute) getEgressGateway() (string, error) {
+	nodeOverlayIp := &iksv1alpha1.NodeOverlayIp{}
+	err := r.client.Get(context.TODO(), types.NamespacedName{Name: r.options.Hostname}, nodeOverlayIp)
+	if err == nil {
+		return "", nil
+	} else if !errors.IsNotFound(err) {
+		return "", err
+	}
+
+	gateways := &iksv1alpha1.OverlayEgressGatewayList{}
+	err = r.client.List(context.TODO(), &client.ListOptions{}, gateways)
+	if err != nil {
+		return "", err
+	}
+
+	for _, gateway := range gateways.Items {
+		if gateway.AppliesToZone(r.options.Zone) && gateway.Status.NodeIp != "" && gateway.Status.Node != r.options.Hostname {
+			return gateway.Status.NodeIp, nil
+		}
+	}
+
+	return "", nil
+}
+
+func addToStatus(m *iksv1alpha1.StaticRoute, hostname string, device string, gateway string, pathMtu int) {
 	// Update the status if necessary
 	foundStatus := false
-	for _, val := range m.Status.NodeStatus {
+	for i := range m.Status.NodeStatus {
+		val := &m.Status.NodeStatus[i]
 		if val.Hostname != hostname {
 			continue
 		}
 
 		val.Gateway = gateway
 		val.Device = device
+		val.PathMtu = pathMtu
 		foundStatus = true
 		break
 	}
@@ -213,6 +417,7 @@ func addToStatus(m *iksv1alpha1.StaticRoute, hostname string, device string, gat
 			Hostname: hostname,
 			Gateway: gateway,
 			Device: device,
+			PathMtu: pathMtu,
 		})
 	}
 }
@@ -238,9 +443,10 @@ func removeFromStatus(m *iksv1alpha1.StaticRoute, hostname string) {
 	m.Status = newStatus
 }
 
-//addFinalizer will add this attribute to the CR
+//addFinalizer will add this attribute to the CR, except in dry-run mode where the route is never removed on deletion
+//and the finalizer would block it
 func (r *ReconcileStaticRoute) addFinalizer(m *iksv1alpha1.StaticRoute) error {
-    if len(m.GetFinalizers()) < 1 && m.GetDeletionTimestamp() == nil {
+    if len(m.GetFinalizers()) < 1 && m.GetDeletionTimestamp() == nil && !util.DryRun() {
         m.SetFinalizers([]string{"finalizer.iks.ibm.com"})
 
         // Update CR
@@ -279,7 +485,7 @@ func getFallbackGateway() (string, error) {
 	return myGateway, nil
 }
 
-func addStaticRoute(subnet string, gateway string) (error) {
+func addStaticRoute(plan *util.Plan, subnet string, gateway string, src string, mtu int) (error) {
 	// check if route already exists
 	out, code, err := util.ExecIpCmd(fmt.Sprintf("route show %s", subnet))
 	if err != nil {
@@ -287,18 +493,32 @@ func addStaticRoute(subnet string, gateway string) (error) {
 	}
 
 	re := regexp.MustCompile(`(?s).*via ([^\s]*) .*`)
+	srcRe := regexp.MustCompile(`(?s).*src ([^\s]*) .*`)
+	mtuRe := regexp.MustCompile(`(?s).*mtu (?:lock )?([0-9]+).*`)
 
 	// if route exists already
 	if out != "" {
 		currGateway := re.ReplaceAllString(out, "$1")
 
-		if currGateway == gateway {
+		currSrc := ""
+		if srcRe.MatchString(out) {
+			currSrc = srcRe.ReplaceAllString(out, "$1")
+		}
+
+		currMtu := 0
+		if mtuRe.MatchString(out) {
+			currMtu, _ = strconv.Atoi(mtuRe.ReplaceAllString(out, "$1"))
+		}
+
+		if currGateway == gateway && currSrc == src && currMtu == mtu {
 			log.Info(fmt.Sprintf("Route for %s via %s already exists", subnet, gateway))
 			return nil
 		}
 
-		// delete the route if the gateway doesn't match
-		out, code, err := util.ExecIpCmd(fmt.Sprintf("route del %s via %s", subnet, currGateway))
+		// delete the route if the gateway, source or MTU doesn't match
+		metrics.AgentDriftCorrections.WithLabelValues("route").Inc()
+		metrics.AgentRouteInstalled.DeleteLabelValues(subnet, currGateway)
+		out, code, err := plan.ExecIpCmd(fmt.Sprintf("route del %s via %s", subnet, currGateway))
 		if err != nil {
 			return err
 		}
@@ -309,7 +529,16 @@ func addStaticRoute(subnet string, gateway string) (error) {
 	}
 
 	// add the new route
-	out, code, err = util.ExecIpCmd(fmt.Sprintf("route add %s via %s", subnet, gateway))
+	cmd := fmt.Sprintf("route add %s via %s", subnet, gateway)
+	if src != "" {
+		cmd = fmt.Sprintf("%s src %s", cmd, src)
+	}
+
+	if mtu != 0 {
+		cmd = fmt.Sprintf("%s mtu %d", cmd, mtu)
+	}
+
+	out, code, err = plan.ExecIpCmd(cmd)
 	if err != nil {
 		return err
 	}
@@ -321,7 +550,7 @@ func addStaticRoute(subnet string, gateway string) (error) {
 	return nil
 }
 
-func delStaticRoute(subnet string) (error) {
+func delStaticRoute(plan *util.Plan, subnet string) (error) {
 	// check if route already exists
 	out, code, err := util.ExecIpCmd(fmt.Sprintf("route show %s", subnet))
 	if err != nil {
@@ -335,7 +564,7 @@ func delStaticRoute(subnet string) (error) {
 	}
 
 	// delete the route 
-	out, code, err = util.ExecIpCmd(fmt.Sprintf("route del %s", strings.TrimSuffix(out, " \n")))
+	out, code, err = plan.ExecIpCmd(fmt.Sprintf("route del %s", strings.TrimSuffix(out, " \n")))
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,222 @@
+package vxlan
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"strings"
+
+	iksv1alpha1 "github.com/jkwong888/iks-overlay-ip-controller/pkg/apis/iks/v1alpha1"
+	nodeoverlayip "github.com/jkwong888/iks-overlay-ip-controller/pkg/controller/nodeoverlayip-pod"
+	"github.com/jkwong888/iks-overlay-ip-controller/pkg/util"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	logf "sigs.k8s.io/controller-runtime/pkg/runtime/log"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+)
+
+var log = logf.Log.WithName("controller_vxlan")
+
+// the all-zeros MAC address sends broadcast and unknown unicast traffic to every remote VTEP
+const floodMac = "00:00:00:00:00:00"
+
+type ManagerOptions struct {
+	Hostname string
+}
+
+// Add creates a new VXLAN Controller and adds it to the Manager. The Manager will set fields on the Controller
+// and Start it when the Manager is Started.
+func Add(mgr manager.Manager, options ManagerOptions) error {
+	return add(mgr, newReconciler(mgr, options), options)
+}
+
+// newReconciler returns a new reconcile.Reconciler
+func newReconciler(mgr manager.Manager, options ManagerOptions) reconcile.Reconciler {
+	return &ReconcileVxlan{client: mgr.GetClient(), scheme: mgr.GetScheme(), options: options}
+}
+
+// add adds a new Controller to mgr with r as the reconcile.Reconciler
+func add(mgr manager.Manager, r reconcile.Reconciler, options ManagerOptions) error {
+	// Create a new controller
+	c, err := controller.New("vxlan-controller", mgr, controller.Options{Reconciler: r})
+	if err != nil {
+		return err
+	}
+
+	// any NodeOverlayIp coming or going changes the remote VTEPs of this node
+	err = c.Watch(&source.Kind{Type: &iksv1alpha1.NodeOverlayIp{}}, &handler.EnqueueRequestsFromMapFunc{
+		ToRequests: handler.ToRequestsFunc(func(a handler.MapObject) []reconcile.Request {
+			return []reconcile.Request{
+				{NamespacedName: types.NamespacedName{Name: options.Hostname}},
+			}
+		}),
+	})
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// blank assignment to verify that ReconcileVxlan implements reconcile.Reconciler
+var _ reconcile.Reconciler = &ReconcileVxlan{}
+
+// ReconcileVxlan reconciles the forwarding database of this node's vxlan overlay device
+type ReconcileVxlan struct {
+	// This client, initialized using mgr.Client() above, is a split client
+	// that reads objects from the cache and writes to the apiserver
+	client client.Client
+	scheme *runtime.Scheme
+	options ManagerOptions
+}
+
+// Reconcile fills the forwarding database of this node's vxlan device with the underlay IPs of the other
+// nodes in the same overlay subnet, and with the static remote VTEPs in VXLAN_REMOTE_VTEPS.
+// Note:
+// The Controller will requeue the Request to be processed again if the returned error is non-nil or
+// Result.Requeue is true, otherwise upon completion it will remove the work from the queue.
+func (r *ReconcileVxlan) Reconcile(request reconcile.Request) (reconcile.Result, error) {
+	reqLogger := log.WithValues("Request.Name", request.Name)
+
+	// Fetch this node's NodeOverlayIp instance
+	instance := &iksv1alpha1.NodeOverlayIp{}
+	err := r.client.Get(context.TODO(), types.NamespacedName{Name: r.options.Hostname}, instance)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return reconcile.Result{}, nil
+		}
+		// Error reading the object - requeue the request.
+		return reconcile.Result{}, err
+	}
+
+	if instance.Status.LinkType != nodeoverlayip.LinkTypeVxlan || instance.Status.InterfaceLabel == "" || instance.Status.IpAddr == "" {
+		// not a vxlan overlay, or the device isn't configured yet
+		return reconcile.Result{}, nil
+	}
+
+	reqLogger.Info("Reconciling VXLAN forwarding database", "device", instance.Status.InterfaceLabel)
+
+	remotes, err := r.remoteVteps(instance)
+	if err != nil {
+		return reconcile.Result{}, err
+	}
+
+	err = syncFdb(instance.Status.InterfaceLabel, remotes)
+	if err != nil {
+		return reconcile.Result{}, err
+	}
+
+	return reconcile.Result{}, nil
+}
+
+// remoteVteps returns the underlay IPs of the other vxlan nodes in the same overlay subnet as instance,
+// and the static remote VTEPs
+func (r *ReconcileVxlan) remoteVteps(instance *iksv1alpha1.NodeOverlayIp) (map[string]bool, error) {
+	remotes := map[string]bool{}
+
+	for _, vtep := range strings.Split(os.Getenv("VXLAN_REMOTE_VTEPS"), ",") {
+		vtep = strings.TrimSpace(vtep)
+		if vtep == "" {
+			continue
+		}
+
+		if net.ParseIP(vtep) == nil {
+			return nil, fmt.Errorf("Invalid VXLAN_REMOTE_VTEPS entry %q", vtep)
+		}
+
+		remotes[vtep] = true
+	}
+
+	_, mySubnet, err := net.ParseCIDR(instance.Status.IpAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	nodeOverlayIps := &iksv1alpha1.NodeOverlayIpList{}
+	err = r.client.List(context.TODO(), &client.ListOptions{}, nodeOverlayIps)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, nodeOverlayIp := range nodeOverlayIps.Items {
+		if nodeOverlayIp.Name == instance.Name || nodeOverlayIp.GetDeletionTimestamp() != nil {
+			continue
+		}
+
+		if nodeOverlayIp.Status.LinkType != nodeoverlayip.LinkTypeVxlan || nodeOverlayIp.Status.UnderlayIp == "" {
+			continue
+		}
+
+		_, subnet, err := net.ParseCIDR(nodeOverlayIp.Status.IpAddr)
+		if err != nil || subnet.String() != mySubnet.String() {
+			// not on the same overlay network
+			continue
+		}
+
+		remotes[nodeOverlayIp.Status.UnderlayIp] = true
+	}
+
+	delete(remotes, instance.Status.UnderlayIp)
+
+	return remotes, nil
+}
+
+// syncFdb makes the flood entries of the device match remotes
+func syncFdb(device string, remotes map[string]bool) error {
+	out, code, err := util.ExecBridgeCmd(fmt.Sprintf("fdb show dev %s", device))
+	if err != nil {
+		return err
+	}
+
+	if code != 0 {
+		return fmt.Errorf("Error executing \"bridge fdb show\", output: %s", out)
+	}
+
+	current := map[string]bool{}
+	re := regexp.MustCompile(`(?m)^` + floodMac + ` .*dst (\S+)`)
+	for _, m := range re.FindAllStringSubmatch(out, -1) {
+		current[m[1]] = true
+	}
+
+	for remote := range remotes {
+		if current[remote] {
+			continue
+		}
+
+		log.Info(fmt.Sprintf("Adding remote VTEP %s to device %s", remote, device))
+		out, code, err := util.ExecBridgeCmd(fmt.Sprintf("fdb append %s dev %s dst %s", floodMac, device, remote))
+		if err != nil {
+			return err
+		}
+
+		if code != 0 {
+			return fmt.Errorf("Error executing \"bridge fdb append\", output: %s", out)
+		}
+	}
+
+	for remote := range current {
+		if remotes[remote] {
+			continue
+		}
+
+		log.Info(fmt.Sprintf("Removing remote VTEP %s from device %s", remote, device))
+		out, code, err := util.ExecBridgeCmd(fmt.Sprintf("fdb del %s dev %s dst %s", floodMac, device, remote))
+		if err != nil {
+			return err
+		}
+
+		if code != 0 {
+			return fmt.Errorf("Error executing \"bridge fdb del\", output: %s", out)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,204 @@
+package wireguard
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	iksv1alpha1 "github.com/jkwong888/iks-overlay-ip-controller/pkg/apis/iks/v1alpha1"
+	nodeoverlayip "github.com/jkwong888/iks-overlay-ip-controller/pkg/controller/nodeoverlayip-pod"
+	"github.com/jkwong888/iks-overlay-ip-controller/pkg/util"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	logf "sigs.k8s.io/controller-runtime/pkg/runtime/log"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+)
+
+var log = logf.Log.WithName("controller_wireguard")
+
+type ManagerOptions struct {
+	Hostname string
+}
+
+// Add creates a new Wireguard Controller and adds it to the Manager. The Manager will set fields on the Controller
+// and Start it when the Manager is Started.
+func Add(mgr manager.Manager, options ManagerOptions) error {
+	return add(mgr, newReconciler(mgr, options), options)
+}
+
+// newReconciler returns a new reconcile.Reconciler
+func newReconciler(mgr manager.Manager, options ManagerOptions) reconcile.Reconciler {
+	return &ReconcileWireguard{client: mgr.GetClient(), scheme: mgr.GetScheme(), options: options}
+}
+
+// add adds a new Controller to mgr with r as the reconcile.Reconciler
+func add(mgr manager.Manager, r reconcile.Reconciler, options ManagerOptions) error {
+	// Create a new controller
+	c, err := controller.New("wireguard-controller", mgr, controller.Options{Reconciler: r})
+	if err != nil {
+		return err
+	}
+
+	// Watch for changes to primary resource WireguardConfig
+	err = c.Watch(&source.Kind{Type: &iksv1alpha1.WireguardConfig{}}, &handler.EnqueueRequestForObject{})
+	if err != nil {
+		return err
+	}
+
+	// the peers are lost when this node's wireguard device is recreated
+	isMyNode := predicate.Funcs{
+		CreateFunc:  func(e event.CreateEvent) bool { return e.Meta.GetName() == options.Hostname },
+		UpdateFunc:  func(e event.UpdateEvent) bool { return e.MetaNew.GetName() == options.Hostname },
+		DeleteFunc:  func(e event.DeleteEvent) bool { return false },
+		GenericFunc: func(e event.GenericEvent) bool { return e.Meta.GetName() == options.Hostname },
+	}
+	err = c.Watch(&source.Kind{Type: &iksv1alpha1.NodeOverlayIp{}}, &handler.EnqueueRequestsFromMapFunc{
+		ToRequests: handler.ToRequestsFunc(func(a handler.MapObject) []reconcile.Request {
+			return []reconcile.Request{
+				{NamespacedName: types.NamespacedName{Name: iksv1alpha1.WireguardConfigName}},
+			}
+		}),
+	}, isMyNode)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// blank assignment to verify that ReconcileWireguard implements reconcile.Reconciler
+var _ reconcile.Reconciler = &ReconcileWireguard{}
+
+// ReconcileWireguard reconciles the peers of this node's wireguard overlay device
+type ReconcileWireguard struct {
+	// This client, initialized using mgr.Client() above, is a split client
+	// that reads objects from the cache and writes to the apiserver
+	client client.Client
+	scheme *runtime.Scheme
+	options ManagerOptions
+}
+
+// Reconcile configures the peers in the WireguardConfig on this node's wireguard device, and removes any
+// peers that are no longer in it.
+// Note:
+// The Controller will requeue the Request to be processed again if the returned error is non-nil or
+// Result.Requeue is true, otherwise upon completion it will remove the work from the queue.
+func (r *ReconcileWireguard) Reconcile(request reconcile.Request) (reconcile.Result, error) {
+	reqLogger := log.WithValues("Request.Name", request.Name)
+
+	if request.Name != iksv1alpha1.WireguardConfigName {
+		return reconcile.Result{}, nil
+	}
+
+	// Fetch this node's NodeOverlayIp instance
+	nodeOverlayIp := &iksv1alpha1.NodeOverlayIp{}
+	err := r.client.Get(context.TODO(), types.NamespacedName{Name: r.options.Hostname}, nodeOverlayIp)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return reconcile.Result{}, nil
+		}
+		// Error reading the object - requeue the request.
+		return reconcile.Result{}, err
+	}
+
+	device := nodeOverlayIp.Status.InterfaceLabel
+	if nodeOverlayIp.Status.LinkType != nodeoverlayip.LinkTypeWireguard || device == "" {
+		// not a wireguard overlay, or the device isn't created yet
+		return reconcile.Result{}, nil
+	}
+
+	// Fetch the WireguardConfig instance
+	instance := &iksv1alpha1.WireguardConfig{}
+	err = r.client.Get(context.TODO(), request.NamespacedName, instance)
+	if err != nil && !errors.IsNotFound(err) {
+		return reconcile.Result{}, err
+	}
+
+	reqLogger.Info("Reconciling wireguard peers", "device", device)
+
+	desired := map[string]bool{}
+	for _, peer := range instance.Spec.Peers {
+		if peer.PublicKey == nodeOverlayIp.Status.WireguardPublicKey {
+			// don't peer with myself
+			continue
+		}
+
+		err = setPeer(device, peer)
+		if err != nil {
+			return reconcile.Result{}, err
+		}
+
+		desired[peer.PublicKey] = true
+	}
+
+	current, err := getPeers(device)
+	if err != nil {
+		return reconcile.Result{}, err
+	}
+
+	for _, publicKey := range current {
+		if desired[publicKey] {
+			continue
+		}
+
+		reqLogger.Info("Removing wireguard peer", "device", device, "publicKey", publicKey)
+		out, code, err := util.ExecWgCmd(fmt.Sprintf("set %s peer %s remove", device, publicKey))
+		if err != nil {
+			return reconcile.Result{}, err
+		}
+
+		if code != 0 {
+			return reconcile.Result{}, fmt.Errorf("Error executing \"wg set\", output: %s", out)
+		}
+	}
+
+	return reconcile.Result{}, nil
+}
+
+// setPeer adds the peer to the device, or updates it if it exists
+func setPeer(device string, peer iksv1alpha1.WireguardPeer) error {
+	cmd := fmt.Sprintf("set %s peer %s", device, peer.PublicKey)
+	if peer.Endpoint != "" {
+		cmd = fmt.Sprintf("%s endpoint %s", cmd, peer.Endpoint)
+	}
+
+	if peer.PersistentKeepalive > 0 {
+		cmd = fmt.Sprintf("%s persistent-keepalive %d", cmd, peer.PersistentKeepalive)
+	}
+
+	// an empty allowed-ips clears the existing ones
+	cmd = fmt.Sprintf("%s allowed-ips %s", cmd, strings.Join(peer.AllowedIps, ","))
+
+	out, code, err := util.ExecWgCmd(cmd)
+	if err != nil {
+		return err
+	}
+
+	if code != 0 {
+		return fmt.Errorf("Error executing \"wg set\", output: %s", out)
+	}
+
+	return nil
+}
+
+// getPeers returns the public keys of the peers configured on the device
+func getPeers(device string) ([]string, error) {
+	out, code, err := util.ExecWgCmd(fmt.Sprintf("show %s peers", device))
+	if err != nil {
+		return nil, err
+	}
+
+	if code != 0 {
+		return nil, fmt.Errorf("Error executing \"wg show\", output: %s", out)
+	}
+
+	return strings.Fields(out), nil
+}
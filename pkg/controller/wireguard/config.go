@@ -0,0 +1,73 @@
+package wireguard
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+
+	ipam "github.com/jkwong888/iks-overlay-ip-controller/pkg/ipam"
+	"gopkg.in/yaml.v2"
+)
+
+type WireguardConfig struct {
+	WireguardConfig *WireguardConfigSpec `yaml:"wireguard,omitempty"`
+}
+
+type WireguardConfigSpec struct {
+	// interval in seconds to send keepalives to every peer, 0 to disable
+	PersistentKeepalive int `yaml:"persistentKeepalive"`
+
+	// on-premise gateways the nodes peer with
+	Peers []WireguardPeerConfig `yaml:"peers"`
+}
+
+type WireguardPeerConfig struct {
+	Name      string `yaml:"name"`
+	PublicKey string `yaml:"publicKey"`
+	Endpoint  string `yaml:"endpoint"`
+
+	// the gateway's address on the overlay network; StaticRoutes with this gateway are routed to the peer
+	Address string `yaml:"address"`
+
+	// additional subnets routed to the peer
+	AllowedIps []string `yaml:"allowedIps"`
+}
+
+// loadConfig reads the wireguard section of the controller config, returning nil if there isn't one
+func loadConfig() (*WireguardConfigSpec, error) {
+	config := &WireguardConfig{}
+
+	yamlFile, err := ioutil.ReadFile(ipam.ConfigFile)
+	if err != nil {
+		return nil, err
+	}
+
+	err = yaml.Unmarshal(yamlFile, config)
+	if err != nil {
+		return nil, err
+	}
+
+	spec := config.WireguardConfig
+	if spec == nil {
+		return nil, nil
+	}
+
+	for _, peer := range spec.Peers {
+		if peer.Name == "" || peer.PublicKey == "" {
+			return nil, fmt.Errorf("Invalid wireguard peer, name and publicKey are required")
+		}
+
+		if peer.Address != "" && net.ParseIP(peer.Address) == nil {
+			return nil, fmt.Errorf("Invalid wireguard peer %s address %q", peer.Name, peer.Address)
+		}
+
+		for _, allowedIp := range peer.AllowedIps {
+			_, _, err := net.ParseCIDR(allowedIp)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid wireguard peer %s allowedIps: %v", peer.Name, err)
+			}
+		}
+	}
+
+	return spec, nil
+}
@@ -0,0 +1,256 @@
+package wireguard
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"reflect"
+	"sort"
+
+	iksv1alpha1 "github.com/jkwong888/iks-overlay-ip-controller/pkg/apis/iks/v1alpha1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	logf "sigs.k8s.io/controller-runtime/pkg/runtime/log"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+)
+
+var log = logf.Log.WithName("controller_wireguard")
+
+// Add creates a new Wireguard Controller and adds it to the Manager. The Manager will set fields on the Controller
+// and Start it when the Manager is Started.
+func Add(mgr manager.Manager) error {
+	return add(mgr, newReconciler(mgr))
+}
+
+// newReconciler returns a new reconcile.Reconciler
+func newReconciler(mgr manager.Manager) reconcile.Reconciler {
+	return &ReconcileWireguard{client: mgr.GetClient(), scheme: mgr.GetScheme()}
+}
+
+// add adds a new Controller to mgr with r as the reconcile.Reconciler
+func add(mgr manager.Manager, r reconcile.Reconciler) error {
+	// Create a new controller
+	c, err := controller.New("wireguard-controller", mgr, controller.Options{Reconciler: r})
+	if err != nil {
+		return err
+	}
+
+	// all peers are gathered into a single WireguardConfig
+	toConfig := &handler.EnqueueRequestsFromMapFunc{
+		ToRequests: handler.ToRequestsFunc(func(a handler.MapObject) []reconcile.Request {
+			return []reconcile.Request{
+				{NamespacedName: types.NamespacedName{Name: iksv1alpha1.WireguardConfigName}},
+			}
+		}),
+	}
+
+	err = c.Watch(&source.Kind{Type: &iksv1alpha1.WireguardConfig{}}, toConfig)
+	if err != nil {
+		return err
+	}
+
+	// node peers come from NodeOverlayIps
+	err = c.Watch(&source.Kind{Type: &iksv1alpha1.NodeOverlayIp{}}, toConfig)
+	if err != nil {
+		return err
+	}
+
+	// StaticRoute subnets are routed to the on-premise peers
+	err = c.Watch(&source.Kind{Type: &iksv1alpha1.StaticRoute{}}, toConfig)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// blank assignment to verify that ReconcileWireguard implements reconcile.Reconciler
+var _ reconcile.Reconciler = &ReconcileWireguard{}
+
+// ReconcileWireguard reconciles the WireguardConfig object
+type ReconcileWireguard struct {
+	// This client, initialized using mgr.Client() above, is a split client
+	// that reads objects from the cache and writes to the apiserver
+	client client.Client
+	scheme *runtime.Scheme
+}
+
+// Reconcile gathers the wireguard peers of the overlay network, i.e. the nodes that published a public key in
+// their NodeOverlayIp status and the on-premise gateways in the controller config, into the WireguardConfig
+// that the network pods configure their wireguard devices from.
+// Note:
+// The Controller will requeue the Request to be processed again if the returned error is non-nil or
+// Result.Requeue is true, otherwise upon completion it will remove the work from the queue.
+func (r *ReconcileWireguard) Reconcile(request reconcile.Request) (reconcile.Result, error) {
+	reqLogger := log.WithValues("Request.Name", request.Name)
+
+	config, err := loadConfig()
+	if err != nil {
+		reqLogger.Error(err, "Unable to read wireguard config")
+		return reconcile.Result{}, err
+	}
+
+	peers, err := r.nodePeers(config)
+	if err != nil {
+		return reconcile.Result{}, err
+	}
+
+	if config != nil {
+		gatewayPeers, err := r.gatewayPeers(config)
+		if err != nil {
+			return reconcile.Result{}, err
+		}
+
+		peers = append(peers, gatewayPeers...)
+	}
+
+	sort.Slice(peers, func(i, j int) bool { return peers[i].Name < peers[j].Name })
+
+	found := &iksv1alpha1.WireguardConfig{}
+	err = r.client.Get(context.TODO(), types.NamespacedName{Name: iksv1alpha1.WireguardConfigName}, found)
+	if err != nil && errors.IsNotFound(err) {
+		if len(peers) == 0 {
+			// wireguard isn't in use
+			return reconcile.Result{}, nil
+		}
+
+		instance := &iksv1alpha1.WireguardConfig{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: iksv1alpha1.WireguardConfigName,
+			},
+			Spec: iksv1alpha1.WireguardConfigSpec{
+				Peers: peers,
+			},
+		}
+
+		reqLogger.Info("Creating WireguardConfig", "peers", len(peers))
+		err = r.client.Create(context.TODO(), instance)
+		if err != nil {
+			return reconcile.Result{}, err
+		}
+
+		return reconcile.Result{}, nil
+	} else if err != nil {
+		return reconcile.Result{}, err
+	}
+
+	if reflect.DeepEqual(found.Spec.Peers, peers) {
+		return reconcile.Result{}, nil
+	}
+
+	reqLogger.Info("Updating WireguardConfig", "peers", len(peers))
+	found.Spec.Peers = peers
+	err = r.client.Update(context.TODO(), found)
+	if err != nil {
+		return reconcile.Result{}, err
+	}
+
+	return reconcile.Result{}, nil
+}
+
+// nodePeers returns a peer for each node with a wireguard overlay device, reached through its underlay IP
+func (r *ReconcileWireguard) nodePeers(config *WireguardConfigSpec) ([]iksv1alpha1.WireguardPeer, error) {
+	nodeOverlayIps := &iksv1alpha1.NodeOverlayIpList{}
+	err := r.client.List(context.TODO(), &client.ListOptions{}, nodeOverlayIps)
+	if err != nil {
+		return nil, err
+	}
+
+	peers := []iksv1alpha1.WireguardPeer{}
+	for _, nodeOverlayIp := range nodeOverlayIps.Items {
+		if nodeOverlayIp.GetDeletionTimestamp() != nil || nodeOverlayIp.Status.WireguardPublicKey == "" {
+			continue
+		}
+
+		ip, _, err := net.ParseCIDR(nodeOverlayIp.Status.IpAddr)
+		if err != nil {
+			continue
+		}
+
+		peer := iksv1alpha1.WireguardPeer{
+			Name:       nodeOverlayIp.Name,
+			PublicKey:  nodeOverlayIp.Status.WireguardPublicKey,
+			AllowedIps: []string{hostCIDR(ip)},
+		}
+
+		if nodeOverlayIp.Status.UnderlayIp != "" && nodeOverlayIp.Status.WireguardListenPort != 0 {
+			peer.Endpoint = net.JoinHostPort(nodeOverlayIp.Status.UnderlayIp, fmt.Sprintf("%d", nodeOverlayIp.Status.WireguardListenPort))
+		}
+
+		if config != nil {
+			peer.PersistentKeepalive = config.PersistentKeepalive
+		}
+
+		peers = append(peers, peer)
+	}
+
+	return peers, nil
+}
+
+// gatewayPeers returns the on-premise gateways in the config.  Each StaticRoute subnet is allowed to the gateway
+// whose overlay address is the route's gateway, or to the first gateway if none matches.
+func (r *ReconcileWireguard) gatewayPeers(config *WireguardConfigSpec) ([]iksv1alpha1.WireguardPeer, error) {
+	peers := []iksv1alpha1.WireguardPeer{}
+	if len(config.Peers) == 0 {
+		return peers, nil
+	}
+
+	for _, peerConfig := range config.Peers {
+		peer := iksv1alpha1.WireguardPeer{
+			Name:                peerConfig.Name,
+			PublicKey:           peerConfig.PublicKey,
+			Endpoint:            peerConfig.Endpoint,
+			AllowedIps:          []string{},
+			PersistentKeepalive: config.PersistentKeepalive,
+		}
+
+		if peerConfig.Address != "" {
+			peer.AllowedIps = append(peer.AllowedIps, hostCIDR(net.ParseIP(peerConfig.Address)))
+		}
+
+		peer.AllowedIps = append(peer.AllowedIps, peerConfig.AllowedIps...)
+		peers = append(peers, peer)
+	}
+
+	routes := &iksv1alpha1.StaticRouteList{}
+	err := r.client.List(context.TODO(), &client.ListOptions{}, routes)
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(routes.Items, func(i, j int) bool { return routes.Items[i].Name < routes.Items[j].Name })
+
+	for _, route := range routes.Items {
+		if route.GetDeletionTimestamp() != nil {
+			continue
+		}
+
+		idx := 0
+		for i, peerConfig := range config.Peers {
+			if peerConfig.Address != "" && peerConfig.Address == route.Spec.Gateway {
+				idx = i
+				break
+			}
+		}
+
+		peers[idx].AllowedIps = append(peers[idx].AllowedIps, route.Spec.Subnet)
+	}
+
+	return peers, nil
+}
+
+// hostCIDR returns the single address CIDR of ip
+func hostCIDR(ip net.IP) string {
+	if ip.To4() != nil {
+		return fmt.Sprintf("%s/32", ip.String())
+	}
+
+	return fmt.Sprintf("%s/128", ip.String())
+}
@@ -0,0 +1,391 @@
+package diagnose
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/jkwong888/iks-overlay-ip-controller/pkg/apis"
+	iksv1alpha1 "github.com/jkwong888/iks-overlay-ip-controller/pkg/apis/iks/v1alpha1"
+	"github.com/jkwong888/iks-overlay-ip-controller/pkg/util"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// the type of the link is at the start of a line of the details, e.g. "    macvlan mode bridge"
+var linkTypeRe = regexp.MustCompile(`(?m)^\s+(macvlan|ipvlan|vlan|vxlan|wireguard|gre|ipip|dummy)\b`)
+
+// the link types without neighbor resolution, whose gateway has no ARP entry
+var noArpLinkTypes = map[string]bool{"wireguard": true, "gre": true, "ipip": true, "dummy": true}
+
+type Options struct {
+	Hostname string
+
+	// Output the report format, "text" or "json"
+	Output string
+}
+
+// Check is the result of comparing one piece of host state with what the CRs declare
+type Check struct {
+	Name     string `json:"name"`
+	Object   string `json:"object"`
+	Expected string `json:"expected,omitempty"`
+	Actual   string `json:"actual,omitempty"`
+	Ok       bool   `json:"ok"`
+	Message  string `json:"message,omitempty"`
+}
+
+// Report is the result of all checks on the node
+type Report struct {
+	Node       string  `json:"node"`
+	Checks     []Check `json:"checks"`
+	Mismatches int     `json:"mismatches"`
+}
+
+// Run compares the links, addresses, routes and rules on the host with what the node's NodeOverlayIp and the
+// StaticRoutes declare, checks the gateway answers ARP and ping, and writes the report to w.  It returns the number of
+// mismatches.
+func Run(cfg *rest.Config, options Options, w io.Writer) (int, error) {
+	if options.Output != "text" && options.Output != "json" {
+		return 0, fmt.Errorf("Invalid output format %q, expected text or json", options.Output)
+	}
+
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		return 0, err
+	}
+
+	if err := apis.AddToScheme(scheme); err != nil {
+		return 0, err
+	}
+
+	c, err := client.New(cfg, client.Options{Scheme: scheme})
+	if err != nil {
+		return 0, err
+	}
+
+	report := &Report{Node: options.Hostname, Checks: []Check{}}
+	err = diagnose(c, options.Hostname, report)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, check := range report.Checks {
+		if !check.Ok {
+			report.Mismatches++
+		}
+	}
+
+	if options.Output == "json" {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return report.Mismatches, enc.Encode(report)
+	}
+
+	printText(w, report)
+	return report.Mismatches, nil
+}
+
+func diagnose(c client.Client, hostname string, report *Report) error {
+	nodeOverlayIp := &iksv1alpha1.NodeOverlayIp{}
+	err := c.Get(context.TODO(), types.NamespacedName{Name: hostname}, nodeOverlayIp)
+	if err != nil {
+		report.add(Check{Name: "nodeoverlayip", Object: hostname, Message: err.Error()})
+		return nil
+	}
+
+	status := nodeOverlayIp.Status
+	device := status.InterfaceLabel
+	if device == "" {
+		device = os.Getenv("INTERFACE_LABEL")
+	}
+
+	if status.IpAddr == "" || status.InterfaceLabel == "" {
+		report.add(Check{Name: "nodeoverlayip", Object: hostname, Expected: "configured", Actual: "not configured",
+			Message: "the NodeOverlayIp has no IP or interface in its status yet"})
+	}
+
+	linkOk := checkLink(report, device, status)
+	if linkOk && status.IpAddr != "" {
+		checkAddr(report, device, status)
+	}
+
+	staticRoutes := &iksv1alpha1.StaticRouteList{}
+	err = c.List(context.TODO(), &client.ListOptions{}, staticRoutes)
+	if err != nil && !strings.Contains(err.Error(), "no matches for kind") {
+		return err
+	}
+
+	zone := nodeOverlayIp.GetLabels()["zone"]
+	for _, staticRoute := range staticRoutes.Items {
+		routeZone := staticRoute.GetLabels()["failure-domain.beta.kubernetes.io/zone"]
+		if (routeZone != "" && routeZone != zone) || staticRoute.GetDeletionTimestamp() != nil {
+			continue
+		}
+
+		checkRoute(report, hostname, &staticRoute)
+		if os.Getenv("EGRESS_SNAT") == "true" && status.IpAddr != "" {
+			checkSnat(report, &staticRoute, strings.Split(status.IpAddr, "/")[0])
+		}
+	}
+
+	if linkOk && status.Gateway != "" {
+		checkGateway(report, device, status)
+	}
+
+	return nil
+}
+
+// checkLink checks the overlay device exists, is up and has the link type and MTU in the status
+func checkLink(report *Report, device string, status iksv1alpha1.NodeOverlayIpStatus) bool {
+	out, code, err := util.ExecIpCmd(fmt.Sprintf("-d link show dev %s", device))
+	if err != nil || code != 0 {
+		report.add(Check{Name: "link", Object: device, Expected: "exists", Actual: "missing", Message: strings.TrimSpace(out)})
+		return false
+	}
+
+	flags := regexp.MustCompile(`<([^>]*)>`).FindStringSubmatch(out)
+	up := len(flags) > 1 && strings.Contains(","+flags[1]+",", ",UP,")
+	report.add(Check{Name: "link state", Object: device, Expected: "UP", Actual: upOrDown(up), Ok: up})
+
+	if status.LinkType != "" {
+		actual := linkType(out)
+		report.add(Check{Name: "link type", Object: device, Expected: status.LinkType, Actual: actual, Ok: actual == status.LinkType})
+	}
+
+	if status.Mtu != 0 {
+		actual := ""
+		if m := regexp.MustCompile(`mtu ([0-9]+)`).FindStringSubmatch(out); m != nil {
+			actual = m[1]
+		}
+		report.add(Check{Name: "link mtu", Object: device, Expected: strconv.Itoa(status.Mtu), Actual: actual, Ok: actual == strconv.Itoa(status.Mtu)})
+	}
+
+	return true
+}
+
+// checkAddr checks the overlay IP is set on the device
+func checkAddr(report *Report, device string, status iksv1alpha1.NodeOverlayIpStatus) {
+	expected := status.IpAddr
+	if status.LinkType == "dummy" {
+		// a dummy device only gets the host address
+		ip, _, err := net.ParseCIDR(expected)
+		if err == nil && ip.To4() != nil {
+			expected = ip.String() + "/32"
+		} else if err == nil {
+			expected = ip.String() + "/128"
+		}
+	}
+
+	out, code, err := util.ExecIpCmd(fmt.Sprintf("addr show dev %s", device))
+	if err != nil || code != 0 {
+		report.add(Check{Name: "address", Object: device, Expected: expected, Message: strings.TrimSpace(out)})
+		return
+	}
+
+	addrs := []string{}
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || (fields[0] != "inet" && fields[0] != "inet6") {
+			continue
+		}
+
+		// Service and floating IPs are set with other labels
+		if fields[0] == "inet" && fields[len(fields)-1] != device {
+			continue
+		}
+
+		if fields[0] == "inet6" && strings.HasPrefix(fields[1], "fe80:") {
+			continue
+		}
+
+		addrs = append(addrs, fields[1])
+	}
+
+	ok := false
+	for _, addr := range addrs {
+		ok = ok || addr == expected
+	}
+
+	report.add(Check{Name: "address", Object: device, Expected: expected, Actual: strings.Join(addrs, ","), Ok: ok && len(addrs) == 1})
+}
+
+// checkRoute checks the route of the StaticRoute is in the main table with the gateway and device the network pod
+// recorded in its status, and that the rules don't send the subnet's traffic anywhere else
+func checkRoute(report *Report, hostname string, staticRoute *iksv1alpha1.StaticRoute) {
+	subnet := staticRoute.Spec.Subnet
+
+	var applied *iksv1alpha1.StaticRouteNodeStatus
+	for i := range staticRoute.Status.NodeStatus {
+		if staticRoute.Status.NodeStatus[i].Hostname == hostname {
+			applied = &staticRoute.Status.NodeStatus[i]
+		}
+	}
+
+	if applied == nil {
+		report.add(Check{Name: "route", Object: subnet, Expected: "applied", Actual: "not in status",
+			Message: fmt.Sprintf("the network pod hasn't applied StaticRoute %s", staticRoute.Name)})
+		return
+	}
+
+	out, _, err := util.ExecIpCmd(fmt.Sprintf("route show %s", subnet))
+	if err != nil {
+		report.add(Check{Name: "route", Object: subnet, Message: err.Error()})
+		return
+	}
+
+	out = strings.TrimSpace(out)
+	expected := fmt.Sprintf("via %s", applied.Gateway)
+	if staticRoute.Spec.Mtu != 0 {
+		expected = fmt.Sprintf("%s mtu %d", expected, staticRoute.Spec.Mtu)
+	}
+
+	ok := out != "" && strings.Contains(out+" ", fmt.Sprintf("via %s ", applied.Gateway))
+	if staticRoute.Spec.Mtu != 0 {
+		ok = ok && regexp.MustCompile(fmt.Sprintf(`mtu (lock )?%d\b`, staticRoute.Spec.Mtu)).MatchString(out)
+	}
+
+	report.add(Check{Name: "route", Object: subnet, Expected: expected, Actual: orMissing(out), Ok: ok})
+
+	// the route the kernel picks after the rules are evaluated, for an address in the subnet
+	_, ipNet, err := net.ParseCIDR(subnet)
+	if err != nil {
+		return
+	}
+
+	out, code, err := util.ExecIpCmd(fmt.Sprintf("route get %s", ipNet.IP.String()))
+	if err != nil || code != 0 {
+		report.add(Check{Name: "route lookup", Object: subnet, Message: strings.TrimSpace(out)})
+		return
+	}
+
+	out = strings.TrimSpace(strings.Split(out, "\n")[0])
+	expected = fmt.Sprintf("via %s dev %s", applied.Gateway, applied.Device)
+	ok = strings.Contains(out+" ", fmt.Sprintf("via %s ", applied.Gateway)) && strings.Contains(out+" ", fmt.Sprintf("dev %s ", applied.Device))
+	check := Check{Name: "route lookup", Object: subnet, Expected: expected, Actual: out, Ok: ok}
+	if !ok {
+		check.Message = "a more specific route or an \"ip rule\" sends the subnet's traffic elsewhere, see \"ip rule show\""
+	}
+	report.add(check)
+}
+
+// checkSnat checks the SNAT chain has a rule for the subnet
+func checkSnat(report *Report, staticRoute *iksv1alpha1.StaticRoute, overlayIp string) {
+	_, ipNet, err := net.ParseCIDR(staticRoute.Spec.Subnet)
+	if err != nil {
+		return
+	}
+
+	expected := fmt.Sprintf("-d %s -j SNAT --to-source %s", ipNet.String(), overlayIp)
+	out, code, err := util.ExecIptablesCmd("-t nat -S OVERLAY-SNAT")
+	if err != nil || code != 0 {
+		report.add(Check{Name: "snat rule", Object: staticRoute.Spec.Subnet, Expected: expected, Actual: "missing chain", Message: strings.TrimSpace(out)})
+		return
+	}
+
+	ok := strings.Contains(out, expected)
+	report.add(Check{Name: "snat rule", Object: staticRoute.Spec.Subnet, Expected: expected, Actual: presentOrMissing(ok), Ok: ok})
+}
+
+// checkGateway pings the gateway, then checks it was resolved in the neighbor table
+func checkGateway(report *Report, device string, status iksv1alpha1.NodeOverlayIpStatus) {
+	out, code, err := util.ExecPingCmd(fmt.Sprintf("-c 3 -W 1 -I %s %s", device, status.Gateway))
+	check := Check{Name: "gateway ping", Object: status.Gateway, Expected: "reply", Actual: "reply", Ok: err == nil && code == 0}
+	if !check.Ok {
+		check.Actual = "no reply"
+		check.Message = strings.TrimSpace(out)
+	}
+	report.add(check)
+
+	if noArpLinkTypes[status.LinkType] {
+		return
+	}
+
+	out, code, err = util.ExecIpCmd(fmt.Sprintf("neigh show %s dev %s", status.Gateway, device))
+	if err != nil || code != 0 {
+		report.add(Check{Name: "gateway neighbor", Object: status.Gateway, Message: strings.TrimSpace(out)})
+		return
+	}
+
+	fields := strings.Fields(out)
+	state := "none"
+	if len(fields) > 0 {
+		state = fields[len(fields)-1]
+	}
+
+	switch state {
+	case "REACHABLE", "STALE", "DELAY", "PROBE", "PERMANENT", "NOARP":
+		report.add(Check{Name: "gateway neighbor", Object: status.Gateway, Expected: "resolved", Actual: strings.TrimSpace(out), Ok: true})
+	default:
+		report.add(Check{Name: "gateway neighbor", Object: status.Gateway, Expected: "resolved", Actual: state,
+			Message: "the gateway doesn't answer ARP on the overlay link"})
+	}
+}
+
+func (r *Report) add(check Check) {
+	r.Checks = append(r.Checks, check)
+}
+
+func printText(w io.Writer, report *Report) {
+	fmt.Fprintf(w, "Node: %s\n\n", report.Node)
+	for _, check := range report.Checks {
+		result := "OK"
+		if !check.Ok {
+			result = "FAIL"
+		}
+
+		fmt.Fprintf(w, "[%-4s] %s %s", result, check.Name, check.Object)
+		if check.Expected != "" || check.Actual != "" {
+			fmt.Fprintf(w, ": expected %q, actual %q", check.Expected, check.Actual)
+		}
+		fmt.Fprintln(w)
+
+		if check.Message != "" {
+			fmt.Fprintf(w, "       %s\n", check.Message)
+		}
+	}
+
+	fmt.Fprintf(w, "\n%d checks, %d mismatches\n", len(report.Checks), report.Mismatches)
+}
+
+// linkType returns the overlay link type in the details of "ip -d link show", or "" for another type
+func linkType(out string) string {
+	if m := linkTypeRe.FindStringSubmatch(out); m != nil {
+		return m[1]
+	}
+
+	return ""
+}
+
+func upOrDown(up bool) string {
+	if up {
+		return "UP"
+	}
+
+	return "DOWN"
+}
+
+func orMissing(s string) string {
+	if s == "" {
+		return "missing"
+	}
+
+	return s
+}
+
+func presentOrMissing(ok bool) string {
+	if ok {
+		return "present"
+	}
+
+	return "missing"
+}
@@ -0,0 +1,57 @@
+package health
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	logf "sigs.k8s.io/controller-runtime/pkg/runtime/log"
+)
+
+var log = logf.Log.WithName("health")
+
+// Checker returns an error if the component is not ready
+type Checker func() error
+
+// Add creates an HTTP server serving /healthz and /readyz on addr and adds it to the Manager.
+// /healthz always succeeds while the manager is running, /readyz succeeds only when ready returns no error.
+func Add(mgr manager.Manager, addr string, ready Checker) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("error listening on %s: %v", addr, err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprint(w, "ok")
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, req *http.Request) {
+		if err := ready(); err != nil {
+			log.V(1).Info("Readiness check failed", "reason", err.Error())
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprint(w, "ok")
+	})
+
+	server := &http.Server{Handler: mux}
+
+	return mgr.Add(manager.RunnableFunc(func(stop <-chan struct{}) error {
+		errChan := make(chan error, 1)
+		go func() {
+			log.Info("Serving health checks", "address", addr)
+			if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+				errChan <- err
+			}
+		}()
+
+		select {
+		case err := <-errChan:
+			return err
+		case <-stop:
+			return server.Shutdown(context.Background())
+		}
+	}))
+}
@@ -0,0 +1,90 @@
+package ipam
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// the classes of errors returned by PhpIPAM, check them with errors.Is
+var (
+	// ErrPoolExhausted no subnet of the zone has a free address
+	ErrPoolExhausted = errors.New("no free addresses")
+
+	// ErrAuth the credentials or token were rejected
+	ErrAuth = errors.New("phpIPAM authentication failed")
+
+	// ErrNotFound the address or subnet doesn't exist in phpIPAM
+	ErrNotFound = errors.New("not found in phpIPAM")
+
+	// ErrUnreachable no subnet of the zone is reachable from the node's VLAN
+	ErrUnreachable = errors.New("no reachable subnet")
+
+	// ErrTransient phpIPAM couldn't be reached or had an internal error, and the call can be retried
+	ErrTransient = errors.New("phpIPAM unavailable")
+)
+
+// transientError wraps an error connecting to phpIPAM or reading its response
+func transientError(err error) error {
+	return fmt.Errorf("%w: %v", ErrTransient, err)
+}
+
+// statusError returns the class of error for the HTTP status code of a phpIPAM response, or nil if it doesn't have one
+func statusError(code int) error {
+	switch {
+	case code == http.StatusUnauthorized || code == http.StatusForbidden:
+		return ErrAuth
+	case code == http.StatusNotFound:
+		return ErrNotFound
+	case code == http.StatusRequestTimeout || code == http.StatusTooManyRequests || code >= 500:
+		return ErrTransient
+	}
+
+	return nil
+}
+
+// responseError returns an error for an unsuccessful phpIPAM response, with the class of error for its code
+func responseError(resp *phpIPAMResponse, format string, args ...interface{}) error {
+	msg := fmt.Sprintf(format, args...)
+	if resp.Message != "" {
+		msg = fmt.Sprintf("%s: %s", msg, resp.Message)
+	}
+
+	class := statusError(resp.Code)
+	if class == nil {
+		return errors.New(msg)
+	}
+
+	return fmt.Errorf("%w: %s", class, msg)
+}
+
+// isNoFreeAddress returns true if an unsuccessful first_free response is because the subnet is full
+func isNoFreeAddress(resp *phpIPAMResponse) bool {
+	return strings.Contains(resp.Message, "No free addresses")
+}
+
+// IsPoolExhausted returns true if the error is because no subnet of the zone has a free address
+func IsPoolExhausted(err error) bool {
+	return errors.Is(err, ErrPoolExhausted)
+}
+
+// IsAuth returns true if the error is because phpIPAM rejected the credentials or token
+func IsAuth(err error) bool {
+	return errors.Is(err, ErrAuth)
+}
+
+// IsNotFound returns true if the error is because the address or subnet doesn't exist in phpIPAM
+func IsNotFound(err error) bool {
+	return errors.Is(err, ErrNotFound)
+}
+
+// IsTransient returns true if the call can be retried, e.g. because phpIPAM couldn't be reached
+func IsTransient(err error) bool {
+	return errors.Is(err, ErrTransient)
+}
+
+// IsUnreachable returns true if the error is because no subnet of the zone is reachable from the node's VLAN
+func IsUnreachable(err error) bool {
+	return errors.Is(err, ErrUnreachable)
+}
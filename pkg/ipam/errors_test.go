@@ -0,0 +1,95 @@
+package ipam
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestDecodeResponseErrors(t *testing.T) {
+	tests := []struct {
+		name       string
+		statusCode int
+		body       string
+		code       int
+		class      error
+		success    bool
+	}{
+		{"success", 200, `{"code":200,"success":true,"data":{"id":"7"}}`, 200, nil, true},
+		{"code from the status", 201, `{"success":true}`, 201, nil, true},
+		{"success as a number", 200, `{"code":200,"success":1}`, 200, nil, true},
+		{"success as a string", 200, `{"code":200,"success":"1"}`, 200, nil, true},
+		{"failure as a number", 200, `{"code":200,"success":0}`, 200, nil, false},
+		{"failure as a string", 200, `{"code":200,"success":"0"}`, 200, nil, false},
+		{"phpIPAM error", 409, `{"code":409,"success":false,"message":"Address already exists"}`, 409, nil, false},
+		{"proxy timeout", 504, `<html><body>Gateway Timeout</body></html>`, 0, ErrTransient, false},
+		{"unauthorized", 401, `Unauthorized`, 0, ErrAuth, false},
+		{"not found", 404, ``, 0, ErrNotFound, false},
+	}
+
+	for _, test := range tests {
+		resp, err := decodeResponse(test.statusCode, []byte(test.body), nil)
+		if test.class != nil {
+			if !errors.Is(err, test.class) {
+				t.Errorf("%s: error %v, expected %v", test.name, err, test.class)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+
+		if resp.Code != test.code {
+			t.Errorf("%s: code %d, expected %d", test.name, resp.Code, test.code)
+		}
+
+		if resp.isSuccess() != test.success {
+			t.Errorf("%s: success %v, expected %v", test.name, resp.isSuccess(), test.success)
+		}
+	}
+
+	// a body that isn't a phpIPAM response with a status without a class is still an error
+	_, err := decodeResponse(200, []byte(`<html></html>`), nil)
+	if err == nil || IsTransient(err) || IsAuth(err) || IsNotFound(err) {
+		t.Errorf("error %v, expected an unclassified error", err)
+	}
+}
+
+func TestResponseError(t *testing.T) {
+	tests := []struct {
+		name    string
+		resp    *phpIPAMResponse
+		class   error
+		message string
+	}{
+		{"auth", &phpIPAMResponse{Code: 403, Message: "Invalid token"}, ErrAuth, "phpIPAM authentication failed: Error reserving address: Invalid token"},
+		{"not found", &phpIPAMResponse{Code: 404, Message: "Address not found"}, ErrNotFound, "not found in phpIPAM: Error reserving address: Address not found"},
+		{"internal error", &phpIPAMResponse{Code: 500}, ErrTransient, "phpIPAM unavailable: Error reserving address"},
+		{"too many requests", &phpIPAMResponse{Code: 429}, ErrTransient, "phpIPAM unavailable: Error reserving address"},
+		{"conflict", &phpIPAMResponse{Code: 409, Message: "Address already exists"}, nil, "Error reserving address: Address already exists"},
+	}
+
+	for _, test := range tests {
+		err := responseError(test.resp, "Error reserving %s", "address")
+		if err.Error() != test.message {
+			t.Errorf("%s: message %q, expected %q", test.name, err.Error(), test.message)
+		}
+
+		for _, class := range []error{ErrAuth, ErrNotFound, ErrTransient} {
+			if errors.Is(err, class) != (class == test.class) {
+				t.Errorf("%s: errors.Is(%v) = %v", test.name, class, errors.Is(err, class))
+			}
+		}
+	}
+}
+
+func TestIsNoFreeAddress(t *testing.T) {
+	if !isNoFreeAddress(&phpIPAMResponse{Code: 404, Message: "No free addresses found"}) {
+		t.Error("expected a full subnet")
+	}
+
+	if isNoFreeAddress(&phpIPAMResponse{Code: 404, Message: "Subnet does not exist"}) {
+		t.Error("expected a missing subnet not to be full")
+	}
+}
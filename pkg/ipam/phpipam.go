@@ -3,14 +3,21 @@ package ipam
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
+	"net/url"
+	"net"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 	"crypto/tls"
 
+	"github.com/jkwong888/iks-overlay-ip-controller/pkg/metrics"
 	"gopkg.in/yaml.v2"
 	logf "sigs.k8s.io/controller-runtime/pkg/runtime/log"
 )
@@ -32,6 +39,19 @@ type PhpIPAMConfigSpec struct {
 	// map of zone to subnet IDs, e.g. "wdc04": ["7", "8", "9"]
 	SubnetMap map[string][]int `yaml:"subnetMap"`
 
+	// how the subnet of the zone is chosen when an address is reserved
+	SubnetSelection SubnetSelectionSpec `yaml:"subnetSelection"`
+
+	// the node label with the ID of the node's private VLAN, "privateVLAN" if not set
+	VlanLabel string `yaml:"vlanLabel"`
+
+	// map of private VLANs to the subnets reachable from them; if set, nodes only get addresses in the subnets of
+	// their VLAN
+	VlanMap []VlanSubnetsSpec `yaml:"vlanMap"`
+
+	// custom fields set on every reserved address, by their name in phpIPAM, e.g. "custom_cluster": "mycluster"
+	CustomFields map[string]string `yaml:"customFields"`
+
 	token string
 }
 
@@ -49,18 +69,69 @@ type PhpIPAMSubnet struct {
 	Mask string `json:"mask,omitempty"`
 }
 
+type PhpIPAMSubnetUsage struct {
+	MaxHosts float64
+	Used float64
+	FreeHosts float64
+}
+
 type PhpIPAMAddress struct {
 	ID string `json:"id,omitempty"`
 	IPAddr string `json:"ip_addr,omitempty"`
 	SubnetId string `json:"subnetId,omitempty"`
+	Hostname string `json:"hostname,omitempty"`
+	Description string `json:"description,omitempty"`
+	Owner string `json:"owner,omitempty"`
+	Note string `json:"note,omitempty"`
+}
+
+// AddressFields are the fields set on an address when it is reserved, in addition to the owner and the configured
+// custom fields
+type AddressFields struct {
+	Hostname string
+	Description string
+	Note string
+
+	// CustomFields by their name in phpIPAM, e.g. "custom_node"
+	CustomFields map[string]string
 }
 
+// reserveLock serializes reservations in the process, so parallel reconciles don't race for the same first free
+// address
+var reserveLock sync.Mutex
+
+// the timeout of API calls, and of calls that list every address of a subnet, which phpIPAM returns in one response
+const (
+	requestTimeout     = 10 * time.Second
+	listRequestTimeout = 60 * time.Second
+)
+
 var config PhpIPAM
 
+// ConfigFile is the controller configuration mounted from the configmap
+var ConfigFile = "/opt/controller-config/overlay-ip-config.yaml"
+
 func NewPhpIPAM() (*PhpIPAM, error) {
+	config, err := LoadConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	// attempt to populate the token
+	err = config.getToken()
+	if err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+// LoadConfig reads the controller configuration without logging in to phpIPAM, e.g. to check which subnets a node
+// reaches
+func LoadConfig() (*PhpIPAM, error) {
 	config := &PhpIPAM{}
 
-	yamlFile, err := ioutil.ReadFile("/opt/controller-config/overlay-ip-config.yaml")
+	yamlFile, err := ioutil.ReadFile(ConfigFile)
 	if err != nil {
 		return nil, err
 	}
@@ -85,8 +156,12 @@ func NewPhpIPAM() (*PhpIPAM, error) {
 		return nil, fmt.Errorf("Subnet Map is empty; expected map of zones to subnet IDs")
 	}
 
-	// attempt to populate the token
-	err = config.getToken()
+	err = config.PhpIPAMConfig.SubnetSelection.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	err = validateVlanMap(config.PhpIPAMConfig.VlanMap)
 	if err != nil {
 		return nil, err
 	}
@@ -94,52 +169,145 @@ func NewPhpIPAM() (*PhpIPAM, error) {
 	return config, nil
 }
 
+// callAPI calls the phpIPAM API; the parameters are sent as a JSON body, or in the query string of a GET
 func (p *PhpIPAM) callAPI(httpVerb string, path string, params map[string]string) (*phpIPAMResponse, error) {
+	return p.callAPIInto(httpVerb, path, params, requestTimeout, nil)
+}
+
+// callAPIInto calls the phpIPAM API and decodes the data of the response into data if it isn't nil, e.g. a pointer to
+// a slice of addresses, instead of generic maps
+func (p *PhpIPAM) callAPIInto(httpVerb string, path string, params map[string]string, timeout time.Duration, data interface{}) (*phpIPAMResponse, error) {
 	tr := &http.Transport{
         TLSClientConfig: &tls.Config{InsecureSkipVerify: p.PhpIPAMConfig.InsecureSkipTLSVerify},
 	}
 
 	var httpClient = &http.Client{
-		Timeout: time.Second * 10,
+		Timeout: timeout,
 		Transport: tr,
 	}
 
-	var sb strings.Builder
-	for key, val := range params {
-		sb.WriteString(fmt.Sprintf("%s=%s\n", key, val))
+	fullPath := strings.TrimRight(*p.PhpIPAMConfig.URL, "/") + path
+	var body io.Reader
+	if httpVerb == http.MethodGet && len(params) > 0 {
+		query := url.Values{}
+		for key, val := range params {
+			query.Set(key, val)
+		}
+		fullPath = fmt.Sprintf("%s?%s", fullPath, query.Encode())
+	} else if len(params) > 0 {
+		paramBytes, err := json.Marshal(params)
+		if err != nil {
+			return nil, err
+		}
+		body = bytes.NewReader(paramBytes)
 	}
 
-	paramString := sb.String()
-	fullPath := fmt.Sprintf("%s/%s", *p.PhpIPAMConfig.URL, path)
-	request, err := http.NewRequest(
-		httpVerb,
-		fullPath,
-		bytes.NewBufferString(paramString))
+	request, err := http.NewRequest(httpVerb, fullPath, body)
 	if err != nil {
 		return nil, err
 	}
 
 	request.Header.Add("token", p.PhpIPAMConfig.token)
+	request.Header.Set("Accept", "application/json")
+	if body != nil {
+		request.Header.Set("Content-Type", "application/json")
+	}
+
+	endpoint := apiEndpoint(path)
+	start := time.Now()
+	defer func() {
+		metrics.IPAMRequestDuration.WithLabelValues(httpVerb, endpoint).Observe(time.Since(start).Seconds())
+	}()
 
-	log.Info(fmt.Sprintf("Calling phpIPAM: %s", fullPath))
+	log.Info(fmt.Sprintf("Calling phpIPAM: %s %s", httpVerb, fullPath))
 	response, err := httpClient.Do(request)
 	if err != nil {
-		return nil, err
+		metrics.IPAMRequestErrors.WithLabelValues(httpVerb, endpoint).Inc()
+		return nil, transientError(err)
 	}
 
 	defer response.Body.Close()
 
-	body, err := ioutil.ReadAll(response.Body)
+	respBody, err := ioutil.ReadAll(response.Body)
 	if err != nil {
-		return nil, err
+		metrics.IPAMRequestErrors.WithLabelValues(httpVerb, endpoint).Inc()
+		return nil, transientError(err)
 	}
 
-	resp := &phpIPAMResponse{}
-	err = json.Unmarshal(body, resp)
+	resp, err := decodeResponse(response.StatusCode, respBody, data)
 	if err != nil {
+		metrics.IPAMRequestErrors.WithLabelValues(httpVerb, endpoint).Inc()
 		return nil, err
 	}
 
+	if !resp.isSuccess() {
+		metrics.IPAMRequestErrors.WithLabelValues(httpVerb, endpoint).Inc()
+	}
+
+	return resp, nil
+}
+
+// apiPath returns the path of an API endpoint of the app, with each segment escaped, e.g. "/api/iks/addresses/7/"
+func (p *PhpIPAM) apiPath(segments ...interface{}) string {
+	var sb strings.Builder
+	sb.WriteString("/api/")
+	sb.WriteString(url.PathEscape(*p.PhpIPAMConfig.AppID))
+	sb.WriteString("/")
+	for _, segment := range segments {
+		sb.WriteString(url.PathEscape(fmt.Sprint(segment)))
+		sb.WriteString("/")
+	}
+
+	return sb.String()
+}
+
+// apiEndpoint strips the app ID and any object IDs or IP addresses from an API path, so
+// that e.g. "/api/iks/addresses/first_free/7/" is reported as "addresses/first_free"
+func apiEndpoint(path string) string {
+	splits := strings.Split(strings.Trim(path, "/"), "/")
+	if len(splits) > 2 && splits[0] == "api" {
+		splits = splits[2:]
+	}
+
+	endpoint := []string{}
+	for _, s := range splits {
+		if s == "" {
+			continue
+		}
+
+		if _, err := strconv.Atoi(s); err == nil {
+			continue
+		}
+
+		if net.ParseIP(s) != nil {
+			continue
+		}
+
+		endpoint = append(endpoint, s)
+	}
+
+	return strings.Join(endpoint, "/")
+}
+
+// decodeResponse decodes a phpIPAM response body, with its data into data if it isn't nil; a body that isn't a phpIPAM response, e.g. the error page of a
+// proxy, is an error with the class of the HTTP status code
+func decodeResponse(statusCode int, body []byte, data interface{}) (*phpIPAMResponse, error) {
+	// the data is decoded into the value data points to, as the pointer is kept in the interface
+	resp := &phpIPAMResponse{Data: data}
+	err := json.Unmarshal(body, resp)
+	if err != nil {
+		class := statusError(statusCode)
+		if class == nil {
+			return nil, fmt.Errorf("Unable to decode phpIPAM response with status %d: %v", statusCode, err)
+		}
+
+		return nil, fmt.Errorf("%w: HTTP status %d", class, statusCode)
+	}
+
+	if resp.Code == 0 {
+		resp.Code = statusCode
+	}
+
 	return resp, nil
 }
 
@@ -153,48 +321,60 @@ func (p *PhpIPAM) getToken() error {
 		Transport: tr,
 	}
 
-	request, err := http.NewRequest(http.MethodPost,
-		fmt.Sprintf("%s/api/%s/user/", *p.PhpIPAMConfig.URL, *p.PhpIPAMConfig.AppID), nil)
+	request, err := http.NewRequest(http.MethodPost, strings.TrimRight(*p.PhpIPAMConfig.URL, "/") + p.apiPath("user"), nil)
+	if err != nil {
+		return err
+	}
 	request.SetBasicAuth(*p.PhpIPAMConfig.username, *p.PhpIPAMConfig.password)
 
 	response, err := httpClient.Do(request)
 	if err != nil {
-		return err
+		return transientError(err)
 	}
 
 	defer response.Body.Close()
 
 	body, err := ioutil.ReadAll(response.Body)
 	if err != nil {
-		return err
+		return transientError(err)
 	}
 
-	resp := &phpIPAMResponse{}
-	err = json.Unmarshal(body, resp)
+	resp, err := decodeResponse(response.StatusCode, body, nil)
+	if err != nil {
+		return err
+	}
 
 	if !resp.isSuccess() {
-		return fmt.Errorf("Error retrieving token, response was %b", resp)
+		// phpIPAM may answer a wrong username or password with a 500
+		if errors.Is(statusError(resp.Code), ErrTransient) && !strings.Contains(resp.Message, "Invalid username or password") {
+			return responseError(resp, "Error retrieving token")
+		}
+
+		return fmt.Errorf("%w: Error retrieving token: %s", ErrAuth, resp.Message)
 	}
 
-	token, err := resp.getValue("token")
+	token, err := resp.getString("token")
 	if err != nil {
 		return err
 	}
 
-	p.PhpIPAMConfig.token = token.(string)
+	p.PhpIPAMConfig.token = token
 
 	return nil
 }
 
 func (r *phpIPAMResponse) isSuccess() bool {
-	// for some reason, phpipam may return bools or ints in "success" responses.  try
-	// to decode them here
+	// for some reason, phpipam may return bools, numbers or strings in "success" responses.  try
+	// to decode them here; numbers are decoded as float64, and 1 is success
 	success := r.Success
 	switch success.(type) {
 	case bool:
 		return success.(bool)
-	case int:
-		return success == 0
+	case float64:
+		return success.(float64) == 1
+	case string:
+		n, err := strconv.ParseFloat(success.(string), 64)
+		return err == nil && n == 1
 	}
 
 	return false
@@ -204,7 +384,11 @@ func (r *phpIPAMResponse) getValue(key string) (interface{}, error) {
 	// split the key on the "." character
 	splits := strings.Split(key, ".")
 
-	tmpVal := r.Data.(map[string]interface{})
+	tmpVal, ok := r.Data.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Unexpected data in phpIPAM response, expected an object: %v", r.Data)
+	}
+
 	for _, s := range splits {
 		tmp := tmpVal[s]
 		if tmp == nil {
@@ -223,12 +407,54 @@ func (r *phpIPAMResponse) getValue(key string) (interface{}, error) {
 	return tmpVal, nil
 }
 
+// getString returns the value of a key in the response data as a string; phpIPAM returns some numbers, e.g. IDs, as
+// strings and some as numbers
+func (r *phpIPAMResponse) getString(key string) (string, error) {
+	val, err := r.getValue(key)
+	if err != nil {
+		return "", err
+	}
+
+	return toString(key, val)
+}
+
+// getItems returns the response data as a list of objects, e.g. the addresses found by a search
+func (r *phpIPAMResponse) getItems() ([]map[string]interface{}, error) {
+	data, ok := r.Data.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Unexpected data in phpIPAM response, expected a list: %v", r.Data)
+	}
+
+	items := []map[string]interface{}{}
+	for _, d := range data {
+		item, ok := d.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("Unexpected item in phpIPAM response, expected an object: %v", d)
+		}
+
+		items = append(items, item)
+	}
+
+	return items, nil
+}
+
+func toString(key string, val interface{}) (string, error) {
+	switch v := val.(type) {
+	case string:
+		return v, nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	}
+
+	return "", fmt.Errorf("Unexpected type for %s in phpIPAM response: %T", key, val)
+}
+
 func (p *PhpIPAM) GetSubnetForIP(ipAddr string) (map[string]string, error) {
 	returnMap := make(map[string]string)
 
 	// find the subnet ids
 	resp, err := p.callAPI(http.MethodGet,
-		fmt.Sprintf("/api/%s/addresses/search/%s/", *p.PhpIPAMConfig.AppID, ipAddr),
+		p.apiPath("addresses", "search", ipAddr),
 		map[string]string{},
 	)
 
@@ -237,103 +463,304 @@ func (p *PhpIPAM) GetSubnetForIP(ipAddr string) (map[string]string, error) {
 	}
 
 	if !resp.isSuccess() {
-		return returnMap, fmt.Errorf("Unable to find subnet for IP %s: %s", ipAddr, resp.Message)
+		return returnMap, responseError(resp, "Unable to find subnet for IP %s", ipAddr)
+	}
+
+	ipaddrs, err := resp.getItems()
+	if err != nil {
+		return returnMap, err
 	}
 
 	// get the first subnets that have this IP address
-	ipaddrs := resp.Data.([]interface{})
-	for _, ipaddr := range ipaddrs {
-		ipmap := ipaddr.(map[string]interface{})
-		subnetid := ipmap["subnetId"].(string)
+	lastErr := fmt.Errorf("%w: IP %s isn't in any subnet", ErrNotFound, ipAddr)
+	for _, ipmap := range ipaddrs {
+		subnetid, err := toString("subnetId", ipmap["subnetId"])
+		if err != nil {
+			return returnMap, err
+		}
 
 		// get the subnet gateway
 		subnetresp, err := p.callAPI(http.MethodGet,
-			fmt.Sprintf("/api/%s/subnets/%s/", *p.PhpIPAMConfig.AppID, subnetid),
+			p.apiPath("subnets", subnetid),
 			map[string]string{},
 		)
 
+		if err != nil {
+			return returnMap, err
+		}
+
 		if !subnetresp.isSuccess() {
-			log.Info(fmt.Sprintf("unable to get subnet %d for ip %s: %s", subnetid, ipaddr, subnetresp.Message))
+			log.Info(fmt.Sprintf("unable to get subnet %s for ip %s: %s", subnetid, ipAddr, subnetresp.Message))
+			lastErr = responseError(subnetresp, "Unable to get subnet %s for IP %s", subnetid, ipAddr)
 			continue
 		}
 
-		mask, err := subnetresp.getValue("mask")
+		mask, err := subnetresp.getString("mask")
 		if err != nil {
 			return returnMap, err
 		}
 
-		subnet, err := subnetresp.getValue("subnet")
+		subnet, err := subnetresp.getString("subnet")
 		if err != nil {
 			return returnMap, err
 		}
 
-		gateway, err := subnetresp.getValue("gateway.ip_addr")
+		gateway, err := subnetresp.getString("gateway.ip_addr")
 		if err != nil {
 			return returnMap, err
 		}
 
-		returnMap["subnet"] = subnet.(string)
-		returnMap["mask"] = mask.(string)
-		returnMap["gateway"] = gateway.(string)
+		returnMap["id"] = subnetid
+		returnMap["subnet"] = subnet
+		returnMap["mask"] = mask
+		returnMap["gateway"] = gateway
 
 		return returnMap, nil
 	}
 
-	return returnMap, fmt.Errorf("unable to find subnets for IP all subnets return error")
+	return returnMap, lastErr
 }
 
-func (p *PhpIPAM) ReserveIPAddress(owner string, zone string) (string, error) {
+// ReserveIPAddress reserves the first free IP in the first subnet reachable by the placement that has one, in the
+// order of the subnet selection strategy, and returns it with the subnet's mask.  The error is ErrPoolExhausted if
+// every subnet is full.
+func (p *PhpIPAM) ReserveIPAddress(owner string, placement Placement) (string, error) {
+	ipAddr, _, err := p.ReserveIPAddressWithFields(owner, placement, AddressFields{})
+	return ipAddr, err
+}
+
+// ReserveIPAddressWithFields reserves an IP like ReserveIPAddress in the subnets chosen for the placement, sets the
+// fields on the address, and also returns the ID of the subnet it's in
+func (p *PhpIPAM) ReserveIPAddressWithFields(owner string, placement Placement, fields AddressFields) (string, int, error) {
+	zone := placement.Zone
+
 	// find the subnet ids
 	log.Info("Reserve IP in zone", "zone", zone, "owner", owner)
 
-	subnetIds := p.PhpIPAMConfig.SubnetMap[zone]
+	reserveLock.Lock()
+	defer reserveLock.Unlock()
 
+	subnetIds, err := p.subnetOrder(placement)
+	if err != nil {
+		return "", 0, err
+	}
+
+	var lastErr error
 	for _, subnetId := range subnetIds {
 		log.Info("Trying to reserve IP in subnet", "subnet", subnetId, "zone", zone, "owner", owner)
 		resp, err := p.callAPI(http.MethodPost,
-			fmt.Sprintf("/api/%s/addresses/first_free/%d/", *p.PhpIPAMConfig.AppID, subnetId),
-			map[string]string{
-				"owner": owner,
-			},
+			p.apiPath("addresses", "first_free", subnetId),
+			p.addressParams(owner, fields),
 		)
 
 		if err != nil {
-			return "", err
+			return "", 0, err
 		}
 
 		if !resp.isSuccess() {
 			log.Info(fmt.Sprintf("Unable to reserve IP on subnet %d", subnetId), "zone", zone, "message", resp.Message)
+			if !isNoFreeAddress(resp) {
+				lastErr = responseError(resp, "Unable to reserve IP on subnet %d", subnetId)
+			}
 			continue
 		}
 
 		// get the IP
-		ipAddr := resp.Data.(string)
+		ipAddr, ok := resp.Data.(string)
+		if !ok {
+			return "", 0, fmt.Errorf("Unexpected data in phpIPAM response, expected an IP address: %v", resp.Data)
+		}
+
 		// get the subnet mask
 		subnetResp, err := p.callAPI(http.MethodGet,
-			fmt.Sprintf("/api/%s/subnets/%d/", *p.PhpIPAMConfig.AppID, subnetId),
+			p.apiPath("subnets", subnetId),
 			map[string]string{},
 		)
 
+		if err != nil {
+			return "", 0, err
+		}
+
 		if !subnetResp.isSuccess() {
 			log.V(1).Info(fmt.Sprintf("Unable to get subnet %d for IP %s: %s", subnetId, ipAddr, subnetResp.Message))
+			lastErr = responseError(subnetResp, "Unable to get subnet %d for IP %s", subnetId, ipAddr)
 			continue
 		}
 
-		mask, err := subnetResp.getValue("mask")
+		mask, err := subnetResp.getString("mask")
+		if err != nil {
+			return "", 0, err
+		}
+
+		return fmt.Sprintf("%s/%s", ipAddr, mask), subnetId, nil
+	}
+
+	// only report the pool as exhausted if no subnet failed for another reason
+	if lastErr != nil {
+		return "", 0, lastErr
+	}
+
+	return "", 0, fmt.Errorf("%w: unable to reserve IP in zone %s, all subnets are full", ErrPoolExhausted, zone)
+}
+
+// addressParams returns the parameters that set the owner, fields and configured custom fields of an address
+func (p *PhpIPAM) addressParams(owner string, fields AddressFields) map[string]string {
+	params := map[string]string{}
+	for key, val := range p.PhpIPAMConfig.CustomFields {
+		params[key] = val
+	}
+
+	for key, val := range fields.CustomFields {
+		params[key] = val
+	}
+
+	params["owner"] = owner
+	if fields.Hostname != "" {
+		params["hostname"] = fields.Hostname
+	}
+
+	if fields.Description != "" {
+		params["description"] = fields.Description
+	}
+
+	if fields.Note != "" {
+		params["note"] = fields.Note
+	}
+
+	return params
+}
+
+// ListSubnetAddresses returns every address in the subnet, e.g. to audit which addresses are in use
+func (p *PhpIPAM) ListSubnetAddresses(subnetId int) ([]PhpIPAMAddress, error) {
+	return p.listSubnetAddresses(subnetId, nil)
+}
+
+// FindIPAddressByOwner returns the address reserved for the owner in a subnet reachable by the placement with the
+// subnet's mask and the subnet's ID, or "" if there is none.  Pass only the zone to search all its subnets, e.g. for
+// an address that's released.
+func (p *PhpIPAM) FindIPAddressByOwner(owner string, placement Placement) (string, int, error) {
+	return p.findIPAddress(owner, placement, "")
+}
+
+// FindIPAddressByNote returns the address reserved for the owner with the note like FindIPAddressByOwner, e.g. to find
+// the address of a reservation made before the controller crashed or failed to record it, and not one left behind by
+// an earlier owner with the same name
+func (p *PhpIPAM) FindIPAddressByNote(owner string, placement Placement, note string) (string, int, error) {
+	return p.findIPAddress(owner, placement, note)
+}
+
+// findIPAddress returns the address reserved for the owner, with the note if it isn't ""
+func (p *PhpIPAM) findIPAddress(owner string, placement Placement, note string) (string, int, error) {
+	subnetIds, err := p.placementSubnets(placement)
+	if err != nil {
+		return "", 0, err
+	}
+
+	for _, subnetId := range subnetIds {
+		// phpIPAM filters the addresses if it supports it, otherwise the whole subnet is returned
+		addresses, err := p.listSubnetAddresses(subnetId, map[string]string{
+			"filter_by":    "owner",
+			"filter_value": owner,
+		})
+		if err != nil {
+			return "", 0, err
+		}
+
+		for _, address := range addresses {
+			if address.Owner != owner || note != "" && address.Note != note {
+				continue
+			}
+
+			mask, err := p.subnetMask(subnetId)
+			if err != nil {
+				return "", 0, err
+			}
+
+			log.Info("Found IP reserved for owner", "ipAddr", address.IPAddr, "owner", owner, "subnet", subnetId)
+			return fmt.Sprintf("%s/%s", address.IPAddr, mask), subnetId, nil
+		}
+	}
+
+	return "", 0, nil
+}
+
+func (p *PhpIPAM) listSubnetAddresses(subnetId int, params map[string]string) ([]PhpIPAMAddress, error) {
+	addresses := []PhpIPAMAddress{}
+	resp, err := p.callAPIInto(http.MethodGet, p.apiPath("subnets", subnetId, "addresses"), params, listRequestTimeout, &addresses)
+	if err != nil {
+		return nil, err
+	}
+
+	if !resp.isSuccess() {
+		// phpIPAM answers an empty subnet with a 404
+		if strings.Contains(resp.Message, "No addresses found") {
+			return []PhpIPAMAddress{}, nil
+		}
+
+		return nil, responseError(resp, "Unable to list addresses in subnet %d", subnetId)
+	}
+
+	return addresses, nil
+}
+
+// subnetMask returns the mask of the subnet, e.g. "24"
+func (p *PhpIPAM) subnetMask(subnetId int) (string, error) {
+	resp, err := p.callAPI(http.MethodGet, p.apiPath("subnets", subnetId), map[string]string{})
+	if err != nil {
+		return "", err
+	}
+
+	if !resp.isSuccess() {
+		return "", responseError(resp, "Unable to get subnet %d", subnetId)
+	}
+
+	return resp.getString("mask")
+}
+
+// UpdateIPAddress sets the owner and fields of a reserved address, e.g. to correct the owner of an address that was
+// assigned twice
+func (p *PhpIPAM) UpdateIPAddress(ipAddr string, owner string, fields AddressFields) error {
+	resp, err := p.callAPI(http.MethodGet,
+		p.apiPath("addresses", "search", ipAddr),
+		map[string]string{},
+	)
+
+	if err != nil {
+		return err
+	}
+
+	if !resp.isSuccess() {
+		return responseError(resp, "Unable to find IP %s", ipAddr)
+	}
+
+	ipaddrs, err := resp.getItems()
+	if err != nil {
+		return err
+	}
+
+	for _, ipmap := range ipaddrs {
+		id, err := toString("id", ipmap["id"])
+		if err != nil {
+			return err
+		}
+
+		updateResp, err := p.callAPI(http.MethodPatch, p.apiPath("addresses", id), p.addressParams(owner, fields))
 		if err != nil {
-			return "", err
+			return err
 		}
 
-		return fmt.Sprintf("%s/%s", ipAddr, mask.(string)), nil
+		if !updateResp.isSuccess() {
+			return responseError(updateResp, "Unable to update IP %s", ipAddr)
+		}
 	}
 
-	return "", fmt.Errorf("unable to reserve IP in zone %s, all subnets return error", zone)
+	return nil
 }
 
 func (p *PhpIPAM) DeleteIPAddress(ipAddr string) (error) {
 	// find the subnet 
-	resp, err := p.callAPI(http.MethodPost,
-		fmt.Sprintf("/api/%s/addresses/search/%s/", *p.PhpIPAMConfig.AppID, ipAddr),
+	resp, err := p.callAPI(http.MethodGet,
+		p.apiPath("addresses", "search", ipAddr),
 		map[string]string{},
 	)
 
@@ -346,19 +773,26 @@ func (p *PhpIPAM) DeleteIPAddress(ipAddr string) (error) {
 			log.Info(fmt.Sprintf("Unable to find IP %s ", ipAddr), "message", resp.Message)
 			return nil
 		} else {
-			return err
+			return responseError(resp, "Unable to find IP %s", ipAddr)
 		}
 	}
 
+	ipaddrs, err := resp.getItems()
+	if err != nil {
+		return err
+	}
+
 	// get the first subnets that have this IP address
-	ipaddrs := resp.Data.([]interface{})
-	for _, ipaddr := range ipaddrs {
-		ipmap := ipaddr.(map[string]interface{})
-		id := ipmap["id"].(string)
+	lastErr := fmt.Errorf("unable to delete IP %s", ipAddr)
+	for _, ipmap := range ipaddrs {
+		id, err := toString("id", ipmap["id"])
+		if err != nil {
+			return err
+		}
 
 		// get the subnet gateway
 		subnetresp, err := p.callAPI(http.MethodDelete,
-			fmt.Sprintf("/api/%s/addresses/%s/", *p.PhpIPAMConfig.AppID, id),
+			p.apiPath("addresses", id),
 			map[string]string{},
 		)
 
@@ -367,12 +801,57 @@ func (p *PhpIPAM) DeleteIPAddress(ipAddr string) (error) {
 		}
 
 		if !subnetresp.isSuccess() {
-			log.Info(fmt.Sprintf("unable to get delete ip %s: %s", ipaddr, subnetresp.Message))
+			log.Info(fmt.Sprintf("unable to get delete ip %s: %s", ipAddr, subnetresp.Message))
+			lastErr = responseError(subnetresp, "Unable to delete IP %s", ipAddr)
 			continue
 		}
 
 		return nil
 	}
 
-	return fmt.Errorf("unable to delete IP")
+	return lastErr
+}
+
+func (p *PhpIPAM) GetSubnetUsage(subnetId int) (*PhpIPAMSubnetUsage, error) {
+	resp, err := p.callAPI(http.MethodGet,
+		p.apiPath("subnets", subnetId, "usage"),
+		map[string]string{},
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !resp.isSuccess() {
+		return nil, fmt.Errorf("Unable to get usage for subnet %d: %s", subnetId, resp.Message)
+	}
+
+	usage := &PhpIPAMSubnetUsage{}
+
+	// phpipam returns some of these as strings and some as numbers
+	for key, dest := range map[string]*float64{
+		"maxhosts":  &usage.MaxHosts,
+		"used":      &usage.Used,
+		"freehosts": &usage.FreeHosts,
+	} {
+		val, err := resp.getValue(key)
+		if err != nil {
+			return nil, err
+		}
+
+		switch v := val.(type) {
+		case float64:
+			*dest = v
+		case string:
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				return nil, fmt.Errorf("Unable to parse %s for subnet %d: %v", key, subnetId, err)
+			}
+			*dest = f
+		default:
+			return nil, fmt.Errorf("Unexpected type for %s for subnet %d: %T", key, subnetId, val)
+		}
+	}
+
+	return usage, nil
 }
@@ -0,0 +1,169 @@
+package ipam
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func testIPAM(appId string) *PhpIPAM {
+	url := "https://phpipam.example.com/"
+	return &PhpIPAM{PhpIPAMConfig: &PhpIPAMConfigSpec{URL: &url, AppID: &appId}}
+}
+
+// fakePhpIPAM serves the responses by the path of the API call, e.g. "subnets/7/usage", and answers other calls
+// with a 404
+func fakePhpIPAM(t *testing.T, subnetMap map[string][]int, responses map[string]string) *PhpIPAM {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		resp, ok := responses[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"code":404,"success":false,"message":"Not found"}`)
+			return
+		}
+
+		fmt.Fprintf(w, `{"code":200,"success":true,"data":%s}`, resp)
+	}))
+	t.Cleanup(server.Close)
+
+	p := testIPAM("iks")
+	p.PhpIPAMConfig.URL = &server.URL
+	p.PhpIPAMConfig.SubnetMap = subnetMap
+
+	return p
+}
+
+func TestApiPath(t *testing.T) {
+	tests := []struct {
+		appId    string
+		segments []interface{}
+		expected string
+	}{
+		{"iks", []interface{}{"addresses", 7}, "/api/iks/addresses/7/"},
+		{"iks", []interface{}{"user"}, "/api/iks/user/"},
+		{"iks", []interface{}{"addresses", "search", "10.10.0.5"}, "/api/iks/addresses/search/10.10.0.5/"},
+		{"my app", []interface{}{"subnets", 7, "addresses"}, "/api/my%20app/subnets/7/addresses/"},
+		{"iks", []interface{}{"addresses", "search", "10.10.0.5/../../user"}, "/api/iks/addresses/search/10.10.0.5%2F..%2F..%2Fuser/"},
+	}
+
+	for _, test := range tests {
+		path := testIPAM(test.appId).apiPath(test.segments...)
+		if path != test.expected {
+			t.Errorf("apiPath(%v) = %s, expected %s", test.segments, path, test.expected)
+		}
+	}
+}
+
+func TestApiEndpoint(t *testing.T) {
+	tests := []struct {
+		path     string
+		expected string
+	}{
+		{"/api/iks/addresses/first_free/7/", "addresses/first_free"},
+		{"/api/iks/addresses/search/10.10.0.5/", "addresses/search"},
+		{"/api/iks/addresses/fd00::5/7/", "addresses"},
+		{"/api/iks/subnets/7/usage/", "subnets/usage"},
+		{"/api/iks/subnets/7/addresses/", "subnets/addresses"},
+		{"/api/iks/user/", "user"},
+		{"addresses/7", "addresses"},
+	}
+
+	for _, test := range tests {
+		endpoint := apiEndpoint(test.path)
+		if endpoint != test.expected {
+			t.Errorf("apiEndpoint(%s) = %s, expected %s", test.path, endpoint, test.expected)
+		}
+	}
+}
+
+func TestDecodeResponseData(t *testing.T) {
+	body := `{"code":200,"success":true,"data":[
+		{"id":"12","ip_addr":"10.10.0.5","subnetId":"7","hostname":"node-a","owner":"node-a","note":"reservation abc"},
+		{"id":"13","ip_addr":"10.10.0.6","subnetId":"7","owner":"node-b"}
+	]}`
+
+	addresses := []PhpIPAMAddress{}
+	resp, err := decodeResponse(200, []byte(body), &addresses)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !resp.isSuccess() {
+		t.Error("expected a successful response")
+	}
+
+	expected := []PhpIPAMAddress{
+		{ID: "12", IPAddr: "10.10.0.5", SubnetId: "7", Hostname: "node-a", Owner: "node-a", Note: "reservation abc"},
+		{ID: "13", IPAddr: "10.10.0.6", SubnetId: "7", Owner: "node-b"},
+	}
+	if len(addresses) != len(expected) {
+		t.Fatalf("decoded %+v, expected %+v", addresses, expected)
+	}
+
+	for i := range expected {
+		if addresses[i] != expected[i] {
+			t.Errorf("decoded %+v, expected %+v", addresses[i], expected[i])
+		}
+	}
+
+	// without a destination the data is decoded into generic values
+	resp, err = decodeResponse(200, []byte(`{"code":200,"success":true,"data":{"subnet":{"id":7}}}`), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id, err := resp.getString("subnet.id")
+	if err != nil || id != "7" {
+		t.Errorf("subnet.id %q, error %v", id, err)
+	}
+}
+
+func TestFindIPAddressByNote(t *testing.T) {
+	p := fakePhpIPAM(t, map[string][]int{"dal10": {7, 8}}, map[string]string{
+		"/api/iks/subnets/7/addresses/": `[{"ip_addr":"10.10.0.5","owner":"node-a","note":"reservation old"}]`,
+		"/api/iks/subnets/8/addresses/": `[
+			{"ip_addr":"10.10.1.5","owner":"node-b","note":"reservation abc"},
+			{"ip_addr":"10.10.1.6","owner":"node-a","note":"reservation abc"}
+		]`,
+		"/api/iks/subnets/7/": `{"id":"7","mask":"24"}`,
+		"/api/iks/subnets/8/": `{"id":"8","mask":"25"}`,
+	})
+	p.PhpIPAMConfig.VlanMap = []VlanSubnetsSpec{{Vlan: "2263901", Subnets: []int{8}}}
+
+	zone := Placement{Zone: "dal10"}
+	vlan := Placement{Zone: "dal10", Labels: map[string]string{"privateVLAN": "2263901"}}
+
+	tests := []struct {
+		name      string
+		placement Placement
+		note      string
+		expected  string
+		subnetId  int
+	}{
+		{"owner", zone, "", "10.10.0.5/24", 7},
+		{"owner on vlan", vlan, "", "10.10.1.6/25", 8},
+		{"token", zone, "reservation abc", "10.10.1.6/25", 8},
+		{"other token", zone, "reservation def", "", 0},
+		{"token off vlan", vlan, "reservation old", "", 0},
+	}
+
+	for _, test := range tests {
+		var ipAddr string
+		var subnetId int
+		var err error
+		if test.note == "" {
+			ipAddr, subnetId, err = p.FindIPAddressByOwner("node-a", test.placement)
+		} else {
+			ipAddr, subnetId, err = p.FindIPAddressByNote("node-a", test.placement, test.note)
+		}
+
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+
+		if ipAddr != test.expected || subnetId != test.subnetId {
+			t.Errorf("%s: found %q in subnet %d, expected %q in subnet %d", test.name, ipAddr, subnetId, test.expected, test.subnetId)
+		}
+	}
+}
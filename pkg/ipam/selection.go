@@ -0,0 +1,265 @@
+package ipam
+
+import (
+	"fmt"
+	"net"
+	"sort"
+)
+
+// the strategies for choosing the subnet of the zone to reserve an address in
+const (
+	// SubnetSelectionOrdered tries the subnets in the order of the subnet map
+	SubnetSelectionOrdered = "ordered"
+
+	// SubnetSelectionLeastUtilized tries the subnet with the lowest share of used addresses first
+	SubnetSelectionLeastUtilized = "least-utilized"
+
+	// SubnetSelectionRoundRobin starts at the next subnet after the one tried first by the previous reservation
+	SubnetSelectionRoundRobin = "round-robin"
+
+	// SubnetSelectionLabelAffinity only uses the subnet mapped to the value of a node label, e.g. the worker pool
+	SubnetSelectionLabelAffinity = "label-affinity"
+)
+
+// SubnetSelectionSpec configures how the subnet of the zone is chosen when an address is reserved
+type SubnetSelectionSpec struct {
+	// Strategy ordered (the default), least-utilized, round-robin or label-affinity
+	Strategy string `yaml:"strategy"`
+
+	// Label the node label used by label-affinity, e.g. "ibm-cloud.kubernetes.io/worker-pool-name"
+	Label string `yaml:"label"`
+
+	// Affinity map of label value to subnet ID used by label-affinity, e.g. "pool-a": 7; addresses for nodes without
+	// the label or with a value that isn't mapped are reserved in the zone's subnets in order
+	Affinity map[string]int `yaml:"affinity"`
+}
+
+// VlanSubnetsSpec maps a private VLAN of a zone to the overlay subnets routed by its gateway appliance
+type VlanSubnetsSpec struct {
+	// Vlan the ID of the VLAN, matched with the value of the node's VLAN label, e.g. "2263901"
+	Vlan string `yaml:"vlan"`
+
+	// UnderlayCidr the subnet of the node addresses on the VLAN, matched with the node's addresses, e.g.
+	// "10.176.162.128/26"
+	UnderlayCidr string `yaml:"underlayCidr"`
+
+	// Subnets the IDs of the overlay subnets reachable from the VLAN, which must be in the zone's subnet map
+	Subnets []int `yaml:"subnets"`
+}
+
+// the node label with the private VLAN, set on IKS worker nodes
+const defaultVlanLabel = "privateVLAN"
+
+// Placement is what the subnet of an address is chosen by
+type Placement struct {
+	// Zone the zone of the node the address is for
+	Zone string
+
+	// Labels the labels of the node the address is for, used by label-affinity and to find its VLAN (optional)
+	Labels map[string]string
+
+	// UnderlayIps the addresses of the node on its private network, used to find its VLAN (optional)
+	UnderlayIps []string
+}
+
+// the subnet round-robin starts at for each zone; it's only kept by this process, so it starts over on a restart
+var roundRobinNext = map[string]int{}
+
+func (s *SubnetSelectionSpec) validate() error {
+	switch s.Strategy {
+	case "", SubnetSelectionOrdered, SubnetSelectionLeastUtilized, SubnetSelectionRoundRobin:
+		return nil
+	case SubnetSelectionLabelAffinity:
+		if s.Label == "" || len(s.Affinity) == 0 {
+			return fmt.Errorf("Subnet selection %s needs a label and an affinity map", s.Strategy)
+		}
+		return nil
+	}
+
+	return fmt.Errorf("Unknown subnet selection strategy %q, expected ordered, least-utilized, round-robin or label-affinity",
+		s.Strategy)
+}
+
+func validateVlanMap(vlanMap []VlanSubnetsSpec) error {
+	for _, entry := range vlanMap {
+		if entry.Vlan == "" && entry.UnderlayCidr == "" {
+			return fmt.Errorf("VLAN map entry for subnets %v needs a vlan or an underlayCidr", entry.Subnets)
+		}
+
+		if entry.UnderlayCidr != "" {
+			_, _, err := net.ParseCIDR(entry.UnderlayCidr)
+			if err != nil {
+				return fmt.Errorf("Invalid underlayCidr in VLAN map: %v", err)
+			}
+		}
+
+		if len(entry.Subnets) == 0 {
+			return fmt.Errorf("VLAN map entry for VLAN %q %s has no subnets", entry.Vlan, entry.UnderlayCidr)
+		}
+	}
+
+	return nil
+}
+
+// placementSubnets returns the subnets of the zone that are reachable from the node's VLAN, if the VLAN map is
+// configured and the node's VLAN is known, or else all the subnets of the zone.  The error is ErrUnreachable if the
+// node's VLAN isn't in the VLAN map, or none of its subnets are in the zone.
+func (p *PhpIPAM) placementSubnets(placement Placement) ([]int, error) {
+	subnetIds := p.PhpIPAMConfig.SubnetMap[placement.Zone]
+	if len(subnetIds) == 0 {
+		return nil, fmt.Errorf("No subnets are configured for zone %s", placement.Zone)
+	}
+
+	vlanMap := p.PhpIPAMConfig.VlanMap
+	if len(vlanMap) == 0 {
+		return subnetIds, nil
+	}
+
+	vlanLabel := p.PhpIPAMConfig.VlanLabel
+	if vlanLabel == "" {
+		vlanLabel = defaultVlanLabel
+	}
+
+	vlan := placement.Labels[vlanLabel]
+	if vlan == "" && len(placement.UnderlayIps) == 0 {
+		// e.g. an address that isn't for a node
+		return subnetIds, nil
+	}
+
+	entry := findVlan(vlanMap, vlan, placement.UnderlayIps)
+	if entry == nil {
+		return nil, fmt.Errorf("%w: the node's VLAN %q and addresses %v aren't in the VLAN map", ErrUnreachable,
+			vlan, placement.UnderlayIps)
+	}
+
+	inZone := map[int]bool{}
+	for _, subnetId := range subnetIds {
+		inZone[subnetId] = true
+	}
+
+	reachable := []int{}
+	for _, subnetId := range entry.Subnets {
+		if inZone[subnetId] {
+			reachable = append(reachable, subnetId)
+		}
+	}
+
+	if len(reachable) == 0 {
+		return nil, fmt.Errorf("%w: subnets %v of VLAN %q %s aren't in the subnet map of zone %s", ErrUnreachable,
+			entry.Subnets, entry.Vlan, entry.UnderlayCidr, placement.Zone)
+	}
+
+	return reachable, nil
+}
+
+// Reaches returns true if addresses for the placement can be reserved in the subnet, e.g. to check that a node can
+// bind an address that moves between nodes
+func (p *PhpIPAM) Reaches(placement Placement, subnetId int) bool {
+	subnetIds, err := p.placementSubnets(placement)
+	if err != nil {
+		return false
+	}
+
+	for _, id := range subnetIds {
+		if id == subnetId {
+			return true
+		}
+	}
+
+	return false
+}
+
+// findVlan returns the VLAN map entry for the VLAN, or the first one whose underlay CIDR has one of the addresses
+func findVlan(vlanMap []VlanSubnetsSpec, vlan string, underlayIps []string) *VlanSubnetsSpec {
+	if vlan != "" {
+		for i := range vlanMap {
+			if vlanMap[i].Vlan == vlan {
+				return &vlanMap[i]
+			}
+		}
+	}
+
+	for i := range vlanMap {
+		if vlanMap[i].UnderlayCidr == "" {
+			continue
+		}
+
+		_, cidr, err := net.ParseCIDR(vlanMap[i].UnderlayCidr)
+		if err != nil {
+			continue
+		}
+
+		for _, underlayIp := range underlayIps {
+			ip := net.ParseIP(underlayIp)
+			if ip != nil && cidr.Contains(ip) {
+				return &vlanMap[i]
+			}
+		}
+	}
+
+	return nil
+}
+
+// subnetOrder returns the subnets reachable by the placement to try reserving an address in, in order.  It's called
+// with reserveLock held.
+func (p *PhpIPAM) subnetOrder(placement Placement) ([]int, error) {
+	subnetIds, err := p.placementSubnets(placement)
+	if err != nil {
+		return nil, err
+	}
+
+	selection := p.PhpIPAMConfig.SubnetSelection
+	switch selection.Strategy {
+	case SubnetSelectionLeastUtilized:
+		return p.leastUtilized(subnetIds), nil
+
+	case SubnetSelectionRoundRobin:
+		start := roundRobinNext[placement.Zone] % len(subnetIds)
+		roundRobinNext[placement.Zone] = start + 1
+
+		return append(append([]int{}, subnetIds[start:]...), subnetIds[:start]...), nil
+
+	case SubnetSelectionLabelAffinity:
+		value, ok := placement.Labels[selection.Label]
+		if !ok {
+			return subnetIds, nil
+		}
+
+		subnetId, ok := selection.Affinity[value]
+		if !ok {
+			return subnetIds, nil
+		}
+
+		for _, id := range subnetIds {
+			if id == subnetId {
+				return []int{subnetId}, nil
+			}
+		}
+
+		return nil, fmt.Errorf("%w: subnet %d for %s=%s isn't one of the subnets %v of zone %s reachable from the node",
+			ErrUnreachable, subnetId, selection.Label, value, subnetIds, placement.Zone)
+	}
+
+	return subnetIds, nil
+}
+
+// leastUtilized returns the subnets sorted by the share of their addresses that are used; subnets whose usage can't
+// be read are tried last
+func (p *PhpIPAM) leastUtilized(subnetIds []int) []int {
+	utilization := map[int]float64{}
+	for _, subnetId := range subnetIds {
+		usage, err := p.GetSubnetUsage(subnetId)
+		if err != nil || usage.MaxHosts <= 0 {
+			log.Info("Unable to get usage of subnet, trying it last", "subnet", subnetId, "error", fmt.Sprint(err))
+			utilization[subnetId] = 2
+			continue
+		}
+
+		utilization[subnetId] = usage.Used / usage.MaxHosts
+	}
+
+	sorted := append([]int{}, subnetIds...)
+	sort.SliceStable(sorted, func(i, j int) bool { return utilization[sorted[i]] < utilization[sorted[j]] })
+
+	return sorted
+}
@@ -0,0 +1,303 @@
+package ipam
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+var testVlanMap = []VlanSubnetsSpec{
+	{Vlan: "2263901", Subnets: []int{7, 8}},
+	{Vlan: "2263902", UnderlayCidr: "10.176.162.128/26", Subnets: []int{9}},
+	{UnderlayCidr: "10.176.163.0/26", Subnets: []int{8, 10}},
+	{Vlan: "2263904", Subnets: []int{11}},
+}
+
+func TestFindVlan(t *testing.T) {
+	tests := []struct {
+		name        string
+		vlan        string
+		underlayIps []string
+		expected    int
+	}{
+		{"vlan", "2263901", nil, 0},
+		{"vlan before addresses", "2263901", []string{"10.176.162.130"}, 0},
+		{"unknown vlan", "2263999", nil, -1},
+		{"address", "", []string{"10.176.162.130"}, 1},
+		{"address without the vlan", "", []string{"10.176.163.5"}, 2},
+		{"second address", "", []string{"192.168.0.1", "10.176.163.5"}, 2},
+		{"unknown vlan with address", "2263999", []string{"10.176.162.130"}, 1},
+		{"invalid address", "", []string{"not-an-ip"}, -1},
+		{"nothing", "", nil, -1},
+	}
+
+	for _, test := range tests {
+		entry := findVlan(testVlanMap, test.vlan, test.underlayIps)
+
+		var expected *VlanSubnetsSpec
+		if test.expected >= 0 {
+			expected = &testVlanMap[test.expected]
+		}
+
+		if entry != expected {
+			t.Errorf("%s: found %+v, expected %+v", test.name, entry, expected)
+		}
+	}
+}
+
+func TestPlacementSubnets(t *testing.T) {
+	subnetMap := map[string][]int{"dal10": {7, 8, 9, 10}, "dal12": {20}}
+
+	tests := []struct {
+		name      string
+		vlanMap   []VlanSubnetsSpec
+		vlanLabel string
+		placement Placement
+		expected  []int
+		err       error
+	}{
+		{
+			name:      "no vlan map",
+			placement: Placement{Zone: "dal10", Labels: map[string]string{"privateVLAN": "2263901"}},
+			expected:  []int{7, 8, 9, 10},
+		},
+		{
+			name:      "not a node",
+			vlanMap:   testVlanMap,
+			placement: Placement{Zone: "dal10"},
+			expected:  []int{7, 8, 9, 10},
+		},
+		{
+			name:      "vlan label",
+			vlanMap:   testVlanMap,
+			placement: Placement{Zone: "dal10", Labels: map[string]string{"privateVLAN": "2263901"}},
+			expected:  []int{7, 8},
+		},
+		{
+			name:      "custom vlan label",
+			vlanMap:   testVlanMap,
+			vlanLabel: "vlan",
+			placement: Placement{Zone: "dal10", Labels: map[string]string{"privateVLAN": "2263901", "vlan": "2263902"}},
+			expected:  []int{9},
+		},
+		{
+			name:      "underlay address",
+			vlanMap:   testVlanMap,
+			placement: Placement{Zone: "dal10", UnderlayIps: []string{"10.176.163.5"}},
+			expected:  []int{8, 10},
+		},
+		{
+			name:      "unknown vlan",
+			vlanMap:   testVlanMap,
+			placement: Placement{Zone: "dal10", Labels: map[string]string{"privateVLAN": "2263999"}},
+			err:       ErrUnreachable,
+		},
+		{
+			name:      "vlan subnets in another zone",
+			vlanMap:   testVlanMap,
+			placement: Placement{Zone: "dal12", Labels: map[string]string{"privateVLAN": "2263904"}},
+			err:       ErrUnreachable,
+		},
+	}
+
+	for _, test := range tests {
+		p := testIPAM("iks")
+		p.PhpIPAMConfig.SubnetMap = subnetMap
+		p.PhpIPAMConfig.VlanMap = test.vlanMap
+		p.PhpIPAMConfig.VlanLabel = test.vlanLabel
+
+		subnetIds, err := p.placementSubnets(test.placement)
+		if test.err != nil {
+			if !errors.Is(err, test.err) {
+				t.Errorf("%s: error %v, expected %v", test.name, err, test.err)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(subnetIds, test.expected) {
+			t.Errorf("%s: subnets %v, expected %v", test.name, subnetIds, test.expected)
+		}
+	}
+
+	// a zone without subnets is a configuration error, not an unreachable subnet
+	p := testIPAM("iks")
+	p.PhpIPAMConfig.SubnetMap = subnetMap
+	_, err := p.placementSubnets(Placement{Zone: "dal13"})
+	if err == nil || IsUnreachable(err) {
+		t.Errorf("zone without subnets: error %v", err)
+	}
+}
+
+func TestReaches(t *testing.T) {
+	p := testIPAM("iks")
+	p.PhpIPAMConfig.SubnetMap = map[string][]int{"dal10": {7, 8, 9, 10}}
+	p.PhpIPAMConfig.VlanMap = testVlanMap
+
+	tests := []struct {
+		name      string
+		placement Placement
+		subnetId  int
+		expected  bool
+	}{
+		{"zone", Placement{Zone: "dal10"}, 9, true},
+		{"vlan subnet", Placement{Zone: "dal10", Labels: map[string]string{"privateVLAN": "2263901"}}, 8, true},
+		{"other vlan subnet", Placement{Zone: "dal10", Labels: map[string]string{"privateVLAN": "2263901"}}, 9, false},
+		{"unknown vlan", Placement{Zone: "dal10", Labels: map[string]string{"privateVLAN": "2263999"}}, 7, false},
+		{"other zone", Placement{Zone: "dal12"}, 7, false},
+	}
+
+	for _, test := range tests {
+		if reaches := p.Reaches(test.placement, test.subnetId); reaches != test.expected {
+			t.Errorf("%s: reaches %v, expected %v", test.name, reaches, test.expected)
+		}
+	}
+}
+
+func TestSubnetOrder(t *testing.T) {
+	subnetMap := map[string][]int{"dal10": {7, 8, 9}}
+	affinity := SubnetSelectionSpec{
+		Strategy: SubnetSelectionLabelAffinity,
+		Label:    "pool",
+		Affinity: map[string]int{"pool-a": 8, "pool-b": 20},
+	}
+
+	tests := []struct {
+		name      string
+		selection SubnetSelectionSpec
+		vlanMap   []VlanSubnetsSpec
+		labels    map[string]string
+		expected  []int
+		err       error
+	}{
+		{"default", SubnetSelectionSpec{}, nil, nil, []int{7, 8, 9}, nil},
+		{"ordered", SubnetSelectionSpec{Strategy: SubnetSelectionOrdered}, nil, nil, []int{7, 8, 9}, nil},
+		{"affinity", affinity, nil, map[string]string{"pool": "pool-a"}, []int{8}, nil},
+		{"affinity without the label", affinity, nil, nil, []int{7, 8, 9}, nil},
+		{"affinity without a mapped value", affinity, nil, map[string]string{"pool": "pool-c"}, []int{7, 8, 9}, nil},
+		{"affinity subnet not in the zone", affinity, nil, map[string]string{"pool": "pool-b"}, nil, ErrUnreachable},
+		{
+			"affinity subnet not reachable from the vlan",
+			affinity,
+			[]VlanSubnetsSpec{{Vlan: "2263901", Subnets: []int{7, 9}}},
+			map[string]string{"pool": "pool-a", "privateVLAN": "2263901"},
+			nil,
+			ErrUnreachable,
+		},
+		{
+			"ordered within the vlan",
+			SubnetSelectionSpec{},
+			[]VlanSubnetsSpec{{Vlan: "2263901", Subnets: []int{9, 7}}},
+			map[string]string{"privateVLAN": "2263901"},
+			[]int{9, 7},
+			nil,
+		},
+	}
+
+	for _, test := range tests {
+		p := testIPAM("iks")
+		p.PhpIPAMConfig.SubnetMap = subnetMap
+		p.PhpIPAMConfig.SubnetSelection = test.selection
+		p.PhpIPAMConfig.VlanMap = test.vlanMap
+
+		subnetIds, err := p.subnetOrder(Placement{Zone: "dal10", Labels: test.labels})
+		if test.err != nil {
+			if !errors.Is(err, test.err) {
+				t.Errorf("%s: error %v, expected %v", test.name, err, test.err)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(subnetIds, test.expected) {
+			t.Errorf("%s: subnets %v, expected %v", test.name, subnetIds, test.expected)
+		}
+	}
+}
+
+func TestSubnetOrderRoundRobin(t *testing.T) {
+	roundRobinNext = map[string]int{}
+	t.Cleanup(func() { roundRobinNext = map[string]int{} })
+
+	p := testIPAM("iks")
+	p.PhpIPAMConfig.SubnetMap = map[string][]int{"dal10": {7, 8, 9}, "dal12": {20, 21}}
+	p.PhpIPAMConfig.SubnetSelection = SubnetSelectionSpec{Strategy: SubnetSelectionRoundRobin}
+
+	tests := []struct {
+		zone     string
+		expected []int
+	}{
+		{"dal10", []int{7, 8, 9}},
+		{"dal10", []int{8, 9, 7}},
+		{"dal12", []int{20, 21}},
+		{"dal10", []int{9, 7, 8}},
+		{"dal10", []int{7, 8, 9}},
+		{"dal12", []int{21, 20}},
+	}
+
+	for i, test := range tests {
+		subnetIds, err := p.subnetOrder(Placement{Zone: test.zone})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !reflect.DeepEqual(subnetIds, test.expected) {
+			t.Errorf("reservation %d in %s: subnets %v, expected %v", i, test.zone, subnetIds, test.expected)
+		}
+	}
+
+	// the subnet map is left unchanged
+	if !reflect.DeepEqual(p.PhpIPAMConfig.SubnetMap["dal10"], []int{7, 8, 9}) {
+		t.Errorf("subnet map changed to %v", p.PhpIPAMConfig.SubnetMap["dal10"])
+	}
+}
+
+func TestLeastUtilized(t *testing.T) {
+	p := fakePhpIPAM(t, map[string][]int{"dal10": {7, 8, 9, 10, 11}}, map[string]string{
+		"/api/iks/subnets/7/usage/":  `{"maxhosts":"254","used":"200","freehosts":"54"}`,
+		"/api/iks/subnets/8/usage/":  `{"maxhosts":254,"used":10,"freehosts":244}`,
+		"/api/iks/subnets/9/usage/":  `{"maxhosts":"62","used":"10","freehosts":"52"}`,
+		"/api/iks/subnets/10/usage/": `{"maxhosts":"0","used":"0","freehosts":"0"}`,
+	})
+	p.PhpIPAMConfig.SubnetSelection = SubnetSelectionSpec{Strategy: SubnetSelectionLeastUtilized}
+
+	// subnet 11 has no usage and 10 has no hosts, so they're tried last in the order of the subnet map
+	expected := []int{8, 9, 7, 10, 11}
+
+	subnetIds, err := p.subnetOrder(Placement{Zone: "dal10"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(subnetIds, expected) {
+		t.Errorf("subnets %v, expected %v", subnetIds, expected)
+	}
+}
+
+func TestSubnetSelectionValidate(t *testing.T) {
+	tests := []struct {
+		name      string
+		selection SubnetSelectionSpec
+		valid     bool
+	}{
+		{"default", SubnetSelectionSpec{}, true},
+		{"least-utilized", SubnetSelectionSpec{Strategy: SubnetSelectionLeastUtilized}, true},
+		{"affinity", SubnetSelectionSpec{Strategy: SubnetSelectionLabelAffinity, Label: "pool", Affinity: map[string]int{"a": 7}}, true},
+		{"affinity without a label", SubnetSelectionSpec{Strategy: SubnetSelectionLabelAffinity, Affinity: map[string]int{"a": 7}}, false},
+		{"unknown", SubnetSelectionSpec{Strategy: "random"}, false},
+	}
+
+	for _, test := range tests {
+		if err := test.selection.validate(); (err == nil) != test.valid {
+			t.Errorf("%s: validate returned %v", test.name, err)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	crmetrics "sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+const namespace = "overlay"
+
+var (
+	// IPAMPoolSize is the number of usable addresses in each IPAM subnet
+	IPAMPoolSize = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "ipam",
+		Name:      "pool_size",
+		Help:      "Number of usable addresses in the IPAM subnet",
+	}, []string{"zone", "subnet"})
+
+	// IPAMPoolUsed is the number of used addresses in each IPAM subnet
+	IPAMPoolUsed = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "ipam",
+		Name:      "pool_used",
+		Help:      "Number of addresses in use in the IPAM subnet",
+	}, []string{"zone", "subnet"})
+
+	// IPAMPoolFree is the number of free addresses in each IPAM subnet
+	IPAMPoolFree = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "ipam",
+		Name:      "pool_free",
+		Help:      "Number of free addresses in the IPAM subnet",
+	}, []string{"zone", "subnet"})
+
+	// IPAMRequestDuration is the latency of calls to the IPAM API
+	IPAMRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "ipam",
+		Name:      "request_duration_seconds",
+		Help:      "Latency of IPAM API calls in seconds, by method and endpoint",
+		Buckets:   prometheus.ExponentialBuckets(0.01, 2, 10),
+	}, []string{"method", "endpoint"})
+
+	// IPAMRequestErrors counts failed calls to the IPAM API
+	IPAMRequestErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "ipam",
+		Name:      "request_errors_total",
+		Help:      "Number of IPAM API calls that failed or returned an unsuccessful response, by method and endpoint",
+	}, []string{"method", "endpoint"})
+
+	// IPAMReservations counts addresses reserved in IPAM
+	IPAMReservations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "ipam",
+		Name:      "reservations_total",
+		Help:      "Number of overlay addresses reserved in IPAM, by zone and result",
+	}, []string{"zone", "result"})
+
+	// IPAMReleases counts addresses released in IPAM
+	IPAMReleases = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "ipam",
+		Name:      "releases_total",
+		Help:      "Number of overlay addresses released in IPAM, by result",
+	}, []string{"result"})
+
+	// NodeOverlayConfigured is 1 when the network pod has configured the node's overlay IP
+	NodeOverlayConfigured = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "node_configured",
+		Help:      "Whether the network pod has configured the overlay IP on the node (1) or not (0)",
+	}, []string{"node", "zone"})
+
+	// AgentRouteInstalled is 1 for each static route the network pod has installed on its node
+	AgentRouteInstalled = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "agent",
+		Name:      "route_installed",
+		Help:      "Static routes installed on the node by the network pod, by StaticRoute subnet and gateway",
+	}, []string{"subnet", "gateway"})
+
+	// AgentDriftCorrections counts host state the network pod found differing from the CRs and fixed
+	AgentDriftCorrections = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "agent",
+		Name:      "drift_corrections_total",
+		Help:      "Number of times the network pod corrected host network state that drifted from the CRs, by resource",
+	}, []string{"resource"})
+
+	// AgentCommandFailures counts failed ip commands run by the network pod
+	AgentCommandFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "agent",
+		Name:      "command_failures_total",
+		Help:      "Number of ip, bridge and wg commands that failed to run or exited non-zero, by command",
+	}, []string{"command"})
+
+	// AgentBGPSessionUp is 1 while the BGP session with a peer is established
+	AgentBGPSessionUp = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "agent",
+		Name:      "bgp_session_up",
+		Help:      "Whether the BGP session with the peer is established",
+	}, []string{"peer"})
+)
+
+func init() {
+	// register with the controller-runtime registry so the metrics are served
+	// on the manager's metrics port
+	crmetrics.Registry.MustRegister(
+		IPAMPoolSize,
+		IPAMPoolUsed,
+		IPAMPoolFree,
+		IPAMRequestDuration,
+		IPAMRequestErrors,
+		IPAMReservations,
+		IPAMReleases,
+		NodeOverlayConfigured,
+		AgentRouteInstalled,
+		AgentDriftCorrections,
+		AgentCommandFailures,
+		AgentBGPSessionUp,
+	)
+}
+
+// Result returns the label value for the result of an operation
+func Result(err error) string {
+	if err != nil {
+		return "error"
+	}
+
+	return "success"
+}
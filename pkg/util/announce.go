@@ -0,0 +1,148 @@
+package util
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// the number of gratuitous ARPs or unsolicited neighbor advertisements sent after an address is added
+var announceCount = 3
+
+// the interval between the advertisements, the same as arping's
+var announceInterval = time.Second
+
+// the IFF_NOARP device flag, set on devices that don't resolve neighbors, e.g. dummy, wireguard and tunnel devices
+const iffNoArp = 0x80
+
+// SetAnnounceCount sets the number of advertisements sent by AnnounceAddress
+func SetAnnounceCount(count int) {
+	if count > 0 {
+		announceCount = count
+	}
+}
+
+// AnnounceAddress tells the other hosts on the device's network that the IP is now on this node, with gratuitous
+// ARPs for an IPv4 address or unsolicited neighbor advertisements for an IPv6 address, so they don't keep sending to
+// the MAC address of the node that had it before.  Devices without neighbor resolution are skipped, and nothing is sent
+// in dry-run mode.
+func AnnounceAddress(device string, ip string) error {
+	addr := net.ParseIP(strings.Split(ip, "/")[0])
+	if addr == nil {
+		return fmt.Errorf("Invalid IP address %q", ip)
+	}
+
+	if !resolvesNeighbors(device) || dryRun {
+		return nil
+	}
+
+	if addr.To4() != nil {
+		return sendGratuitousArp(device, addr.String())
+	}
+
+	return sendUnsolicitedNa(device, addr)
+}
+
+// FlushNeighbor removes the neighbor entry of the IP on the device, e.g. of the gateway, so the node resolves its MAC
+// address again instead of using a stale entry.  In dry-run mode the flush is recorded in the plan.
+func FlushNeighbor(plan *Plan, device string, ip string) error {
+	out, code, err := plan.ExecIpCmd(fmt.Sprintf("neigh flush to %s dev %s", ip, device))
+	if err != nil {
+		return err
+	}
+
+	if code != 0 {
+		return fmt.Errorf("Error executing \"ip neigh flush\", output: %s", out)
+	}
+
+	return nil
+}
+
+func sendGratuitousArp(device string, ip string) error {
+	out, code, err := ExecArpingCmd(fmt.Sprintf("-U -c %d -I %s %s", announceCount, device, ip))
+	if err != nil {
+		return err
+	}
+
+	if code != 0 {
+		return fmt.Errorf("Error executing \"arping\", output: %s", out)
+	}
+
+	return nil
+}
+
+// sendUnsolicitedNa sends neighbor advertisements for the IP with the override flag to all nodes on the device's
+// link, as described in RFC 4861 section 7.2.6
+func sendUnsolicitedNa(device string, ip net.IP) error {
+	intf, err := net.InterfaceByName(device)
+	if err != nil {
+		return err
+	}
+
+	conn, err := net.ListenPacket("ip6:ipv6-icmp", "::")
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// neighbor discovery messages are dropped unless the hop limit is 255
+	rawConn, err := conn.(*net.IPConn).SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var sockErr error
+	err = rawConn.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_MULTICAST_HOPS, 255)
+	})
+	if err != nil {
+		return err
+	}
+
+	if sockErr != nil {
+		return sockErr
+	}
+
+	// type, code, checksum (filled in by the kernel), flags, target address and the target link-layer address option
+	msg := []byte{136, 0, 0, 0, 0x20, 0, 0, 0}
+	msg = append(msg, ip.To16()...)
+	msg = append(msg, 2, byte((2+len(intf.HardwareAddr)+7)/8))
+	msg = append(msg, intf.HardwareAddr...)
+	for len(msg)%8 != 0 {
+		msg = append(msg, 0)
+	}
+
+	allNodes := &net.IPAddr{IP: net.ParseIP("ff02::1"), Zone: device}
+	for i := 0; i < announceCount; i++ {
+		if i > 0 {
+			time.Sleep(announceInterval)
+		}
+
+		log.Info("Sending unsolicited neighbor advertisement", "device", device, "ipAddr", ip.String())
+		_, err = conn.WriteTo(msg, allNodes)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// resolvesNeighbors returns false if the device has the NOARP flag
+func resolvesNeighbors(device string) bool {
+	out, err := ioutil.ReadFile(fmt.Sprintf("/sys/class/net/%s/flags", device))
+	if err != nil {
+		return true
+	}
+
+	flags, err := strconv.ParseInt(strings.TrimSpace(string(out)), 0, 64)
+	if err != nil {
+		return true
+	}
+
+	return flags&iffNoArp == 0
+}
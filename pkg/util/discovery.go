@@ -0,0 +1,32 @@
+package util
+
+import (
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/rest"
+)
+
+// HasKind returns true if the kind is served in iks.ibm.com/v1alpha1, i.e. its CRD is installed
+func HasKind(cfg *rest.Config, kind string) (bool, error) {
+	client, err := discovery.NewDiscoveryClientForConfig(cfg)
+	if err != nil {
+		return false, err
+	}
+
+	resources, err := client.ServerResourcesForGroupVersion("iks.ibm.com/v1alpha1")
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return false, nil
+		}
+
+		return false, err
+	}
+
+	for _, resource := range resources.APIResources {
+		if resource.Kind == kind {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
@@ -0,0 +1,120 @@
+package util
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
+)
+
+// in dry-run mode, commands that change the host are logged and recorded in the plan instead of run
+var dryRun = false
+
+// PlanStep is a command that would have changed the host in dry-run mode
+type PlanStep struct {
+	// Action add, replace or delete
+	Action string `json:"action"`
+
+	// Command the command that would have run, e.g. "ip route add 192.168.0.0/24 via 192.168.100.1"
+	Command string `json:"command"`
+}
+
+// Plan records the commands one reconcile skipped in dry-run mode, so they can be published on its object.  Each
+// reconcile passes its own plan to the commands it runs, so concurrent reconciles don't wait for each other or mix their
+// steps.  Commands run with a nil Plan are skipped in dry-run mode without being recorded.
+type Plan struct {
+	steps []PlanStep
+}
+
+// SetDryRun enables dry-run mode
+func SetDryRun(enabled bool) {
+	dryRun = enabled
+}
+
+// DryRun returns true in dry-run mode
+func DryRun() bool {
+	return dryRun
+}
+
+// NewPlan returns a Plan to record the commands of a reconcile in dry-run mode, and nil otherwise
+func NewPlan() *Plan {
+	if !dryRun {
+		return nil
+	}
+
+	return &Plan{}
+}
+
+// Steps returns the commands recorded in the plan
+func (p *Plan) Steps() []PlanStep {
+	if p == nil {
+		return nil
+	}
+
+	return p.steps
+}
+
+func (p *Plan) add(step PlanStep) {
+	if p == nil {
+		return
+	}
+
+	p.steps = append(p.steps, step)
+}
+
+// PublishPlan records an event on the object for each step of the plan, so it can be reviewed with
+// "kubectl describe"
+func PublishPlan(recorder record.EventRecorder, object runtime.Object, steps []PlanStep) {
+	for _, step := range steps {
+		recorder.Event(object, corev1.EventTypeNormal, "DryRun", fmt.Sprintf("%s: %s", step.Action, step.Command))
+	}
+}
+
+// skipInDryRun returns true if the command changes the host and must not be run in dry-run mode, and records it in
+// the plan
+func skipInDryRun(plan *Plan, bin string, cmdStrArr []string, label string) bool {
+	if !dryRun {
+		return false
+	}
+
+	action, changesHost := planAction(label)
+	if !changesHost {
+		return false
+	}
+
+	command := filepath.Base(bin) + " " + strings.Join(cmdStrArr, " ")
+	log.Info("Dry run, not executing command", "action", action, "command", command)
+	if action != "" {
+		plan.add(PlanStep{Action: action, Command: command})
+	}
+
+	return true
+}
+
+// planAction returns the kind of change a command makes from its metric label, e.g. "route add" or "iptables delete",
+// and false for commands that only read the host
+func planAction(label string) (string, bool) {
+	if label == "arping" {
+		// announcements don't change the host, but tell other hosts the address moved
+		return "", true
+	}
+
+	words := strings.Fields(label)
+	if len(words) < 2 {
+		return "", false
+	}
+
+	switch words[len(words)-1] {
+	case "add", "append", "insert", "new-chain":
+		return "add", true
+	case "set", "replace", "change":
+		return "replace", true
+	case "del", "delete", "flush":
+		return "delete", true
+	}
+
+	return "", false
+}
@@ -0,0 +1,62 @@
+package util
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPlanAction(t *testing.T) {
+	tests := []struct {
+		label       string
+		action      string
+		changesHost bool
+	}{
+		{"route add", "add", true},
+		{"iptables append", "add", true},
+		{"link set", "replace", true},
+		{"addr del", "delete", true},
+		{"neigh flush", "delete", true},
+		{"route show", "", false},
+		{"ping", "", false},
+		{"arping", "", true},
+	}
+
+	for _, test := range tests {
+		action, changesHost := planAction(test.label)
+		if action != test.action || changesHost != test.changesHost {
+			t.Errorf("planAction(%q) = %q, %v, expected %q, %v", test.label, action, changesHost, test.action, test.changesHost)
+		}
+	}
+}
+
+func TestPlan(t *testing.T) {
+	SetDryRun(true)
+	t.Cleanup(func() { SetDryRun(false) })
+
+	// each reconcile records its own steps
+	first, second := NewPlan(), NewPlan()
+	first.ExecIpCmd("route add 192.168.0.0/24 via 10.0.0.1")
+	second.ExecIpCmd("link del tmp0")
+	first.ExecIpCmd("addr del 10.10.0.5/24 dev tmp0")
+
+	// commands without a plan are skipped without being recorded
+	ExecIpCmd("route del 192.168.1.0/24")
+
+	expected := []PlanStep{
+		{Action: "add", Command: "ip route add 192.168.0.0/24 via 10.0.0.1"},
+		{Action: "delete", Command: "ip addr del 10.10.0.5/24 dev tmp0"},
+	}
+	if steps := first.Steps(); !reflect.DeepEqual(steps, expected) {
+		t.Errorf("first plan %+v, expected %+v", steps, expected)
+	}
+
+	expected = []PlanStep{{Action: "delete", Command: "ip link del tmp0"}}
+	if steps := second.Steps(); !reflect.DeepEqual(steps, expected) {
+		t.Errorf("second plan %+v, expected %+v", steps, expected)
+	}
+
+	SetDryRun(false)
+	if plan := NewPlan(); plan != nil || plan.Steps() != nil {
+		t.Error("expected no plan outside dry-run mode")
+	}
+}
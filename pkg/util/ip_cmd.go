@@ -4,20 +4,87 @@ import (
 	"strings"
 	"bytes"
 	"os/exec"
+	"path/filepath"
 	"syscall"
 
+	"github.com/jkwong888/iks-overlay-ip-controller/pkg/metrics"
 	logf "sigs.k8s.io/controller-runtime/pkg/runtime/log"
 )
 
 var log = logf.Log.WithName("ip_cmd")
 var iproute_bin = "/usr/sbin/ip"
+var bridge_bin = "/usr/sbin/bridge"
+var wg_bin = "/usr/bin/wg"
+var nsenter_bin = "/usr/bin/nsenter"
+var iptables_bin = "/usr/sbin/iptables"
+var arping_bin = "/usr/sbin/arping"
+var ping_bin = "/usr/bin/ping"
+
+// LookupBinaries finds the binaries in the PATH instead of their locations in the network pod image, for commands
+// run directly on the host, e.g. by the CNI plugin
+func LookupBinaries() {
+	for _, bin := range []*string{&iproute_bin, &bridge_bin, &wg_bin, &nsenter_bin, &iptables_bin, &arping_bin, &ping_bin} {
+		if path, err := exec.LookPath(filepath.Base(*bin)); err == nil {
+			*bin = path
+		}
+	}
+}
 
 func ExecIpCmd(cmdStr string) (string, int, error) {
-	// tokenize cmdStr
 	cmdStrArr := strings.Split(cmdStr, " ")
+	return execCmd(nil, iproute_bin, cmdStrArr, cmdLabel(cmdStrArr))
+}
+
+// ExecBridgeCmd runs a "bridge" command, e.g. to manage the forwarding database of a vxlan device
+func ExecBridgeCmd(cmdStr string) (string, int, error) {
+	cmdStrArr := strings.Split(cmdStr, " ")
+	return execCmd(nil, bridge_bin, cmdStrArr, cmdLabel(cmdStrArr))
+}
+
+// ExecWgCmd runs a "wg" command to configure a wireguard device
+func ExecWgCmd(cmdStr string) (string, int, error) {
+	cmdStrArr := strings.Split(cmdStr, " ")
+	return execCmd(nil, wg_bin, cmdStrArr, "wg "+cmdStrArr[0])
+}
+
+// ExecIptablesCmd runs an "iptables" command, e.g. "-t nat -A OVERLAY-SNAT ...".  It waits for the xtables lock
+// held by kube-proxy and the CNI plugins instead of failing while they update their rules.
+func ExecIptablesCmd(cmdStr string) (string, int, error) {
+	cmdStrArr := strings.Split(cmdStr, " ")
+	return execCmd(nil, iptables_bin, append([]string{"-w"}, cmdStrArr...), iptablesLabel(cmdStrArr))
+}
+
+// ExecNetnsIpCmd runs an "ip" command in the network namespace at the path, e.g. of a pod sandbox
+func ExecNetnsIpCmd(netns string, cmdStr string) (string, int, error) {
+	cmdStrArr := strings.Split(cmdStr, " ")
+	return execCmd(nil, nsenter_bin, append([]string{"--net=" + netns, iproute_bin}, cmdStrArr...), cmdLabel(cmdStrArr))
+}
 
-	log.Info("Executing ip command", "command", strings.Join(cmdStrArr, " "))
-	cmd := exec.Command(iproute_bin, cmdStrArr...)
+// ExecArpingCmd runs an "arping" command
+func ExecArpingCmd(cmdStr string) (string, int, error) {
+	cmdStrArr := strings.Split(cmdStr, " ")
+	return execCmd(nil, arping_bin, cmdStrArr, "arping")
+}
+
+// ExecPingCmd runs a "ping" command, e.g. to probe the path MTU
+func ExecPingCmd(cmdStr string) (string, int, error) {
+	cmdStrArr := strings.Split(cmdStr, " ")
+	return execCmd(nil, ping_bin, cmdStrArr, "ping")
+}
+
+// ExecIpCmd runs an "ip" command like ExecIpCmd, and records it in the plan if it's skipped in dry-run mode
+func (p *Plan) ExecIpCmd(cmdStr string) (string, int, error) {
+	cmdStrArr := strings.Split(cmdStr, " ")
+	return execCmd(p, iproute_bin, cmdStrArr, cmdLabel(cmdStrArr))
+}
+
+func execCmd(plan *Plan, bin string, cmdStrArr []string, label string) (string, int, error) {
+	if skipInDryRun(plan, bin, cmdStrArr, label) {
+		return "", 0, nil
+	}
+
+	log.Info("Executing command", "binary", bin, "command", strings.Join(cmdStrArr, " "))
+	cmd := exec.Command(bin, cmdStrArr...)
 
 	var stdout, stderr bytes.Buffer
     cmd.Stdout = &stdout
@@ -25,6 +92,7 @@ func ExecIpCmd(cmdStr string) (string, int, error) {
 
 	err := cmd.Start()
 	if err != nil {
+		metrics.AgentCommandFailures.WithLabelValues(label).Inc()
 		return "", 1, err
 	}
 
@@ -37,14 +105,54 @@ func ExecIpCmd(cmdStr string) (string, int, error) {
             // defined for both Unix and Windows and in both cases has
             // an ExitStatus() method with the same signature.
             if status, ok := exiterr.Sys().(syscall.WaitStatus); ok {
+				// a non-zero exit from a "show" just means the object doesn't exist, and from a "ping" that the
+				// probe wasn't answered
+				if !strings.HasSuffix(label, " show") && label != "ping" {
+					metrics.AgentCommandFailures.WithLabelValues(label).Inc()
+				}
 				return string(stderr.Bytes()), status.ExitStatus(), nil
             }
         } else {
+			metrics.AgentCommandFailures.WithLabelValues(label).Inc()
 			return string(stderr.Bytes()), 1, err
         }
 	}
 
-	log.Info("ip command executed", "command", strings.Join(cmdStrArr, " "), "output", string(stdout.Bytes()), "error", string(stderr.Bytes()))
+	log.Info("Command executed", "binary", bin, "command", strings.Join(cmdStrArr, " "), "output", string(stdout.Bytes()), "error", string(stderr.Bytes()))
 
 	return string(stdout.Bytes()), 0, nil
 }
+
+// cmdLabel returns the object and action of an ip command, e.g. "route add", to use as a metric label
+func cmdLabel(cmdStrArr []string) string {
+	// skip options, e.g. "-d link show"
+	for len(cmdStrArr) > 0 && strings.HasPrefix(cmdStrArr[0], "-") {
+		cmdStrArr = cmdStrArr[1:]
+	}
+
+	if len(cmdStrArr) < 2 {
+		return strings.Join(cmdStrArr, " ")
+	}
+
+	return strings.Join(cmdStrArr[:2], " ")
+}
+
+// iptablesLabel returns the command of an iptables command, e.g. "iptables append", to use as a metric label
+func iptablesLabel(cmdStrArr []string) string {
+	commands := map[string]string{
+		"-A": "append",
+		"-D": "delete",
+		"-I": "insert",
+		"-N": "new-chain",
+		"-F": "flush",
+		"-S": "show",
+	}
+
+	for _, arg := range cmdStrArr {
+		if command, ok := commands[arg]; ok {
+			return "iptables " + command
+		}
+	}
+
+	return "iptables"
+}
@@ -0,0 +1,173 @@
+package util
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MinIpv4Mtu is the smallest MTU probed, every IPv4 link must carry it; IPv6 links must carry 1280
+const MinIpv4Mtu = 576
+const minIpv6Mtu = 1280
+
+// how many pings of a size go unanswered before it's taken as too large, so one lost reply doesn't lower the result
+const probeAttempts = 3
+
+// LinkMtu returns the MTU of the device
+func LinkMtu(device string) (int, error) {
+	out, err := ioutil.ReadFile(fmt.Sprintf("/sys/class/net/%s/mtu", device))
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.Atoi(strings.TrimSpace(string(out)))
+}
+
+// ProbePathMtu returns the largest packet size up to maxMtu that reaches the IP through the device without being
+// fragmented, found by pinging it with the don't fragment bit set.  It returns 0 if the IP doesn't answer pings.
+func ProbePathMtu(device string, ip string, maxMtu int) (int, error) {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return 0, fmt.Errorf("Invalid IP address %q", ip)
+	}
+
+	// the ping payload excludes the IP and ICMP headers
+	minMtu, headers := MinIpv4Mtu, 28
+	if addr.To4() == nil {
+		minMtu, headers = minIpv6Mtu, 48
+	}
+
+	if maxMtu < minMtu {
+		return 0, fmt.Errorf("MTU %d of device %s is too small to probe", maxMtu, device)
+	}
+
+	fits := func(mtu int) (bool, error) {
+		for i := 0; i < probeAttempts; i++ {
+			_, code, err := ExecPingCmd(fmt.Sprintf("-c 1 -W 1 -M do -s %d -I %s %s", mtu-headers, device, addr.String()))
+			if err != nil {
+				return false, err
+			}
+
+			if code == 0 {
+				return true, nil
+			}
+		}
+
+		return false, nil
+	}
+
+	// the whole device MTU usually fits, so try it first
+	ok, err := fits(maxMtu)
+	if err != nil {
+		return 0, err
+	}
+
+	if ok {
+		return maxMtu, nil
+	}
+
+	ok, err = fits(minMtu)
+	if err != nil || !ok {
+		return 0, err
+	}
+
+	// binary search for the largest size that fits, low always fits and high never does
+	low, high := minMtu, maxMtu
+	for high-low > 1 {
+		mid := (low + high) / 2
+		ok, err := fits(mid)
+		if err != nil {
+			return 0, err
+		}
+
+		if ok {
+			low = mid
+		} else {
+			high = mid
+		}
+	}
+
+	return low, nil
+}
+
+// PathMtuProber probes path MTUs in the background, so reconciles report the last result instead of waiting for the
+// pings of a probe
+type PathMtuProber struct {
+	interval time.Duration
+
+	// onResult is called with the key of a probe that found a different path MTU, e.g. to requeue its object
+	onResult func(key string)
+
+	lock    sync.Mutex
+	results map[string]*pathMtuResult
+}
+
+type pathMtuResult struct {
+	// the device, IP and maximum MTU probed
+	target  string
+	mtu     int
+	probed  time.Time
+	running bool
+}
+
+// NewPathMtuProber returns a prober that probes each path again once its result is older than the interval
+func NewPathMtuProber(interval time.Duration, onResult func(key string)) *PathMtuProber {
+	return &PathMtuProber{
+		interval: interval,
+		onResult: onResult,
+		results:  map[string]*pathMtuResult{},
+	}
+}
+
+// PathMtu returns the last path MTU probed for the key, or 0 if it wasn't probed yet or the IP didn't answer.  It
+// starts probing the path to the IP through the device in the background if the result is stale or was for
+// another path.
+func (p *PathMtuProber) PathMtu(key string, device string, ip string, maxMtu int) int {
+	target := fmt.Sprintf("%s %s %d", device, ip, maxMtu)
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	result, ok := p.results[key]
+	if !ok || result.target != target {
+		result = &pathMtuResult{target: target}
+		p.results[key] = result
+	}
+
+	if !result.running && time.Since(result.probed) >= p.interval {
+		result.running = true
+		go p.probe(key, result, device, ip, maxMtu)
+	}
+
+	return result.mtu
+}
+
+// Forget drops the result for the key, e.g. when its object is deleted
+func (p *PathMtuProber) Forget(key string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	delete(p.results, key)
+}
+
+func (p *PathMtuProber) probe(key string, result *pathMtuResult, device string, ip string, maxMtu int) {
+	mtu, err := ProbePathMtu(device, ip, maxMtu)
+	if err != nil {
+		log.Error(err, "Failed to probe the path MTU", "device", device, "ip", ip)
+	}
+
+	p.lock.Lock()
+	changed := result.mtu != mtu && p.results[key] == result
+	result.mtu = mtu
+	result.probed = time.Now()
+	result.running = false
+	p.lock.Unlock()
+
+	if changed {
+		p.onResult(key)
+	}
+}
@@ -0,0 +1,106 @@
+package util
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// fakePing replaces ping with a script answering pings of packets up to the path MTU, and dropping every lossEvery'th
+// ping if it isn't 0
+func fakePing(t *testing.T, pathMtu int, lossEvery int) {
+	dir, err := ioutil.TempDir("", "ping")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	script := fmt.Sprintf(`#!/bin/sh
+count=$(($(cat %[1]s/count 2>/dev/null || echo 0) + 1))
+echo $count > %[1]s/count
+[ %[3]d -ne 0 ] && [ $((count %% %[3]d)) -eq 0 ] && exit 1
+[ $(($8 + 28)) -le %[2]d ]
+`, dir, pathMtu, lossEvery)
+
+	bin := filepath.Join(dir, "ping")
+	if err = ioutil.WriteFile(bin, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	previous := ping_bin
+	ping_bin = bin
+	t.Cleanup(func() {
+		ping_bin = previous
+		os.RemoveAll(dir)
+	})
+}
+
+func TestProbePathMtu(t *testing.T) {
+	tests := []struct {
+		name      string
+		pathMtu   int
+		lossEvery int
+		maxMtu    int
+		expected  int
+	}{
+		{"whole link", 1500, 0, 1500, 1500},
+		{"tunnel", 1400, 0, 1500, 1400},
+		{"minimum", 576, 0, 1500, 576},
+		{"not answered", 500, 0, 1500, 0},
+		{"lost pings", 1400, 2, 1500, 1400},
+		{"lost pings at every size", 1432, 3, 9000, 1432},
+	}
+
+	for _, test := range tests {
+		fakePing(t, test.pathMtu, test.lossEvery)
+
+		mtu, err := ProbePathMtu("eth0", "10.0.0.1", test.maxMtu)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+
+		if mtu != test.expected {
+			t.Errorf("%s: path MTU %d, expected %d", test.name, mtu, test.expected)
+		}
+	}
+}
+
+func TestPathMtuProber(t *testing.T) {
+	fakePing(t, 1400, 0)
+
+	results := make(chan string, 10)
+	prober := NewPathMtuProber(time.Hour, func(key string) { results <- key })
+
+	// the first call starts the probe in the background
+	if mtu := prober.PathMtu("route", "eth0", "10.0.0.1", 1500); mtu != 0 {
+		t.Errorf("path MTU %d before the probe finished", mtu)
+	}
+
+	select {
+	case key := <-results:
+		if key != "route" {
+			t.Errorf("probe finished for %q", key)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for the probe")
+	}
+
+	if mtu := prober.PathMtu("route", "eth0", "10.0.0.1", 1500); mtu != 1400 {
+		t.Errorf("path MTU %d, expected 1400", mtu)
+	}
+
+	// the result isn't stale, so it isn't probed again
+	select {
+	case key := <-results:
+		t.Errorf("probed %q again", key)
+	case <-time.After(500 * time.Millisecond):
+	}
+
+	// another path is probed from scratch
+	if mtu := prober.PathMtu("route", "eth0", "10.0.0.2", 1500); mtu != 0 {
+		t.Errorf("path MTU %d of another path before it was probed", mtu)
+	}
+	<-results
+}
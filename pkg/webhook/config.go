@@ -0,0 +1,104 @@
+package webhook
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+
+	ipam "github.com/jkwong888/iks-overlay-ip-controller/pkg/ipam"
+	"gopkg.in/yaml.v2"
+)
+
+type WebhookConfig struct {
+	WebhookConfig *WebhookConfigSpec `yaml:"webhook,omitempty"`
+}
+
+type WebhookConfigSpec struct {
+	// ranges that static routes and overlay IPs may not overlap, e.g. the cluster's pod and service CIDRs
+	ProtectedRanges []string `yaml:"protectedRanges"`
+
+	// overlay subnets gateways may be in, in addition to the subnets of the existing NodeOverlayIps
+	OverlaySubnets []string `yaml:"overlaySubnets"`
+}
+
+// the IKS default pod and service CIDRs, the IKS private network and the IBM Cloud service network
+var defaultProtectedRanges = []string{
+	"172.30.0.0/16",
+	"172.21.0.0/16",
+	"10.0.0.0/8",
+	"161.26.0.0/16",
+}
+
+// validatorConfig is the parsed webhook configuration
+type validatorConfig struct {
+	protectedRanges []*net.IPNet
+	overlaySubnets  []*net.IPNet
+}
+
+func loadConfig() (*validatorConfig, error) {
+	config := &WebhookConfig{}
+
+	yamlFile, err := ioutil.ReadFile(ipam.ConfigFile)
+	if err != nil {
+		return nil, err
+	}
+
+	err = yaml.Unmarshal(yamlFile, config)
+	if err != nil {
+		return nil, err
+	}
+
+	spec := config.WebhookConfig
+	if spec == nil {
+		spec = &WebhookConfigSpec{}
+	}
+
+	if spec.ProtectedRanges == nil {
+		spec.ProtectedRanges = defaultProtectedRanges
+	}
+
+	protectedRanges, err := parseCIDRs(spec.ProtectedRanges)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid webhook protectedRanges: %v", err)
+	}
+
+	overlaySubnets, err := parseCIDRs(spec.OverlaySubnets)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid webhook overlaySubnets: %v", err)
+	}
+
+	return &validatorConfig{
+		protectedRanges: protectedRanges,
+		overlaySubnets:  overlaySubnets,
+	}, nil
+}
+
+// ProtectedRanges returns the ranges static routes may not overlap, e.g. for the BGP speaker to ignore the prefixes
+// learned in them, as the webhook may not be enabled
+func ProtectedRanges() ([]*net.IPNet, error) {
+	config, err := loadConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	return config.protectedRanges, nil
+}
+
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	nets := []*net.IPNet{}
+	for _, cidr := range cidrs {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+
+		nets = append(nets, ipNet)
+	}
+
+	return nets, nil
+}
+
+// overlaps returns true if the two networks share any addresses
+func overlaps(a *net.IPNet, b *net.IPNet) bool {
+	return a.Contains(b.IP) || b.Contains(a.IP)
+}
@@ -0,0 +1,94 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"reflect"
+
+	iksv1alpha1 "github.com/jkwong888/iks-overlay-ip-controller/pkg/apis/iks/v1alpha1"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+	atypes "sigs.k8s.io/controller-runtime/pkg/webhook/admission/types"
+)
+
+// nodeOverlayIpValidator rejects NodeOverlayIps with addresses that would break node networking
+type nodeOverlayIpValidator struct {
+	decoder atypes.Decoder
+}
+
+var _ admission.Handler = &nodeOverlayIpValidator{}
+
+func (v *nodeOverlayIpValidator) Handle(ctx context.Context, req atypes.Request) atypes.Response {
+	instance := &iksv1alpha1.NodeOverlayIp{}
+	err := v.decoder.Decode(req, instance)
+	if err != nil {
+		return admission.ErrorResponse(http.StatusBadRequest, err)
+	}
+
+	if req.AdmissionRequest.Operation == admissionv1beta1.Update {
+		// allow updates that don't change the address, so existing objects can always be cleaned up
+		old := &iksv1alpha1.NodeOverlayIp{}
+		err = json.Unmarshal(req.AdmissionRequest.OldObject.Raw, old)
+		if err != nil {
+			return admission.ErrorResponse(http.StatusBadRequest, err)
+		}
+
+		if old.Status.IpAddr == instance.Status.IpAddr && old.Status.Gateway == instance.Status.Gateway &&
+			reflect.DeepEqual(old.Spec, instance.Spec) {
+			return admission.ValidationResponse(true, "")
+		}
+	}
+
+	config, err := loadConfig()
+	if err != nil {
+		return admission.ErrorResponse(http.StatusInternalServerError, err)
+	}
+
+	err = validateNodeOverlayIp(config, instance)
+	if err != nil {
+		log.Info("Rejecting NodeOverlayIp", "name", instance.Name, "reason", err.Error())
+		return denied(err)
+	}
+
+	return admission.ValidationResponse(true, "")
+}
+
+func validateNodeOverlayIp(config *validatorConfig, instance *iksv1alpha1.NodeOverlayIp) error {
+	if instance.Status.IpAddr == "" {
+		// not reserved yet
+		return nil
+	}
+
+	ip, subnet, err := net.ParseCIDR(instance.Status.IpAddr)
+	if err != nil {
+		return fmt.Errorf("status.ipAddr %q is not a valid CIDR", instance.Status.IpAddr)
+	}
+
+	for _, protected := range config.protectedRanges {
+		if overlaps(subnet, protected) {
+			return fmt.Errorf("status.ipAddr %q overlaps the protected range %s", instance.Status.IpAddr, protected.String())
+		}
+	}
+
+	if instance.Status.Gateway == "" {
+		return nil
+	}
+
+	gateway := net.ParseIP(instance.Status.Gateway)
+	if gateway == nil {
+		return fmt.Errorf("status.gateway %q is not a valid IP address", instance.Status.Gateway)
+	}
+
+	if !subnet.Contains(gateway) {
+		return fmt.Errorf("status.gateway %q is not in the subnet of %s", instance.Status.Gateway, instance.Status.IpAddr)
+	}
+
+	if gateway.Equal(ip) {
+		return fmt.Errorf("status.gateway %q is the same as the node's address", instance.Status.Gateway)
+	}
+
+	return nil
+}
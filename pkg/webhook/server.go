@@ -0,0 +1,102 @@
+package webhook
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	logf "sigs.k8s.io/controller-runtime/pkg/runtime/log"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+	atypes "sigs.k8s.io/controller-runtime/pkg/webhook/admission/types"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/types"
+)
+
+var log = logf.Log.WithName("webhook")
+
+type ServerOptions struct {
+	// Port the webhook server listens on
+	Port int32
+
+	// CertDir contains tls.crt and tls.key, usually mounted from a secret
+	CertDir string
+}
+
+// Add creates the validating webhook server for StaticRoutes and NodeOverlayIps and adds it to the Manager.
+// The webhook is disabled if there is no certificate in the CertDir.
+func Add(mgr manager.Manager, options ServerOptions) error {
+	certFile := filepath.Join(options.CertDir, "tls.crt")
+	keyFile := filepath.Join(options.CertDir, "tls.key")
+
+	if _, err := os.Stat(certFile); os.IsNotExist(err) {
+		log.Info("No webhook certificate found, validating webhook is disabled", "certFile", certFile)
+		return nil
+	}
+
+	decoder, err := admission.NewDecoder(mgr.GetScheme())
+	if err != nil {
+		return err
+	}
+
+	staticRouteWebhook := &admission.Webhook{
+		Name:     "validate-staticroutes.iks.ibm.com",
+		Type:     types.WebhookTypeValidating,
+		Path:     "/validate-staticroutes",
+		Handlers: []admission.Handler{&staticRouteValidator{client: mgr.GetClient(), decoder: decoder}},
+	}
+
+	nodeOverlayIpWebhook := &admission.Webhook{
+		Name:     "validate-nodeoverlayips.iks.ibm.com",
+		Type:     types.WebhookTypeValidating,
+		Path:     "/validate-nodeoverlayips",
+		Handlers: []admission.Handler{&nodeOverlayIpValidator{decoder: decoder}},
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(staticRouteWebhook.Path, staticRouteWebhook)
+	mux.Handle(nodeOverlayIpWebhook.Path, nodeOverlayIpWebhook)
+
+	return mgr.Add(manager.RunnableFunc(func(stop <-chan struct{}) error {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return err
+		}
+
+		addr := fmt.Sprintf(":%d", options.Port)
+		listener, err := tls.Listen("tcp", addr, &tls.Config{Certificates: []tls.Certificate{cert}})
+		if err != nil {
+			return fmt.Errorf("error listening on %s: %v", addr, err)
+		}
+
+		server := &http.Server{Handler: mux}
+
+		errChan := make(chan error, 1)
+		go func(l net.Listener) {
+			log.Info("Serving validating webhooks", "address", addr)
+			if err := server.Serve(l); err != nil && err != http.ErrServerClosed {
+				errChan <- err
+			}
+		}(listener)
+
+		select {
+		case err := <-errChan:
+			return err
+		case <-stop:
+			return server.Shutdown(context.Background())
+		}
+	}))
+}
+
+// denied returns a response rejecting the request with err as the message shown to the user
+func denied(err error) atypes.Response {
+	resp := admission.ValidationResponse(false, string(metav1.StatusReasonForbidden))
+	resp.Response.Result.Code = http.StatusForbidden
+	resp.Response.Result.Message = err.Error()
+
+	return resp
+}
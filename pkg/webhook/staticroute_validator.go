@@ -0,0 +1,127 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"reflect"
+
+	iksv1alpha1 "github.com/jkwong888/iks-overlay-ip-controller/pkg/apis/iks/v1alpha1"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+	atypes "sigs.k8s.io/controller-runtime/pkg/webhook/admission/types"
+)
+
+// staticRouteValidator rejects StaticRoutes that would break node networking
+type staticRouteValidator struct {
+	client  client.Client
+	decoder atypes.Decoder
+}
+
+var _ admission.Handler = &staticRouteValidator{}
+
+func (v *staticRouteValidator) Handle(ctx context.Context, req atypes.Request) atypes.Response {
+	instance := &iksv1alpha1.StaticRoute{}
+	err := v.decoder.Decode(req, instance)
+	if err != nil {
+		return admission.ErrorResponse(http.StatusBadRequest, err)
+	}
+
+	if req.AdmissionRequest.Operation == admissionv1beta1.Update {
+		// allow updates that don't change the spec (e.g. finalizers), so existing objects can always be cleaned up
+		old := &iksv1alpha1.StaticRoute{}
+		err = json.Unmarshal(req.AdmissionRequest.OldObject.Raw, old)
+		if err != nil {
+			return admission.ErrorResponse(http.StatusBadRequest, err)
+		}
+
+		if reflect.DeepEqual(old.Spec, instance.Spec) {
+			return admission.ValidationResponse(true, "")
+		}
+	}
+
+	config, err := loadConfig()
+	if err != nil {
+		return admission.ErrorResponse(http.StatusInternalServerError, err)
+	}
+
+	err = v.validate(ctx, config, instance)
+	if err != nil {
+		log.Info("Rejecting StaticRoute", "name", instance.Name, "reason", err.Error())
+		return denied(err)
+	}
+
+	return admission.ValidationResponse(true, "")
+}
+
+func (v *staticRouteValidator) validate(ctx context.Context, config *validatorConfig, instance *iksv1alpha1.StaticRoute) error {
+	ip, subnet, err := net.ParseCIDR(instance.Spec.Subnet)
+	if err != nil {
+		return fmt.Errorf("spec.subnet %q is not a valid CIDR", instance.Spec.Subnet)
+	}
+
+	if !ip.Equal(subnet.IP) {
+		return fmt.Errorf("spec.subnet %q has host bits set, did you mean %s?", instance.Spec.Subnet, subnet.String())
+	}
+
+	if ones, _ := subnet.Mask.Size(); ones == 0 {
+		return fmt.Errorf("spec.subnet %q is a default route", instance.Spec.Subnet)
+	}
+
+	for _, protected := range config.protectedRanges {
+		if overlaps(subnet, protected) {
+			return fmt.Errorf("spec.subnet %q overlaps the protected range %s", instance.Spec.Subnet, protected.String())
+		}
+	}
+
+	if instance.Spec.Gateway == "" {
+		return nil
+	}
+
+	gateway := net.ParseIP(instance.Spec.Gateway)
+	if gateway == nil {
+		return fmt.Errorf("spec.gateway %q is not a valid IP address", instance.Spec.Gateway)
+	}
+
+	overlaySubnets, err := v.overlaySubnets(ctx, config)
+	if err != nil {
+		return err
+	}
+
+	for _, overlaySubnet := range overlaySubnets {
+		if overlaySubnet.Contains(gateway) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("spec.gateway %q is not in any known overlay subnet", instance.Spec.Gateway)
+}
+
+// overlaySubnets returns the configured overlay subnets and the subnets of all reserved NodeOverlayIps
+func (v *staticRouteValidator) overlaySubnets(ctx context.Context, config *validatorConfig) ([]*net.IPNet, error) {
+	subnets := append([]*net.IPNet{}, config.overlaySubnets...)
+
+	nodeOverlayIps := &iksv1alpha1.NodeOverlayIpList{}
+	err := v.client.List(ctx, &client.ListOptions{}, nodeOverlayIps)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, nodeOverlayIp := range nodeOverlayIps.Items {
+		if nodeOverlayIp.Status.IpAddr == "" {
+			continue
+		}
+
+		_, subnet, err := net.ParseCIDR(nodeOverlayIp.Status.IpAddr)
+		if err != nil {
+			continue
+		}
+
+		subnets = append(subnets, subnet)
+	}
+
+	return subnets, nil
+}